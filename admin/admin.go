@@ -0,0 +1,47 @@
+package admin
+
+import "time"
+
+// Role is the custom type to define what an admin can do on the internal router
+type Role string
+
+// Define the valid admin roles
+// Support: recover instances
+// BillingAdmin: manage plans, promotions and credits
+// Superuser: everything, including managing admins, the audit log and /debug
+const (
+	RoleSupport      Role = "support"
+	RoleBillingAdmin Role = "billing-admin"
+	RoleSuperuser    Role = "superuser"
+)
+
+// Valid returns whether the role is one of the defined roles
+func (r Role) Valid() bool {
+	switch r {
+	case RoleSupport, RoleBillingAdmin, RoleSuperuser:
+		return true
+	default:
+		return false
+	}
+}
+
+// Admin is an operator of RMC. Admins authenticate with an admin API key, or with a client certificate
+// whose Common Name is the admin's Name
+type Admin struct {
+	ID         string     `json:"id" gorm:"primaryKey"`
+	Name       string     `json:"name" gorm:"uniqueIndex;not null"`
+	Role       Role       `json:"role" gorm:"not null"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	DisabledAt *time.Time `json:"disabledAt"`
+}
+
+// AdminKey is an admin API key. Only the hash of the key is stored
+type AdminKey struct {
+	ID         string     `json:"id" gorm:"primaryKey"`
+	AdminID    string     `json:"adminId" gorm:"index;not null"`
+	Prefix     string     `json:"prefix" gorm:"not null"`
+	Hash       string     `json:"-" gorm:"uniqueIndex;not null"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
@@ -0,0 +1,271 @@
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miragespace/rmc/audit"
+
+	"github.com/google/uuid"
+	extErrors "github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// ErrAdminExists is returned when creating an admin with a name that is already taken
+var ErrAdminExists = errors.New("Admin with the same name already exists")
+
+// ErrNotFound is returned when the admin or key does not exist
+var ErrNotFound = errors.New("Not found")
+
+// ErrInvalidKey is returned when bootstrapping with a malformed admin API key
+var ErrInvalidKey = errors.New("Invalid admin API key")
+
+const (
+	keyPrefix = "rmca_"
+	keyBytes  = 32
+	// length of the key shown in listing so admins can tell keys apart
+	keyDisplayLength = len(keyPrefix) + 8
+	// last used timestamp is only written once per interval to avoid a write on every request
+	keyTouchInterval = time.Minute
+)
+
+// ManagerOptions describes the dependencies of admin Manager
+type ManagerOptions struct {
+	AuditManager *audit.Manager
+	DB           *gorm.DB
+	Logger       *zap.Logger
+}
+
+// Manager handles the database operations relating to Admins, and authenticates requests to the internal router
+type Manager struct {
+	ManagerOptions
+}
+
+// NewManager returns a new admin Manager
+func NewManager(option ManagerOptions) (*Manager, error) {
+	if option.AuditManager == nil {
+		return nil, fmt.Errorf("nil AuditManager is invalid")
+	}
+	if option.DB == nil {
+		return nil, fmt.Errorf("nil DB is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	if err := option.DB.AutoMigrate(&Admin{}, &AdminKey{}); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot initilize admin.Manager")
+	}
+	return &Manager{
+		ManagerOptions: option,
+	}, nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Bootstrap will create a superuser with the given admin API key if there are no admins yet.
+// This is how the first admin is created; subsequent admins are created via the internal router
+func (m *Manager) Bootstrap(ctx context.Context, name, rawKey string) error {
+	if !strings.HasPrefix(rawKey, keyPrefix) || len(rawKey) < len(keyPrefix)+32 {
+		return ErrInvalidKey
+	}
+
+	return m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Admin{}).Count(&count).Error; err != nil {
+			return extErrors.Wrap(err, "Cannot count admins")
+		}
+		if count > 0 {
+			return nil
+		}
+
+		now := time.Now()
+		a := &Admin{
+			ID:        uuid.New().String(),
+			Name:      name,
+			Role:      RoleSuperuser,
+			CreatedAt: now,
+		}
+		if err := tx.Create(a).Error; err != nil {
+			return extErrors.Wrap(err, "Cannot create bootstrap admin")
+		}
+		if err := tx.Create(&AdminKey{
+			ID:        uuid.New().String(),
+			AdminID:   a.ID,
+			Prefix:    rawKey[:keyDisplayLength],
+			Hash:      hashKey(rawKey),
+			CreatedAt: now,
+		}).Error; err != nil {
+			return extErrors.Wrap(err, "Cannot create bootstrap admin key")
+		}
+		return nil
+	})
+}
+
+// Create will create a new admin
+func (m *Manager) Create(ctx context.Context, name string, role Role) (*Admin, error) {
+	a := &Admin{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Role:      role,
+		CreatedAt: time.Now(),
+	}
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Admin{}).Where("name = ?", name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAdminExists
+		}
+		return tx.Create(a).Error
+	})
+	if err == ErrAdminExists {
+		return nil, err
+	}
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot create admin")
+	}
+	return a, nil
+}
+
+// List returns all admins, including disabled admins
+func (m *Manager) List(ctx context.Context) ([]Admin, error) {
+	admins := make([]Admin, 0, 1)
+	if err := m.DB.WithContext(ctx).Order("created_at asc").Find(&admins).Error; err != nil {
+		return nil, extErrors.Wrap(err, "Cannot list admins")
+	}
+	return admins, nil
+}
+
+// Disable will disable the admin. Keys and client certificates of the admin are rejected immediately
+func (m *Manager) Disable(ctx context.Context, adminID string) error {
+	result := m.DB.WithContext(ctx).
+		Model(&Admin{}).
+		Where("id = ? AND disabled_at IS NULL", adminID).
+		Update("disabled_at", time.Now())
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot disable admin")
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// NewKey will create a new admin API key. The returned raw key is not stored and cannot be retrieved again
+func (m *Manager) NewKey(ctx context.Context, adminID string) (*AdminKey, string, error) {
+	var count int64
+	result := m.DB.WithContext(ctx).
+		Model(&Admin{}).
+		Where("id = ? AND disabled_at IS NULL", adminID).
+		Count(&count)
+	if result.Error != nil {
+		return nil, "", extErrors.Wrap(result.Error, "Cannot get admin")
+	}
+	if count == 0 {
+		return nil, "", ErrNotFound
+	}
+
+	buf := make([]byte, keyBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", extErrors.Wrap(err, "Cannot generate admin API key")
+	}
+	raw := keyPrefix + hex.EncodeToString(buf)
+
+	key := &AdminKey{
+		ID:        uuid.New().String(),
+		AdminID:   adminID,
+		Prefix:    raw[:keyDisplayLength],
+		Hash:      hashKey(raw),
+		CreatedAt: time.Now(),
+	}
+	if err := m.DB.WithContext(ctx).Create(key).Error; err != nil {
+		return nil, "", extErrors.Wrap(err, "Cannot save admin API key")
+	}
+	return key, raw, nil
+}
+
+// ListKeys returns the keys of the admin, including revoked keys
+func (m *Manager) ListKeys(ctx context.Context, adminID string) ([]AdminKey, error) {
+	keys := make([]AdminKey, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Where("admin_id = ?", adminID).
+		Order("created_at desc").
+		Find(&keys)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot list admin API keys")
+	}
+	return keys, nil
+}
+
+// RevokeKey will revoke the admin API key immediately
+func (m *Manager) RevokeKey(ctx context.Context, adminID, keyID string) error {
+	result := m.DB.WithContext(ctx).
+		Model(&AdminKey{}).
+		Where("id = ? AND admin_id = ? AND revoked_at IS NULL", keyID, adminID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot revoke admin API key")
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// verifyKey returns the active admin of the raw key, or nil if the key is unknown or revoked
+func (m *Manager) verifyKey(ctx context.Context, raw string) (*Admin, error) {
+	var key AdminKey
+	result := m.DB.WithContext(ctx).
+		Where("hash = ? AND revoked_at IS NULL", hashKey(raw)).
+		First(&key)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot find admin API key")
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > keyTouchInterval {
+		result = m.DB.WithContext(ctx).
+			Model(&AdminKey{}).
+			Where("id = ?", key.ID).
+			Update("last_used_at", now)
+		if result.Error != nil {
+			return nil, extErrors.Wrap(result.Error, "Cannot update admin API key usage")
+		}
+	}
+
+	return m.activeAdmin(ctx, "id = ?", key.AdminID)
+}
+
+// verifyCertificate returns the active admin named by the verified client certificate, or nil if there is none
+func (m *Manager) verifyCertificate(ctx context.Context, commonName string) (*Admin, error) {
+	return m.activeAdmin(ctx, "name = ?", commonName)
+}
+
+func (m *Manager) activeAdmin(ctx context.Context, query string, arg string) (*Admin, error) {
+	var a Admin
+	result := m.DB.WithContext(ctx).
+		Where(query, arg).
+		Where("disabled_at IS NULL").
+		First(&a)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot get admin")
+	}
+	return &a, nil
+}
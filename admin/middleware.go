@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/miragespace/rmc/audit"
+	resp "github.com/miragespace/rmc/response"
+
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+)
+
+// ContextKey is a defined type to be used in context.Context containing the Admin
+type ContextKey string
+
+// Context is key used in context.Context containing the authenticated Admin
+const Context ContextKey = "adminContext"
+
+var bearerPrefix = "Bearer "
+
+// authenticate returns the Admin of the request, via admin API key or verified client certificate
+func (m *Manager) authenticate(r *http.Request) (*Admin, error) {
+	ctx := r.Context()
+
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, bearerPrefix) {
+		token := header[len(bearerPrefix):]
+		if !strings.HasPrefix(token, keyPrefix) {
+			return nil, nil
+		}
+		return m.verifyKey(ctx, token)
+	}
+
+	// only set when the internal router is served with a client CA (mTLS)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return m.verifyCertificate(ctx, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}
+
+	return nil, nil
+}
+
+// Middleware returns a http middleware that authenticates admins and records every request in the audit log,
+// including rejected requests. It should be used on the internal router itself, so every admin endpoint is protected
+func (m *Manager) Middleware() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			entry := audit.NewRequestEntry(r)
+			defer func() {
+				m.AuditManager.RecordRequest(r, entry, ww.Status())
+			}()
+
+			a, err := m.authenticate(r)
+			if err != nil {
+				m.Logger.Error("Cannot authenticate admin",
+					zap.Error(err),
+				)
+				resp.WriteError(ww, r, resp.ErrUnexpected())
+				return
+			}
+			if a == nil {
+				resp.WriteError(ww, r, resp.ErrUnauthorized().AddMessages("Admin API key or client certificate is required"))
+				return
+			}
+
+			entry.ActorType = audit.ActorAdmin
+			entry.ActorID = a.ID
+
+			ctx := context.WithValue(audit.NewContext(r.Context(), entry), Context, a)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireRole returns a http middleware that only allows admins with one of the roles. Superusers are always allowed
+func RequireRole(roles ...Role) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			a, ok := r.Context().Value(Context).(*Admin)
+			if !ok {
+				resp.WriteError(w, r, resp.ErrUnauthorized())
+				return
+			}
+			if a.Role == RoleSuperuser {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for _, role := range roles {
+				if a.Role == role {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Admin role is not allowed for this request"))
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	resp "github.com/miragespace/rmc/response"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+// ServiceOptions contains the configuration for Service router
+type ServiceOptions struct {
+	AdminManager *Manager
+	Logger       *zap.Logger
+}
+
+// Service is the admin management API router
+type Service struct {
+	ServiceOptions
+}
+
+// NewService will create an instance of the admin management API router
+func NewService(option ServiceOptions) (*Service, error) {
+	if option.AdminManager == nil {
+		return nil, fmt.Errorf("nil AdminManager is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	return &Service{
+		ServiceOptions: option,
+	}, nil
+}
+
+// NewAdminRequest is the model of request to create a new admin
+type NewAdminRequest struct {
+	Name string `json:"name"` // also the Common Name of the admin's client certificate
+	Role Role   `json:"role"`
+}
+
+func (s *Service) listAdmins(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	admins, err := s.AdminManager.List(ctx)
+	if err != nil {
+		s.Logger.Error("Unable to list admins",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list admins"))
+		return
+	}
+
+	resp.WriteResponse(w, r, admins)
+}
+
+func (s *Service) createAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req NewAdminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	if len(req.Name) == 0 {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Name is required"))
+		return
+	}
+	if !req.Role.Valid() {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Role must be one of: support, billing-admin, superuser"))
+		return
+	}
+
+	a, err := s.AdminManager.Create(ctx, req.Name, req.Role)
+	switch err {
+	case nil:
+	case ErrAdminExists:
+		resp.WriteError(w, r, resp.ErrConflict().AddMessages("Admin with the same name already exists"))
+		return
+	default:
+		s.Logger.Error("Unable to create admin",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to create admin"))
+		return
+	}
+
+	resp.WriteResponse(w, r, a)
+}
+
+func (s *Service) disableAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	adminID := chi.URLParam(r, "id")
+
+	if current, ok := ctx.Value(Context).(*Admin); ok && current.ID == adminID {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Admins cannot disable themselves"))
+		return
+	}
+
+	err := s.AdminManager.Disable(ctx, adminID)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Admin does not exist or is already disabled"))
+		return
+	default:
+		s.Logger.Error("Unable to disable admin",
+			zap.Error(err),
+			zap.String("AdminID", adminID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to disable admin"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) listKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	adminID := chi.URLParam(r, "id")
+
+	keys, err := s.AdminManager.ListKeys(ctx, adminID)
+	if err != nil {
+		s.Logger.Error("Unable to list admin API keys",
+			zap.Error(err),
+			zap.String("AdminID", adminID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list admin API keys"))
+		return
+	}
+
+	resp.WriteResponse(w, r, keys)
+}
+
+func (s *Service) createKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	adminID := chi.URLParam(r, "id")
+
+	key, raw, err := s.AdminManager.NewKey(ctx, adminID)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Admin does not exist or is disabled"))
+		return
+	default:
+		s.Logger.Error("Unable to create admin API key",
+			zap.Error(err),
+			zap.String("AdminID", adminID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to create admin API key"))
+		return
+	}
+
+	// the raw key is only ever returned here
+	resp.WriteResponse(w, r, struct {
+		*AdminKey
+		Token string `json:"token"`
+	}{
+		AdminKey: key,
+		Token:    raw,
+	})
+}
+
+func (s *Service) revokeKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	adminID := chi.URLParam(r, "id")
+	keyID := chi.URLParam(r, "keyId")
+
+	err := s.AdminManager.RevokeKey(ctx, adminID, keyID)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Admin API key does not exist or is already revoked"))
+		return
+	default:
+		s.Logger.Error("Unable to revoke admin API key",
+			zap.Error(err),
+			zap.String("AdminID", adminID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to revoke admin API key"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminRouter will return the routes under admin management API
+func (s *Service) AdminRouter() http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/", s.listAdmins)
+	r.Post("/", s.createAdmin)
+	r.Delete("/{id}", s.disableAdmin)
+	r.Get("/{id}/keys", s.listKeys)
+	r.Post("/{id}/keys", s.createKey)
+	r.Delete("/{id}/keys/{keyId}", s.revokeKey)
+
+	return r
+}
@@ -0,0 +1,42 @@
+package audit
+
+import "time"
+
+// ActorType is the custom type to define who performed an action
+type ActorType string
+
+// Define the valid actor types
+const (
+	ActorAnonymous ActorType = "anonymous" // failed authentication, or routes without authentication (e.g. login)
+	ActorCustomer  ActorType = "customer"
+	ActorAPIKey    ActorType = "apiKey"
+	ActorAdmin     ActorType = "admin"
+	ActorSystem    ActorType = "system" // background tasks, e.g. the instance reconciler. ActorID names the task
+)
+
+// Outcome is the custom type to define the result of an action
+type Outcome string
+
+// Define the valid outcomes
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeDenied  Outcome = "denied" // rejected by authentication or authorization
+	OutcomeFailure Outcome = "failure"
+)
+
+// Entry is an append-only record of an action
+type Entry struct {
+	ID         string    `json:"id" gorm:"primaryKey"`
+	Timestamp  time.Time `json:"timestamp" gorm:"index;not null"`
+	ActorType  ActorType `json:"actorType" gorm:"not null"`
+	ActorID    string    `json:"actorId" gorm:"index"`
+	Action     string    `json:"action" gorm:"not null"`  // e.g. "POST /instances/{id}/recover"
+	Target     string    `json:"target"`                  // e.g. "/instances/7c0d.../recover"
+	CustomerID string    `json:"customerId" gorm:"index"` // the customer whose resources are affected, which may not be the actor
+	InstanceID string    `json:"instanceId" gorm:"index"`
+	RequestID  string    `json:"requestId"`
+	IP         string    `json:"ip"`
+	StatusCode int       `json:"statusCode"`
+	Outcome    Outcome   `json:"outcome"`
+	Detail     string    `json:"detail"` // e.g. why the system performed the action
+}
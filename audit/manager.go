@@ -0,0 +1,131 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	extErrors "github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// ManagerOptions describes the dependencies of audit Manager
+type ManagerOptions struct {
+	DB     *gorm.DB
+	Logger *zap.Logger
+}
+
+// Manager records and queries the audit log
+type Manager struct {
+	ManagerOptions
+}
+
+// NewManager returns a new audit Manager
+func NewManager(option ManagerOptions) (*Manager, error) {
+	if option.DB == nil {
+		return nil, fmt.Errorf("nil DB is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	if err := option.DB.AutoMigrate(&Entry{}); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot initilize audit.Manager")
+	}
+	return &Manager{
+		ManagerOptions: option,
+	}, nil
+}
+
+// Record will append the entry to the audit log. ID and Timestamp are set if empty
+func (m *Manager) Record(ctx context.Context, entry *Entry) error {
+	if entry.ID == "" {
+		entry.ID = uuid.New().String()
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	if err := m.DB.WithContext(ctx).Create(entry).Error; err != nil {
+		return extErrors.Wrap(err, "Cannot record audit entry")
+	}
+	return nil
+}
+
+// ListOption is used when querying the audit log
+type ListOption struct {
+	ActorType  ActorType
+	ActorID    string
+	CustomerID string // actions affecting the customer's resources, or performed by the customer
+	InstanceID string
+	Before     time.Time
+	Limit      int
+}
+
+// List returns the audit entries matching ListOption, newest first
+func (m *Manager) List(ctx context.Context, opt ListOption) ([]Entry, error) {
+	baseQuery := m.DB.WithContext(ctx).Order("timestamp desc")
+	if len(opt.ActorType) > 0 {
+		baseQuery = baseQuery.Where("actor_type = ?", opt.ActorType)
+	}
+	if len(opt.ActorID) > 0 {
+		baseQuery = baseQuery.Where("actor_id = ?", opt.ActorID)
+	}
+	if len(opt.CustomerID) > 0 {
+		baseQuery = baseQuery.Where("customer_id = ? OR actor_id = ?", opt.CustomerID, opt.CustomerID)
+	}
+	if len(opt.InstanceID) > 0 {
+		baseQuery = baseQuery.Where("instance_id = ?", opt.InstanceID)
+	}
+	if !opt.Before.IsZero() {
+		baseQuery = baseQuery.Where("timestamp < ?", opt.Before)
+	}
+	if opt.Limit > 0 {
+		baseQuery = baseQuery.Limit(opt.Limit)
+	}
+
+	entries := make([]Entry, 0, 1)
+	if err := baseQuery.Find(&entries).Error; err != nil {
+		return nil, extErrors.Wrap(err, "Cannot list audit entries")
+	}
+	return entries, nil
+}
+
+// Prune deletes the entries older than the retention, and returns the number of entries deleted.
+// This is the only way entries are removed from the audit log
+func (m *Manager) Prune(ctx context.Context, retention time.Duration) (int64, error) {
+	result := m.DB.WithContext(ctx).
+		Where("timestamp < ?", time.Now().Add(-retention)).
+		Delete(&Entry{})
+	if result.Error != nil {
+		return 0, extErrors.Wrap(result.Error, "Cannot prune audit entries")
+	}
+	return result.RowsAffected, nil
+}
+
+// HandleRetention will prune the audit log hourly in the background, keeping the entries within the retention
+func (m *Manager) HandleRetention(ctx context.Context, retention time.Duration) {
+	m.Logger.Info("Audit log retention: " + retention.String())
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		for {
+			count, err := m.Prune(ctx, retention)
+			if err != nil {
+				m.Logger.Error("Unable to prune audit log",
+					zap.Error(err),
+				)
+			} else if count > 0 {
+				m.Logger.Info("Pruned audit log",
+					zap.Int64("Count", count),
+				)
+			}
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
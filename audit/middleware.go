@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miragespace/rmc/auth"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+)
+
+// ContextKey is a defined type to be used in context.Context containing the Entry of the request
+type ContextKey string
+
+// Context is key used in context.Context containing the Entry of the request
+const Context ContextKey = "auditContext"
+
+// NewContext returns a context with the Entry of the request, so handlers can describe the action with SetActor and SetTarget
+func NewContext(ctx context.Context, entry *Entry) context.Context {
+	return context.WithValue(ctx, Context, entry)
+}
+
+func fromContext(ctx context.Context) *Entry {
+	entry, _ := ctx.Value(Context).(*Entry)
+	return entry
+}
+
+// SetActor sets who performed the action of the request, e.g. after a customer has logged in. Requests not audited are ignored
+func SetActor(ctx context.Context, actorType ActorType, actorID string) {
+	if entry := fromContext(ctx); entry != nil {
+		entry.ActorType = actorType
+		entry.ActorID = actorID
+	}
+}
+
+// SetTarget sets the customer and instance affected by the action of the request. Empty values are unchanged.
+// Requests not audited are ignored
+func SetTarget(ctx context.Context, customerID, instanceID string) {
+	entry := fromContext(ctx)
+	if entry == nil {
+		return
+	}
+	if customerID != "" {
+		entry.CustomerID = customerID
+	}
+	if instanceID != "" {
+		entry.InstanceID = instanceID
+	}
+}
+
+// NewRequestEntry returns an Entry of an anonymous request. It should be recorded with RecordRequest after the request is served
+func NewRequestEntry(r *http.Request) *Entry {
+	return &Entry{
+		ActorType: ActorAnonymous,
+		Target:    r.URL.Path,
+		RequestID: middleware.GetReqID(r.Context()),
+		IP:        remoteIP(r),
+	}
+}
+
+// RecordRequest completes the entry with the route and the response status, and appends it to the audit log.
+// Errors are logged, as the response has already been sent
+func (m *Manager) RecordRequest(r *http.Request, entry *Entry, statusCode int) {
+	// route pattern is only known after routing, e.g. "/instances/{id}/recover"
+	pattern := r.URL.Path
+	rctx := chi.RouteContext(r.Context())
+	if rctx != nil && rctx.RoutePattern() != "" {
+		pattern = rctx.RoutePattern()
+	}
+	if entry.InstanceID == "" && rctx != nil && strings.HasPrefix(pattern, "/instances/{id}") {
+		entry.InstanceID = rctx.URLParam("id")
+	}
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	entry.Action = r.Method + " " + pattern
+	entry.StatusCode = statusCode
+	entry.Outcome = outcomeOf(statusCode)
+
+	if err := m.Record(context.Background(), entry); err != nil {
+		m.Logger.Error("Cannot record action in audit log",
+			zap.Error(err),
+			zap.String("Action", entry.Action),
+			zap.String("ActorID", entry.ActorID),
+		)
+	}
+}
+
+// Middleware returns a http middleware that records every mutating request (anything but GET, HEAD and OPTIONS)
+// in the audit log, including rejected requests. Actors are set by Identify after authentication
+func (m *Manager) Middleware() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			entry := NewRequestEntry(r)
+			ctx := NewContext(r.Context(), entry)
+			defer func() {
+				m.RecordRequest(r, entry, ww.Status())
+			}()
+
+			next.ServeHTTP(ww, r.WithContext(ctx))
+		})
+	}
+}
+
+// Identify is a http middleware that sets the actor of the request from the auth.Claims. It must be used after auth.Middleware
+func Identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims, ok := r.Context().Value(auth.Context).(*auth.Claims); ok {
+			if claims.APIKeyID != "" {
+				SetActor(r.Context(), ActorAPIKey, claims.APIKeyID)
+			} else {
+				SetActor(r.Context(), ActorCustomer, claims.ID)
+			}
+			SetTarget(r.Context(), claims.ID, "")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// outcomeOf returns the Outcome of a http response
+func outcomeOf(statusCode int) Outcome {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return OutcomeDenied
+	case statusCode >= http.StatusBadRequest:
+		return OutcomeFailure
+	default:
+		return OutcomeSuccess
+	}
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/miragespace/rmc/auth"
+	resp "github.com/miragespace/rmc/response"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+// ServiceOptions contains the configuration for Service router
+type ServiceOptions struct {
+	AuditManager *Manager
+	Logger       *zap.Logger
+}
+
+// Service is the audit log API router
+type Service struct {
+	ServiceOptions
+}
+
+// NewService will create an instance of the audit log API router
+func NewService(option ServiceOptions) (*Service, error) {
+	if option.AuditManager == nil {
+		return nil, fmt.Errorf("nil AuditManager is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	return &Service{
+		ServiceOptions: option,
+	}, nil
+}
+
+func (s *Service) listEntries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	s.writeEntries(w, r, ListOption{
+		ActorType:  ActorType(query.Get("actorType")),
+		ActorID:    query.Get("actorId"),
+		CustomerID: query.Get("customerId"),
+		InstanceID: query.Get("instanceId"),
+	})
+}
+
+func (s *Service) listCustomerEntries(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(auth.Context).(*auth.Claims)
+
+	s.writeEntries(w, r, ListOption{
+		CustomerID: claims.ID,
+		InstanceID: r.URL.Query().Get("instanceId"),
+	})
+}
+
+// writeEntries responds with a page of the entries matching opt, before the "before" query param
+func (s *Service) writeEntries(w http.ResponseWriter, r *http.Request, opt ListOption) {
+	ctx := r.Context()
+
+	opt.Limit = 50
+	if before := r.URL.Query().Get("before"); before != "" {
+		parsedTime, err := time.Parse(time.RFC3339Nano, before)
+		if err != nil {
+			resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Invalid before param"))
+			return
+		}
+		opt.Before = parsedTime
+	}
+
+	entries, err := s.AuditManager.List(ctx, opt)
+	if err != nil {
+		s.Logger.Error("Unable to list audit entries",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list audit entries"))
+		return
+	}
+
+	resp.WriteResponse(w, r, entries)
+}
+
+// AdminRouter will return the routes under audit log API
+func (s *Service) AdminRouter() http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/", s.listEntries)
+
+	return r
+}
+
+// Router will return the routes for customers to view the actions on their account and instances
+func (s *Service) Router() http.Handler {
+	r := chi.NewRouter()
+
+	r.Use(auth.RequireSession)
+
+	r.Get("/", s.listCustomerEntries)
+
+	return r
+}
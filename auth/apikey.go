@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	extErrors "github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// Scope limits what an API key is allowed to do
+type Scope string
+
+// define scopes that can be granted to an API key. Interactive sessions (JWT) are not scoped
+const (
+	ScopeInstancesRead     Scope = "instances:read"
+	ScopeInstancesControl  Scope = "instances:control"
+	ScopeSubscriptionsRead Scope = "subscriptions:read"
+	ScopeBillingRead       Scope = "billing:read"
+)
+
+// Scopes lists all the scopes that can be granted to an API key
+var Scopes = []Scope{
+	ScopeInstancesRead,
+	ScopeInstancesControl,
+	ScopeSubscriptionsRead,
+	ScopeBillingRead,
+}
+
+// ErrInvalidScope is returned when an API key is requested with an unknown scope
+var ErrInvalidScope = errors.New("Invalid scope")
+
+// ErrTooManyAPIKeys is returned when a customer already has maxAPIKeys active keys
+var ErrTooManyAPIKeys = errors.New("Too many active API keys")
+
+// ErrAPIKeyNotFound is returned when revoking an API key that does not exist (or is already revoked)
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+const (
+	apiKeyPrefix = "rmc_"
+	// API keys are random, so a sha256 hash is sufficient (unlike passwords)
+	apiKeyBytes = 32
+	// length of the key shown in listing so customers can tell keys apart
+	apiKeyDisplayLength = len(apiKeyPrefix) + 8
+	maxAPIKeys          = 25
+	// last used timestamp is only written once per interval to avoid a write on every request
+	apiKeyTouchInterval = time.Minute
+)
+
+// APIKey is a long-lived, scoped and revocable token for automation. Only the hash of the key is stored
+type APIKey struct {
+	ID         string     `json:"id" gorm:"primaryKey"`
+	CustomerID string     `json:"-" gorm:"index;not null"`
+	Name       string     `json:"name" gorm:"not null"`
+	Prefix     string     `json:"prefix" gorm:"not null"`
+	Hash       string     `json:"-" gorm:"uniqueIndex;not null"`
+	Scopes     string     `json:"-" gorm:"not null"` // space separated, similar to OAuth
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	LastUsedIP string     `json:"lastUsedIP"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
+
+// GetScopes returns the scopes granted to this key
+func (k *APIKey) GetScopes() []Scope {
+	fields := strings.Fields(k.Scopes)
+	scopes := make([]Scope, 0, len(fields))
+	for _, f := range fields {
+		scopes = append(scopes, Scope(f))
+	}
+	return scopes
+}
+
+// Active returns whether the key can still be used to authenticate
+func (k *APIKey) Active(ref time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(ref) {
+		return false
+	}
+	return true
+}
+
+// APIKeyOption specifies the parameters to create a new API key
+type APIKeyOption struct {
+	CustomerID string
+	Name       string
+	Scopes     []Scope
+	ExpiresAt  *time.Time
+}
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope Scope) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIKey will create a new API key for the customer. The returned raw key is not stored and cannot be retrieved again
+func (a *Auth) CreateAPIKey(ctx context.Context, opt APIKeyOption) (*APIKey, string, error) {
+	if len(opt.Scopes) == 0 {
+		return nil, "", ErrInvalidScope
+	}
+	scopes := make([]string, 0, len(opt.Scopes))
+	seen := make(map[Scope]bool)
+	for _, scope := range opt.Scopes {
+		if !validScope(scope) {
+			return nil, "", ErrInvalidScope
+		}
+		if seen[scope] {
+			continue
+		}
+		seen[scope] = true
+		scopes = append(scopes, string(scope))
+	}
+
+	now := time.Now()
+
+	var count int64
+	result := a.DB.WithContext(ctx).
+		Model(&APIKey{}).
+		Where("customer_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", opt.CustomerID, now).
+		Count(&count)
+	if result.Error != nil {
+		return nil, "", extErrors.Wrap(result.Error, "Cannot count existing API keys")
+	}
+	if count >= maxAPIKeys {
+		return nil, "", ErrTooManyAPIKeys
+	}
+
+	buf := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", extErrors.Wrap(err, "Cannot generate API key")
+	}
+	raw := apiKeyPrefix + hex.EncodeToString(buf)
+
+	key := &APIKey{
+		ID:         uuid.New().String(),
+		CustomerID: opt.CustomerID,
+		Name:       opt.Name,
+		Prefix:     raw[:apiKeyDisplayLength],
+		Hash:       hashAPIKey(raw),
+		Scopes:     strings.Join(scopes, " "),
+		CreatedAt:  now,
+		ExpiresAt:  opt.ExpiresAt,
+	}
+	result = a.DB.WithContext(ctx).Create(key)
+	if result.Error != nil {
+		return nil, "", extErrors.Wrap(result.Error, "Cannot save API key")
+	}
+
+	return key, raw, nil
+}
+
+// ListAPIKeys returns all the API keys of the customer, including revoked and expired keys
+func (a *Auth) ListAPIKeys(ctx context.Context, customerID string) ([]APIKey, error) {
+	keys := make([]APIKey, 0, 1)
+	result := a.DB.WithContext(ctx).
+		Where("customer_id = ?", customerID).
+		Order("created_at DESC").
+		Find(&keys)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot list API keys")
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey will revoke the API key immediately
+func (a *Auth) RevokeAPIKey(ctx context.Context, customerID, keyID string) error {
+	result := a.DB.WithContext(ctx).
+		Model(&APIKey{}).
+		Where("id = ? AND customer_id = ? AND revoked_at IS NULL", keyID, customerID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot revoke API key")
+	}
+	if result.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// verifyAPIKey returns the Claims for the raw API key, or nil if the key is unknown, revoked or expired
+func (a *Auth) verifyAPIKey(ctx context.Context, raw, remoteIP string) (*Claims, error) {
+	var key APIKey
+	result := a.DB.WithContext(ctx).
+		Where("hash = ?", hashAPIKey(raw)).
+		First(&key)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot find API key")
+	}
+
+	now := time.Now()
+	if !key.Active(now) {
+		return nil, nil
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval || key.LastUsedIP != remoteIP {
+		result = a.DB.WithContext(ctx).
+			Model(&APIKey{}).
+			Where("id = ?", key.ID).
+			Updates(map[string]interface{}{
+				"last_used_at": now,
+				"last_used_ip": remoteIP,
+			})
+		if result.Error != nil {
+			return nil, extErrors.Wrap(result.Error, "Cannot update API key usage")
+		}
+	}
+
+	return &Claims{
+		ID:       key.CustomerID,
+		APIKeyID: key.ID,
+		Scopes:   key.GetScopes(),
+	}, nil
+}
@@ -8,7 +8,9 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-redis/redis/v7"
 	"github.com/johnsto/go-passwordless"
+	extErrors "github.com/pkg/errors"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
 // ContextKey is a defined type to be used in context.Context containing the Claims
@@ -29,8 +31,10 @@ const (
 // Auth provides passwordless authentication
 type Auth struct {
 	Options
-	pw     *passwordless.Passwordless
-	jwtKey []byte
+	pw        *passwordless.Passwordless
+	jwtKey    []byte
+	providers map[string]IdentityProvider
+	logins    loginStore
 }
 
 // Claims is the struct for jwt token
@@ -38,11 +42,38 @@ type Claims struct {
 	jwt.StandardClaims
 	Email string `json:"email"`
 	ID    string `json:"id"`
+	// Session is the ID of the login session, and is not set for API keys
+	Session string `json:"sid,omitempty"`
+	// StepUpUntil is the unix time until which the session is step-up verified with a second factor (see StepUp)
+	StepUpUntil int64 `json:"stepUpUntil,omitempty"`
+
+	// APIKeyID and Scopes are only set when authenticated with an API key
+	APIKeyID string  `json:"-"`
+	Scopes   []Scope `json:"-"`
+}
+
+// HasScope returns whether the Claims allow the scope. Interactive sessions have all scopes
+func (c *Claims) HasScope(scope Scope) bool {
+	if c.APIKeyID == "" {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// SteppedUp returns whether the session is currently step-up verified
+func (c *Claims) SteppedUp() bool {
+	return c.StepUpUntil > time.Now().Unix()
 }
 
 // Options provides initialization parameters for Auth
 type Options struct {
 	Redis  redis.UniversalClient
+	DB     *gorm.DB
 	Logger *zap.Logger
 
 	JWTSigningKey string
@@ -52,14 +83,21 @@ type Options struct {
 	From        string
 	Hostname    string
 	EmailOption EmailOption
+
+	// IdentityProviders are the optional external identity providers (e.g. OIDCProvider) customers can login with
+	IdentityProviders []IdentityProvider
 }
 
 // EmailOption specifies the name shown in the email, and the LinkGenerator for the login link
 type EmailOption struct {
 	Name          string
 	LinkGenerator LinkGenerator
+	Composer      EmailComposer // Optional. The built-in email is used if a Composer is not provided
 }
 
+// EmailComposer renders the subject, text and html of the login email with the token and link
+type EmailComposer func(token, link string) (subject, text, html string, err error)
+
 // LinkGenerator is used to generator a login link
 type LinkGenerator func(uid, token string) string
 
@@ -70,6 +108,9 @@ func (o *Options) validate() error {
 	if o.Redis == nil {
 		return fmt.Errorf("nil redisClient is invalid")
 	}
+	if o.DB == nil {
+		return fmt.Errorf("nil DB is invalid")
+	}
 	if o.Logger == nil {
 		return fmt.Errorf("nil Logger is invalid")
 	}
@@ -104,6 +145,18 @@ func New(option Options) (*Auth, error) {
 		return nil, err
 	}
 
+	if err := option.DB.AutoMigrate(&APIKey{}, &TOTP{}, &RecoveryCode{}); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot initialize auth")
+	}
+
+	providers := make(map[string]IdentityProvider)
+	for _, p := range option.IdentityProviders {
+		if _, ok := providers[p.Name()]; ok {
+			return nil, fmt.Errorf("Duplicate identity provider %s", p.Name())
+		}
+		providers[p.Name()] = p
+	}
+
 	pw := passwordless.New(passwordless.NewRedisStore(option.Redis))
 	pw.SetTransport("Log", passwordless.LogTransport{
 		MessageFunc: func(token, uid string) string {
@@ -118,8 +171,10 @@ func New(option Options) (*Auth, error) {
 	), passwordless.NewCrockfordGenerator(32), time.Minute*15)
 
 	return &Auth{
-		Options: option,
-		pw:      pw,
-		jwtKey:  []byte(option.JWTSigningKey),
+		Options:   option,
+		pw:        pw,
+		jwtKey:    []byte(option.JWTSigningKey),
+		providers: providers,
+		logins:    &redisLoginStore{client: option.Redis},
 	}, nil
 }
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	extErrors "github.com/pkg/errors"
+)
+
+// ErrUnknownProvider is returned when logging in with an identity provider that is not configured
+var ErrUnknownProvider = errors.New("Unknown identity provider")
+
+// ErrInvalidState is returned when the authorization response does not match a pending login (expired, reused or forged)
+var ErrInvalidState = errors.New("Invalid or expired login state")
+
+// ErrUnverifiedEmail is returned when the identity provider does not vouch for the email address
+var ErrUnverifiedEmail = errors.New("Email address is not verified by the identity provider")
+
+const (
+	// time allowed between starting the login and returning from the identity provider
+	loginStateTTL = time.Minute * 10
+)
+
+// LoginCookie holds the state of the login started by the browser. The authorization response is only accepted
+// along with the cookie, so a response obtained by someone else cannot be completed in another browser (login CSRF)
+const LoginCookie = "rmc_login"
+
+// Identity is an external identity asserted by an IdentityProvider
+type Identity struct {
+	Provider      string
+	Subject       string // unique and stable within the provider
+	Email         string
+	EmailVerified bool
+}
+
+// IdentityProvider performs the authorization code flow (with PKCE) with an external identity provider
+type IdentityProvider interface {
+	// Name is the identifier used in routes and stored with linked identities, e.g. "google"
+	Name() string
+	// DisplayName is shown on the login button, e.g. "Google"
+	DisplayName() string
+	// AuthCodeURL returns the URL to redirect the customer to
+	AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error)
+	// Exchange redeems the authorization code and returns the verified Identity
+	Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Identity, error)
+}
+
+// ProviderInfo describes a configured IdentityProvider to the frontend
+type ProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// pending login, stored in Redis by state
+type loginState struct {
+	Provider     string `json:"provider"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"codeVerifier"`
+}
+
+func loginStateKey(state string) string {
+	return "rmc:login:" + state
+}
+
+// loginStore keeps the pending logins between BeginLogin and CompleteLogin
+type loginStore interface {
+	save(state string, data []byte, ttl time.Duration) error
+	// take returns and removes the pending login, so each state can only be used once. nil if there's none
+	take(state string) ([]byte, error)
+}
+
+type redisLoginStore struct {
+	client redis.UniversalClient
+}
+
+func (s *redisLoginStore) save(state string, data []byte, ttl time.Duration) error {
+	return s.client.Set(loginStateKey(state), data, ttl).Err()
+}
+
+func (s *redisLoginStore) take(state string) ([]byte, error) {
+	var get *redis.StringCmd
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.Get(loginStateKey(state))
+		pipe.Del(loginStateKey(state))
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(get.Val()), nil
+}
+
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Providers returns the configured identity providers
+func (a *Auth) Providers() []ProviderInfo {
+	providers := make([]ProviderInfo, 0, len(a.providers))
+	for _, p := range a.providers {
+		providers = append(providers, ProviderInfo{
+			Name:        p.Name(),
+			DisplayName: p.DisplayName(),
+		})
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name < providers[j].Name
+	})
+	return providers
+}
+
+// BeginLogin starts a login with the identity provider, and returns the URL to redirect the customer to along
+// with the state of the login, which is to be set as the LoginCookie (see SetLoginCookie)
+func (a *Auth) BeginLogin(ctx context.Context, provider string) (authorizationURL string, state string, err error) {
+	p, ok := a.providers[provider]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+
+	state, err = randomString(32)
+	if err != nil {
+		return "", "", extErrors.Wrap(err, "Cannot generate state")
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return "", "", extErrors.Wrap(err, "Cannot generate nonce")
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", "", extErrors.Wrap(err, "Cannot generate code verifier")
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	data, err := json.Marshal(loginState{
+		Provider:     provider,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+	})
+	if err != nil {
+		return "", "", extErrors.Wrap(err, "Cannot encode login state")
+	}
+	if err := a.logins.save(state, data, loginStateTTL); err != nil {
+		return "", "", extErrors.Wrap(err, "Cannot save login state")
+	}
+
+	authorizationURL, err = p.AuthCodeURL(ctx, state, nonce, base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		return "", "", err
+	}
+	return authorizationURL, state, nil
+}
+
+// loginCookie returns the LoginCookie. The frontend may be on another site, so the cookie is sent on cross-site
+// requests in production, which requires it to be Secure
+func (a *Auth) loginCookie(state string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     LoginCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if a.Environment == EnvProduction {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	return cookie
+}
+
+// SetLoginCookie sets the LoginCookie to the state returned by BeginLogin
+func (a *Auth) SetLoginCookie(w http.ResponseWriter, state string) {
+	http.SetCookie(w, a.loginCookie(state, int(loginStateTTL.Seconds())))
+}
+
+// ClearLoginCookie removes the LoginCookie once the login is completed
+func (a *Auth) ClearLoginCookie(w http.ResponseWriter) {
+	http.SetCookie(w, a.loginCookie("", -1))
+}
+
+// CompleteLogin redeems the authorization code returned by the identity provider, and returns the verified Identity.
+// cookieState is the value of the LoginCookie, which must match the state. Each state can only be used once
+func (a *Auth) CompleteLogin(ctx context.Context, provider, code, state, cookieState string) (*Identity, error) {
+	p, ok := a.providers[provider]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	if len(state) == 0 || subtle.ConstantTimeCompare([]byte(state), []byte(cookieState)) != 1 {
+		return nil, ErrInvalidState
+	}
+
+	data, err := a.logins.take(state)
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot get login state")
+	}
+	if data == nil {
+		return nil, ErrInvalidState
+	}
+
+	var pending loginState
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot decode login state")
+	}
+	if pending.Provider != provider {
+		return nil, ErrInvalidState
+	}
+
+	identity, err := p.Exchange(ctx, code, pending.CodeVerifier, pending.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if !identity.EmailVerified {
+		return nil, ErrUnverifiedEmail
+	}
+	return identity, nil
+}
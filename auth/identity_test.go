@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miragespace/rmc/auth/mockoidc"
+)
+
+type memoryLoginStore struct {
+	mu     sync.Mutex
+	logins map[string][]byte
+}
+
+func (s *memoryLoginStore) save(state string, data []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins[state] = data
+	return nil
+}
+
+func (s *memoryLoginStore) take(state string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := s.logins[state]
+	delete(s.logins, state)
+	return data, nil
+}
+
+// newTestAuth returns an Auth with the providers "mock" and "other", both logging in with a mockoidc issuer
+func newTestAuth(t *testing.T) *Auth {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(nil)
+	issuerURL := "http://" + srv.Listener.Addr().String()
+	issuer, err := mockoidc.New(issuerURL)
+	if err != nil {
+		t.Fatalf("mockoidc.New: %v", err)
+	}
+	srv.Config.Handler = issuer.Handler()
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	a := &Auth{
+		providers: make(map[string]IdentityProvider),
+		logins: &memoryLoginStore{
+			logins: make(map[string][]byte),
+		},
+	}
+	for _, name := range []string{"mock", "other"} {
+		p, err := NewOIDCProvider(OIDCConfig{
+			Name:        name,
+			Issuer:      issuerURL,
+			ClientID:    "rmc",
+			RedirectURL: "http://frontend.test/login/oidc/" + name,
+		})
+		if err != nil {
+			t.Fatalf("NewOIDCProvider: %v", err)
+		}
+		a.providers[name] = p
+	}
+	return a
+}
+
+// authorize starts a login and submits the login page of the issuer like a browser would. Returns the code and
+// state of the authorization response, and the state set as the LoginCookie
+func authorize(t *testing.T, a *Auth, provider, email string, verified bool) (code, state, cookieState string) {
+	t.Helper()
+	authorizationURL, cookieState, err := a.BeginLogin(context.Background(), provider)
+	if err != nil {
+		t.Fatalf("BeginLogin: %v", err)
+	}
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		t.Fatalf("Invalid authorization URL: %v", err)
+	}
+
+	form := url.Values{}
+	form.Set("query", u.RawQuery)
+	form.Set("email", email)
+	if verified {
+		form.Set("email_verified", "true")
+	}
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	u.RawQuery = ""
+	res, err := client.PostForm(u.String(), form)
+	if err != nil {
+		t.Fatalf("Cannot submit the login page: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("Expected a redirect from the login page, got HTTP %d", res.StatusCode)
+	}
+	redirect, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid redirect: %v", err)
+	}
+	return redirect.Query().Get("code"), redirect.Query().Get("state"), cookieState
+}
+
+func TestCompleteLogin(t *testing.T) {
+	a := newTestAuth(t)
+	code, state, cookieState := authorize(t, a, "mock", "gamer@example.com", true)
+
+	identity, err := a.CompleteLogin(context.Background(), "mock", code, state, cookieState)
+	if err != nil {
+		t.Fatalf("CompleteLogin: %v", err)
+	}
+	if identity.Provider != "mock" || identity.Email != "gamer@example.com" || identity.Subject != "gamer@example.com" {
+		t.Fatalf("Unexpected identity %+v", identity)
+	}
+}
+
+func TestCompleteLoginRequiresCookie(t *testing.T) {
+	a := newTestAuth(t)
+	code, state, cookieState := authorize(t, a, "mock", "gamer@example.com", true)
+	// e.g. the attacker's own login, whose authorization response the victim is tricked into completing
+	_, _, otherState := authorize(t, a, "mock", "attacker@example.com", true)
+
+	for _, cookie := range []string{"", otherState} {
+		if _, err := a.CompleteLogin(context.Background(), "mock", code, state, cookie); err != ErrInvalidState {
+			t.Fatalf("Expected ErrInvalidState with cookie %q, got %v", cookie, err)
+		}
+	}
+
+	// the login can still be completed by the browser which started it
+	if _, err := a.CompleteLogin(context.Background(), "mock", code, state, cookieState); err != nil {
+		t.Fatalf("CompleteLogin: %v", err)
+	}
+}
+
+func TestCompleteLoginOnce(t *testing.T) {
+	a := newTestAuth(t)
+	code, state, cookieState := authorize(t, a, "mock", "gamer@example.com", true)
+
+	if _, err := a.CompleteLogin(context.Background(), "mock", code, state, cookieState); err != nil {
+		t.Fatalf("CompleteLogin: %v", err)
+	}
+	if _, err := a.CompleteLogin(context.Background(), "mock", code, state, cookieState); err != ErrInvalidState {
+		t.Fatalf("Expected ErrInvalidState when reusing the state, got %v", err)
+	}
+}
+
+func TestCompleteLoginRejects(t *testing.T) {
+	a := newTestAuth(t)
+
+	code, state, cookieState := authorize(t, a, "mock", "gamer@example.com", false)
+	if _, err := a.CompleteLogin(context.Background(), "mock", code, state, cookieState); err != ErrUnverifiedEmail {
+		t.Fatalf("Expected ErrUnverifiedEmail, got %v", err)
+	}
+
+	code, state, cookieState = authorize(t, a, "mock", "gamer@example.com", true)
+	if _, err := a.CompleteLogin(context.Background(), "other", code, state, cookieState); err != ErrInvalidState {
+		t.Fatalf("Expected ErrInvalidState when completing with another provider, got %v", err)
+	}
+
+	_, state, cookieState = authorize(t, a, "mock", "gamer@example.com", true)
+	if _, err := a.CompleteLogin(context.Background(), "mock", "forged", state, cookieState); err != ErrInvalidState {
+		t.Fatalf("Expected ErrInvalidState with a forged code, got %v", err)
+	}
+
+	if _, err := a.CompleteLogin(context.Background(), "unknown", code, state, cookieState); err != ErrUnknownProvider {
+		t.Fatalf("Expected ErrUnknownProvider, got %v", err)
+	}
+}
+
+func TestLoginCookie(t *testing.T) {
+	a := &Auth{
+		Options: Options{
+			Environment: EnvProduction,
+		},
+	}
+	w := httptest.NewRecorder()
+	a.SetLoginCookie(w, "state")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected a cookie, got %d", len(cookies))
+	}
+	c := cookies[0]
+	if c.Name != LoginCookie || c.Value != "state" || !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteNoneMode {
+		t.Fatalf("Unexpected cookie %+v", c)
+	}
+
+	w = httptest.NewRecorder()
+	a.ClearLoginCookie(w)
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Fatalf("Expected the cookie to be removed, got %+v", cookies)
+	}
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"time"
 
@@ -13,9 +14,13 @@ import (
 var bearerPrefix = "Bearer "
 var jwtSigningMethod = jwt.SigningMethodHS256
 
+// RefreshClaim is the struct for refresh token. StandardClaims.Id identifies the token within the Session
 type RefreshClaim struct {
 	jwt.StandardClaims
-	ID string `json:"id"`
+	ID      string `json:"id"`
+	Session string `json:"sid"`
+	// StepUpUntil is not part of the token, and is set from the session by RefreshSession
+	StepUpUntil int64 `json:"-"`
 }
 
 // CreateTokenFromClaims will create a signed jwt token that contains the given Claims
@@ -28,19 +33,7 @@ func (a *Auth) CreateTokenFromClaims(claims Claims) (string, error) {
 	return token.SignedString(a.jwtKey)
 }
 
-func (a *Auth) CreateRefreshTokenFromClaims(claims Claims) (string, error) {
-	expirationTime := time.Now().Add(time.Hour * 24)
-	refresh := RefreshClaim{
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
-		ID: claims.ID,
-	}
-	token := jwt.NewWithClaims(jwtSigningMethod, refresh)
-	return token.SignedString(a.jwtKey)
-}
-
-func (a *Auth) VerifyRefreshToken(token string) (*RefreshClaim, error) {
+func (a *Auth) verifyRefreshToken(token string) (*RefreshClaim, error) {
 	claims := &RefreshClaim{}
 	jwtToken, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
 		return a.jwtKey, nil
@@ -60,6 +53,10 @@ func (a *Auth) VerifyRefreshToken(token string) (*RefreshClaim, error) {
 	if !jwtToken.Valid {
 		return nil, nil
 	}
+	// refresh tokens issued before sessions were stored server-side cannot be revoked
+	if claims.Session == "" || claims.StandardClaims.Id == "" {
+		return nil, nil
+	}
 	return claims, nil
 }
 
@@ -86,8 +83,7 @@ func (a *Auth) verifyToken(token string) (*Claims, error) {
 	return claims, nil
 }
 
-// Middleware returns a http middleware to verify Bearer in the header
-// TODO: Implement refresh mechanism
+// Middleware returns a http middleware to verify Bearer in the header. Bearer can either be a JWT or an API key
 func (a *Auth) Middleware() func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -97,9 +93,16 @@ func (a *Auth) Middleware() func(next http.Handler) http.Handler {
 				resp.WriteError(w, r, resp.ErrNoBearer())
 				return
 			}
-			claims, err := a.verifyToken(auth[n:])
+			var claims *Claims
+			var err error
+			token := auth[n:]
+			if isAPIKey(token) {
+				claims, err = a.verifyAPIKey(r.Context(), token, remoteIP(r))
+			} else {
+				claims, err = a.verifyToken(token)
+			}
 			if err != nil {
-				a.Logger.Error("Cannot verify JWT token",
+				a.Logger.Error("Cannot verify bearer token",
 					zap.Error(err),
 				)
 				resp.WriteError(w, r, resp.ErrUnexpected())
@@ -109,6 +112,21 @@ func (a *Auth) Middleware() func(next http.Handler) http.Handler {
 				resp.WriteError(w, r, resp.ErrNoBearer())
 				return
 			}
+			if claims.APIKeyID == "" {
+				// access tokens are rejected as soon as their session ends (e.g. logout)
+				active, err := a.sessionActive(claims.Session)
+				if err != nil {
+					a.Logger.Error("Cannot verify session",
+						zap.Error(err),
+					)
+					resp.WriteError(w, r, resp.ErrUnexpected())
+					return
+				}
+				if !active {
+					resp.WriteError(w, r, resp.ErrNoBearer())
+					return
+				}
+			}
 
 			ctx := context.WithValue(r.Context(), Context, claims)
 
@@ -131,3 +149,66 @@ func (a *Auth) ClaimCheck() func(next http.Handler) http.Handler {
 		})
 	}
 }
+
+// RequireScope returns a http middleware that only allows API keys with the given scope. Interactive sessions are always allowed
+func RequireScope(scope Scope) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(Context).(*Claims)
+			if !ok || !claims.HasScope(scope) {
+				resp.WriteError(w, r, resp.ErrForbidden().AddMessages("API key is missing scope: "+string(scope)))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireStepUp is a http middleware for destructive actions. If the customer has enabled two-factor authentication,
+// the session must be step-up verified (see StepUp). API keys cannot be step-up verified
+func (a *Auth) RequireStepUp(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(Context).(*Claims)
+		if !ok {
+			resp.WriteError(w, r, resp.ErrUnauthorized())
+			return
+		}
+		if claims.APIKeyID == "" && claims.SteppedUp() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		enabled, err := a.totpEnabled(r.Context(), claims.ID)
+		if err != nil {
+			a.Logger.Error("Cannot verify two-factor authentication",
+				zap.Error(err),
+			)
+			resp.WriteError(w, r, resp.ErrUnexpected())
+			return
+		}
+		if enabled {
+			resp.WriteError(w, r, resp.ErrStepUpRequired())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireSession is a http middleware that rejects API keys, for routes that are only available to interactive sessions
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(Context).(*Claims)
+		if !ok || claims.APIKeyID != "" {
+			resp.WriteError(w, r, resp.ErrForbidden().AddMessages("API keys cannot be used for this request"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,251 @@
+// Package mockoidc is a minimal OpenID Connect issuer for testing social login. It supports the
+// authorization code flow with PKCE only, and lets you pick any email on the authorize page.
+// Do not use it in production
+package mockoidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const keyID = "mockoidc"
+
+var authorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Mock OIDC Login</title></head>
+<body>
+<h1>Mock OIDC Login</h1>
+<p>Logging in to <code>{{.ClientID}}</code></p>
+<form method="POST">
+	<input type="hidden" name="query" value="{{.Query}}">
+	<label>Email <input type="email" name="email" value="gamer@example.com" required></label><br>
+	<label>Subject <input type="text" name="sub" placeholder="defaults to email"></label><br>
+	<label><input type="checkbox" name="email_verified" value="true" checked> Email verified</label><br>
+	<button type="submit">Login</button>
+</form>
+</body>
+</html>`))
+
+type authorization struct {
+	ClientID      string
+	RedirectURI   string
+	Nonce         string
+	CodeChallenge string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	ExpiresAt     time.Time
+}
+
+// Issuer serves the discovery, JWKS, authorize and token endpoints of the mock identity provider
+type Issuer struct {
+	url string
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+func randomString() string {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeTokenError(w http.ResponseWriter, code, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.url,
+		"authorization_endpoint":                i.url + "/authorize",
+		"token_endpoint":                        i.url + "/token",
+		"jwks_uri":                              i.url + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := i.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": keyID,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			},
+		},
+	})
+}
+
+func (i *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "Only response_type=code with S256 PKCE is supported", http.StatusBadRequest)
+			return
+		}
+		if q.Get("client_id") == "" || q.Get("redirect_uri") == "" {
+			http.Error(w, "client_id and redirect_uri are required", http.StatusBadRequest)
+			return
+		}
+		authorizeTemplate.Execute(w, struct {
+			ClientID string
+			Query    string
+		}{
+			ClientID: q.Get("client_id"),
+			Query:    r.URL.RawQuery,
+		})
+
+	case http.MethodPost:
+		q, err := url.ParseQuery(r.PostFormValue("query"))
+		if err != nil {
+			http.Error(w, "Invalid query", http.StatusBadRequest)
+			return
+		}
+		redirect, err := url.Parse(q.Get("redirect_uri"))
+		if err != nil {
+			http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+			return
+		}
+		email := r.PostFormValue("email")
+		sub := r.PostFormValue("sub")
+		if sub == "" {
+			sub = email
+		}
+
+		code := randomString()
+		i.mu.Lock()
+		i.codes[code] = authorization{
+			ClientID:      q.Get("client_id"),
+			RedirectURI:   q.Get("redirect_uri"),
+			Nonce:         q.Get("nonce"),
+			CodeChallenge: q.Get("code_challenge"),
+			Subject:       sub,
+			Email:         email,
+			EmailVerified: r.PostFormValue("email_verified") == "true",
+			ExpiresAt:     time.Now().Add(time.Minute),
+		}
+		i.mu.Unlock()
+
+		params := redirect.Query()
+		params.Set("code", code)
+		params.Set("state", q.Get("state"))
+		redirect.RawQuery = params.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeTokenError(w, "unsupported_grant_type", "Only authorization_code is supported")
+		return
+	}
+
+	// codes can only be redeemed once
+	code := r.PostFormValue("code")
+	i.mu.Lock()
+	auth, ok := i.codes[code]
+	delete(i.codes, code)
+	i.mu.Unlock()
+
+	if !ok || time.Now().After(auth.ExpiresAt) {
+		writeTokenError(w, "invalid_grant", "Unknown or expired code")
+		return
+	}
+	if r.PostFormValue("client_id") != auth.ClientID || r.PostFormValue("redirect_uri") != auth.RedirectURI {
+		writeTokenError(w, "invalid_grant", "client_id or redirect_uri does not match")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.CodeChallenge {
+		writeTokenError(w, "invalid_grant", "PKCE verification failed")
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            i.url,
+		"sub":            auth.Subject,
+		"aud":            auth.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          auth.Nonce,
+		"email":          auth.Email,
+		"email_verified": auth.EmailVerified,
+	})
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(i.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// New returns an Issuer with a freshly generated signing key. issuerURL is where Handler is served,
+// and must match the issuer configured in the relying party
+func New(issuerURL string) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{
+		url:   issuerURL,
+		key:   key,
+		codes: make(map[string]authorization),
+	}, nil
+}
+
+// Handler returns the handler serving the endpoints of the Issuer
+func (i *Issuer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("/jwks", i.jwks)
+	mux.HandleFunc("/authorize", i.authorize)
+	mux.HandleFunc("/token", i.token)
+	return mux
+}
@@ -0,0 +1,356 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	extErrors "github.com/pkg/errors"
+)
+
+const (
+	// JWKS is fetched again at most once per interval when an unknown key ID is seen (i.e. key rotation)
+	jwksRefreshInterval = time.Minute
+	// allowed clock skew when validating ID tokens
+	idTokenLeeway = time.Minute
+)
+
+// OIDCConfig specifies an OpenID Connect identity provider
+type OIDCConfig struct {
+	Name         string // e.g. "google"
+	DisplayName  string // e.g. "Google"
+	Issuer       string // e.g. "https://accounts.google.com". Discovery is done via Issuer + "/.well-known/openid-configuration"
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string   // the frontend page that completes the login with the code and state
+	Scopes       []string // defaults to "openid email profile"
+	// Some providers (e.g. Microsoft) do not send email_verified. Only set this if the provider
+	// verifies every email it asserts, otherwise an account could be taken over via an unverified email
+	TrustEmail bool
+	HTTPClient *http.Client
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// OIDCProvider is an IdentityProvider using OpenID Connect authorization code flow with PKCE.
+// Only RS256 signed ID tokens are accepted
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+// NewOIDCProvider returns a new OIDCProvider. Discovery is done lazily on first use
+func NewOIDCProvider(config OIDCConfig) (*OIDCProvider, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("Empty Name is invalid")
+	}
+	if config.Issuer == "" {
+		return nil, fmt.Errorf("Empty Issuer is invalid")
+	}
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("Empty ClientID is invalid")
+	}
+	if config.RedirectURL == "" {
+		return nil, fmt.Errorf("Empty RedirectURL is invalid")
+	}
+	if config.DisplayName == "" {
+		config.DisplayName = config.Name
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{
+			Timeout: time.Second * 10,
+		}
+	}
+	return &OIDCProvider{
+		config: config,
+		client: client,
+		keys:   make(map[string]*rsa.PublicKey),
+	}, nil
+}
+
+// Name implements IdentityProvider
+func (o *OIDCProvider) Name() string {
+	return o.config.Name
+}
+
+// DisplayName implements IdentityProvider
+func (o *OIDCProvider) DisplayName() string {
+	return o.config.DisplayName
+}
+
+func (o *OIDCProvider) getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	res, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP %d", endpoint, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (o *OIDCProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+
+	var d oidcDiscovery
+	endpoint := strings.TrimSuffix(o.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := o.getJSON(ctx, endpoint, &d); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot fetch OpenID configuration")
+	}
+	if d.Issuer != o.config.Issuer {
+		return nil, fmt.Errorf("OpenID configuration issuer %s does not match %s", d.Issuer, o.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("OpenID configuration of %s is incomplete", o.config.Issuer)
+	}
+	o.discovery = &d
+	return o.discovery, nil
+}
+
+// getKey returns the public key with the key ID, fetching the JWKS again if the key is not known
+func (o *OIDCProvider) getKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	d, err := o.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(o.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("Unknown key ID %s", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := o.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot fetch JWKS")
+	}
+	o.keysFetched = time.Now()
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	o.keys = keys
+
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unknown key ID %s", kid)
+}
+
+// AuthCodeURL implements IdentityProvider
+func (o *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	d, err := o.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", extErrors.Wrap(err, "Invalid authorization endpoint")
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", o.config.ClientID)
+	q.Set("redirect_uri", o.config.RedirectURL)
+	q.Set("scope", strings.Join(o.config.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", codeChallenge)
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// audience can either be a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+type idTokenClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  audience    `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	IssuedAt  int64       `json:"iat"`
+	Nonce     string      `json:"nonce"`
+	Email     string      `json:"email"`
+	Verified  interface{} `json:"email_verified"` // some providers send a string
+}
+
+// Valid implements jwt.Claims, and only checks the timestamps. Other claims are checked in Exchange
+func (c *idTokenClaims) Valid() error {
+	now := time.Now()
+	if now.After(time.Unix(c.ExpiresAt, 0).Add(idTokenLeeway)) {
+		return fmt.Errorf("ID token is expired")
+	}
+	if c.IssuedAt > 0 && now.Add(idTokenLeeway).Before(time.Unix(c.IssuedAt, 0)) {
+		return fmt.Errorf("ID token is issued in the future")
+	}
+	return nil
+}
+
+func (c *idTokenClaims) emailVerified() bool {
+	switch v := c.Verified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	default:
+		return false
+	}
+}
+
+// Exchange implements IdentityProvider
+func (o *OIDCProvider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Identity, error) {
+	d, err := o.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.config.RedirectURL)
+	form.Set("client_id", o.config.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	if o.config.ClientSecret != "" {
+		form.Set("client_secret", o.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err := o.client.Do(req)
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot redeem authorization code")
+	}
+	defer res.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot decode token response")
+	}
+	if res.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, ErrInvalidState
+	}
+
+	claims := &idTokenClaims{}
+	_, err = jwt.ParseWithClaims(tokens.IDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+		}
+		kid, _ := token.Header["kid"].(string)
+		return o.getKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Invalid ID token")
+	}
+
+	if claims.Issuer != o.config.Issuer {
+		return nil, fmt.Errorf("ID token issuer %s does not match %s", claims.Issuer, o.config.Issuer)
+	}
+	validAudience := false
+	for _, aud := range claims.Audience {
+		if aud == o.config.ClientID {
+			validAudience = true
+		}
+	}
+	if !validAudience {
+		return nil, fmt.Errorf("ID token is not issued for this client")
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+	if claims.Subject == "" || claims.Email == "" {
+		return nil, fmt.Errorf("ID token has no subject or email")
+	}
+
+	return &Identity{
+		Provider:      o.config.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: o.config.TrustEmail || claims.emailVerified(),
+	}, nil
+}
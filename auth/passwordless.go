@@ -32,32 +32,48 @@ func (a *Auth) Verify(ctx context.Context, uid, token string) (bool, error) {
 
 func composeFuncGetter(options EmailOption) passwordless.ComposerFunc {
 	return func(ctx context.Context, token, uid, recipient string, w io.Writer) error {
+		link := options.LinkGenerator(uid, token)
+
+		compose := options.Composer
+		if compose == nil {
+			compose = defaultComposer(options.Name)
+		}
+		subject, text, html, err := compose(token, link)
+		if err != nil {
+			return err
+		}
+
 		e := &passwordless.Email{
-			Subject: "Login Token for " + options.Name,
+			Subject: subject,
 			To:      recipient,
 		}
+		e.AddBody("text/plain", text)
+		if html != "" {
+			e.AddBody("text/html", html)
+		}
 
-		link := options.LinkGenerator(uid, token)
+		_, err = e.Write(w)
 
+		return err
+	}
+}
+
+func defaultComposer(name string) EmailComposer {
+	return func(token, link string) (string, string, string, error) {
+		subject := "Login Token for " + name
 		text := "You (or someone who knows your email address) wants " +
-			"to sign in to " + options.Name + ".\n\n" +
+			"to sign in to " + name + ".\n\n" +
 			"Your token (expires in 15 minutes) is " + token + " - or use the following link: " +
 			link + "\n\n" +
 			"(If you were did not request or were not expecting this email, " +
 			"you can safely ignore it.)"
 		html := "<!doctype html><html><body>" +
 			"<p>You (or someone who knows your email address) wants " +
-			"to sign in to " + options.Name + ".</p>" +
+			"to sign in to " + name + ".</p>" +
 			"<p>Your token (expires in 15 minutes) is <b>" + token + "</b> - or <a href=\"" + link + "\">" +
 			"click here</a> to sign in automatically.</p>" +
 			"<p>(If you did not request or were not expecting this email, " +
 			"you can safely ignore it.)</p></body></html>"
-
-		e.AddBody("text/plain", text)
-		e.AddBody("text/html", html)
-
-		_, err := e.Write(w)
-
-		return err
+		return subject, text, html, nil
 	}
 }
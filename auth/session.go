@@ -0,0 +1,309 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	extErrors "github.com/pkg/errors"
+)
+
+// ErrInvalidRefreshToken is returned when the refresh token is malformed, expired, or its session has ended
+var ErrInvalidRefreshToken = errors.New("Invalid refresh token")
+
+// ErrRefreshTokenReused is returned when a refresh token that was already rotated is presented again.
+// The whole session is ended as the token has likely been stolen
+var ErrRefreshTokenReused = errors.New("Refresh token was reused")
+
+// ErrSessionNotFound is returned when ending a session that does not exist (or has already ended)
+var ErrSessionNotFound = errors.New("Session not found")
+
+const (
+	// each rotation extends the session, so a session ends after refreshTTL of inactivity
+	refreshTTL = time.Hour * 24
+	// User-Agent can be arbitrarily long
+	maxDeviceLength = 256
+)
+
+// Each session (a refresh token family) is a hash in Redis, with the ID of the current refresh token.
+// Sessions of a customer are indexed in a set so they can be listed and ended together
+func sessionKey(sessionID string) string {
+	return "rmc:session:" + sessionID
+}
+
+func customerSessionsKey(customerID string) string {
+	return "rmc:sessions:" + customerID
+}
+
+// KEYS: session, customer sessions. ARGV: presented token ID, next token ID, device, ip, last seen, session ID, ttl
+// returns 1 if rotated, 0 if the presented token was already rotated (session is ended), -1 if the session does not exist
+var rotateScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'current')
+if not current then
+	return -1
+end
+if current ~= ARGV[1] then
+	redis.call('DEL', KEYS[1])
+	redis.call('SREM', KEYS[2], ARGV[6])
+	return 0
+end
+redis.call('HSET', KEYS[1], 'current', ARGV[2], 'device', ARGV[3], 'ip', ARGV[4], 'lastSeen', ARGV[5])
+redis.call('EXPIRE', KEYS[1], ARGV[7])
+redis.call('EXPIRE', KEYS[2], ARGV[7])
+return 1
+`)
+
+// SessionInfo describes where a session is used from
+type SessionInfo struct {
+	Device string
+	IP     string
+}
+
+// SessionInfoFromRequest returns the SessionInfo of the client making the request
+func SessionInfoFromRequest(r *http.Request) SessionInfo {
+	device := r.UserAgent()
+	if len(device) > maxDeviceLength {
+		device = device[:maxDeviceLength]
+	}
+	return SessionInfo{
+		Device: device,
+		IP:     remoteIP(r),
+	}
+}
+
+// Session is a login session of a customer
+type Session struct {
+	ID        string    `json:"id"`
+	Device    string    `json:"device"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func (a *Auth) signRefreshToken(customerID, sessionID, tokenID string) (string, error) {
+	refresh := RefreshClaim{
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenID,
+			ExpiresAt: time.Now().Add(refreshTTL).Unix(),
+		},
+		ID:      customerID,
+		Session: sessionID,
+	}
+	token := jwt.NewWithClaims(jwtSigningMethod, refresh)
+	return token.SignedString(a.jwtKey)
+}
+
+// NewSession will start a new session for the customer in claims, and return the first refresh token of the session.
+// claims.Session will be set, and should be used to create the access token
+func (a *Auth) NewSession(ctx context.Context, claims *Claims, info SessionInfo) (string, error) {
+	sessionID := uuid.New().String()
+	tokenID := uuid.New().String()
+
+	refreshToken, err := a.signRefreshToken(claims.ID, sessionID, tokenID)
+	if err != nil {
+		return "", extErrors.Wrap(err, "Cannot sign refresh token")
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	_, err = a.Redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(sessionKey(sessionID),
+			"customer", claims.ID,
+			"current", tokenID,
+			"device", info.Device,
+			"ip", info.IP,
+			"createdAt", now,
+			"lastSeen", now,
+		)
+		pipe.Expire(sessionKey(sessionID), refreshTTL)
+		pipe.SAdd(customerSessionsKey(claims.ID), sessionID)
+		pipe.Expire(customerSessionsKey(claims.ID), refreshTTL)
+		return nil
+	})
+	if err != nil {
+		return "", extErrors.Wrap(err, "Cannot save session")
+	}
+
+	claims.Session = sessionID
+	return refreshToken, nil
+}
+
+// RefreshSession will rotate the refresh token. The returned RefreshClaim identifies the customer and the session,
+// and the returned token replaces the presented token, which cannot be used again
+func (a *Auth) RefreshSession(ctx context.Context, refreshToken string, info SessionInfo) (*RefreshClaim, string, error) {
+	refresh, err := a.verifyRefreshToken(refreshToken)
+	if err != nil {
+		return nil, "", err
+	}
+	if refresh == nil {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	nextID := uuid.New().String()
+	nextToken, err := a.signRefreshToken(refresh.ID, refresh.Session, nextID)
+	if err != nil {
+		return nil, "", extErrors.Wrap(err, "Cannot sign refresh token")
+	}
+
+	result, err := rotateScript.Run(a.Redis,
+		[]string{sessionKey(refresh.Session), customerSessionsKey(refresh.ID)},
+		refresh.StandardClaims.Id,
+		nextID,
+		info.Device,
+		info.IP,
+		strconv.FormatInt(time.Now().Unix(), 10),
+		refresh.Session,
+		int64(refreshTTL/time.Second),
+	).Int()
+	if err != nil {
+		return nil, "", extErrors.Wrap(err, "Cannot rotate refresh token")
+	}
+
+	switch result {
+	case 1:
+		refresh.StepUpUntil, err = a.stepUpUntil(refresh.Session)
+		if err != nil {
+			return nil, "", err
+		}
+		return refresh, nextToken, nil
+	case 0:
+		return nil, "", ErrRefreshTokenReused
+	default:
+		return nil, "", ErrInvalidRefreshToken
+	}
+}
+
+// Logout will end the session of the refresh token. If all is true, every session of the customer is ended,
+// in which case the refresh token must be the current token of its session
+func (a *Auth) Logout(ctx context.Context, refreshToken string, all bool) error {
+	refresh, err := a.verifyRefreshToken(refreshToken)
+	if err != nil {
+		return err
+	}
+	if refresh == nil {
+		return ErrInvalidRefreshToken
+	}
+
+	if !all {
+		return a.EndSession(ctx, refresh.ID, refresh.Session)
+	}
+
+	current, err := a.Redis.HGet(sessionKey(refresh.Session), "current").Result()
+	if err == redis.Nil {
+		return ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot get session")
+	}
+	if current != refresh.StandardClaims.Id {
+		// same as a reuse during refresh
+		if err := a.EndSession(ctx, refresh.ID, refresh.Session); err != nil && err != ErrSessionNotFound {
+			return err
+		}
+		return ErrRefreshTokenReused
+	}
+
+	return a.EndAllSessions(ctx, refresh.ID)
+}
+
+// EndSession will end the session of the customer. Access tokens of the session are rejected immediately
+func (a *Auth) EndSession(ctx context.Context, customerID, sessionID string) error {
+	owner, err := a.Redis.HGet(sessionKey(sessionID), "customer").Result()
+	if err == redis.Nil {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot get session")
+	}
+	if owner != customerID {
+		return ErrSessionNotFound
+	}
+
+	_, err = a.Redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(sessionKey(sessionID))
+		pipe.SRem(customerSessionsKey(customerID), sessionID)
+		return nil
+	})
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot end session")
+	}
+	return nil
+}
+
+// EndAllSessions will end every session of the customer
+func (a *Auth) EndAllSessions(ctx context.Context, customerID string) error {
+	sessionIDs, err := a.Redis.SMembers(customerSessionsKey(customerID)).Result()
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot list sessions")
+	}
+
+	keys := make([]string, 0, len(sessionIDs)+1)
+	for _, sessionID := range sessionIDs {
+		keys = append(keys, sessionKey(sessionID))
+	}
+	keys = append(keys, customerSessionsKey(customerID))
+
+	if err := a.Redis.Del(keys...).Err(); err != nil {
+		return extErrors.Wrap(err, "Cannot end sessions")
+	}
+	return nil
+}
+
+// ListSessions returns the active sessions of the customer
+func (a *Auth) ListSessions(ctx context.Context, customerID string) ([]Session, error) {
+	sessionIDs, err := a.Redis.SMembers(customerSessionsKey(customerID)).Result()
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot list sessions")
+	}
+
+	cmds := make([]*redis.StringStringMapCmd, len(sessionIDs))
+	_, err = a.Redis.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, sessionID := range sessionIDs {
+			cmds[i] = pipe.HGetAll(sessionKey(sessionID))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot get sessions")
+	}
+
+	sessions := make([]Session, 0, len(sessionIDs))
+	expired := make([]interface{}, 0)
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			expired = append(expired, sessionIDs[i])
+			continue
+		}
+		createdAt, _ := strconv.ParseInt(fields["createdAt"], 10, 64)
+		lastSeen, _ := strconv.ParseInt(fields["lastSeen"], 10, 64)
+		sessions = append(sessions, Session{
+			ID:        sessionIDs[i],
+			Device:    fields["device"],
+			IP:        fields["ip"],
+			CreatedAt: time.Unix(createdAt, 0),
+			LastSeen:  time.Unix(lastSeen, 0),
+		})
+	}
+
+	// sessions expire on their own, so clean up the index lazily
+	if len(expired) > 0 {
+		if err := a.Redis.SRem(customerSessionsKey(customerID), expired...).Err(); err != nil {
+			return nil, extErrors.Wrap(err, "Cannot remove expired sessions")
+		}
+	}
+
+	return sessions, nil
+}
+
+func (a *Auth) sessionActive(sessionID string) (bool, error) {
+	n, err := a.Redis.Exists(sessionKey(sessionID)).Result()
+	if err != nil {
+		return false, extErrors.Wrap(err, "Cannot check session")
+	}
+	return n == 1, nil
+}
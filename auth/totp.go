@@ -0,0 +1,453 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	extErrors "github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// ErrTOTPEnabled is returned when enrolling while two-factor authentication is already enabled
+var ErrTOTPEnabled = errors.New("Two-factor authentication is already enabled")
+
+// ErrTOTPNotEnrolled is returned when confirming or using two-factor authentication without enrolling
+var ErrTOTPNotEnrolled = errors.New("Two-factor authentication is not enabled")
+
+// ErrInvalidCode is returned when the TOTP or recovery code is incorrect or was already used
+var ErrInvalidCode = errors.New("Invalid verification code")
+
+// ErrTooManyAttempts is returned when too many incorrect codes were entered recently
+var ErrTooManyAttempts = errors.New("Too many incorrect verification codes")
+
+const (
+	totpPeriod  = 30
+	totpDigits  = 6
+	totpSkew    = 1 // steps accepted before and after the current step, for clock drift
+	secretBytes = 20
+
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 5 // 10 hex characters, shown as xxxxx-xxxxx
+
+	// StepUpDuration is how long a session stays step-up verified after entering a code
+	StepUpDuration = time.Minute * 10
+
+	maxCodeAttempts    = 5
+	codeAttemptsWindow = time.Minute * 5
+	stepUpSessionField = "stepUpUntil"
+)
+
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// KEYS: session. ARGV: field, step-up expiry. A session that has ended must not be recreated without a TTL
+var stepUpScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// TOTP is the time-based one-time password secret of a customer. Two-factor authentication is only
+// enabled after the customer confirms the enrollment with a valid code
+type TOTP struct {
+	CustomerID   string     `gorm:"primaryKey"`
+	Secret       string     `gorm:"not null"` // base32 encoded
+	CreatedAt    time.Time  `gorm:"not null"`
+	ConfirmedAt  *time.Time ``
+	LastUsedStep int64      `gorm:"not null;default:0"` // a code cannot be used twice
+}
+
+// RecoveryCode can be used once in place of a TOTP code, e.g. when the authenticator is lost. Only the hash is stored
+type RecoveryCode struct {
+	ID         string     `gorm:"primaryKey"`
+	CustomerID string     `gorm:"index;not null"`
+	Hash       string     `gorm:"not null"`
+	CreatedAt  time.Time  `gorm:"not null"`
+	UsedAt     *time.Time ``
+}
+
+// TOTPStatus describes the two-factor authentication of a customer
+type TOTPStatus struct {
+	Enabled                bool       `json:"enabled"`
+	ConfirmedAt            *time.Time `json:"confirmedAt"`
+	RecoveryCodesRemaining int64      `json:"recoveryCodesRemaining"`
+}
+
+// TOTPEnrollment is returned when enrolling, to be added to an authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URL    string `json:"url"` // otpauth:// URL, usually shown as a QR code
+}
+
+func hotp(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, see RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step the code is valid for, or 0 if it is not valid
+func matchTOTP(secret string, code string, now time.Time) int64 {
+	key, err := secretEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRecoveryCodes(customerID string) ([]string, []RecoveryCode, error) {
+	now := time.Now()
+	raw := make([]string, recoveryCodeCount)
+	codes := make([]RecoveryCode, recoveryCodeCount)
+	for i := range raw {
+		buf := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(buf)
+		raw[i] = code[:5] + "-" + code[5:]
+		codes[i] = RecoveryCode{
+			ID:         uuid.New().String(),
+			CustomerID: customerID,
+			Hash:       hashRecoveryCode(code),
+			CreatedAt:  now,
+		}
+	}
+	return raw, codes, nil
+}
+
+func (a *Auth) getTOTP(ctx context.Context, customerID string) (*TOTP, error) {
+	var t TOTP
+	result := a.DB.WithContext(ctx).First(&t, "customer_id = ?", customerID)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot get TOTP")
+	}
+	return &t, nil
+}
+
+// EnrollTOTP will generate a new TOTP secret for the customer. It must be confirmed with ConfirmTOTP
+// before two-factor authentication is enabled. Enrolling again replaces an unconfirmed secret
+func (a *Auth) EnrollTOTP(ctx context.Context, customerID, email string) (*TOTPEnrollment, error) {
+	buf := make([]byte, secretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot generate TOTP secret")
+	}
+	secret := secretEncoding.EncodeToString(buf)
+
+	err := a.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing TOTP
+		result := tx.First(&existing, "customer_id = ?", customerID)
+		if result.Error == nil && existing.ConfirmedAt != nil {
+			return ErrTOTPEnabled
+		}
+		if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return result.Error
+		}
+		return tx.Save(&TOTP{
+			CustomerID: customerID,
+			Secret:     secret,
+			CreatedAt:  time.Now(),
+		}).Error
+	})
+	if err == ErrTOTPEnabled {
+		return nil, err
+	}
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot save TOTP")
+	}
+
+	issuer := a.EmailOption.Name
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	return &TOTPEnrollment{
+		Secret: secret,
+		URL: (&url.URL{
+			Scheme:   "otpauth",
+			Host:     "totp",
+			Path:     "/" + issuer + ":" + email,
+			RawQuery: params.Encode(),
+		}).String(),
+	}, nil
+}
+
+// ConfirmTOTP will enable two-factor authentication if the code is valid for the enrolled secret,
+// and return the recovery codes. The recovery codes are not stored and cannot be retrieved again
+func (a *Auth) ConfirmTOTP(ctx context.Context, customerID, code string) ([]string, error) {
+	if err := a.checkAttempts(customerID); err != nil {
+		return nil, err
+	}
+
+	t, err := a.getTOTP(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if t.ConfirmedAt != nil {
+		return nil, ErrTOTPEnabled
+	}
+
+	step := matchTOTP(t.Secret, strings.TrimSpace(code), time.Now())
+	if step == 0 {
+		return nil, a.failedAttempt(customerID)
+	}
+
+	raw, codes, err := newRecoveryCodes(customerID)
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot generate recovery codes")
+	}
+
+	err = a.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&TOTP{}).
+			Where("customer_id = ? AND confirmed_at IS NULL", customerID).
+			Updates(map[string]interface{}{
+				"confirmed_at":   time.Now(),
+				"last_used_step": step,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTOTPEnabled
+		}
+		if err := tx.Where("customer_id = ?", customerID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&codes).Error
+	})
+	if err == ErrTOTPEnabled {
+		return nil, err
+	}
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot confirm TOTP")
+	}
+	return raw, nil
+}
+
+// DisableTOTP will disable two-factor authentication and delete the recovery codes
+func (a *Auth) DisableTOTP(ctx context.Context, customerID string) error {
+	err := a.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("customer_id = ?", customerID).Delete(&TOTP{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("customer_id = ?", customerID).Delete(&RecoveryCode{}).Error
+	})
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot disable TOTP")
+	}
+	return nil
+}
+
+// GetTOTPStatus returns whether two-factor authentication is enabled for the customer
+func (a *Auth) GetTOTPStatus(ctx context.Context, customerID string) (*TOTPStatus, error) {
+	t, err := a.getTOTP(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	status := &TOTPStatus{}
+	if t == nil || t.ConfirmedAt == nil {
+		return status, nil
+	}
+	status.Enabled = true
+	status.ConfirmedAt = t.ConfirmedAt
+
+	result := a.DB.WithContext(ctx).
+		Model(&RecoveryCode{}).
+		Where("customer_id = ? AND used_at IS NULL", customerID).
+		Count(&status.RecoveryCodesRemaining)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot count recovery codes")
+	}
+	return status, nil
+}
+
+// RegenerateRecoveryCodes will replace the recovery codes of the customer
+func (a *Auth) RegenerateRecoveryCodes(ctx context.Context, customerID string) ([]string, error) {
+	status, err := a.GetTOTPStatus(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	if !status.Enabled {
+		return nil, ErrTOTPNotEnrolled
+	}
+
+	raw, codes, err := newRecoveryCodes(customerID)
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot generate recovery codes")
+	}
+	err = a.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("customer_id = ?", customerID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&codes).Error
+	})
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot save recovery codes")
+	}
+	return raw, nil
+}
+
+func (a *Auth) totpEnabled(ctx context.Context, customerID string) (bool, error) {
+	var count int64
+	result := a.DB.WithContext(ctx).
+		Model(&TOTP{}).
+		Where("customer_id = ? AND confirmed_at IS NOT NULL", customerID).
+		Count(&count)
+	if result.Error != nil {
+		return false, extErrors.Wrap(result.Error, "Cannot get TOTP")
+	}
+	return count > 0, nil
+}
+
+// verifyCode checks a TOTP code or a recovery code. Each code can only be used once
+func (a *Auth) verifyCode(ctx context.Context, customerID, code string) error {
+	if err := a.checkAttempts(customerID); err != nil {
+		return err
+	}
+
+	t, err := a.getTOTP(ctx, customerID)
+	if err != nil {
+		return err
+	}
+	if t == nil || t.ConfirmedAt == nil {
+		return ErrTOTPNotEnrolled
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		step := matchTOTP(t.Secret, code, time.Now())
+		if step == 0 {
+			return a.failedAttempt(customerID)
+		}
+		result := a.DB.WithContext(ctx).
+			Model(&TOTP{}).
+			Where("customer_id = ? AND last_used_step < ?", customerID, step).
+			Update("last_used_step", step)
+		if result.Error != nil {
+			return extErrors.Wrap(result.Error, "Cannot update TOTP")
+		}
+		if result.RowsAffected == 0 {
+			// replayed code
+			return a.failedAttempt(customerID)
+		}
+		return nil
+	}
+
+	result := a.DB.WithContext(ctx).
+		Model(&RecoveryCode{}).
+		Where("customer_id = ? AND hash = ? AND used_at IS NULL", customerID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot use recovery code")
+	}
+	if result.RowsAffected == 0 {
+		return a.failedAttempt(customerID)
+	}
+	return nil
+}
+
+func codeAttemptsKey(customerID string) string {
+	return "rmc:2fa:attempts:" + customerID
+}
+
+func (a *Auth) checkAttempts(customerID string) error {
+	attempts, err := a.Redis.Get(codeAttemptsKey(customerID)).Int()
+	if err != nil && err != redis.Nil {
+		return extErrors.Wrap(err, "Cannot get verification attempts")
+	}
+	if attempts >= maxCodeAttempts {
+		return ErrTooManyAttempts
+	}
+	return nil
+}
+
+// failedAttempt records an incorrect code and returns ErrInvalidCode
+func (a *Auth) failedAttempt(customerID string) error {
+	key := codeAttemptsKey(customerID)
+	_, err := a.Redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Incr(key)
+		pipe.Expire(key, codeAttemptsWindow)
+		return nil
+	})
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot record verification attempt")
+	}
+	return ErrInvalidCode
+}
+
+// StepUp verifies the TOTP or recovery code, and marks the session of claims as step-up verified for StepUpDuration.
+// claims.StepUpUntil will be set, and a new access token should be created from claims
+func (a *Auth) StepUp(ctx context.Context, claims *Claims, code string) error {
+	if err := a.verifyCode(ctx, claims.ID, code); err != nil {
+		return err
+	}
+
+	until := time.Now().Add(StepUpDuration).Unix()
+	updated, err := stepUpScript.Run(a.Redis, []string{sessionKey(claims.Session)}, stepUpSessionField, until).Int()
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot save step-up verification")
+	}
+	if updated == 0 {
+		return ErrSessionNotFound
+	}
+
+	claims.StepUpUntil = until
+	return nil
+}
+
+// stepUpUntil returns when the step-up verification of the session expires, so refreshed access tokens keep it
+func (a *Auth) stepUpUntil(sessionID string) (int64, error) {
+	until, err := a.Redis.HGet(sessionKey(sessionID), stepUpSessionField).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, extErrors.Wrap(err, "Cannot get step-up verification")
+	}
+	return until, nil
+}
@@ -2,14 +2,20 @@ package broker
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/miragespace/rmc/spec"
 	"github.com/miragespace/rmc/spec/broker"
 	"github.com/miragespace/rmc/spec/protocol"
+	"github.com/miragespace/rmc/tracing"
 
 	extErrors "github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
@@ -132,6 +138,18 @@ func (a *AMQPBroker) setupExchanges(channel *amqp.Channel) error {
 	return nil
 }
 
+// Ping checks that the broker can be reached by opening and closing a channel on the connection
+func (a *AMQPBroker) Ping(ctx context.Context) error {
+	if a.connection == nil || a.connection.IsClosed() {
+		return fmt.Errorf("connection to broker is closed")
+	}
+	channel, err := a.connection.Channel()
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot open channel")
+	}
+	return channel.Close()
+}
+
 // Close will close the channel and connection to release resources
 func (a *AMQPBroker) Close() {
 	if a.producerChannel != nil {
@@ -145,88 +163,160 @@ func (a *AMQPBroker) Close() {
 	}
 }
 
-func (a *AMQPBroker) publishViaRoutingKey(exchange, routingKey string, body []byte) error {
-	return a.producerChannel.Publish(
+var (
+	publishedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmc_broker_published_total",
+		Help: "Messages published to the broker by exchange and result (ok or error)",
+	}, []string{"exchange", "result"})
+	consumedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmc_broker_consumed_total",
+		Help: "Messages consumed from the broker by exchange and result (ok or malformed)",
+	}, []string{"exchange", "result"})
+	consumeLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rmc_broker_consume_lag_seconds",
+		Help:    "Time between a message being published and consumed, by exchange",
+		Buckets: []float64{.01, .05, .1, .5, 1, 5, 15, 30, 60, 300},
+	}, []string{"exchange"})
+)
+
+// publishedAtHeader is the header holding when a message was published, in Unix nanoseconds. The Timestamp
+// property of AMQP messages only has a precision of seconds, which is too coarse to measure the lag
+const publishedAtHeader = "x-published-at"
+
+// observeDelivery records that a message was consumed from the exchange
+func observeDelivery(exchange string, d amqp.Delivery, err error) {
+	if err != nil {
+		consumedTotal.WithLabelValues(exchange, "malformed").Inc()
+		return
+	}
+	consumedTotal.WithLabelValues(exchange, "ok").Inc()
+	if publishedAt, ok := d.Headers[publishedAtHeader].(int64); ok {
+		consumeLag.WithLabelValues(exchange).Observe(time.Since(time.Unix(0, publishedAt)).Seconds())
+	}
+}
+
+// tableCarrier adapts the headers of an AMQP message to propagation.TextMapCarrier
+type tableCarrier amqp.Table
+
+func (t tableCarrier) Get(key string) string {
+	value, _ := t[key].(string)
+	return value
+}
+
+func (t tableCarrier) Set(key, value string) {
+	t[key] = value
+}
+
+func (t tableCarrier) Keys() []string {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (a *AMQPBroker) publishViaRoutingKey(ctx context.Context, exchange, routingKey string, body []byte) error {
+	ctx, span := tracing.StartChild(ctx, exchange+" publish", trace.SpanKindProducer,
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.String("messaging.destination", exchange),
+		attribute.String("messaging.rabbitmq.routing_key", routingKey),
+	)
+	defer span.End()
+
+	now := time.Now()
+	headers := amqp.Table{
+		publishedAtHeader: now.UnixNano(),
+	}
+	tracing.Inject(ctx, tableCarrier(headers))
+	err := a.producerChannel.Publish(
 		exchange,
 		routingKey,
 		false,
 		false,
 		amqp.Publishing{
+			Headers:      headers,
 			DeliveryMode: amqp.Persistent,
-			Timestamp:    time.Now(),
+			Timestamp:    now,
 			ContentType:  "application/x-protobuf",
 			Body:         body,
 		},
 	)
+	if err != nil {
+		tracing.SetError(span, err)
+		publishedTotal.WithLabelValues(exchange, "error").Inc()
+	} else {
+		publishedTotal.WithLabelValues(exchange, "ok").Inc()
+	}
+	return err
 }
 
 // SendControlRequest will send the request to control to a specific host
-func (a *AMQPBroker) SendControlRequest(hostIdentifier string, p *protocol.ControlRequest) error {
+func (a *AMQPBroker) SendControlRequest(ctx context.Context, hostIdentifier string, p *protocol.ControlRequest) error {
 	protoBytes, err := proto.Marshal(p)
 	if err != nil {
 		return extErrors.Wrap(err, "Cannot encode message into bytes")
 	}
-	if err := a.publishViaRoutingKey(instanceControlExchange, hostIdentifier, protoBytes); err != nil {
+	if err := a.publishViaRoutingKey(ctx, instanceControlExchange, hostIdentifier, protoBytes); err != nil {
 		return extErrors.Wrap(err, "Cannot publish control request")
 	}
 	return nil
 }
 
 // SendProvisionRequest will send request to provision to a specific host
-func (a *AMQPBroker) SendProvisionRequest(hostIdentifier string, p *protocol.ProvisionRequest) error {
+func (a *AMQPBroker) SendProvisionRequest(ctx context.Context, hostIdentifier string, p *protocol.ProvisionRequest) error {
 	protoBytes, err := proto.Marshal(p)
 	if err != nil {
 		return extErrors.Wrap(err, "Cannot encode message into bytes")
 	}
-	if err := a.publishViaRoutingKey(instanceProvisionExchange, hostIdentifier, protoBytes); err != nil {
+	if err := a.publishViaRoutingKey(ctx, instanceProvisionExchange, hostIdentifier, protoBytes); err != nil {
 		return extErrors.Wrap(err, "Cannot publish provision request")
 	}
 	return nil
 }
 
 // SendControlReply will send the control result back to the producer
-func (a *AMQPBroker) SendControlReply(p *protocol.ControlReply) error {
+func (a *AMQPBroker) SendControlReply(ctx context.Context, p *protocol.ControlReply) error {
 	protoBytes, err := proto.Marshal(p)
 	if err != nil {
 		return extErrors.Wrap(err, "Cannot encode message into bytes")
 	}
-	if err := a.publishViaRoutingKey(instanceControlExchange, hostReplyRoutingKey, protoBytes); err != nil {
+	if err := a.publishViaRoutingKey(ctx, instanceControlExchange, hostReplyRoutingKey, protoBytes); err != nil {
 		return extErrors.Wrap(err, "Cannot publish control reply")
 	}
 	return nil
 }
 
 // SendProvisionReply will send the provision result back to the producer
-func (a *AMQPBroker) SendProvisionReply(p *protocol.ProvisionReply) error {
+func (a *AMQPBroker) SendProvisionReply(ctx context.Context, p *protocol.ProvisionReply) error {
 	protoBytes, err := proto.Marshal(p)
 	if err != nil {
 		return extErrors.Wrap(err, "Cannot encode message into bytes")
 	}
-	if err := a.publishViaRoutingKey(instanceProvisionExchange, hostReplyRoutingKey, protoBytes); err != nil {
+	if err := a.publishViaRoutingKey(ctx, instanceProvisionExchange, hostReplyRoutingKey, protoBytes); err != nil {
 		return extErrors.Wrap(err, "Cannot publish provision reply")
 	}
 	return nil
 }
 
 // SendHeartbeat signals the host is alive along with host metadata
-func (a *AMQPBroker) SendHeartbeat(b *protocol.Heartbeat) error {
+func (a *AMQPBroker) SendHeartbeat(ctx context.Context, b *protocol.Heartbeat) error {
 	protoBytes, err := proto.Marshal(b)
 	if err != nil {
 		return extErrors.Wrap(err, "Cannot encode message into bytes")
 	}
-	if err := a.publishViaRoutingKey(hostHeartbeatExchange, "heartbeat", protoBytes); err != nil {
+	if err := a.publishViaRoutingKey(ctx, hostHeartbeatExchange, "heartbeat", protoBytes); err != nil {
 		return extErrors.Wrap(err, "Cannot publish heartbeats")
 	}
 	return nil
 }
 
 // SendTask signals API background task instance to do work
-func (a *AMQPBroker) SendTask(taskType spec.TaskType, p *protocol.Task) error {
+func (a *AMQPBroker) SendTask(ctx context.Context, taskType spec.TaskType, p *protocol.Task) error {
 	protoBytes, err := proto.Marshal(p)
 	if err != nil {
 		return extErrors.Wrap(err, "Cannot encode message into bytes")
 	}
-	if err := a.publishViaRoutingKey(asyncTaskExchange, string(taskType), protoBytes); err != nil {
+	if err := a.publishViaRoutingKey(ctx, asyncTaskExchange, string(taskType), protoBytes); err != nil {
 		return extErrors.Wrap(err, "Cannot publish task request")
 	}
 	return nil
@@ -267,21 +357,26 @@ func (a *AMQPBroker) getMsgChannel(qName, exchange, routingKey string) (<-chan a
 }
 
 // ReceiveControlRequest will consumer control requests directed to the host
-func (a *AMQPBroker) ReceiveControlRequest(ctx context.Context, hostIdentifier string) (<-chan *protocol.ControlRequest, error) {
+func (a *AMQPBroker) ReceiveControlRequest(ctx context.Context, hostIdentifier string) (<-chan broker.ControlRequest, error) {
 	name := "control_" + hostIdentifier
 	msgChan, err := a.getMsgChannel(name, instanceControlExchange, hostIdentifier)
 	if err != nil {
 		return nil, extErrors.Wrap(err, "Cannot setup consumer")
 	}
-	rChan := make(chan *protocol.ControlRequest)
+	rChan := make(chan broker.ControlRequest)
 	go func() {
 		for d := range msgChan {
 			var req protocol.ControlRequest
-			if err := proto.Unmarshal(d.Body, &req); err != nil {
+			err := proto.Unmarshal(d.Body, &req)
+			observeDelivery(instanceControlExchange, d, err)
+			if err != nil {
 				d.Nack(false, false)
 				continue
 			}
-			rChan <- &req
+			rChan <- broker.ControlRequest{
+				Context:        tracing.Extract(ctx, tableCarrier(d.Headers)),
+				ControlRequest: &req,
+			}
 			if err := d.Ack(false); err != nil {
 				a.logger.Error("Unable to ack control request message",
 					zap.Error(err),
@@ -295,21 +390,26 @@ func (a *AMQPBroker) ReceiveControlRequest(ctx context.Context, hostIdentifier s
 }
 
 // ReceiveProvisionRequest will consumer provision requests directed to the host
-func (a *AMQPBroker) ReceiveProvisionRequest(ctx context.Context, hostIdentifier string) (<-chan *protocol.ProvisionRequest, error) {
+func (a *AMQPBroker) ReceiveProvisionRequest(ctx context.Context, hostIdentifier string) (<-chan broker.ProvisionRequest, error) {
 	name := "provision_" + hostIdentifier
 	msgChan, err := a.getMsgChannel(name, instanceProvisionExchange, hostIdentifier)
 	if err != nil {
 		return nil, extErrors.Wrap(err, "Cannot setup consumer")
 	}
-	rChan := make(chan *protocol.ProvisionRequest)
+	rChan := make(chan broker.ProvisionRequest)
 	go func() {
 		for d := range msgChan {
 			var req protocol.ProvisionRequest
-			if err := proto.Unmarshal(d.Body, &req); err != nil {
+			err := proto.Unmarshal(d.Body, &req)
+			observeDelivery(instanceProvisionExchange, d, err)
+			if err != nil {
 				d.Nack(false, false)
 				continue
 			}
-			rChan <- &req
+			rChan <- broker.ProvisionRequest{
+				Context:          tracing.Extract(ctx, tableCarrier(d.Headers)),
+				ProvisionRequest: &req,
+			}
 			if err := d.Ack(false); err != nil {
 				a.logger.Error("Unable to ack provision request message",
 					zap.Error(err),
@@ -323,21 +423,26 @@ func (a *AMQPBroker) ReceiveProvisionRequest(ctx context.Context, hostIdentifier
 }
 
 // ReceiveControlReply will consumer control replies from hosts
-func (a *AMQPBroker) ReceiveControlReply(ctx context.Context) (<-chan *protocol.ControlReply, error) {
+func (a *AMQPBroker) ReceiveControlReply(ctx context.Context) (<-chan broker.ControlReply, error) {
 	name := "process_control_" + hostReplyRoutingKey
 	msgChan, err := a.getMsgChannel(name, instanceControlExchange, hostReplyRoutingKey)
 	if err != nil {
 		return nil, extErrors.Wrap(err, "Cannot setup consumer")
 	}
-	rChan := make(chan *protocol.ControlReply)
+	rChan := make(chan broker.ControlReply)
 	go func() {
 		for d := range msgChan {
 			var req protocol.ControlReply
-			if err := proto.Unmarshal(d.Body, &req); err != nil {
+			err := proto.Unmarshal(d.Body, &req)
+			observeDelivery(instanceControlExchange, d, err)
+			if err != nil {
 				d.Nack(false, false)
 				continue
 			}
-			rChan <- &req
+			rChan <- broker.ControlReply{
+				Context:      tracing.Extract(ctx, tableCarrier(d.Headers)),
+				ControlReply: &req,
+			}
 			if err := d.Ack(false); err != nil {
 				a.logger.Error("Unable to ack control reply message",
 					zap.Error(err),
@@ -351,21 +456,26 @@ func (a *AMQPBroker) ReceiveControlReply(ctx context.Context) (<-chan *protocol.
 }
 
 // ReceiveProvisionReply will consumer provision replies from hosts
-func (a *AMQPBroker) ReceiveProvisionReply(ctx context.Context) (<-chan *protocol.ProvisionReply, error) {
+func (a *AMQPBroker) ReceiveProvisionReply(ctx context.Context) (<-chan broker.ProvisionReply, error) {
 	name := "process_provision_" + hostReplyRoutingKey
 	msgChan, err := a.getMsgChannel(name, instanceProvisionExchange, hostReplyRoutingKey)
 	if err != nil {
 		return nil, extErrors.Wrap(err, "Cannot setup consumer")
 	}
-	rChan := make(chan *protocol.ProvisionReply)
+	rChan := make(chan broker.ProvisionReply)
 	go func() {
 		for d := range msgChan {
 			var req protocol.ProvisionReply
-			if err := proto.Unmarshal(d.Body, &req); err != nil {
+			err := proto.Unmarshal(d.Body, &req)
+			observeDelivery(instanceProvisionExchange, d, err)
+			if err != nil {
 				d.Nack(false, false)
 				continue
 			}
-			rChan <- &req
+			rChan <- broker.ProvisionReply{
+				Context:        tracing.Extract(ctx, tableCarrier(d.Headers)),
+				ProvisionReply: &req,
+			}
 			if err := d.Ack(false); err != nil {
 				a.logger.Error("Unable to ack provision reply message",
 					zap.Error(err),
@@ -379,21 +489,26 @@ func (a *AMQPBroker) ReceiveProvisionReply(ctx context.Context) (<-chan *protoco
 }
 
 // ReceiveHeartbeat will consumer heartbeats from hosts
-func (a *AMQPBroker) ReceiveHeartbeat(ctx context.Context, processor string) (<-chan *protocol.Heartbeat, error) {
+func (a *AMQPBroker) ReceiveHeartbeat(ctx context.Context, processor string) (<-chan broker.Heartbeat, error) {
 	name := "process_" + hostHeartbeatExchange + "_" + processor
 	msgChan, err := a.getMsgChannel(name, hostHeartbeatExchange, "#")
 	if err != nil {
 		return nil, extErrors.Wrap(err, "Cannot setup consumer")
 	}
-	hChan := make(chan *protocol.Heartbeat)
+	hChan := make(chan broker.Heartbeat)
 	go func() {
 		for d := range msgChan {
 			var req protocol.Heartbeat
-			if err := proto.Unmarshal(d.Body, &req); err != nil {
+			err := proto.Unmarshal(d.Body, &req)
+			observeDelivery(hostHeartbeatExchange, d, err)
+			if err != nil {
 				d.Nack(false, false)
 				continue
 			}
-			hChan <- &req
+			hChan <- broker.Heartbeat{
+				Context:   tracing.Extract(ctx, tableCarrier(d.Headers)),
+				Heartbeat: &req,
+			}
 			if err := d.Ack(false); err != nil {
 				a.logger.Error("Unable to ack heartbeat message",
 					zap.Error(err),
@@ -407,21 +522,26 @@ func (a *AMQPBroker) ReceiveHeartbeat(ctx context.Context, processor string) (<-
 }
 
 // ReceiveTask will consumer tasks from API service
-func (a *AMQPBroker) ReceiveTask(ctx context.Context, taskType spec.TaskType) (<-chan *protocol.Task, error) {
+func (a *AMQPBroker) ReceiveTask(ctx context.Context, taskType spec.TaskType) (<-chan broker.Task, error) {
 	name := "process_" + asyncTaskExchange + "_" + string(taskType)
 	msgChan, err := a.getMsgChannel(name, asyncTaskExchange, string(taskType))
 	if err != nil {
 		return nil, extErrors.Wrap(err, "Cannot setup consumer")
 	}
-	tChan := make(chan *protocol.Task)
+	tChan := make(chan broker.Task)
 	go func() {
 		for d := range msgChan {
 			var req protocol.Task
-			if err := proto.Unmarshal(d.Body, &req); err != nil {
+			err := proto.Unmarshal(d.Body, &req)
+			observeDelivery(asyncTaskExchange, d, err)
+			if err != nil {
 				d.Nack(false, false)
 				continue
 			}
-			tChan <- &req
+			tChan <- broker.Task{
+				Context: tracing.Extract(ctx, tableCarrier(d.Headers)),
+				Task:    &req,
+			}
 			if err := d.Ack(false); err != nil {
 				a.logger.Error("Unable to ack heartbeat message",
 					zap.Error(err),
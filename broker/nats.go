@@ -22,50 +22,50 @@ func (n *NATSBroker) Close() {
 
 }
 
-func (n *NATSBroker) SendControlRequest(hostIdentifier string, p *protocol.ControlRequest) error {
+func (n *NATSBroker) SendControlRequest(ctx context.Context, hostIdentifier string, p *protocol.ControlRequest) error {
 	return nil
 }
 
-func (n *NATSBroker) SendControlReply(p *protocol.ControlReply) error {
+func (n *NATSBroker) SendControlReply(ctx context.Context, p *protocol.ControlReply) error {
 	return nil
 }
 
-func (n *NATSBroker) SendProvisionRequest(hostIdentifier string, p *protocol.ProvisionRequest) error {
+func (n *NATSBroker) SendProvisionRequest(ctx context.Context, hostIdentifier string, p *protocol.ProvisionRequest) error {
 	return nil
 }
 
-func (n *NATSBroker) SendProvisionReply(p *protocol.ProvisionReply) error {
+func (n *NATSBroker) SendProvisionReply(ctx context.Context, p *protocol.ProvisionReply) error {
 	return nil
 }
 
-func (n *NATSBroker) SendHeartbeat(p *protocol.Heartbeat) error {
+func (n *NATSBroker) SendHeartbeat(ctx context.Context, p *protocol.Heartbeat) error {
 	return nil
 }
 
-func (n *NATSBroker) ReceiveControlRequest(ctx context.Context, hostIdentifier string) (<-chan *protocol.ControlRequest, error) {
+func (n *NATSBroker) ReceiveControlRequest(ctx context.Context, hostIdentifier string) (<-chan broker.ControlRequest, error) {
 	return nil, nil
 }
 
-func (n *NATSBroker) ReceiveProvisionRequest(ctx context.Context, hostIdentifier string) (<-chan *protocol.ProvisionRequest, error) {
+func (n *NATSBroker) ReceiveProvisionRequest(ctx context.Context, hostIdentifier string) (<-chan broker.ProvisionRequest, error) {
 	return nil, nil
 }
 
-func (n *NATSBroker) ReceiveControlReply(ctx context.Context) (<-chan *protocol.ControlReply, error) {
+func (n *NATSBroker) ReceiveControlReply(ctx context.Context) (<-chan broker.ControlReply, error) {
 	return nil, nil
 }
 
-func (n *NATSBroker) ReceiveProvisionReply(ctx context.Context) (<-chan *protocol.ProvisionReply, error) {
+func (n *NATSBroker) ReceiveProvisionReply(ctx context.Context) (<-chan broker.ProvisionReply, error) {
 	return nil, nil
 }
 
-func (n *NATSBroker) ReceiveHeartbeat(ctx context.Context, processor string) (<-chan *protocol.Heartbeat, error) {
+func (n *NATSBroker) ReceiveHeartbeat(ctx context.Context, processor string) (<-chan broker.Heartbeat, error) {
 	return nil, nil
 }
 
-func (n *NATSBroker) SendTask(taskType spec.TaskType, p *protocol.Task) error {
+func (n *NATSBroker) SendTask(ctx context.Context, taskType spec.TaskType, p *protocol.Task) error {
 	return nil
 }
 
-func (n *NATSBroker) ReceiveTask(ctx context.Context, taskType spec.TaskType) (<-chan *protocol.Task, error) {
+func (n *NATSBroker) ReceiveTask(ctx context.Context, taskType spec.TaskType) (<-chan broker.Task, error) {
 	return nil, nil
 }
@@ -2,25 +2,40 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/smtp"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
+	_ "time/tzdata" // schedules are in the timezone of the customer
 
+	"github.com/miragespace/rmc/admin"
+	"github.com/miragespace/rmc/audit"
 	"github.com/miragespace/rmc/auth"
 	"github.com/miragespace/rmc/broker"
 	"github.com/miragespace/rmc/customer"
 	"github.com/miragespace/rmc/db"
 	"github.com/miragespace/rmc/external"
+	"github.com/miragespace/rmc/health"
 	"github.com/miragespace/rmc/host"
 	"github.com/miragespace/rmc/instance"
+	"github.com/miragespace/rmc/metrics"
+	"github.com/miragespace/rmc/notification"
+	"github.com/miragespace/rmc/ratelimit"
 	"github.com/miragespace/rmc/response"
 	"github.com/miragespace/rmc/subscription"
+	"github.com/miragespace/rmc/team"
+	"github.com/miragespace/rmc/tracing"
 	"github.com/miragespace/rmc/util"
+	"github.com/miragespace/rmc/webhook"
 
 	"github.com/TheZeroSlave/zapsentry"
 	"github.com/getsentry/sentry-go"
@@ -92,8 +107,29 @@ func main() {
 
 	defer logger.Sync()
 
-	// a Stripe client will allow us to mock testing
-	stripeClient := external.NewStripeClient(os.Getenv("STRIPE_KEY"))
+	// Export the spans, if an exporter is configured. Trace IDs are logged regardless
+	exporter, err := tracing.NewExporter(context.Background(), os.Getenv("TRACING_EXPORTER"), os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	if err != nil {
+		logger.Fatal("Cannot initialize tracing exporter",
+			zap.Error(err),
+		)
+	}
+	sampleRatio, err := tracing.ParseSampleRatio(os.Getenv("TRACING_SAMPLE_RATIO"))
+	if err != nil {
+		logger.Fatal("Cannot parse TRACING_SAMPLE_RATIO",
+			zap.Error(err),
+		)
+	}
+	if err := tracing.Init(tracing.Options{
+		ServiceName: "rmc-api",
+		Exporter:    exporter,
+		SampleRatio: sampleRatio,
+		Logger:      logger,
+	}); err != nil {
+		logger.Fatal("Cannot initialize tracing",
+			zap.Error(err),
+		)
+	}
 
 	// Initialize backend connections
 	db, err := db.New(db.Options{
@@ -106,6 +142,19 @@ func main() {
 		)
 	}
 
+	// a BillingProvider allows us to run without a Stripe account (BILLING_PROVIDER=fake)
+	var billingProvider external.BillingProvider
+	if os.Getenv("BILLING_PROVIDER") == "fake" {
+		billingProvider, err = external.NewFakeBillingProvider(db)
+		if err != nil {
+			logger.Fatal("Cannot initialize fake BillingProvider",
+				zap.Error(err),
+			)
+		}
+	} else {
+		billingProvider = external.NewStripeClient(os.Getenv("STRIPE_KEY"))
+	}
+
 	rdb := redis.NewUniversalClient(&redis.UniversalOptions{
 		Addrs:    []string{os.Getenv("REDIS_URI")},
 		Password: os.Getenv("REDIS_PW"),
@@ -140,8 +189,55 @@ func main() {
 
 	// Initialize authentication manager
 	smtpAuth := smtp.PlainAuth("", os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("SMTP_HOST"))
+	// team invitations are only logged in development, similar to login tokens
+	var mailer external.Mailer
+	if authEnvironment == auth.EnvProduction {
+		mailer = external.NewSMTPMailer(os.Getenv("SMTP_HOST")+":"+os.Getenv("SMTP_PORT"), os.Getenv("SMTP_FROM"), smtpAuth)
+	} else {
+		mailer = &external.LogMailer{
+			Logger: logger,
+		}
+	}
+
+	// transactional email templates, optionally overridden by the templates in NOTIFICATION_TEMPLATES
+	templates := notification.NewTemplates()
+	if dir := os.Getenv("NOTIFICATION_TEMPLATES"); dir != "" {
+		if err := templates.Load(dir); err != nil {
+			logger.Fatal("Cannot load notification templates",
+				zap.Error(err),
+			)
+		}
+	}
+
+	// optional social login, e.g. OIDC_PROVIDERS=google with OIDC_GOOGLE_ISSUER, OIDC_GOOGLE_CLIENT_ID, etc
+	var identityProviders []auth.IdentityProvider
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider, err := auth.NewOIDCProvider(auth.OIDCConfig{
+			Name:         name,
+			DisplayName:  os.Getenv(prefix + "DISPLAY_NAME"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  fmt.Sprintf("%s/login/oidc/%s", frontendOrigin, name),
+			TrustEmail:   os.Getenv(prefix+"TRUST_EMAIL") == "true",
+		})
+		if err != nil {
+			logger.Fatal("Cannot initialize identity provider",
+				zap.Error(err),
+				zap.String("Provider", name),
+			)
+		}
+		identityProviders = append(identityProviders, provider)
+	}
+
 	auth, err := auth.New(auth.Options{
 		Redis:  rdb,
+		DB:     db,
 		Logger: logger,
 
 		JWTSigningKey: os.Getenv("JWT_KEY"),
@@ -155,7 +251,21 @@ func main() {
 			LinkGenerator: func(uid, token string) string {
 				return fmt.Sprintf("%s/login/%s/%s", frontendOrigin, uid, token)
 			},
+			// the customer is not known yet when requesting a login, so the default locale is used
+			Composer: func(token, link string) (string, string, string, error) {
+				msg, err := templates.Render(notification.DefaultLocale, notification.EventLogin, map[string]interface{}{
+					"SiteName": os.Getenv("SITE_NAME"),
+					"SiteURL":  frontendOrigin,
+					"Token":    token,
+					"Link":     link,
+				})
+				if err != nil {
+					return "", "", "", err
+				}
+				return msg.Subject, msg.Text, msg.HTML, nil
+			},
 		},
+		IdentityProviders: identityProviders,
 	})
 	if err != nil {
 		logger.Fatal("Cannot initialize AuthManager",
@@ -163,14 +273,79 @@ func main() {
 		)
 	}
 
+	// e.g. RATE_LIMITS="login:email=3/10m,control:instance=3/5m", see ratelimit.DefaultLimits
+	limits, err := ratelimit.ParseLimits(os.Getenv("RATE_LIMITS"))
+	if err != nil {
+		logger.Fatal("Cannot parse RATE_LIMITS",
+			zap.Error(err),
+		)
+	}
+	limiter, err := ratelimit.New(ratelimit.Options{
+		Redis:  rdb,
+		Logger: logger,
+		Limits: limits,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize rate limiter",
+			zap.Error(err),
+		)
+	}
+
 	// Initialize Managers
-	customerManager, err := customer.NewManager(logger, db, stripeClient)
+	customerManager, err := customer.NewManager(logger, db, billingProvider)
 	if err != nil {
 		logger.Fatal("Cannot initialize CustomerManager",
 			zap.Error(err),
 		)
 	}
 
+	notificationManager, err := notification.NewManager(notification.ManagerOptions{
+		CustomerManager: customerManager,
+		Mailer:          mailer,
+		Templates:       templates,
+		DB:              db,
+		Logger:          logger,
+		SiteName:        os.Getenv("SITE_NAME"),
+		SiteURL:         frontendOrigin,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize NotificationManager",
+			zap.Error(err),
+		)
+	}
+
+	// webhooks cannot reach private networks unless WEBHOOK_ALLOW_PRIVATE=true, e.g. for local development
+	var webhookClient *http.Client
+	if os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true" {
+		webhookClient = &http.Client{
+			Timeout: time.Second * 10,
+		}
+	}
+	webhookManager, err := webhook.NewManager(webhook.ManagerOptions{
+		DB:         db,
+		Logger:     logger,
+		HTTPClient: webhookClient,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize WebhookManager",
+			zap.Error(err),
+		)
+	}
+
+	teamManager, err := team.NewManager(team.ManagerOptions{
+		CustomerManager: customerManager,
+		DB:              db,
+		Logger:          logger,
+		Mailer:          mailer,
+		SiteName:        os.Getenv("SITE_NAME"),
+		InvitationURL:   frontendOrigin + "/teams",
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize TeamManager",
+			zap.Error(err),
+		)
+	}
+
 	hostManager, err := host.NewManager(logger, db)
 	if err != nil {
 		logger.Fatal("Cannot initialize HostManager",
@@ -186,10 +361,12 @@ func main() {
 	}
 	defer subscriptionProducer.Close()
 	subscriptionManager, err := subscription.NewManager(subscription.ManagerOptions{
-		StripeClient: stripeClient,
-		Producer:     subscriptionProducer,
-		DB:           db,
-		Logger:       logger,
+		BillingProvider:     billingProvider,
+		Producer:            subscriptionProducer,
+		DB:                  db,
+		Logger:              logger,
+		NotificationManager: notificationManager,
+		WebhookManager:      webhookManager,
 	})
 	if err != nil {
 		logger.Fatal("Cannot initialize SubscriptionManager",
@@ -207,10 +384,41 @@ func main() {
 		)
 	}
 
+	auditManager, err := audit.NewManager(audit.ManagerOptions{
+		DB:     db,
+		Logger: logger,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize AuditManager",
+			zap.Error(err),
+		)
+	}
+
+	adminManager, err := admin.NewManager(admin.ManagerOptions{
+		AuditManager: auditManager,
+		DB:           db,
+		Logger:       logger,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize AdminManager",
+			zap.Error(err),
+		)
+	}
+
+	// the first superuser has to be created out of band
+	if bootstrapKey := os.Getenv("ADMIN_BOOTSTRAP_KEY"); bootstrapKey != "" {
+		if err := adminManager.Bootstrap(context.Background(), "bootstrap", bootstrapKey); err != nil {
+			logger.Fatal("Cannot bootstrap superuser",
+				zap.Error(err),
+			)
+		}
+	}
+
 	// Initialize servce routers
 	customerRouter, err := customer.NewService(customer.ServiceOptions{
 		Auth:            auth,
 		CustomerManager: customerManager,
+		Limiter:         limiter,
 		Logger:          logger,
 	})
 	if err != nil {
@@ -231,11 +439,29 @@ func main() {
 		Producer: instanceProducer,
 	})
 
+	eventHub, err := instance.NewEventHub(instance.EventHubOptions{
+		URI:    os.Getenv("POSTGRES_URI"),
+		Logger: logger,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize Instance EventHub",
+			zap.Error(err),
+		)
+	}
+	hubCtx, stopHub := context.WithCancel(context.Background())
+	defer stopHub()
+	go eventHub.Run(hubCtx)
+
 	instanceRouter, err := instance.NewService(instance.ServiceOptions{
+		Auth:                auth,
 		SubscriptionManager: subscriptionManager,
 		HostManager:         hostManager,
 		InstanceManager:     instanceManager,
 		LifecycleManager:    instanceLifecycleManager,
+		Policy:              teamManager,
+		GrantManager:        teamManager,
+		EventHub:            eventHub,
+		Limiter:             limiter,
 		Logger:              logger,
 	})
 	if err != nil {
@@ -245,7 +471,9 @@ func main() {
 	}
 
 	subscriptionRouter, err := subscription.NewService(subscription.ServiceOptions{
+		Auth:                auth,
 		SubscriptionManager: subscriptionManager,
+		Policy:              teamManager,
 		Logger:              logger,
 	})
 	if err != nil {
@@ -254,6 +482,57 @@ func main() {
 		)
 	}
 
+	teamRouter, err := team.NewService(team.ServiceOptions{
+		TeamManager: teamManager,
+		Logger:      logger,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize Team Service Router",
+			zap.Error(err),
+		)
+	}
+
+	adminRouter, err := admin.NewService(admin.ServiceOptions{
+		AdminManager: adminManager,
+		Logger:       logger,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize Admin Service Router",
+			zap.Error(err),
+		)
+	}
+
+	auditRouter, err := audit.NewService(audit.ServiceOptions{
+		AuditManager: auditManager,
+		Logger:       logger,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize Audit Service Router",
+			zap.Error(err),
+		)
+	}
+
+	notificationRouter, err := notification.NewService(notification.ServiceOptions{
+		NotificationManager: notificationManager,
+		Logger:              logger,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize Notification Service Router",
+			zap.Error(err),
+		)
+	}
+
+	webhookRouter, err := webhook.NewService(webhook.ServiceOptions{
+		WebhookManager: webhookManager,
+		Limiter:        limiter,
+		Logger:         logger,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize Webhook Service Router",
+			zap.Error(err),
+		)
+	}
+
 	hostRouter, err := host.NewService(host.ServiceOptions{
 		HostManager: hostManager,
 		Logger:      logger,
@@ -266,31 +545,62 @@ func main() {
 
 	// Initialize http/middlewares
 	r := chi.NewRouter()
-
+	r.Use(metrics.Middleware("public"))
+	r.Use(tracing.Middleware("public", true))
+
+	// client IPs (for rate limiting and sessions) are only correct if the proxy in front sets X-Forwarded-For.
+	// TRUST_PROXY is the number of proxies in front of the server, "true" being a single one
+	trustedProxies := 0
+	if trustProxy := os.Getenv("TRUST_PROXY"); trustProxy == "true" {
+		trustedProxies = 1
+	} else if n, err := strconv.Atoi(trustProxy); err == nil {
+		trustedProxies = n
+	}
+	if trustedProxies > 0 {
+		r.Use(util.ForwardedFor(trustedProxies))
+	}
+	r.Use(middleware.RequestID)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{frontendOrigin},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "Last-Event-ID"},
+		ExposedHeaders:   []string{"Retry-After"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
+	// every mutating request is recorded in the audit log
+	r.Use(auditManager.Middleware())
 	r.Use(util.Recovery(logger))
 
 	r.Mount("/auth", customerRouter.AuthRouter())
 
-	authMiddleware := chi.Chain(auth.Middleware(), auth.ClaimCheck())
+	authMiddleware := chi.Chain(auth.Middleware(), auth.ClaimCheck(), audit.Identify)
 	authenticated := r.With(authMiddleware...)
 
 	authenticated.Mount("/customers", customerRouter.Router())
+	authenticated.Mount("/customers/webhooks", webhookRouter.Router())
+	authenticated.Mount("/customers/audit", auditRouter.Router())
 	authenticated.Mount("/instances", instanceRouter.Router())
 	authenticated.Mount("/subscriptions", subscriptionRouter.Router())
+	authenticated.Mount("/billing", subscriptionRouter.BillingRouter())
 	authenticated.Mount("/hosts", hostRouter.Router())
+	authenticated.Mount("/teams", teamRouter.Router())
+	authenticated.Mount("/notifications", notificationRouter.Router())
 
-	// internal router listens to a different port
+	// internal router listens to a different port. Every request must be authenticated as an admin
+	// and is recorded in the audit log, so new mounts only need to specify the roles allowed
 	internal := chi.NewRouter()
-	internal.Mount("/instances", instanceRouter.AdminRouter())
-	internal.Mount("/subscriptions", subscriptionRouter.AdminRouter())
-	internal.Mount("/debug", middleware.Profiler())
+	internal.Use(metrics.Middleware("internal"))
+	internal.Use(tracing.Middleware("internal", false))
+	internal.Use(middleware.RequestID)
+	internal.Use(adminManager.Middleware())
+	internal.Use(util.Recovery(logger))
+	internal.With(admin.RequireRole(admin.RoleSupport)).Mount("/instances", instanceRouter.AdminRouter())
+	internal.With(admin.RequireRole(admin.RoleSupport)).Mount("/hosts", hostRouter.AdminRouter())
+	internal.With(admin.RequireRole(admin.RoleBillingAdmin)).Mount("/subscriptions", subscriptionRouter.AdminRouter())
+	internal.With(admin.RequireRole(admin.RoleSuperuser)).Mount("/admins", adminRouter.AdminRouter())
+	internal.With(admin.RequireRole(admin.RoleSuperuser)).Mount("/audit", auditRouter.AdminRouter())
+	internal.With(admin.RequireRole(admin.RoleSuperuser)).Mount("/debug", middleware.Profiler())
 
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, os.Getenv("SITE_URL"), 302)
@@ -314,6 +624,33 @@ func main() {
 		Addr:    ":8888",
 	}
 
+	checker := health.NewChecker()
+	checker.Add("postgres", health.Postgres(db))
+	checker.Add("redis", health.Redis(rdb))
+	checker.Add("broker", amqpBroker.Ping)
+	checker.AddInformational("heartbeats", hostManager.CheckHeartbeats)
+	metricsSrv := metrics.NewServer(os.Getenv("METRICS_LISTEN"), checker.Handlers())
+
+	// admins can authenticate with client certificates (mTLS) if the internal router is served over TLS
+	internalCert, internalKey := os.Getenv("ADMIN_TLS_CERT"), os.Getenv("ADMIN_TLS_KEY")
+	if clientCA := os.Getenv("ADMIN_TLS_CLIENT_CA"); clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			logger.Fatal("Cannot read admin client CA",
+				zap.Error(err),
+			)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			logger.Fatal("Cannot parse admin client CA")
+		}
+		internalSrv.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
@@ -326,16 +663,33 @@ func main() {
 	}()
 
 	go func() {
-		if err := internalSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if internalCert != "" && internalKey != "" {
+			err = internalSrv.ListenAndServeTLS(internalCert, internalKey)
+		} else {
+			err = internalSrv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatal("Unable to listen for internal routes",
 				zap.Error(err),
 			)
 		}
 	}()
 
+	go func() {
+		if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatal("Unable to listen for metrics",
+				zap.Error(err),
+			)
+		}
+	}()
+
 	logger.Info("API Started")
 
 	<-c
+	// end the event streams, which are otherwise never idle for Shutdown
+	stopHub()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -345,4 +699,10 @@ func main() {
 	if err := internalSrv.Shutdown(ctx); err != nil {
 		logger.Fatal("Internal Router Shutdown Failed", zap.Error(err))
 	}
+	if err := metricsSrv.Shutdown(ctx); err != nil {
+		logger.Fatal("Metrics Server Shutdown Failed", zap.Error(err))
+	}
+	if err := tracing.Shutdown(ctx); err != nil {
+		logger.Error("Unable to export the remaining spans", zap.Error(err))
+	}
 }
@@ -0,0 +1,26 @@
+// mockoidc is a minimal OpenID Connect issuer for testing social login locally. It supports the
+// authorization code flow with PKCE only, and lets you pick any email on the authorize page.
+// Do not use it in production
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/miragespace/rmc/auth/mockoidc"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:9998", "address to listen on")
+	issuerURL := flag.String("issuer", "http://localhost:9998", "issuer URL, must match OIDC_<NAME>_ISSUER")
+	flag.Parse()
+
+	i, err := mockoidc.New(*issuerURL)
+	if err != nil {
+		log.Fatalf("Cannot generate signing key: %v", err)
+	}
+
+	log.Printf("Mock OIDC issuer %s listening on %s", *issuerURL, *addr)
+	log.Fatal(http.ListenAndServe(*addr, i.Handler()))
+}
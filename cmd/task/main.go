@@ -3,18 +3,29 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
+	"net/smtp"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+	_ "time/tzdata" // schedules are in the timezone of the customer
 
+	"github.com/miragespace/rmc/audit"
 	"github.com/miragespace/rmc/auth"
 	"github.com/miragespace/rmc/broker"
+	"github.com/miragespace/rmc/customer"
 	"github.com/miragespace/rmc/db"
 	"github.com/miragespace/rmc/external"
+	"github.com/miragespace/rmc/health"
 	"github.com/miragespace/rmc/host"
 	"github.com/miragespace/rmc/instance"
+	"github.com/miragespace/rmc/metrics"
+	"github.com/miragespace/rmc/notification"
 	"github.com/miragespace/rmc/subscription"
+	"github.com/miragespace/rmc/team"
+	"github.com/miragespace/rmc/tracing"
+	"github.com/miragespace/rmc/webhook"
 
 	"github.com/TheZeroSlave/zapsentry"
 	"github.com/getsentry/sentry-go"
@@ -82,7 +93,29 @@ func main() {
 
 	defer logger.Sync()
 
-	stripeClient := external.NewStripeClient(os.Getenv("STRIPE_KEY"))
+	// Export the spans, if an exporter is configured. Trace IDs are logged regardless
+	exporter, err := tracing.NewExporter(context.Background(), os.Getenv("TRACING_EXPORTER"), os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	if err != nil {
+		logger.Fatal("Cannot initialize tracing exporter",
+			zap.Error(err),
+		)
+	}
+	sampleRatio, err := tracing.ParseSampleRatio(os.Getenv("TRACING_SAMPLE_RATIO"))
+	if err != nil {
+		logger.Fatal("Cannot parse TRACING_SAMPLE_RATIO",
+			zap.Error(err),
+		)
+	}
+	if err := tracing.Init(tracing.Options{
+		ServiceName: "rmc-task",
+		Exporter:    exporter,
+		SampleRatio: sampleRatio,
+		Logger:      logger,
+	}); err != nil {
+		logger.Fatal("Cannot initialize tracing",
+			zap.Error(err),
+		)
+	}
 
 	// Initialize backend connections
 	db, err := db.New(db.Options{
@@ -95,6 +128,90 @@ func main() {
 		)
 	}
 
+	// a BillingProvider allows us to run without a Stripe account (BILLING_PROVIDER=fake)
+	var billingProvider external.BillingProvider
+	if os.Getenv("BILLING_PROVIDER") == "fake" {
+		billingProvider, err = external.NewFakeBillingProvider(db)
+		if err != nil {
+			logger.Fatal("Cannot initialize fake BillingProvider",
+				zap.Error(err),
+			)
+		}
+	} else {
+		billingProvider = external.NewStripeClient(os.Getenv("STRIPE_KEY"))
+	}
+
+	// budget alerts and notifications are only logged in development, similar to login tokens
+	var mailer external.Mailer
+	if authEnvironment == auth.EnvProduction {
+		smtpAuth := smtp.PlainAuth("", os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("SMTP_HOST"))
+		mailer = external.NewSMTPMailer(os.Getenv("SMTP_HOST")+":"+os.Getenv("SMTP_PORT"), os.Getenv("SMTP_FROM"), smtpAuth)
+	} else {
+		mailer = &external.LogMailer{
+			Logger: logger,
+		}
+	}
+
+	customerManager, err := customer.NewManager(logger, db, billingProvider)
+	if err != nil {
+		logger.Fatal("Cannot initialize CustomerManager",
+			zap.Error(err),
+		)
+	}
+
+	// transactional email templates, optionally overridden by the templates in NOTIFICATION_TEMPLATES
+	templates := notification.NewTemplates()
+	if dir := os.Getenv("NOTIFICATION_TEMPLATES"); dir != "" {
+		if err := templates.Load(dir); err != nil {
+			logger.Fatal("Cannot load notification templates",
+				zap.Error(err),
+			)
+		}
+	}
+
+	notificationManager, err := notification.NewManager(notification.ManagerOptions{
+		CustomerManager: customerManager,
+		Mailer:          mailer,
+		Templates:       templates,
+		DB:              db,
+		Logger:          logger,
+		SiteName:        os.Getenv("SITE_NAME"),
+		SiteURL:         os.Getenv("SITE_URL"),
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize NotificationManager",
+			zap.Error(err),
+		)
+	}
+
+	// webhooks cannot reach private networks unless WEBHOOK_ALLOW_PRIVATE=true, e.g. for local development
+	var webhookClient *http.Client
+	if os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true" {
+		webhookClient = &http.Client{
+			Timeout: time.Second * 10,
+		}
+	}
+	webhookManager, err := webhook.NewManager(webhook.ManagerOptions{
+		DB:         db,
+		Logger:     logger,
+		HTTPClient: webhookClient,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize WebhookManager",
+			zap.Error(err),
+		)
+	}
+
+	auditManager, err := audit.NewManager(audit.ManagerOptions{
+		DB:     db,
+		Logger: logger,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize AuditManager",
+			zap.Error(err),
+		)
+	}
+
 	amqpBroker, err := broker.NewAMQPBroker(logger, os.Getenv("AMQP_URI"))
 	if err != nil {
 		log.Fatal("Cannot connect to Broker",
@@ -112,10 +229,13 @@ func main() {
 	defer subscriptionProducer.Close()
 
 	subscriptionManager, err := subscription.NewManager(subscription.ManagerOptions{
-		StripeClient: stripeClient,
-		Producer:     subscriptionProducer,
-		DB:           db,
-		Logger:       logger,
+		BillingProvider:     billingProvider,
+		Producer:            subscriptionProducer,
+		DB:                  db,
+		Logger:              logger,
+		Mailer:              mailer,
+		NotificationManager: notificationManager,
+		WebhookManager:      webhookManager,
 	})
 	if err != nil {
 		logger.Fatal("Cannot initialize SubscriptionManager",
@@ -140,6 +260,23 @@ func main() {
 		)
 	}
 
+	instanceProducer, err := amqpBroker.Producer()
+	if err != nil {
+		logger.Fatal("Cannot setup producer for instance",
+			zap.Error(err),
+		)
+	}
+	defer instanceProducer.Close()
+
+	instanceLifecycleManager, err := instance.NewLifecycleManager(instance.LifecycleManagerOption{
+		Producer: instanceProducer,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize instance LifecycleManager",
+			zap.Error(err),
+		)
+	}
+
 	instanceConsumer, err := amqpBroker.Consumer()
 	if err != nil {
 		logger.Fatal("Cannot setup consumer for instance",
@@ -151,8 +288,12 @@ func main() {
 	instanceTask, err := instance.NewTask(instance.TaskOptions{
 		InstanceManager:     instanceManager,
 		SubscriptionManager: subscriptionManager,
+		LifecycleManager:    instanceLifecycleManager,
 		Consumer:            instanceConsumer,
 		Logger:              logger,
+		NotificationManager: notificationManager,
+		WebhookManager:      webhookManager,
+		AuditManager:        auditManager,
 	})
 	if err != nil {
 		logger.Fatal("Cannot get instance task",
@@ -168,6 +309,31 @@ func main() {
 	}
 	defer hostConsumer.Close()
 
+	teamManager, err := team.NewManager(team.ManagerOptions{
+		CustomerManager: customerManager,
+		DB:              db,
+		Logger:          logger,
+	})
+	if err != nil {
+		logger.Fatal("Cannot initialize TeamManager",
+			zap.Error(err),
+		)
+	}
+
+	instanceScheduler, err := instance.NewScheduler(instance.SchedulerOptions{
+		InstanceManager:     instanceManager,
+		SubscriptionManager: subscriptionManager,
+		LifecycleManager:    instanceLifecycleManager,
+		Policy:              teamManager,
+		AuditManager:        auditManager,
+		Logger:              logger,
+	})
+	if err != nil {
+		logger.Fatal("Cannot get instance scheduler",
+			zap.Error(err),
+		)
+	}
+
 	hostTask, err := host.NewTask(host.TaskOptions{
 		HostManager: hostManager,
 		Consumer:    hostConsumer,
@@ -187,11 +353,39 @@ func main() {
 	}
 	defer subscriptionConsumer.Close()
 
+	// invalid or empty intervals fall back to the defaults
+	reportInterval, _ := time.ParseDuration(os.Getenv("USAGE_REPORT_INTERVAL"))
+	reconcileInterval, _ := time.ParseDuration(os.Getenv("USAGE_RECONCILE_INTERVAL"))
+	paymentInterval, _ := time.ParseDuration(os.Getenv("PAYMENT_CHECK_INTERVAL"))
+	notificationRetryInterval, err := time.ParseDuration(os.Getenv("NOTIFICATION_RETRY_INTERVAL"))
+	if err != nil || notificationRetryInterval <= 0 {
+		notificationRetryInterval = time.Minute
+	}
+	webhookRetryInterval, err := time.ParseDuration(os.Getenv("WEBHOOK_RETRY_INTERVAL"))
+	if err != nil || webhookRetryInterval <= 0 {
+		webhookRetryInterval = time.Second * 30
+	}
+	scheduleInterval, err := time.ParseDuration(os.Getenv("SCHEDULE_INTERVAL"))
+	if err != nil || scheduleInterval <= 0 {
+		scheduleInterval = time.Second * 30
+	}
+	trialInterval, err := time.ParseDuration(os.Getenv("TRIAL_CHECK_INTERVAL"))
+	if err != nil || trialInterval <= 0 {
+		trialInterval = time.Minute
+	}
+	auditRetention, err := time.ParseDuration(os.Getenv("AUDIT_RETENTION"))
+	if err != nil || auditRetention <= 0 {
+		auditRetention = time.Hour * 24 * 365
+	}
+
 	subscriptionTask, err := subscription.NewTask(subscription.TaskOptions{
-		StripeClient:        stripeClient,
+		BillingProvider:     billingProvider,
 		Consumer:            subscriptionConsumer,
 		SubscriptionManager: subscriptionManager,
 		Logger:              logger,
+		ReportInterval:      reportInterval,
+		ReconcileInterval:   reconcileInterval,
+		PaymentInterval:     paymentInterval,
 	})
 	if err != nil {
 		logger.Fatal("Cannot get subscription task",
@@ -222,9 +416,40 @@ func main() {
 		)
 	}
 
+	instanceTask.HandleTrials(ctx, trialInterval)
+	subscriptionTask.HandleSchedule(ctx)
+	notificationManager.HandleRetry(ctx, notificationRetryInterval)
+	webhookManager.HandleRetry(ctx, webhookRetryInterval)
+	auditManager.HandleRetention(ctx, auditRetention)
+	instanceScheduler.HandleSchedule(ctx, scheduleInterval)
+	hostManager.HandleMetricsRetention(ctx)
+
+	hostManager.RegisterMetrics()
+	instanceManager.RegisterMetrics()
+	checker := health.NewChecker()
+	checker.Add("postgres", health.Postgres(db))
+	checker.Add("broker", amqpBroker.Ping)
+	checker.AddInformational("heartbeats", hostManager.CheckHeartbeats)
+	metricsSrv := metrics.NewServer(os.Getenv("METRICS_LISTEN"), checker.Handlers())
+	go func() {
+		if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatal("Unable to listen for metrics",
+				zap.Error(err),
+			)
+		}
+	}()
+
 	logger.Info("API task started")
 
 	<-c
 	cancel()
 
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := metricsSrv.Shutdown(shutdownCtx); err != nil {
+		logger.Fatal("Metrics Server Shutdown Failed", zap.Error(err))
+	}
+	if err := tracing.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Unable to export the remaining spans", zap.Error(err))
+	}
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,9 +12,12 @@ import (
 	"github.com/docker/docker/client"
 	"github.com/miragespace/rmc/auth"
 	"github.com/miragespace/rmc/broker"
+	"github.com/miragespace/rmc/health"
 	"github.com/miragespace/rmc/host"
 	"github.com/miragespace/rmc/host/docker"
 	"github.com/miragespace/rmc/host/worker"
+	"github.com/miragespace/rmc/metrics"
+	"github.com/miragespace/rmc/tracing"
 	"github.com/miragespace/rmc/util"
 
 	"github.com/TheZeroSlave/zapsentry"
@@ -82,6 +86,30 @@ func main() {
 
 	defer logger.Sync()
 
+	// Export the spans, if an exporter is configured. Trace IDs are logged regardless
+	exporter, err := tracing.NewExporter(context.Background(), os.Getenv("TRACING_EXPORTER"), os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	if err != nil {
+		logger.Fatal("Cannot initialize tracing exporter",
+			zap.Error(err),
+		)
+	}
+	sampleRatio, err := tracing.ParseSampleRatio(os.Getenv("TRACING_SAMPLE_RATIO"))
+	if err != nil {
+		logger.Fatal("Cannot parse TRACING_SAMPLE_RATIO",
+			zap.Error(err),
+		)
+	}
+	if err := tracing.Init(tracing.Options{
+		ServiceName: "rmc-worker",
+		Exporter:    exporter,
+		SampleRatio: sampleRatio,
+		Logger:      logger,
+	}); err != nil {
+		logger.Fatal("Cannot initialize tracing",
+			zap.Error(err),
+		)
+	}
+
 	hostName := os.Getenv("HOST_NAME")
 	if len(hostName) == 0 {
 		logger.Fatal("Host Name must be specified")
@@ -165,6 +193,34 @@ func main() {
 
 	controller.Run(ctx)
 
+	checker := health.NewChecker()
+	checker.Add("broker", amqpBroker.Ping)
+	checker.Add("docker", docker.Ping)
+	checker.Add("heartbeat", controller.CheckHeartbeat)
+	handlers := checker.Handlers()
+	handlers["/status"] = controller.StatusHandler()
+	metricsListen := os.Getenv("METRICS_LISTEN")
+	if metricsListen == "" {
+		metricsListen = metrics.LocalListen
+	}
+	metricsSrv := metrics.NewServer(metricsListen, handlers)
+	go func() {
+		if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatal("Unable to listen for metrics",
+				zap.Error(err),
+			)
+		}
+	}()
+
 	<-c
 	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := metricsSrv.Shutdown(shutdownCtx); err != nil {
+		logger.Fatal("Metrics Server Shutdown Failed", zap.Error(err))
+	}
+	if err := tracing.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Unable to export the remaining spans", zap.Error(err))
+	}
 }
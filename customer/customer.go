@@ -8,3 +8,12 @@ type Customer struct {
 	Email     string    `json:"email" gorm:"uniqueIndex;not null"` // User's email address
 	CreatedAt time.Time `json:"createdAt"`
 }
+
+// Identity is an external identity (e.g. a Google account) linked to a Customer
+type Identity struct {
+	Provider   string    `json:"provider" gorm:"primaryKey"`
+	Subject    string    `json:"-" gorm:"primaryKey"` // unique and stable within the provider
+	CustomerID string    `json:"-" gorm:"index;not null"`
+	Email      string    `json:"email"` // email asserted by the provider when linked
+	CreatedAt  time.Time `json:"createdAt"`
+}
@@ -5,65 +5,53 @@ import (
 	"errors"
 	"time"
 
+	"github.com/miragespace/rmc/auth"
+	"github.com/miragespace/rmc/external"
+
 	extErrors "github.com/pkg/errors"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/client"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
 // Manager handles the database operations relating to Customers
 type Manager struct {
-	stripeClient *client.API
-	db           *gorm.DB
-	logger       *zap.Logger
+	billing external.BillingProvider
+	db      *gorm.DB
+	logger  *zap.Logger
 }
 
 // NewManager returns a new Manager for customers
-func NewManager(logger *zap.Logger, db *gorm.DB, s *client.API) (*Manager, error) {
-	if err := db.AutoMigrate(&Customer{}); err != nil {
+func NewManager(logger *zap.Logger, db *gorm.DB, b external.BillingProvider) (*Manager, error) {
+	if err := db.AutoMigrate(&Customer{}, &Identity{}); err != nil {
 		return nil, extErrors.Wrap(err, "Cannot initilize customer.Manager")
 	}
 	return &Manager{
-		stripeClient: s,
-		db:           db,
-		logger:       logger,
+		billing: b,
+		db:      db,
+		logger:  logger,
 	}, nil
 }
 
 // New will create a new customer profile in Stripe and in the database
 func (m *Manager) New(ctx context.Context, email string) (*Customer, error) {
-	listParams := &stripe.CustomerListParams{
-		ListParams: stripe.ListParams{
-			Context: ctx,
-		},
-		Email: stripe.String(email),
-	}
-	listParams.Filters.AddFilter("limit", "", "1")
-	l := m.stripeClient.Customers.List(listParams)
-
-	if l.Err() != nil {
+	c, err := m.billing.FindCustomerByEmail(ctx, email)
+	if err != nil {
 		m.logger.Error("Stripe returned error",
-			zap.Error(l.Err()),
+			zap.Error(err),
 		)
-		return nil, extErrors.Wrap(l.Err(), "Cannot query customer by email to Stripe")
-	}
-
-	var c *stripe.Customer
-	for l.Next() {
-		c = l.Customer()
+		return nil, extErrors.Wrap(err, "Cannot query customer by email to Stripe")
 	}
 
 	if c == nil {
 		// actually a new customer
-		var err error
 		params := &stripe.CustomerParams{
 			Params: stripe.Params{
 				Context: ctx,
 			},
 			Email: stripe.String(email),
 		}
-		c, err = m.stripeClient.Customers.New(params)
+		c, err = m.billing.NewCustomer(params)
 		if err != nil {
 			m.logger.Error("Stripe returned error",
 				zap.Error(err),
@@ -130,5 +118,89 @@ func (m *Manager) GetByEmail(ctx context.Context, email string) (*Customer, erro
 }
 
 func (m *Manager) GetStripe(ctx context.Context, id string) (*stripe.Customer, error) {
-	return m.stripeClient.Customers.Get(id, nil)
+	return m.billing.GetCustomer(id, nil)
+}
+
+// GetByIdentity will return the customer linked to the external identity. If the identity is not linked yet,
+// it is linked to the customer with the same (verified) email address, or to a new customer
+func (m *Manager) GetByIdentity(ctx context.Context, identity *auth.Identity) (*Customer, error) {
+	var linked Identity
+	result := m.db.WithContext(ctx).First(&linked, "provider = ? AND subject = ?", identity.Provider, identity.Subject)
+	if result.Error == nil {
+		cust, err := m.GetByID(ctx, linked.CustomerID)
+		if err != nil {
+			return nil, err
+		}
+		if cust != nil {
+			return cust, nil
+		}
+	} else if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		m.logger.Error("Database returned error",
+			zap.Error(result.Error),
+		)
+		return nil, extErrors.Wrap(result.Error, "Cannot get identity")
+	}
+
+	if !identity.EmailVerified {
+		// linking by an unverified email would allow taking over the customer with that email
+		return nil, auth.ErrUnverifiedEmail
+	}
+
+	cust, err := m.GetByEmail(ctx, identity.Email)
+	if err != nil {
+		return nil, err
+	}
+	if cust == nil {
+		cust, err = m.New(ctx, identity.Email)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result = m.db.WithContext(ctx).Save(&Identity{
+		Provider:   identity.Provider,
+		Subject:    identity.Subject,
+		CustomerID: cust.ID,
+		Email:      identity.Email,
+		CreatedAt:  time.Now(),
+	})
+	if result.Error != nil {
+		m.logger.Error("Database returned error",
+			zap.Error(result.Error),
+		)
+		return nil, extErrors.Wrap(result.Error, "Cannot link identity")
+	}
+
+	return cust, nil
+}
+
+// ListIdentities returns the external identities linked to the customer
+func (m *Manager) ListIdentities(ctx context.Context, customerID string) ([]Identity, error) {
+	identities := make([]Identity, 0, 1)
+	result := m.db.WithContext(ctx).
+		Where("customer_id = ?", customerID).
+		Order("created_at asc").
+		Find(&identities)
+	if result.Error != nil {
+		m.logger.Error("Database returned error",
+			zap.Error(result.Error),
+		)
+		return nil, extErrors.Wrap(result.Error, "Cannot list identities")
+	}
+	return identities, nil
+}
+
+// UnlinkIdentity will remove the link between the customer and the provider. The customer can
+// still login with email
+func (m *Manager) UnlinkIdentity(ctx context.Context, customerID, provider string) (bool, error) {
+	result := m.db.WithContext(ctx).
+		Where("customer_id = ? AND provider = ?", customerID, provider).
+		Delete(&Identity{})
+	if result.Error != nil {
+		m.logger.Error("Database returned error",
+			zap.Error(result.Error),
+		)
+		return false, extErrors.Wrap(result.Error, "Cannot unlink identity")
+	}
+	return result.RowsAffected > 0, nil
 }
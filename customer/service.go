@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/miragespace/rmc/audit"
 	"github.com/miragespace/rmc/auth"
+	"github.com/miragespace/rmc/ratelimit"
 	resp "github.com/miragespace/rmc/response"
 
 	"github.com/go-chi/chi"
@@ -20,6 +24,7 @@ var validate *validator.Validate = validator.New()
 type ServiceOptions struct {
 	Auth            *auth.Auth
 	CustomerManager *Manager
+	Limiter         *ratelimit.Limiter
 	Logger          *zap.Logger
 }
 
@@ -41,6 +46,9 @@ func NewService(option ServiceOptions) (*Service, error) {
 	if option.CustomerManager == nil {
 		return nil, fmt.Errorf("nil CustomerManager is invalid")
 	}
+	if option.Limiter == nil {
+		return nil, fmt.Errorf("nil Limiter is invalid")
+	}
 	if option.Logger == nil {
 		return nil, fmt.Errorf("nil Logger is invalid")
 	}
@@ -87,18 +95,26 @@ func (s *Service) refreshSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	refresh, err := s.Auth.VerifyRefreshToken(req.RefreshToken)
-	if err != nil {
-		s.Logger.Error("Unable to verify refresh token",
+	refresh, refreshToken, err := s.Auth.RefreshSession(ctx, req.RefreshToken, auth.SessionInfoFromRequest(r))
+	switch err {
+	case nil:
+	case auth.ErrInvalidRefreshToken:
+		resp.WriteError(w, r, resp.ErrUnauthorized().AddMessages("Invalid refresh token"))
+		return
+	case auth.ErrRefreshTokenReused:
+		s.Logger.Warn("Refresh token reuse detected, session ended")
+		resp.WriteError(w, r, resp.ErrUnauthorized().AddMessages("Invalid refresh token"))
+		return
+	default:
+		s.Logger.Error("Unable to rotate refresh token",
 			zap.Error(err),
 		)
 		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to refresh access token"))
 		return
 	}
-	if refresh == nil {
-		resp.WriteError(w, r, resp.ErrUnauthorized().AddMessages("Invalid refresh token"))
-		return
-	}
+
+	audit.SetActor(ctx, audit.ActorCustomer, refresh.ID)
+	audit.SetTarget(ctx, refresh.ID, "")
 
 	logger := s.Logger.With(
 		zap.String("CustomerID", refresh.ID),
@@ -113,12 +129,11 @@ func (s *Service) refreshSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: add blacklist
-	// TODO: allow clear on logout
-
 	claims := auth.Claims{
-		ID:    cust.ID,
-		Email: cust.Email,
+		ID:          cust.ID,
+		Email:       cust.Email,
+		Session:     refresh.Session,
+		StepUpUntil: refresh.StepUpUntil,
 	}
 
 	accessToken, err := s.Auth.CreateTokenFromClaims(claims)
@@ -131,12 +146,49 @@ func (s *Service) refreshSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp.WriteResponse(w, r, struct {
-		AccessToken string `json:"accessToken"`
+		AccessToken  string `json:"accessToken"`
+		RefreshToken string `json:"refreshToken"`
 	}{
-		AccessToken: accessToken,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
 	})
 }
 
+func (s *Service) logout(w http.ResponseWriter, r *http.Request) {
+	s.endSessions(w, r, false)
+}
+
+func (s *Service) logoutAll(w http.ResponseWriter, r *http.Request) {
+	s.endSessions(w, r, true)
+}
+
+func (s *Service) endSessions(w http.ResponseWriter, r *http.Request, all bool) {
+	ctx := r.Context()
+
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+
+	err := s.Auth.Logout(ctx, req.RefreshToken, all)
+	switch err {
+	case nil, auth.ErrSessionNotFound:
+		// logging out of an ended session is not an error
+	case auth.ErrInvalidRefreshToken, auth.ErrRefreshTokenReused:
+		resp.WriteError(w, r, resp.ErrUnauthorized().AddMessages("Invalid refresh token"))
+		return
+	default:
+		s.Logger.Error("Unable to end session",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to logout"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type TokensRequest struct {
 	UID   string `json:"uid"`
 	Token string `json:"token"`
@@ -197,30 +249,38 @@ func (s *Service) handleLogin(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	s.issueTokens(w, r, logger, cust)
+}
+
+// issueTokens starts a new session for the customer and responds with the access and refresh token
+func (s *Service) issueTokens(w http.ResponseWriter, r *http.Request, logger *zap.Logger, cust *Customer) {
+	// the login is recorded as the customer once identified
+	audit.SetActor(r.Context(), audit.ActorCustomer, cust.ID)
+	audit.SetTarget(r.Context(), cust.ID, "")
+
 	claims := auth.Claims{
 		ID:    cust.ID,
 		Email: cust.Email,
 	}
 
-	accessToken, err := s.Auth.CreateTokenFromClaims(claims)
+	refreshToken, err := s.Auth.NewSession(r.Context(), &claims, auth.SessionInfoFromRequest(r))
 	if err != nil {
-		logger.Error("Unable to generate access token",
+		logger.Error("Unable to start session",
 			zap.Error(err),
 		)
 		resp.WriteError(w, r, resp.ErrVerifyToken())
 		return
 	}
-	refreshToken, err := s.Auth.CreateRefreshTokenFromClaims(claims)
+
+	accessToken, err := s.Auth.CreateTokenFromClaims(claims)
 	if err != nil {
-		logger.Error("Unable to generate refresh token",
+		logger.Error("Unable to generate access token",
 			zap.Error(err),
 		)
 		resp.WriteError(w, r, resp.ErrVerifyToken())
 		return
 	}
 
-	// TODO: save refreshToken (hashed) to database (in auth package)
-
 	resp.WriteResponse(w, r, struct {
 		AccessToken  string `json:"accessToken"`
 		RefreshToken string `json:"refreshToken"`
@@ -230,6 +290,99 @@ func (s *Service) handleLogin(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *Service) listProviders(w http.ResponseWriter, r *http.Request) {
+	resp.WriteResponse(w, r, s.Auth.Providers())
+}
+
+func (s *Service) beginOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider := chi.URLParam(r, "provider")
+
+	authorizationURL, state, err := s.Auth.BeginLogin(r.Context(), provider)
+	switch err {
+	case nil:
+	case auth.ErrUnknownProvider:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Identity provider is not configured"))
+		return
+	default:
+		s.Logger.Error("Unable to start login with identity provider",
+			zap.Error(err),
+			zap.String("Provider", provider),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to login with identity provider"))
+		return
+	}
+
+	s.Auth.SetLoginCookie(w, state)
+	resp.WriteResponse(w, r, struct {
+		AuthorizationURL string `json:"authorizationUrl"`
+	}{
+		AuthorizationURL: authorizationURL,
+	})
+}
+
+// OIDCTokensRequest is the model of the authorization response from the identity provider, as passed on by the frontend
+type OIDCTokensRequest struct {
+	Code  string `json:"code" validate:"required"`
+	State string `json:"state" validate:"required"`
+}
+
+func (s *Service) completeOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	provider := chi.URLParam(r, "provider")
+
+	var req OIDCTokensRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	if err := validate.Struct(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Code and state are required"))
+		return
+	}
+
+	logger := s.Logger.With(zap.String("Provider", provider))
+
+	// the login can only be completed by the browser which started it
+	var cookieState string
+	if cookie, err := r.Cookie(auth.LoginCookie); err == nil {
+		cookieState = cookie.Value
+	}
+	s.Auth.ClearLoginCookie(w)
+
+	identity, err := s.Auth.CompleteLogin(ctx, provider, req.Code, req.State, cookieState)
+	switch err {
+	case nil:
+	case auth.ErrUnknownProvider:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Identity provider is not configured"))
+		return
+	case auth.ErrInvalidState:
+		resp.WriteError(w, r, resp.ErrUnauthorized().AddMessages("Login has expired or is invalid, please try again"))
+		return
+	case auth.ErrUnverifiedEmail:
+		resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Email address is not verified by the identity provider"))
+		return
+	default:
+		logger.Error("Unable to verify identity with identity provider",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrVerifyToken())
+		return
+	}
+
+	logger = logger.With(zap.String("email", identity.Email))
+
+	cust, err := s.CustomerManager.GetByIdentity(ctx, identity)
+	if err != nil {
+		logger.Error("Unable to link identity to Customer",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrVerifyToken())
+		return
+	}
+
+	s.issueTokens(w, r, logger, cust)
+}
+
 func (s *Service) getStripeCustomer(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	claims := ctx.Value(auth.Context).(*auth.Claims)
@@ -253,18 +406,484 @@ func (s *Service) getStripeCustomer(w http.ResponseWriter, r *http.Request) {
 func (s *Service) AuthRouter() http.Handler {
 	r := chi.NewRouter()
 
-	r.Post("/requestLogin", s.requestLogin)
-	r.Post("/requestTokens", s.handleLogin)
+	r.Use(s.Limiter.Middleware(ratelimit.AuthIP, ratelimit.ByIP))
+
+	// each login request sends an email, so limit by recipient as well
+	r.With(
+		s.Limiter.Middleware(ratelimit.LoginIP, ratelimit.ByIP),
+		s.Limiter.Middleware(ratelimit.LoginEmail, ratelimit.ByJSONField("email")),
+	).Post("/requestLogin", s.requestLogin)
+	r.With(s.Limiter.Middleware(ratelimit.TokensIP, ratelimit.ByIP)).Post("/requestTokens", s.handleLogin)
 	r.Post("/refresh", s.refreshSession)
+	r.Post("/logout", s.logout)
+	r.Post("/logoutAll", s.logoutAll)
+	r.Get("/providers", s.listProviders)
+	r.Post("/oidc/{provider}", s.beginOIDCLogin)
+	r.Post("/oidc/{provider}/tokens", s.completeOIDCLogin)
 
 	return r
 }
 
+// TokenRequest is the model of user request for a new API key
+type TokenRequest struct {
+	Name      string       `json:"name" validate:"required,max=64"`
+	Scopes    []auth.Scope `json:"scopes" validate:"required,min=1"`
+	ExpiresAt *time.Time   `json:"expiresAt"`
+}
+
+func (s *Service) createToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	var req TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	if err := validate.Struct(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Name and at least one scope are required"))
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Expiration must be in the future"))
+		return
+	}
+
+	key, raw, err := s.Auth.CreateAPIKey(ctx, auth.APIKeyOption{
+		CustomerID: claims.ID,
+		Name:       req.Name,
+		Scopes:     req.Scopes,
+		ExpiresAt:  req.ExpiresAt,
+	})
+	switch err {
+	case nil:
+	case auth.ErrInvalidScope:
+		scopes := make([]string, len(auth.Scopes))
+		for i, scope := range auth.Scopes {
+			scopes[i] = string(scope)
+		}
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Valid scopes are: "+strings.Join(scopes, ", ")))
+		return
+	case auth.ErrTooManyAPIKeys:
+		resp.WriteError(w, r, resp.ErrConflict().AddMessages("Too many active API keys. Please revoke unused keys"))
+		return
+	default:
+		logger.Error("Unable to create API key",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to create API key"))
+		return
+	}
+
+	// the raw key is only ever returned here
+	resp.WriteResponse(w, r, struct {
+		*auth.APIKey
+		Scopes []auth.Scope `json:"scopes"`
+		Token  string       `json:"token"`
+	}{
+		APIKey: key,
+		Scopes: key.GetScopes(),
+		Token:  raw,
+	})
+}
+
+type publicAPIKey struct {
+	auth.APIKey
+	Scopes []auth.Scope `json:"scopes"`
+	Active bool         `json:"active"`
+}
+
+func (s *Service) listTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	keys, err := s.Auth.ListAPIKeys(ctx, claims.ID)
+	if err != nil {
+		logger.Error("Unable to list API keys",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list API keys"))
+		return
+	}
+
+	now := time.Now()
+	results := make([]publicAPIKey, len(keys))
+	for i := range keys {
+		results[i] = publicAPIKey{
+			APIKey: keys[i],
+			Scopes: keys[i].GetScopes(),
+			Active: keys[i].Active(now),
+		}
+	}
+
+	resp.WriteResponse(w, r, results)
+}
+
+func (s *Service) revokeToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	keyID := chi.URLParam(r, "id")
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+		zap.String("APIKeyID", keyID),
+	)
+
+	err := s.Auth.RevokeAPIKey(ctx, claims.ID, keyID)
+	switch err {
+	case nil:
+	case auth.ErrAPIKeyNotFound:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("API key does not exist or is already revoked"))
+		return
+	default:
+		logger.Error("Unable to revoke API key",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to revoke API key"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type publicSession struct {
+	auth.Session
+	Current bool `json:"current"`
+}
+
+func (s *Service) listSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	sessions, err := s.Auth.ListSessions(ctx, claims.ID)
+	if err != nil {
+		logger.Error("Unable to list sessions",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list sessions"))
+		return
+	}
+
+	results := make([]publicSession, len(sessions))
+	for i := range sessions {
+		results[i] = publicSession{
+			Session: sessions[i],
+			Current: sessions[i].ID == claims.Session,
+		}
+	}
+
+	resp.WriteResponse(w, r, results)
+}
+
+func (s *Service) endSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	sessionID := chi.URLParam(r, "id")
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+		zap.String("SessionID", sessionID),
+	)
+
+	err := s.Auth.EndSession(ctx, claims.ID, sessionID)
+	switch err {
+	case nil:
+	case auth.ErrSessionNotFound:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Session does not exist or has already ended"))
+		return
+	default:
+		logger.Error("Unable to end session",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to end session"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) endAllSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	if err := s.Auth.EndAllSessions(ctx, claims.ID); err != nil {
+		logger.Error("Unable to end all sessions",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to end sessions"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) listIdentities(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	identities, err := s.CustomerManager.ListIdentities(ctx, claims.ID)
+	if err != nil {
+		logger.Error("Unable to list linked identities",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list linked identities"))
+		return
+	}
+
+	resp.WriteResponse(w, r, identities)
+}
+
+func (s *Service) unlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	provider := chi.URLParam(r, "provider")
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+		zap.String("Provider", provider),
+	)
+
+	unlinked, err := s.CustomerManager.UnlinkIdentity(ctx, claims.ID, provider)
+	if err != nil {
+		logger.Error("Unable to unlink identity",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to unlink identity"))
+		return
+	}
+	if !unlinked {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("No identity is linked with the provider"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CodeRequest is the model of user request with a TOTP or recovery code
+type CodeRequest struct {
+	Code string `json:"code" validate:"required,max=32"`
+}
+
+func (s *Service) writeCodeError(w http.ResponseWriter, r *http.Request, logger *zap.Logger, err error, action string) {
+	switch err {
+	case auth.ErrInvalidCode:
+		resp.WriteError(w, r, resp.ErrUnauthorized().AddMessages("Invalid verification code"))
+	case auth.ErrTooManyAttempts:
+		resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Too many incorrect codes, please try again later"))
+	case auth.ErrTOTPNotEnrolled:
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Two-factor authentication is not enabled"))
+	case auth.ErrTOTPEnabled:
+		resp.WriteError(w, r, resp.ErrConflict().AddMessages("Two-factor authentication is already enabled"))
+	default:
+		logger.Error("Unable to "+action,
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to "+action))
+	}
+}
+
+func decodeCode(w http.ResponseWriter, r *http.Request) (*CodeRequest, bool) {
+	var req CodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return nil, false
+	}
+	if err := validate.Struct(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Code is required"))
+		return nil, false
+	}
+	return &req, true
+}
+
+func (s *Service) getTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	status, err := s.Auth.GetTOTPStatus(ctx, claims.ID)
+	if err != nil {
+		logger.Error("Unable to get two-factor authentication status",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to get two-factor authentication status"))
+		return
+	}
+
+	resp.WriteResponse(w, r, status)
+}
+
+func (s *Service) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	enrollment, err := s.Auth.EnrollTOTP(ctx, claims.ID, claims.Email)
+	if err != nil {
+		s.writeCodeError(w, r, logger, err, "enroll two-factor authentication")
+		return
+	}
+
+	resp.WriteResponse(w, r, enrollment)
+}
+
+func (s *Service) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	req, ok := decodeCode(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := s.Auth.ConfirmTOTP(ctx, claims.ID, req.Code)
+	if err != nil {
+		s.writeCodeError(w, r, logger, err, "confirm two-factor authentication")
+		return
+	}
+
+	// the recovery codes are only ever returned here, or when regenerated
+	resp.WriteResponse(w, r, struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{
+		RecoveryCodes: codes,
+	})
+}
+
+func (s *Service) stepUp(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	req, ok := decodeCode(w, r)
+	if !ok {
+		return
+	}
+
+	stepped := *claims
+	err := s.Auth.StepUp(ctx, &stepped, req.Code)
+	switch err {
+	case nil:
+	case auth.ErrSessionNotFound:
+		resp.WriteError(w, r, resp.ErrNoBearer())
+		return
+	default:
+		s.writeCodeError(w, r, logger, err, "verify code")
+		return
+	}
+
+	accessToken, err := s.Auth.CreateTokenFromClaims(stepped)
+	if err != nil {
+		logger.Error("Unable to generate access token",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to verify code"))
+		return
+	}
+
+	resp.WriteResponse(w, r, struct {
+		AccessToken string    `json:"accessToken"`
+		StepUpUntil time.Time `json:"stepUpUntil"`
+	}{
+		AccessToken: accessToken,
+		StepUpUntil: time.Unix(stepped.StepUpUntil, 0),
+	})
+}
+
+func (s *Service) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	codes, err := s.Auth.RegenerateRecoveryCodes(ctx, claims.ID)
+	if err != nil {
+		s.writeCodeError(w, r, logger, err, "regenerate recovery codes")
+		return
+	}
+
+	resp.WriteResponse(w, r, struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{
+		RecoveryCodes: codes,
+	})
+}
+
+func (s *Service) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	if err := s.Auth.DisableTOTP(ctx, claims.ID); err != nil {
+		logger.Error("Unable to disable two-factor authentication",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to disable two-factor authentication"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // Router will return the routes under customer API
 func (s *Service) Router() http.Handler {
 	r := chi.NewRouter()
 
+	// API keys cannot manage the account or mint other API keys
+	r.Use(auth.RequireSession)
+
 	r.Get("/stripe", s.getStripeCustomer)
+	r.Get("/tokens", s.listTokens)
+	r.Post("/tokens", s.createToken)
+	r.Delete("/tokens/{id}", s.revokeToken)
+	r.Get("/sessions", s.listSessions)
+	r.Delete("/sessions", s.endAllSessions)
+	r.Delete("/sessions/{id}", s.endSession)
+	r.Get("/identities", s.listIdentities)
+	r.Delete("/identities/{provider}", s.unlinkIdentity)
+	r.Get("/2fa", s.getTwoFactor)
+	r.Post("/2fa", s.enrollTwoFactor)
+	r.Post("/2fa/confirm", s.confirmTwoFactor)
+	r.Post("/2fa/verify", s.stepUp)
+	r.With(s.Auth.RequireStepUp).Post("/2fa/recoveryCodes", s.regenerateRecoveryCodes)
+	r.With(s.Auth.RequireStepUp).Delete("/2fa", s.disableTwoFactor)
 
 	return r
 }
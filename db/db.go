@@ -6,7 +6,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/miragespace/rmc/tracing"
+
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -23,7 +27,84 @@ func (l *patchedLogger) Trace(ctx context.Context, begin time.Time, fc func() (s
 	if err == gorm.ErrRecordNotFound {
 		return
 	}
-	l.Logger.Trace(ctx, begin, fc, err)
+	logger := l.Logger
+	logger.ZapLogger = tracing.Logger(ctx, logger.ZapLogger)
+	logger.Trace(ctx, begin, fc, err)
+}
+
+const spanKey = "rmc:span"
+
+func startSpan(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx, span := tracing.StartChild(db.Statement.Context, "gorm "+operation, trace.SpanKindClient,
+			attribute.String("db.system", "postgresql"),
+		)
+		if !span.IsRecording() {
+			// not part of a trace, or not sampled
+			return
+		}
+		// queries issued by the callbacks, e.g. preloads, are children of the span
+		db.Statement.Context = ctx
+		db.InstanceSet(spanKey, span)
+	}
+}
+
+func endSpan(db *gorm.DB) {
+	value, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	span.SetAttributes(
+		attribute.String("db.statement", db.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+	if db.Statement.Table != "" {
+		span.SetAttributes(attribute.String("db.sql.table", db.Statement.Table))
+	}
+	if db.Error != gorm.ErrRecordNotFound {
+		tracing.SetError(span, db.Error)
+	}
+	span.End()
+}
+
+// registerTracing wraps each query in a span, if the context of the query is part of a trace
+func registerTracing(db *gorm.DB) error {
+	callback := db.Callback()
+	if err := callback.Create().Before("gorm:create").Register("rmc:start_span", startSpan("create")); err != nil {
+		return err
+	}
+	if err := callback.Create().After("gorm:create").Register("rmc:end_span", endSpan); err != nil {
+		return err
+	}
+	if err := callback.Query().Before("gorm:query").Register("rmc:start_span", startSpan("query")); err != nil {
+		return err
+	}
+	if err := callback.Query().After("gorm:query").Register("rmc:end_span", endSpan); err != nil {
+		return err
+	}
+	if err := callback.Update().Before("gorm:update").Register("rmc:start_span", startSpan("update")); err != nil {
+		return err
+	}
+	if err := callback.Update().After("gorm:update").Register("rmc:end_span", endSpan); err != nil {
+		return err
+	}
+	if err := callback.Delete().Before("gorm:delete").Register("rmc:start_span", startSpan("delete")); err != nil {
+		return err
+	}
+	if err := callback.Delete().After("gorm:delete").Register("rmc:end_span", endSpan); err != nil {
+		return err
+	}
+	if err := callback.Row().Before("gorm:row").Register("rmc:start_span", startSpan("row")); err != nil {
+		return err
+	}
+	if err := callback.Row().After("gorm:row").Register("rmc:end_span", endSpan); err != nil {
+		return err
+	}
+	if err := callback.Raw().Before("gorm:raw").Register("rmc:start_span", startSpan("raw")); err != nil {
+		return err
+	}
+	return callback.Raw().After("gorm:raw").Register("rmc:end_span", endSpan)
 }
 
 // Options defines the configuration for DB handler
@@ -54,6 +135,9 @@ func New(option Options) (*gorm.DB, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "Cannot connect to database")
 	}
+	if err := registerTracing(db); err != nil {
+		return nil, errors.Wrap(err, "Cannot register tracing callbacks")
+	}
 	pool, err := db.DB()
 	if err != nil {
 		return nil, errors.Wrap(err, "Cannot get the connection pool")
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Migration records a one-off data migration that was applied to the database
+type Migration struct {
+	Name      string    `gorm:"primaryKey"`
+	AppliedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// RunMigration applies the one-off data migration in a transaction, unless a migration with the same name was
+// applied before. Schema changes are left to AutoMigrate, this is for backfilling existing rows
+func RunMigration(db *gorm.DB, name string, migrate func(tx *gorm.DB) error) error {
+	if err := db.AutoMigrate(&Migration{}); err != nil {
+		return errors.Wrap(err, "Cannot create migrations table")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		// the row is claimed first, so concurrent instances starting up don't apply the migration twice
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&Migration{Name: name})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		if err := migrate(tx); err != nil {
+			return errors.Wrapf(err, "Cannot apply migration %s", name)
+		}
+		return nil
+	})
+}
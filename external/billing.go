@@ -0,0 +1,57 @@
+package external
+
+import (
+	"context"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// BillingProvider abstracts the payment gateway used for customers, payment methods, plans and usage based billing.
+// Stripe's data types are used as the common currency so existing API responses keep their shape regardless of the provider
+type BillingProvider interface {
+	// FindCustomerByEmail returns the customer with the given email, or nil if none was found
+	FindCustomerByEmail(ctx context.Context, email string) (*stripe.Customer, error)
+	NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error)
+	GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+
+	AttachPaymentMethod(id string, params *stripe.PaymentMethodAttachParams) (*stripe.PaymentMethod, error)
+
+	NewProduct(params *stripe.ProductParams) (*stripe.Product, error)
+	// FindProductByMetadata returns the active product with the given metadata value, or nil if none was found
+	FindProductByMetadata(ctx context.Context, key, value string) (*stripe.Product, error)
+	// UpdateProduct changes the product's details, or archives it with Active set to false
+	UpdateProduct(id string, params *stripe.ProductParams) (*stripe.Product, error)
+	NewPrice(params *stripe.PriceParams) (*stripe.Price, error)
+	// FindPriceByLookupKey returns the active price with the given lookup key, or nil if none was found
+	FindPriceByLookupKey(ctx context.Context, lookupKey string) (*stripe.Price, error)
+	// UpdatePrice changes the price's nickname, or archives it with Active set to false. The amount of a price cannot be changed
+	UpdatePrice(id string, params *stripe.PriceParams) (*stripe.Price, error)
+
+	NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+
+	NewUsageRecord(params *stripe.UsageRecordParams) (*stripe.UsageRecord, error)
+	// ListUsageRecordSummaries returns the usage summaries of a subscription item, one per invoice period. The current period has an empty Invoice
+	ListUsageRecordSummaries(params *stripe.UsageRecordSummaryListParams) ([]*stripe.UsageRecordSummary, error)
+
+	NewCoupon(params *stripe.CouponParams) (*stripe.Coupon, error)
+	NewPromotionCode(params *stripe.PromotionCodeParams) (*stripe.PromotionCode, error)
+	// FindPromotionCode returns the active promotion code with the given customer facing code, or nil if none was found
+	FindPromotionCode(ctx context.Context, code string) (*stripe.PromotionCode, error)
+
+	// NewTaxRate creates an (exclusive) tax rate, e.g. VAT of an EU country, to be set as the default tax rates of subscriptions
+	NewTaxRate(params *stripe.TaxRateParams) (*stripe.TaxRate, error)
+	// NewTaxID adds a tax ID (e.g. a VAT number) to the customer, which is shown on their invoices
+	NewTaxID(params *stripe.TaxIDParams) (*stripe.TaxID, error)
+	// DeleteTaxID removes the tax ID of the customer set in params
+	DeleteTaxID(id string, params *stripe.TaxIDParams) (*stripe.TaxID, error)
+
+	// NewCustomerBalanceTransaction adjusts the customer's balance. A negative Amount is a credit, which is drawn down by the next invoices
+	NewCustomerBalanceTransaction(params *stripe.CustomerBalanceTransactionParams) (*stripe.CustomerBalanceTransaction, error)
+
+	// ListInvoices returns a single page of invoices, newest first
+	ListInvoices(params *stripe.InvoiceListParams) ([]*stripe.Invoice, error)
+	GetInvoice(id string, params *stripe.InvoiceParams) (*stripe.Invoice, error)
+}
@@ -0,0 +1,1311 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	extErrors "github.com/pkg/errors"
+	"github.com/stripe/stripe-go/v72"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Defining the kinds of objects kept by FakeBillingProvider
+const (
+	fakeKindCustomer     = "customer"
+	fakeKindProduct      = "product"
+	fakeKindPrice        = "price"
+	fakeKindSubscription = "subscription"
+	fakeKindUsageRecord  = "usage_record"
+	fakeKindInvoice      = "invoice"
+	fakeKindCoupon       = "coupon"
+	fakeKindPromotion    = "promotion_code"
+	fakeKindBalance      = "balance_transaction"
+	fakeKindTaxRate      = "tax_rate"
+)
+
+// fakeObject is a Stripe object serialized as JSON. When FakeBillingProvider is backed by Postgres,
+// this is the row stored in the fake_billing_objects table
+type fakeObject struct {
+	ID        string    `gorm:"primaryKey"`
+	Kind      string    `gorm:"index;not null"`
+	Data      []byte    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// TableName overrides the table name used by gorm
+func (fakeObject) TableName() string {
+	return "fake_billing_objects"
+}
+
+// FakeBillingProvider is a BillingProvider that never leaves the process (or the database).
+// It is used to exercise the full subscribe -> provision -> usage -> cancel flow without a Stripe account.
+// Subscriptions are always active once the customer has a default payment method (or trialing without one),
+// and renew when they are fetched after their current period has ended
+type FakeBillingProvider struct {
+	db *gorm.DB
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+}
+
+var _ BillingProvider = &FakeBillingProvider{}
+
+// NewFakeBillingProvider returns a FakeBillingProvider. If db is nil, objects will only be kept in memory,
+// otherwise they are persisted so that multiple processes (e.g. api and task) can share the same state
+func NewFakeBillingProvider(db *gorm.DB) (*FakeBillingProvider, error) {
+	if db != nil {
+		if err := db.AutoMigrate(&fakeObject{}); err != nil {
+			return nil, extErrors.Wrap(err, "Cannot initilize external.FakeBillingProvider")
+		}
+	}
+	return &FakeBillingProvider{
+		db:      db,
+		objects: make(map[string]fakeObject),
+	}, nil
+}
+
+func fakeID(prefix string) string {
+	return prefix + "_fake_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+func contextOf(params *stripe.Params) context.Context {
+	if params == nil || params.Context == nil {
+		return context.Background()
+	}
+	return params.Context
+}
+
+func errResourceMissing(msg string) *stripe.Error {
+	return &stripe.Error{
+		Code:           stripe.ErrorCodeResourceMissing,
+		HTTPStatusCode: http.StatusNotFound,
+		Msg:            msg,
+		Type:           stripe.ErrorTypeInvalidRequest,
+	}
+}
+
+func (f *FakeBillingProvider) put(ctx context.Context, kind, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot encode fake billing object")
+	}
+	obj := fakeObject{
+		ID:        id,
+		Kind:      kind,
+		Data:      data,
+		CreatedAt: time.Now(),
+	}
+	if f.db != nil {
+		return f.db.WithContext(ctx).
+			Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"data"}),
+			}).
+			Create(&obj).Error
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// like the upsert above, updates keep the creation time, which orders list
+	if existing, ok := f.objects[id]; ok {
+		obj.CreatedAt = existing.CreatedAt
+	}
+	f.objects[id] = obj
+	return nil
+}
+
+// get decodes the object with the given id into v. found will be false if no such object exists
+func (f *FakeBillingProvider) get(ctx context.Context, kind, id string, v interface{}) (found bool, err error) {
+	var obj fakeObject
+	if f.db != nil {
+		result := f.db.WithContext(ctx).First(&obj, "id = ? AND kind = ?", id, kind)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		if result.Error != nil {
+			return false, result.Error
+		}
+	} else {
+		f.mu.Lock()
+		var ok bool
+		obj, ok = f.objects[id]
+		f.mu.Unlock()
+		if !ok || obj.Kind != kind {
+			return false, nil
+		}
+	}
+	if err := json.Unmarshal(obj.Data, v); err != nil {
+		return false, extErrors.Wrap(err, "Cannot decode fake billing object")
+	}
+	return true, nil
+}
+
+// list calls fn with the raw JSON of every object of the given kind, oldest first
+func (f *FakeBillingProvider) list(ctx context.Context, kind string, fn func(data []byte) error) error {
+	objs := make([]fakeObject, 0, 1)
+	if f.db != nil {
+		if result := f.db.WithContext(ctx).
+			Order("created_at asc, id asc").
+			Find(&objs, "kind = ?", kind); result.Error != nil {
+			return result.Error
+		}
+	} else {
+		f.mu.Lock()
+		for _, obj := range f.objects {
+			if obj.Kind == kind {
+				objs = append(objs, obj)
+			}
+		}
+		f.mu.Unlock()
+		// map iteration is random, sort the same way as the query above
+		sort.Slice(objs, func(i, j int) bool {
+			if !objs[i].CreatedAt.Equal(objs[j].CreatedAt) {
+				return objs[i].CreatedAt.Before(objs[j].CreatedAt)
+			}
+			return objs[i].ID < objs[j].ID
+		})
+	}
+	for _, obj := range objs {
+		if err := fn(obj.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindCustomerByEmail returns the fake customer with the given email, or nil if none was found
+func (f *FakeBillingProvider) FindCustomerByEmail(ctx context.Context, email string) (*stripe.Customer, error) {
+	var found *stripe.Customer
+	err := f.list(ctx, fakeKindCustomer, func(data []byte) error {
+		var c stripe.Customer
+		if err := json.Unmarshal(data, &c); err != nil {
+			return err
+		}
+		if found == nil && c.Email == email {
+			found = &c
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+func (f *FakeBillingProvider) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	c := &stripe.Customer{
+		ID:              fakeID("cus"),
+		Created:         time.Now().Unix(),
+		InvoiceSettings: &stripe.CustomerInvoiceSettings{},
+	}
+	if params.Email != nil {
+		c.Email = *params.Email
+	}
+	if err := f.put(contextOf(&params.Params), fakeKindCustomer, c.ID, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCustomer returns the customer. Like Stripe, tax_ids is only included if it is expanded
+func (f *FakeBillingProvider) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	var ctx context.Context = context.Background()
+	if params != nil {
+		ctx = contextOf(&params.Params)
+	}
+	c, err := f.getCustomer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return customerResponse(c, params), nil
+}
+
+// getCustomer returns the customer as stored, including the fields which are only returned by Stripe when expanded
+func (f *FakeBillingProvider) getCustomer(ctx context.Context, id string) (*stripe.Customer, error) {
+	var c stripe.Customer
+	found, err := f.get(ctx, fakeKindCustomer, id, &c)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errResourceMissing("No such customer: " + id)
+	}
+	return &c, nil
+}
+
+// customerResponse omits the fields of the customer which were not expanded with params
+func customerResponse(c *stripe.Customer, params *stripe.CustomerParams) *stripe.Customer {
+	if params != nil {
+		for _, field := range params.Expand {
+			if field != nil && *field == "tax_ids" {
+				return c
+			}
+		}
+	}
+	response := *c
+	response.TaxIDs = nil
+	return &response
+}
+
+func (f *FakeBillingProvider) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	c, err := f.getCustomer(contextOf(&params.Params), id)
+	if err != nil {
+		return nil, err
+	}
+	if params.Email != nil {
+		c.Email = *params.Email
+	}
+	if params.Name != nil {
+		c.Name = *params.Name
+	}
+	if params.Address != nil {
+		// the address is replaced as a whole
+		c.Address = stripe.Address{
+			City:       stripe.StringValue(params.Address.City),
+			Country:    stripe.StringValue(params.Address.Country),
+			Line1:      stripe.StringValue(params.Address.Line1),
+			Line2:      stripe.StringValue(params.Address.Line2),
+			PostalCode: stripe.StringValue(params.Address.PostalCode),
+			State:      stripe.StringValue(params.Address.State),
+		}
+	}
+	if params.TaxExempt != nil {
+		c.TaxExempt = stripe.CustomerTaxExempt(*params.TaxExempt)
+	}
+	if params.InvoiceSettings != nil && params.InvoiceSettings.DefaultPaymentMethod != nil {
+		c.InvoiceSettings = &stripe.CustomerInvoiceSettings{
+			DefaultPaymentMethod: &stripe.PaymentMethod{
+				ID: *params.InvoiceSettings.DefaultPaymentMethod,
+			},
+		}
+	}
+	if err := f.put(contextOf(&params.Params), fakeKindCustomer, c.ID, c); err != nil {
+		return nil, err
+	}
+	return customerResponse(c, params), nil
+}
+
+// AttachPaymentMethod accepts any payment method ID (e.g. "pm_card_visa") as a valid card
+func (f *FakeBillingProvider) AttachPaymentMethod(id string, params *stripe.PaymentMethodAttachParams) (*stripe.PaymentMethod, error) {
+	if params.Customer == nil {
+		return nil, fmt.Errorf("PaymentMethodAttachParams.Customer is required")
+	}
+	c, err := f.getCustomer(contextOf(&params.Params), *params.Customer)
+	if err != nil {
+		return nil, err
+	}
+	return &stripe.PaymentMethod{
+		ID:       id,
+		Object:   "payment_method",
+		Created:  time.Now().Unix(),
+		Customer: c,
+		Type:     stripe.PaymentMethodTypeCard,
+	}, nil
+}
+
+func (f *FakeBillingProvider) NewProduct(params *stripe.ProductParams) (*stripe.Product, error) {
+	p := &stripe.Product{
+		ID:       fakeID("prod"),
+		Active:   true,
+		Created:  time.Now().Unix(),
+		Metadata: params.Metadata,
+	}
+	if params.Name != nil {
+		p.Name = *params.Name
+	}
+	if params.Description != nil {
+		p.Description = *params.Description
+	}
+	if params.Active != nil {
+		p.Active = *params.Active
+	}
+	if err := f.put(contextOf(&params.Params), fakeKindProduct, p.ID, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// FindProductByMetadata returns the active fake product with the given metadata value, or nil if none was found
+func (f *FakeBillingProvider) FindProductByMetadata(ctx context.Context, key, value string) (*stripe.Product, error) {
+	var found *stripe.Product
+	err := f.list(ctx, fakeKindProduct, func(data []byte) error {
+		var p stripe.Product
+		if err := json.Unmarshal(data, &p); err != nil {
+			return err
+		}
+		if found == nil && p.Active && p.Metadata[key] == value {
+			found = &p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+func (f *FakeBillingProvider) NewPrice(params *stripe.PriceParams) (*stripe.Price, error) {
+	ctx := contextOf(&params.Params)
+	if params.Product == nil {
+		return nil, fmt.Errorf("PriceParams.Product is required")
+	}
+	var product stripe.Product
+	found, err := f.get(ctx, fakeKindProduct, *params.Product, &product)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errResourceMissing("No such product: " + *params.Product)
+	}
+
+	p := &stripe.Price{
+		ID:            fakeID("price"),
+		Object:        "price",
+		Active:        true,
+		BillingScheme: stripe.PriceBillingSchemePerUnit,
+		Created:       time.Now().Unix(),
+		Metadata:      params.Metadata,
+		Product:       &product,
+		Type:          stripe.PriceTypeOneTime,
+	}
+	if params.Currency != nil {
+		p.Currency = stripe.Currency(*params.Currency)
+	}
+	if params.LookupKey != nil {
+		p.LookupKey = *params.LookupKey
+	}
+	if params.Nickname != nil {
+		p.Nickname = *params.Nickname
+	}
+	if params.UnitAmountDecimal != nil {
+		p.UnitAmountDecimal = *params.UnitAmountDecimal
+		p.UnitAmount = int64(*params.UnitAmountDecimal)
+	}
+	if params.Recurring != nil {
+		p.Type = stripe.PriceTypeRecurring
+		p.Recurring = &stripe.PriceRecurring{
+			IntervalCount: 1,
+		}
+		if params.Recurring.AggregateUsage != nil {
+			p.Recurring.AggregateUsage = stripe.PriceRecurringAggregateUsage(*params.Recurring.AggregateUsage)
+		}
+		if params.Recurring.Interval != nil {
+			p.Recurring.Interval = stripe.PriceRecurringInterval(*params.Recurring.Interval)
+		}
+		if params.Recurring.IntervalCount != nil {
+			p.Recurring.IntervalCount = *params.Recurring.IntervalCount
+		}
+		if params.Recurring.UsageType != nil {
+			p.Recurring.UsageType = stripe.PriceRecurringUsageType(*params.Recurring.UsageType)
+		}
+	}
+	if err := f.put(ctx, fakeKindPrice, p.ID, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// FindPriceByLookupKey returns the active fake price with the given lookup key, or nil if none was found
+func (f *FakeBillingProvider) FindPriceByLookupKey(ctx context.Context, lookupKey string) (*stripe.Price, error) {
+	var found *stripe.Price
+	err := f.list(ctx, fakeKindPrice, func(data []byte) error {
+		var p stripe.Price
+		if err := json.Unmarshal(data, &p); err != nil {
+			return err
+		}
+		if found == nil && p.Active && p.LookupKey == lookupKey {
+			found = &p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// UpdateProduct supports changing the name, description, metadata and archiving (Active)
+func (f *FakeBillingProvider) UpdateProduct(id string, params *stripe.ProductParams) (*stripe.Product, error) {
+	ctx := contextOf(&params.Params)
+	var p stripe.Product
+	found, err := f.get(ctx, fakeKindProduct, id, &p)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errResourceMissing("No such product: " + id)
+	}
+	if params.Name != nil {
+		p.Name = *params.Name
+	}
+	if params.Description != nil {
+		p.Description = *params.Description
+	}
+	if params.Metadata != nil {
+		p.Metadata = params.Metadata
+	}
+	if params.Active != nil {
+		p.Active = *params.Active
+	}
+	if err := f.put(ctx, fakeKindProduct, p.ID, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// UpdatePrice supports changing the nickname, metadata and archiving (Active). Like Stripe, the amount cannot be changed
+func (f *FakeBillingProvider) UpdatePrice(id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	ctx := contextOf(&params.Params)
+	var p stripe.Price
+	found, err := f.get(ctx, fakeKindPrice, id, &p)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errResourceMissing("No such price: " + id)
+	}
+	if params.Nickname != nil {
+		p.Nickname = *params.Nickname
+	}
+	if params.Metadata != nil {
+		p.Metadata = params.Metadata
+	}
+	if params.Active != nil {
+		p.Active = *params.Active
+	}
+	if err := f.put(ctx, fakeKindPrice, p.ID, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// NewSubscription will create an active subscription if the customer has a default payment method,
+// otherwise it fails the same way Stripe does
+func (f *FakeBillingProvider) NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	ctx := contextOf(&params.Params)
+	if params.Customer == nil {
+		return nil, fmt.Errorf("SubscriptionParams.Customer is required")
+	}
+	c, err := f.getCustomer(contextOf(&params.Params), *params.Customer)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var trialEnd time.Time
+	if params.TrialPeriodDays != nil {
+		trialEnd = now.AddDate(0, 0, int(*params.TrialPeriodDays))
+	}
+	if params.TrialEnd != nil {
+		trialEnd = time.Unix(*params.TrialEnd, 0)
+	}
+	if trialEnd.IsZero() && !hasPaymentMethod(c) {
+		return nil, errResourceMissing("This customer has no attached payment source or default payment method.")
+	}
+
+	sub := &stripe.Subscription{
+		ID:                 fakeID("sub"),
+		Object:             "subscription",
+		CollectionMethod:   stripe.SubscriptionCollectionMethodChargeAutomatically,
+		Created:            now.Unix(),
+		StartDate:          now.Unix(),
+		BillingCycleAnchor: now.Unix(),
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   now.AddDate(0, 1, 0).Unix(),
+		Customer:           c,
+		Metadata:           params.Metadata,
+		Status:             stripe.SubscriptionStatusActive,
+		Items: &stripe.SubscriptionItemList{
+			Data: make([]*stripe.SubscriptionItem, 0, len(params.Items)),
+		},
+	}
+	for _, itemParams := range params.Items {
+		if itemParams.Price == nil {
+			return nil, fmt.Errorf("SubscriptionItemsParams.Price is required")
+		}
+		var price stripe.Price
+		found, err := f.get(ctx, fakeKindPrice, *itemParams.Price, &price)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, errResourceMissing("No such price: " + *itemParams.Price)
+		}
+		if !price.Active {
+			return nil, &stripe.Error{
+				HTTPStatusCode: http.StatusBadRequest,
+				Type:           stripe.ErrorTypeInvalidRequest,
+				Msg:            "The price specified is inactive: " + price.ID,
+			}
+		}
+		item := &stripe.SubscriptionItem{
+			ID:           fakeID("si"),
+			Created:      now.Unix(),
+			Price:        &price,
+			Subscription: sub.ID,
+		}
+		if itemParams.Quantity != nil {
+			item.Quantity = *itemParams.Quantity
+		}
+		sub.Items.Data = append(sub.Items.Data, item)
+	}
+	sub.Items.TotalCount = uint32(len(sub.Items.Data))
+	for _, item := range sub.Items.Data[1:] {
+		if item.Price.Currency != sub.Items.Data[0].Price.Currency {
+			return nil, &stripe.Error{
+				HTTPStatusCode: http.StatusBadRequest,
+				Type:           stripe.ErrorTypeInvalidRequest,
+				Msg:            "All prices on a subscription must have the same currency",
+			}
+		}
+	}
+
+	for _, rateID := range params.DefaultTaxRates {
+		var rate stripe.TaxRate
+		found, err := f.get(ctx, fakeKindTaxRate, *rateID, &rate)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, errResourceMissing("No such tax rate: " + *rateID)
+		}
+		sub.DefaultTaxRates = append(sub.DefaultTaxRates, &rate)
+	}
+
+	if !trialEnd.IsZero() {
+		sub.Status = stripe.SubscriptionStatusTrialing
+		sub.TrialStart = now.Unix()
+		sub.TrialEnd = trialEnd.Unix()
+		sub.CurrentPeriodEnd = trialEnd.Unix()
+	}
+
+	if params.PromotionCode != nil || params.Coupon != nil {
+		discount, err := f.redeem(ctx, params.PromotionCode, params.Coupon, now)
+		if err != nil {
+			return nil, err
+		}
+		discount.Customer = c.ID
+		discount.Subscription = sub.ID
+		sub.Discount = discount
+	}
+
+	// licensed items are billed upfront
+	if _, err := f.newInvoice(ctx, sub, stripe.InvoiceBillingReasonSubscriptionCreate, nil); err != nil {
+		return nil, err
+	}
+
+	if err := f.put(ctx, fakeKindSubscription, sub.ID, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func hasPaymentMethod(c *stripe.Customer) bool {
+	return c.InvoiceSettings != nil && c.InvoiceSettings.DefaultPaymentMethod != nil
+}
+
+// redeem validates the promotion code (or coupon) and returns the discount to apply to a subscription
+func (f *FakeBillingProvider) redeem(ctx context.Context, promotionCodeID, couponID *string, now time.Time) (*stripe.Discount, error) {
+	discount := &stripe.Discount{
+		ID:     fakeID("di"),
+		Object: "discount",
+		Start:  now.Unix(),
+	}
+	if promotionCodeID != nil {
+		var promo stripe.PromotionCode
+		found, err := f.get(ctx, fakeKindPromotion, *promotionCodeID, &promo)
+		if err != nil {
+			return nil, err
+		}
+		if !found || !promo.Active {
+			return nil, errResourceMissing("No such promotion code: " + *promotionCodeID)
+		}
+		promo.TimesRedeemed++
+		if promo.MaxRedemptions > 0 && promo.TimesRedeemed >= promo.MaxRedemptions {
+			promo.Active = false
+		}
+		if err := f.put(ctx, fakeKindPromotion, promo.ID, &promo); err != nil {
+			return nil, err
+		}
+		discount.PromotionCode = &promo
+		couponID = &promo.Coupon.ID
+	}
+
+	var coupon stripe.Coupon
+	found, err := f.get(ctx, fakeKindCoupon, *couponID, &coupon)
+	if err != nil {
+		return nil, err
+	}
+	if !found || !coupon.Valid {
+		return nil, errResourceMissing("No such coupon: " + *couponID)
+	}
+	coupon.TimesRedeemed++
+	if coupon.MaxRedemptions > 0 && coupon.TimesRedeemed >= coupon.MaxRedemptions {
+		coupon.Valid = false
+	}
+	if err := f.put(ctx, fakeKindCoupon, coupon.ID, &coupon); err != nil {
+		return nil, err
+	}
+	discount.Coupon = &coupon
+	if coupon.Duration == stripe.CouponDurationRepeating {
+		discount.End = now.AddDate(0, int(coupon.DurationInMonths), 0).Unix()
+	}
+	return discount, nil
+}
+
+// GetSubscription returns the subscription, renewing (or ending) it first if the current period is over
+func (f *FakeBillingProvider) GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	var ctx context.Context = context.Background()
+	if params != nil {
+		ctx = contextOf(&params.Params)
+	}
+	var sub stripe.Subscription
+	found, err := f.get(ctx, fakeKindSubscription, id, &sub)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errResourceMissing("No such subscription: " + id)
+	}
+
+	now := time.Now()
+	renewing := func() bool {
+		return (sub.Status == stripe.SubscriptionStatusActive || sub.Status == stripe.SubscriptionStatusTrialing) &&
+			now.Unix() >= sub.CurrentPeriodEnd
+	}
+	if renewing() {
+		for renewing() {
+			// metered items are billed in arrears, except for usage during the trial
+			ended := &stripe.Period{
+				Start: sub.CurrentPeriodStart,
+				End:   sub.CurrentPeriodEnd,
+			}
+			if sub.Status == stripe.SubscriptionStatusTrialing {
+				ended = nil
+				sub.Status = stripe.SubscriptionStatusActive
+			}
+			if sub.CancelAtPeriodEnd {
+				sub.Status = stripe.SubscriptionStatusCanceled
+				sub.EndedAt = sub.CurrentPeriodEnd
+			} else {
+				sub.CurrentPeriodStart = sub.CurrentPeriodEnd
+				sub.CurrentPeriodEnd = time.Unix(sub.CurrentPeriodEnd, 0).AddDate(0, 1, 0).Unix()
+			}
+			invoice, err := f.newInvoice(ctx, &sub, stripe.InvoiceBillingReasonSubscriptionCycle, ended)
+			if err != nil {
+				return nil, err
+			}
+			if !invoice.Paid {
+				// e.g. the trial ended without a payment method
+				sub.Status = stripe.SubscriptionStatusPastDue
+			}
+		}
+		if err := f.put(ctx, fakeKindSubscription, sub.ID, &sub); err != nil {
+			return nil, err
+		}
+	}
+	return &sub, nil
+}
+
+func (f *FakeBillingProvider) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	sub, err := f.GetSubscription(id, params)
+	if err != nil {
+		return nil, err
+	}
+	if params.CancelAtPeriodEnd != nil {
+		sub.CancelAtPeriodEnd = *params.CancelAtPeriodEnd
+		if sub.CancelAtPeriodEnd {
+			sub.CanceledAt = time.Now().Unix()
+		} else {
+			sub.CanceledAt = 0
+		}
+	}
+	if params.Metadata != nil {
+		sub.Metadata = params.Metadata
+	}
+	if params.TrialEndNow != nil && *params.TrialEndNow && sub.Status == stripe.SubscriptionStatusTrialing {
+		now := time.Now()
+		sub.Status = stripe.SubscriptionStatusActive
+		sub.TrialEnd = now.Unix()
+		sub.CurrentPeriodStart = now.Unix()
+		sub.CurrentPeriodEnd = now.AddDate(0, 1, 0).Unix()
+		invoice, err := f.newInvoice(contextOf(&params.Params), sub, stripe.InvoiceBillingReasonSubscriptionUpdate, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !invoice.Paid {
+			sub.Status = stripe.SubscriptionStatusPastDue
+		}
+	}
+	if err := f.put(contextOf(&params.Params), fakeKindSubscription, sub.ID, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (f *FakeBillingProvider) NewCoupon(params *stripe.CouponParams) (*stripe.Coupon, error) {
+	c := &stripe.Coupon{
+		ID:       fakeID("co"),
+		Object:   "coupon",
+		Created:  time.Now().Unix(),
+		Duration: stripe.CouponDurationOnce,
+		Metadata: params.Metadata,
+		Valid:    true,
+	}
+	if params.ID != nil {
+		c.ID = *params.ID
+	}
+	if params.AmountOff != nil {
+		c.AmountOff = *params.AmountOff
+	}
+	if params.PercentOff != nil {
+		c.PercentOff = *params.PercentOff
+	}
+	if c.AmountOff == 0 && c.PercentOff == 0 {
+		return nil, fmt.Errorf("CouponParams requires either AmountOff or PercentOff")
+	}
+	if params.Currency != nil {
+		c.Currency = stripe.Currency(*params.Currency)
+	}
+	if params.Duration != nil {
+		c.Duration = stripe.CouponDuration(*params.Duration)
+	}
+	if params.DurationInMonths != nil {
+		c.DurationInMonths = *params.DurationInMonths
+	}
+	if params.MaxRedemptions != nil {
+		c.MaxRedemptions = *params.MaxRedemptions
+	}
+	if params.Name != nil {
+		c.Name = *params.Name
+	}
+	if err := f.put(contextOf(&params.Params), fakeKindCoupon, c.ID, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (f *FakeBillingProvider) NewPromotionCode(params *stripe.PromotionCodeParams) (*stripe.PromotionCode, error) {
+	ctx := contextOf(&params.Params)
+	if params.Coupon == nil {
+		return nil, fmt.Errorf("PromotionCodeParams.Coupon is required")
+	}
+	var coupon stripe.Coupon
+	found, err := f.get(ctx, fakeKindCoupon, *params.Coupon, &coupon)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errResourceMissing("No such coupon: " + *params.Coupon)
+	}
+	p := &stripe.PromotionCode{
+		ID:       fakeID("promo"),
+		Object:   "promotion_code",
+		Active:   true,
+		Code:     strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:8]),
+		Coupon:   &coupon,
+		Created:  time.Now().Unix(),
+		Metadata: params.Metadata,
+	}
+	if params.Active != nil {
+		p.Active = *params.Active
+	}
+	if params.Code != nil {
+		p.Code = *params.Code
+	}
+	if params.MaxRedemptions != nil {
+		p.MaxRedemptions = *params.MaxRedemptions
+	}
+	if err := f.put(ctx, fakeKindPromotion, p.ID, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// FindPromotionCode returns the active promotion code with the given code, or nil if none was found
+func (f *FakeBillingProvider) FindPromotionCode(ctx context.Context, code string) (*stripe.PromotionCode, error) {
+	var found *stripe.PromotionCode
+	err := f.list(ctx, fakeKindPromotion, func(data []byte) error {
+		var p stripe.PromotionCode
+		if err := json.Unmarshal(data, &p); err != nil {
+			return err
+		}
+		if found == nil && p.Active && p.Code == code {
+			found = &p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// NewTaxRate creates a tax rate which can be set as the default tax rates of subscriptions
+func (f *FakeBillingProvider) NewTaxRate(params *stripe.TaxRateParams) (*stripe.TaxRate, error) {
+	if params.DisplayName == nil || params.Percentage == nil {
+		return nil, fmt.Errorf("TaxRateParams.DisplayName and Percentage are required")
+	}
+	rate := &stripe.TaxRate{
+		ID:          fakeID("txr"),
+		Object:      "tax_rate",
+		Active:      true,
+		Created:     time.Now().Unix(),
+		DisplayName: *params.DisplayName,
+		Metadata:    params.Metadata,
+		Percentage:  *params.Percentage,
+	}
+	if params.Description != nil {
+		rate.Description = *params.Description
+	}
+	if params.Jurisdiction != nil {
+		rate.Jurisdiction = *params.Jurisdiction
+	}
+	if params.Inclusive != nil {
+		rate.Inclusive = *params.Inclusive
+	}
+	if err := f.put(contextOf(&params.Params), fakeKindTaxRate, rate.ID, rate); err != nil {
+		return nil, err
+	}
+	return rate, nil
+}
+
+// NewTaxID adds the tax ID to the customer. Only eu_vat is supported, and it is always verified
+func (f *FakeBillingProvider) NewTaxID(params *stripe.TaxIDParams) (*stripe.TaxID, error) {
+	ctx := contextOf(&params.Params)
+	if params.Customer == nil || params.Type == nil || params.Value == nil {
+		return nil, fmt.Errorf("TaxIDParams.Customer, Type and Value are required")
+	}
+	if *params.Type != string(stripe.TaxIDTypeEUVAT) {
+		return nil, &stripe.Error{
+			HTTPStatusCode: http.StatusBadRequest,
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Msg:            "Unsupported tax ID type: " + *params.Type,
+		}
+	}
+	if len(*params.Value) < 2 {
+		return nil, &stripe.Error{
+			HTTPStatusCode: http.StatusBadRequest,
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Msg:            "Invalid value for eu_vat: " + *params.Value,
+		}
+	}
+	c, err := f.getCustomer(contextOf(&params.Params), *params.Customer)
+	if err != nil {
+		return nil, err
+	}
+	id := &stripe.TaxID{
+		ID:      fakeID("txi"),
+		Object:  "tax_id",
+		Country: (*params.Value)[:2],
+		Created: time.Now().Unix(),
+		Type:    stripe.TaxIDType(*params.Type),
+		Value:   *params.Value,
+		Verification: &stripe.TaxIDVerification{
+			Status: stripe.TaxIDVerificationStatusVerified,
+		},
+	}
+	if c.TaxIDs == nil {
+		c.TaxIDs = &stripe.TaxIDList{}
+	}
+	c.TaxIDs.Data = append(c.TaxIDs.Data, id)
+	c.TaxIDs.TotalCount = uint32(len(c.TaxIDs.Data))
+	if err := f.put(ctx, fakeKindCustomer, c.ID, c); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// DeleteTaxID removes the tax ID from the customer
+func (f *FakeBillingProvider) DeleteTaxID(id string, params *stripe.TaxIDParams) (*stripe.TaxID, error) {
+	ctx := contextOf(&params.Params)
+	if params.Customer == nil {
+		return nil, fmt.Errorf("TaxIDParams.Customer is required")
+	}
+	c, err := f.getCustomer(contextOf(&params.Params), *params.Customer)
+	if err != nil {
+		return nil, err
+	}
+	var deleted *stripe.TaxID
+	if c.TaxIDs != nil {
+		ids := make([]*stripe.TaxID, 0, len(c.TaxIDs.Data))
+		for _, taxID := range c.TaxIDs.Data {
+			if taxID.ID == id {
+				deleted = taxID
+				continue
+			}
+			ids = append(ids, taxID)
+		}
+		c.TaxIDs.Data = ids
+		c.TaxIDs.TotalCount = uint32(len(ids))
+	}
+	if deleted == nil {
+		return nil, errResourceMissing("No such tax id: " + id)
+	}
+	if err := f.put(ctx, fakeKindCustomer, c.ID, c); err != nil {
+		return nil, err
+	}
+	deleted.Deleted = true
+	return deleted, nil
+}
+
+func (f *FakeBillingProvider) NewCustomerBalanceTransaction(params *stripe.CustomerBalanceTransactionParams) (*stripe.CustomerBalanceTransaction, error) {
+	ctx := contextOf(&params.Params)
+	if params.Customer == nil || params.Amount == nil {
+		return nil, fmt.Errorf("CustomerBalanceTransactionParams.Customer and Amount are required")
+	}
+	c, err := f.getCustomer(contextOf(&params.Params), *params.Customer)
+	if err != nil {
+		return nil, err
+	}
+	c.Balance += *params.Amount
+	if err := f.put(ctx, fakeKindCustomer, c.ID, c); err != nil {
+		return nil, err
+	}
+
+	t := &stripe.CustomerBalanceTransaction{
+		ID:            fakeID("cbtxn"),
+		Object:        "customer_balance_transaction",
+		Amount:        *params.Amount,
+		Created:       time.Now().Unix(),
+		Customer:      &stripe.Customer{ID: c.ID},
+		EndingBalance: c.Balance,
+		Metadata:      params.Metadata,
+		Type:          stripe.CustomerBalanceTransactionTypeAdjustment,
+	}
+	if params.Currency != nil {
+		t.Currency = stripe.Currency(*params.Currency)
+	}
+	if params.Description != nil {
+		t.Description = *params.Description
+	}
+	if err := f.put(ctx, fakeKindBalance, t.ID, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewUsageRecord keeps the reported usage record as is
+func (f *FakeBillingProvider) NewUsageRecord(params *stripe.UsageRecordParams) (*stripe.UsageRecord, error) {
+	if params.SubscriptionItem == nil {
+		return nil, fmt.Errorf("UsageRecordParams.SubscriptionItem is required")
+	}
+	record := &stripe.UsageRecord{
+		ID:               fakeID("mbur"),
+		SubscriptionItem: *params.SubscriptionItem,
+		Timestamp:        time.Now().Unix(),
+	}
+	if params.Quantity != nil {
+		record.Quantity = *params.Quantity
+	}
+	if params.Timestamp != nil {
+		record.Timestamp = *params.Timestamp
+	}
+	if err := f.put(contextOf(&params.Params), fakeKindUsageRecord, record.ID, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ListUsageRecordSummaries returns the summary for the current period of the subscription owning the subscription item
+func (f *FakeBillingProvider) ListUsageRecordSummaries(params *stripe.UsageRecordSummaryListParams) ([]*stripe.UsageRecordSummary, error) {
+	ctx := context.Background()
+	if params.Context != nil {
+		ctx = params.Context
+	}
+	if params.SubscriptionItem == nil {
+		return nil, fmt.Errorf("UsageRecordSummaryListParams.SubscriptionItem is required")
+	}
+
+	var subscriptionID string
+	err := f.list(ctx, fakeKindSubscription, func(data []byte) error {
+		var sub stripe.Subscription
+		if err := json.Unmarshal(data, &sub); err != nil {
+			return err
+		}
+		for _, item := range sub.Items.Data {
+			if item.ID == *params.SubscriptionItem {
+				subscriptionID = sub.ID
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if subscriptionID == "" {
+		return nil, errResourceMissing("No such subscription item: " + *params.SubscriptionItem)
+	}
+	// renew the subscription first, if needed
+	sub, err := f.GetSubscription(subscriptionID, &stripe.SubscriptionParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	current := &stripe.Period{
+		Start: sub.CurrentPeriodStart,
+		End:   sub.CurrentPeriodEnd,
+	}
+	total, err := f.lastUsageDuringPeriod(ctx, *params.SubscriptionItem, current)
+	if err != nil {
+		return nil, err
+	}
+	return []*stripe.UsageRecordSummary{
+		{
+			ID:               fakeID("sis"),
+			Object:           "usage_record_summary",
+			Period:           current,
+			SubscriptionItem: *params.SubscriptionItem,
+			TotalUsage:       total,
+		},
+	}, nil
+}
+
+// lastUsageDuringPeriod returns the quantity of the latest usage record reported within the period
+func (f *FakeBillingProvider) lastUsageDuringPeriod(ctx context.Context, subscriptionItemID string, period *stripe.Period) (int64, error) {
+	var latest *stripe.UsageRecord
+	err := f.list(ctx, fakeKindUsageRecord, func(data []byte) error {
+		var r stripe.UsageRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		if r.SubscriptionItem != subscriptionItemID || r.Timestamp < period.Start || r.Timestamp > period.End {
+			return nil
+		}
+		if latest == nil || r.Timestamp >= latest.Timestamp {
+			latest = &r
+		}
+		return nil
+	})
+	if err != nil || latest == nil {
+		return 0, err
+	}
+	return latest.Quantity, nil
+}
+
+// newInvoice creates an invoice for the subscription. Licensed items are billed for the current period
+// (unless the subscription has ended or is trialing), and metered items are billed for the ended period, if any.
+// The subscription's discount and the customer's credit balance are applied, and the rest is paid by the default payment method
+func (f *FakeBillingProvider) newInvoice(ctx context.Context, sub *stripe.Subscription, reason stripe.InvoiceBillingReason, ended *stripe.Period) (*stripe.Invoice, error) {
+	now := time.Now()
+	invoice := &stripe.Invoice{
+		ID:            fakeID("in"),
+		Object:        "invoice",
+		BillingReason: reason,
+		Created:       now.Unix(),
+		Customer:      sub.Customer,
+		CustomerEmail: sub.Customer.Email,
+		Lines: &stripe.InvoiceLineList{
+			Data: make([]*stripe.InvoiceLine, 0, len(sub.Items.Data)),
+		},
+		Paid:         true,
+		PeriodStart:  sub.CurrentPeriodStart,
+		PeriodEnd:    sub.CurrentPeriodEnd,
+		Status:       stripe.InvoiceStatusPaid,
+		Subscription: &stripe.Subscription{ID: sub.ID},
+	}
+	current := &stripe.Period{
+		Start: sub.CurrentPeriodStart,
+		End:   sub.CurrentPeriodEnd,
+	}
+	for _, item := range sub.Items.Data {
+		if item.Price == nil || item.Price.Recurring == nil {
+			continue
+		}
+		line := &stripe.InvoiceLine{
+			ID:               fakeID("il"),
+			Object:           "line_item",
+			Currency:         item.Price.Currency,
+			Description:      item.Price.Nickname,
+			Price:            item.Price,
+			Subscription:     sub.ID,
+			SubscriptionItem: item.ID,
+			Type:             stripe.InvoiceLineTypeSubscription,
+		}
+		switch item.Price.Recurring.UsageType {
+		case stripe.PriceRecurringUsageTypeMetered:
+			if ended == nil {
+				continue
+			}
+			quantity, err := f.lastUsageDuringPeriod(ctx, item.ID, ended)
+			if err != nil {
+				return nil, err
+			}
+			line.Period = ended
+			line.Quantity = quantity
+		default:
+			if sub.Status != stripe.SubscriptionStatusActive {
+				continue
+			}
+			line.Period = current
+			line.Quantity = item.Quantity
+		}
+		line.Amount = int64(math.Round(float64(line.Quantity) * item.Price.UnitAmountDecimal))
+		invoice.Currency = line.Currency
+		invoice.Subtotal += line.Amount
+		invoice.Lines.Data = append(invoice.Lines.Data, line)
+	}
+	invoice.Lines.TotalCount = uint32(len(invoice.Lines.Data))
+	invoice.Total = invoice.Subtotal
+
+	if d := sub.Discount; d != nil && d.Coupon != nil && (d.End == 0 || now.Unix() < d.End) && invoice.Subtotal > 0 {
+		discount := d.Coupon.AmountOff
+		if d.Coupon.PercentOff > 0 {
+			discount = int64(math.Round(float64(invoice.Subtotal) * d.Coupon.PercentOff / 100))
+		}
+		if discount > invoice.Subtotal {
+			discount = invoice.Subtotal
+		}
+		invoice.Discount = d
+		invoice.TotalDiscountAmounts = []*stripe.InvoiceDiscountAmount{
+			{
+				Amount:   discount,
+				Discount: d,
+			},
+		}
+		invoice.Total -= discount
+		if d.Coupon.Duration == stripe.CouponDurationOnce {
+			d.End = now.Unix()
+		}
+	}
+
+	c, err := f.getCustomer(ctx, sub.Customer.ID)
+	if err != nil {
+		return nil, err
+	}
+	invoice.CustomerAddress = &c.Address
+	invoice.CustomerName = &c.Name
+	invoice.CustomerTaxExempt = c.TaxExempt
+	if c.TaxIDs != nil {
+		for _, id := range c.TaxIDs.Data {
+			invoice.CustomerTaxIDs = append(invoice.CustomerTaxIDs, &stripe.InvoiceCustomerTaxID{
+				Type:  id.Type,
+				Value: id.Value,
+			})
+		}
+	}
+
+	// tax rates are exclusive, and don't apply to tax exempt customers (e.g. reverse charge)
+	if c.TaxExempt == "" || c.TaxExempt == stripe.CustomerTaxExemptNone {
+		taxable := invoice.Total
+		for _, rate := range sub.DefaultTaxRates {
+			tax := int64(math.Round(float64(taxable) * rate.Percentage / 100))
+			invoice.TotalTaxAmounts = append(invoice.TotalTaxAmounts, &stripe.InvoiceTaxAmount{
+				Amount:  tax,
+				TaxRate: rate,
+			})
+			invoice.Tax += tax
+		}
+		invoice.Total += invoice.Tax
+	}
+
+	// credit (negative balance) is drawn down first
+	invoice.StartingBalance = c.Balance
+	invoice.AmountDue = invoice.Total
+	if c.Balance < 0 && invoice.Total > 0 {
+		applied := -c.Balance
+		if applied > invoice.Total {
+			applied = invoice.Total
+		}
+		invoice.AmountDue -= applied
+		c.Balance += applied
+		if err := f.put(ctx, fakeKindCustomer, c.ID, c); err != nil {
+			return nil, err
+		}
+	}
+	invoice.EndingBalance = c.Balance
+
+	if invoice.AmountDue > 0 && !hasPaymentMethod(c) {
+		invoice.Paid = false
+		invoice.Status = stripe.InvoiceStatusOpen
+		// there is nothing to charge, which is a failed payment attempt
+		invoice.AttemptCount = 1
+	} else {
+		invoice.AmountPaid = invoice.AmountDue
+	}
+
+	if err := f.put(ctx, fakeKindInvoice, invoice.ID, invoice); err != nil {
+		return nil, err
+	}
+	return invoice, nil
+}
+
+// ListInvoices returns a single page of invoices, newest first
+func (f *FakeBillingProvider) ListInvoices(params *stripe.InvoiceListParams) ([]*stripe.Invoice, error) {
+	ctx := context.Background()
+	if params.Context != nil {
+		ctx = params.Context
+	}
+	invoices := make([]*stripe.Invoice, 0, 1)
+	err := f.list(ctx, fakeKindInvoice, func(data []byte) error {
+		var invoice stripe.Invoice
+		if err := json.Unmarshal(data, &invoice); err != nil {
+			return err
+		}
+		if params.Customer != nil && (invoice.Customer == nil || invoice.Customer.ID != *params.Customer) {
+			return nil
+		}
+		if params.Subscription != nil && (invoice.Subscription == nil || invoice.Subscription.ID != *params.Subscription) {
+			return nil
+		}
+		if params.Status != nil && string(invoice.Status) != *params.Status {
+			return nil
+		}
+		if params.CreatedRange != nil && invoice.Created < params.CreatedRange.GreaterThanOrEqual {
+			return nil
+		}
+		invoices = append(invoices, &invoice)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// list is oldest first, so invoices created within the same second stay newest first after sorting
+	for i, j := 0, len(invoices)-1; i < j; i, j = i+1, j-1 {
+		invoices[i], invoices[j] = invoices[j], invoices[i]
+	}
+	sort.SliceStable(invoices, func(i, j int) bool {
+		return invoices[i].Created > invoices[j].Created
+	})
+
+	if params.StartingAfter != nil {
+		for k, invoice := range invoices {
+			if invoice.ID == *params.StartingAfter {
+				invoices = invoices[k+1:]
+				break
+			}
+		}
+	}
+	if params.Limit != nil && int64(len(invoices)) > *params.Limit {
+		invoices = invoices[:*params.Limit]
+	}
+	return invoices, nil
+}
+
+func (f *FakeBillingProvider) GetInvoice(id string, params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	var ctx context.Context = context.Background()
+	if params != nil {
+		ctx = contextOf(&params.Params)
+	}
+	var invoice stripe.Invoice
+	found, err := f.get(ctx, fakeKindInvoice, id, &invoice)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errResourceMissing("No such invoice: " + id)
+	}
+	return &invoice, nil
+}
@@ -0,0 +1,432 @@
+package external
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+func newTestFake(t *testing.T) *FakeBillingProvider {
+	t.Helper()
+	f, err := NewFakeBillingProvider(nil)
+	if err != nil {
+		t.Fatalf("NewFakeBillingProvider: %v", err)
+	}
+	return f
+}
+
+// newTestCustomer returns a customer with a default payment method
+func newTestCustomer(t *testing.T, f *FakeBillingProvider, email string) *stripe.Customer {
+	t.Helper()
+	c, err := f.NewCustomer(&stripe.CustomerParams{
+		Email: stripe.String(email),
+	})
+	if err != nil {
+		t.Fatalf("NewCustomer: %v", err)
+	}
+	pm, err := f.AttachPaymentMethod("pm_card_visa", &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(c.ID),
+	})
+	if err != nil {
+		t.Fatalf("AttachPaymentMethod: %v", err)
+	}
+	c, err = f.UpdateCustomer(c.ID, &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(pm.ID),
+		},
+	})
+	if err != nil {
+		t.Fatalf("UpdateCustomer: %v", err)
+	}
+	return c
+}
+
+// newTestPrices returns a licensed price of 100 and a metered price of 2 per unit
+func newTestPrices(t *testing.T, f *FakeBillingProvider) (licensed, metered *stripe.Price) {
+	t.Helper()
+	product, err := f.NewProduct(&stripe.ProductParams{
+		Name: stripe.String("Minecraft Server"),
+	})
+	if err != nil {
+		t.Fatalf("NewProduct: %v", err)
+	}
+	licensed, err = f.NewPrice(&stripe.PriceParams{
+		Currency:          stripe.String(string(stripe.CurrencyUSD)),
+		Product:           stripe.String(product.ID),
+		Nickname:          stripe.String("Base Fee"),
+		UnitAmountDecimal: stripe.Float64(100),
+		Recurring: &stripe.PriceRecurringParams{
+			Interval:  stripe.String(string(stripe.PriceRecurringIntervalMonth)),
+			UsageType: stripe.String(string(stripe.PriceRecurringUsageTypeLicensed)),
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPrice: %v", err)
+	}
+	metered, err = f.NewPrice(&stripe.PriceParams{
+		Currency:          stripe.String(string(stripe.CurrencyUSD)),
+		Product:           stripe.String(product.ID),
+		Nickname:          stripe.String("Running Time"),
+		UnitAmountDecimal: stripe.Float64(2),
+		Recurring: &stripe.PriceRecurringParams{
+			AggregateUsage: stripe.String(string(stripe.PriceRecurringAggregateUsageLastDuringPeriod)),
+			Interval:       stripe.String(string(stripe.PriceRecurringIntervalMonth)),
+			UsageType:      stripe.String(string(stripe.PriceRecurringUsageTypeMetered)),
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPrice: %v", err)
+	}
+	return licensed, metered
+}
+
+// endPeriod moves the current period of the subscription into the past, so the next fetch renews it
+func endPeriod(t *testing.T, f *FakeBillingProvider, sub *stripe.Subscription) *stripe.Period {
+	t.Helper()
+	period := &stripe.Period{
+		Start: time.Now().AddDate(0, -1, 0).Unix(),
+		End:   time.Now().Add(-time.Minute).Unix(),
+	}
+	sub.CurrentPeriodStart = period.Start
+	sub.CurrentPeriodEnd = period.End
+	if err := f.put(context.Background(), fakeKindSubscription, sub.ID, sub); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	return period
+}
+
+func itemOf(sub *stripe.Subscription, price *stripe.Price) *stripe.SubscriptionItem {
+	for _, item := range sub.Items.Data {
+		if item.Price.ID == price.ID {
+			return item
+		}
+	}
+	return nil
+}
+
+func TestFakeBillingSubscriptionRequiresPaymentMethod(t *testing.T) {
+	f := newTestFake(t)
+	licensed, _ := newTestPrices(t, f)
+	c, err := f.NewCustomer(&stripe.CustomerParams{
+		Email: stripe.String("nocard@example.com"),
+	})
+	if err != nil {
+		t.Fatalf("NewCustomer: %v", err)
+	}
+
+	_, err = f.NewSubscription(&stripe.SubscriptionParams{
+		Customer: stripe.String(c.ID),
+		Items: []*stripe.SubscriptionItemsParams{
+			{Price: stripe.String(licensed.ID), Quantity: stripe.Int64(1)},
+		},
+	})
+	if stripeErr, ok := err.(*stripe.Error); !ok || stripeErr.Code != stripe.ErrorCodeResourceMissing {
+		t.Fatalf("expected a resource_missing error, got %v", err)
+	}
+}
+
+func TestFakeBillingSubscriptionLifecycle(t *testing.T) {
+	f := newTestFake(t)
+	c := newTestCustomer(t, f, "lifecycle@example.com")
+	licensed, metered := newTestPrices(t, f)
+
+	// subscribe
+	sub, err := f.NewSubscription(&stripe.SubscriptionParams{
+		Customer: stripe.String(c.ID),
+		Items: []*stripe.SubscriptionItemsParams{
+			{Price: stripe.String(licensed.ID), Quantity: stripe.Int64(1)},
+			{Price: stripe.String(metered.ID)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewSubscription: %v", err)
+	}
+	if sub.Status != stripe.SubscriptionStatusActive {
+		t.Fatalf("expected an active subscription, got %s", sub.Status)
+	}
+	invoices, err := f.ListInvoices(&stripe.InvoiceListParams{
+		Customer: stripe.String(c.ID),
+	})
+	if err != nil {
+		t.Fatalf("ListInvoices: %v", err)
+	}
+	if len(invoices) != 1 || invoices[0].BillingReason != stripe.InvoiceBillingReasonSubscriptionCreate {
+		t.Fatalf("expected the subscription_create invoice, got %d invoices", len(invoices))
+	}
+	if invoices[0].AmountPaid != 100 {
+		t.Fatalf("expected the licensed item to be billed upfront, got %d", invoices[0].AmountPaid)
+	}
+
+	// report usage, the latest record of the period wins
+	period := endPeriod(t, f, sub)
+	meteredItem := itemOf(sub, metered)
+	for i, quantity := range []int64{10, 30} {
+		_, err := f.NewUsageRecord(&stripe.UsageRecordParams{
+			SubscriptionItem: stripe.String(meteredItem.ID),
+			Quantity:         stripe.Int64(quantity),
+			Timestamp:        stripe.Int64(period.Start + int64(i+1)*3600),
+		})
+		if err != nil {
+			t.Fatalf("NewUsageRecord: %v", err)
+		}
+	}
+	total, err := f.lastUsageDuringPeriod(context.Background(), meteredItem.ID, period)
+	if err != nil {
+		t.Fatalf("lastUsageDuringPeriod: %v", err)
+	}
+	if total != 30 {
+		t.Fatalf("expected a usage of 30, got %d", total)
+	}
+
+	// renew, the usage of the ended period is billed in arrears
+	sub, err = f.GetSubscription(sub.ID, nil)
+	if err != nil {
+		t.Fatalf("GetSubscription: %v", err)
+	}
+	if sub.CurrentPeriodStart != period.End {
+		t.Fatalf("expected the subscription to renew at %d, got %d", period.End, sub.CurrentPeriodStart)
+	}
+	invoices, err = f.ListInvoices(&stripe.InvoiceListParams{
+		Subscription: stripe.String(sub.ID),
+	})
+	if err != nil {
+		t.Fatalf("ListInvoices: %v", err)
+	}
+	if len(invoices) != 2 || invoices[0].BillingReason != stripe.InvoiceBillingReasonSubscriptionCycle {
+		t.Fatalf("expected the subscription_cycle invoice first, got %d invoices", len(invoices))
+	}
+	if invoices[0].AmountPaid != 100+30*2 {
+		t.Fatalf("expected the renewal to bill %d, got %d", 100+30*2, invoices[0].AmountPaid)
+	}
+
+	summaries, err := f.ListUsageRecordSummaries(&stripe.UsageRecordSummaryListParams{
+		SubscriptionItem: stripe.String(meteredItem.ID),
+	})
+	if err != nil {
+		t.Fatalf("ListUsageRecordSummaries: %v", err)
+	}
+	if len(summaries) != 1 || summaries[0].TotalUsage != 0 {
+		t.Fatalf("expected no usage in the new period, got %+v", summaries)
+	}
+
+	// cancel at the end of the period
+	sub, err = f.UpdateSubscription(sub.ID, &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(true),
+	})
+	if err != nil {
+		t.Fatalf("UpdateSubscription: %v", err)
+	}
+	if sub.Status != stripe.SubscriptionStatusActive || sub.CanceledAt == 0 {
+		t.Fatalf("expected an active subscription pending cancellation, got %s", sub.Status)
+	}
+	endPeriod(t, f, sub)
+	sub, err = f.GetSubscription(sub.ID, nil)
+	if err != nil {
+		t.Fatalf("GetSubscription: %v", err)
+	}
+	if sub.Status != stripe.SubscriptionStatusCanceled || sub.EndedAt == 0 {
+		t.Fatalf("expected a canceled subscription, got %s", sub.Status)
+	}
+}
+
+func TestFakeBillingTrialWithoutPaymentMethod(t *testing.T) {
+	f := newTestFake(t)
+	licensed, _ := newTestPrices(t, f)
+	c, err := f.NewCustomer(&stripe.CustomerParams{
+		Email: stripe.String("trial@example.com"),
+	})
+	if err != nil {
+		t.Fatalf("NewCustomer: %v", err)
+	}
+
+	sub, err := f.NewSubscription(&stripe.SubscriptionParams{
+		Customer:        stripe.String(c.ID),
+		TrialPeriodDays: stripe.Int64(7),
+		Items: []*stripe.SubscriptionItemsParams{
+			{Price: stripe.String(licensed.ID), Quantity: stripe.Int64(1)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewSubscription: %v", err)
+	}
+	if sub.Status != stripe.SubscriptionStatusTrialing {
+		t.Fatalf("expected a trialing subscription, got %s", sub.Status)
+	}
+
+	// the trial ends without a payment method to charge
+	endPeriod(t, f, sub)
+	sub, err = f.GetSubscription(sub.ID, nil)
+	if err != nil {
+		t.Fatalf("GetSubscription: %v", err)
+	}
+	if sub.Status != stripe.SubscriptionStatusPastDue {
+		t.Fatalf("expected a past_due subscription, got %s", sub.Status)
+	}
+	invoices, err := f.ListInvoices(&stripe.InvoiceListParams{
+		Customer: stripe.String(c.ID),
+		Status:   stripe.String(string(stripe.InvoiceStatusOpen)),
+	})
+	if err != nil {
+		t.Fatalf("ListInvoices: %v", err)
+	}
+	if len(invoices) != 1 || invoices[0].AmountDue != 100 {
+		t.Fatalf("expected an open invoice of 100, got %d invoices", len(invoices))
+	}
+}
+
+func TestFakeBillingListOrder(t *testing.T) {
+	f := newTestFake(t)
+	var ids []string
+	for i := 0; i < 20; i++ {
+		c, err := f.NewCustomer(&stripe.CustomerParams{
+			Email: stripe.String("duplicate@example.com"),
+		})
+		if err != nil {
+			t.Fatalf("NewCustomer: %v", err)
+		}
+		ids = append(ids, c.ID)
+	}
+
+	for i := 0; i < 5; i++ {
+		var listed []string
+		err := f.list(context.Background(), fakeKindCustomer, func(data []byte) error {
+			listed = append(listed, string(data))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		if len(listed) != len(ids) {
+			t.Fatalf("expected %d customers, got %d", len(ids), len(listed))
+		}
+		// the oldest customer with the email is found, regardless of map iteration order
+		c, err := f.FindCustomerByEmail(context.Background(), "duplicate@example.com")
+		if err != nil {
+			t.Fatalf("FindCustomerByEmail: %v", err)
+		}
+		if c.ID != ids[0] {
+			t.Fatalf("expected customer %s, got %s", ids[0], c.ID)
+		}
+	}
+
+	// updates keep the position of the object
+	if _, err := f.UpdateCustomer(ids[0], &stripe.CustomerParams{
+		Name: stripe.String("Updated"),
+	}); err != nil {
+		t.Fatalf("UpdateCustomer: %v", err)
+	}
+	c, err := f.FindCustomerByEmail(context.Background(), "duplicate@example.com")
+	if err != nil {
+		t.Fatalf("FindCustomerByEmail: %v", err)
+	}
+	if c.ID != ids[0] {
+		t.Fatalf("expected customer %s after update, got %s", ids[0], c.ID)
+	}
+}
+
+func TestFakeBillingListInvoicesNewestFirst(t *testing.T) {
+	f := newTestFake(t)
+	c := newTestCustomer(t, f, "invoices@example.com")
+	licensed, _ := newTestPrices(t, f)
+
+	var subscriptions []string
+	for i := 0; i < 5; i++ {
+		sub, err := f.NewSubscription(&stripe.SubscriptionParams{
+			Customer: stripe.String(c.ID),
+			Items: []*stripe.SubscriptionItemsParams{
+				{Price: stripe.String(licensed.ID), Quantity: stripe.Int64(1)},
+			},
+		})
+		if err != nil {
+			t.Fatalf("NewSubscription: %v", err)
+		}
+		subscriptions = append(subscriptions, sub.ID)
+	}
+
+	invoices, err := f.ListInvoices(&stripe.InvoiceListParams{
+		Customer: stripe.String(c.ID),
+	})
+	if err != nil {
+		t.Fatalf("ListInvoices: %v", err)
+	}
+	if len(invoices) != len(subscriptions) {
+		t.Fatalf("expected %d invoices, got %d", len(subscriptions), len(invoices))
+	}
+	for i, invoice := range invoices {
+		if expected := subscriptions[len(subscriptions)-1-i]; invoice.Subscription.ID != expected {
+			t.Fatalf("expected invoice %d to be of subscription %s, got %s", i, expected, invoice.Subscription.ID)
+		}
+	}
+
+	// pagination continues after the last invoice of the previous page
+	page, err := f.ListInvoices(&stripe.InvoiceListParams{
+		Customer:   stripe.String(c.ID),
+		ListParams: stripe.ListParams{Limit: stripe.Int64(2), StartingAfter: stripe.String(invoices[1].ID)},
+	})
+	if err != nil {
+		t.Fatalf("ListInvoices: %v", err)
+	}
+	if len(page) != 2 || page[0].ID != invoices[2].ID || page[1].ID != invoices[3].ID {
+		t.Fatalf("unexpected second page")
+	}
+}
+
+func TestFakeBillingTaxID(t *testing.T) {
+	f := newTestFake(t)
+	c := newTestCustomer(t, f, "taxid@example.com")
+
+	for _, value := range []string{"", "D"} {
+		if _, err := f.NewTaxID(&stripe.TaxIDParams{
+			Customer: stripe.String(c.ID),
+			Type:     stripe.String(string(stripe.TaxIDTypeEUVAT)),
+			Value:    stripe.String(value),
+		}); err == nil {
+			t.Fatalf("NewTaxID with value %q: expected an error", value)
+		}
+	}
+
+	id, err := f.NewTaxID(&stripe.TaxIDParams{
+		Customer: stripe.String(c.ID),
+		Type:     stripe.String(string(stripe.TaxIDTypeEUVAT)),
+		Value:    stripe.String("DE123456789"),
+	})
+	if err != nil {
+		t.Fatalf("NewTaxID: %v", err)
+	}
+	if id.Country != "DE" {
+		t.Fatalf("expected country DE, got %s", id.Country)
+	}
+
+	// like Stripe, tax IDs are only returned when expanded
+	c, err = f.GetCustomer(c.ID, &stripe.CustomerParams{})
+	if err != nil {
+		t.Fatalf("GetCustomer: %v", err)
+	}
+	if c.TaxIDs != nil {
+		t.Fatalf("expected tax IDs to be omitted unless expanded")
+	}
+	params := &stripe.CustomerParams{}
+	params.AddExpand("tax_ids")
+	c, err = f.GetCustomer(c.ID, params)
+	if err != nil {
+		t.Fatalf("GetCustomer: %v", err)
+	}
+	if c.TaxIDs == nil || len(c.TaxIDs.Data) != 1 || c.TaxIDs.Data[0].ID != id.ID {
+		t.Fatalf("expected the tax ID when expanded")
+	}
+
+	if _, err := f.DeleteTaxID(id.ID, &stripe.TaxIDParams{
+		Customer: stripe.String(c.ID),
+	}); err != nil {
+		t.Fatalf("DeleteTaxID: %v", err)
+	}
+	c, err = f.GetCustomer(c.ID, params)
+	if err != nil {
+		t.Fatalf("GetCustomer: %v", err)
+	}
+	if c.TaxIDs != nil && len(c.TaxIDs.Data) > 0 {
+		t.Fatalf("expected no tax IDs, got %d", len(c.TaxIDs.Data))
+	}
+}
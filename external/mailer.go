@@ -0,0 +1,126 @@
+package external
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/johnsto/go-passwordless"
+	"go.uber.org/zap"
+)
+
+// Mailer sends transactional emails (e.g. budget alerts) to customers
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// Email is a multipart (text and html) email to a single recipient
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// smtpTimeout bounds sending an email if the context of Send has no deadline
+const smtpTimeout = time.Second * 30
+
+// SMTPMailer delivers emails via SMTP, with STARTTLS and authentication if the server supports them
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer returns a Mailer that delivers via the SMTP server at addr ("host:port")
+func NewSMTPMailer(addr, from string, auth smtp.Auth) *SMTPMailer {
+	return &SMTPMailer{
+		addr: addr,
+		from: from,
+		auth: auth,
+	}
+}
+
+// Send will deliver the email to Email.To, and gives up once ctx is done
+func (s *SMTPMailer) Send(ctx context.Context, email Email) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, smtpTimeout)
+		defer cancel()
+	}
+	host, _, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// net/smtp doesn't take a context, so the deadline applies to the whole conversation
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); ok && s.auth != nil {
+		if err := c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(email.To); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	e := &passwordless.Email{
+		Subject: email.Subject,
+		To:      email.To,
+	}
+	e.AddBody("text/plain", email.Text)
+	if email.HTML != "" {
+		e.AddBody("text/html", email.HTML)
+	}
+	if _, err := e.Write(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// LogMailer logs emails instead of delivering them, for use in development
+type LogMailer struct {
+	Logger *zap.Logger
+}
+
+// Send will log the email
+func (l *LogMailer) Send(ctx context.Context, email Email) error {
+	l.Logger.Info("Email not sent in development",
+		zap.String("To", email.To),
+		zap.String("Subject", email.Subject),
+		zap.String("Text", email.Text),
+	)
+	return nil
+}
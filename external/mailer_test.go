@@ -0,0 +1,41 @@
+package external
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSMTPMailerTimeout(t *testing.T) {
+	// a server which accepts connections but never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	start := time.Now()
+	err = NewSMTPMailer(l.Addr().String(), "rmc@example.com", nil).Send(ctx, Email{
+		To:      "gamer@example.com",
+		Subject: "Subject",
+		Text:    "Text",
+	})
+	if err == nil {
+		t.Fatalf("Expected an error from an unresponsive server")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("Send took %s, expected it to give up with the context", elapsed)
+	}
+}
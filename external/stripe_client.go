@@ -1,9 +1,283 @@
 package external
 
-import "github.com/stripe/stripe-go/v72/client"
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
 
-func NewStripeClient(key string) *client.API {
+	"github.com/miragespace/rmc/tracing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	stripeRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "rmc_stripe_request_duration_seconds",
+		Help: "Latency of Stripe API requests by method, path and status",
+	}, []string{"method", "path", "status"})
+	stripeRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmc_stripe_request_errors_total",
+		Help: "Stripe API requests that failed with a network error or an error status, by method and path",
+	}, []string{"method", "path"})
+)
+
+// stripeIDRegexp matches the IDs in Stripe API paths, e.g. cus_IqLeNf0ztTZ9EV or si_IqLeSgM5W4cIXV,
+// but not the resources, e.g. subscription_items, which are lowercase
+var stripeIDRegexp = regexp.MustCompile(`/[a-z]+_[a-z0-9]*[A-Z0-9][A-Za-z0-9]*`)
+
+// instrumentedTransport records the latency and errors of each request to Stripe, including the retries of
+// stripe-go, and traces the requests made with the context of a trace in the stripe.Params
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// IDs are replaced to keep the number of series bounded
+	path := stripeIDRegexp.ReplaceAllString(r.URL.Path, "/{id}")
+	_, span := tracing.StartChild(r.Context(), "stripe "+r.Method+" "+path, trace.SpanKindClient,
+		attribute.String("http.method", r.Method),
+		attribute.String("http.target", r.URL.Path),
+	)
+	defer span.End()
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		if resp.StatusCode >= http.StatusBadRequest {
+			tracing.SetError(span, errors.New(http.StatusText(resp.StatusCode)))
+		}
+	} else {
+		tracing.SetError(span, err)
+	}
+	stripeRequestDuration.WithLabelValues(r.Method, path, status).Observe(time.Since(start).Seconds())
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		stripeRequestErrors.WithLabelValues(r.Method, path).Inc()
+	}
+	return resp, err
+}
+
+// StripeClient is the BillingProvider backed by the live Stripe API
+type StripeClient struct {
+	api *client.API
+}
+
+var _ BillingProvider = &StripeClient{}
+
+// NewStripeClient returns a BillingProvider talking to Stripe with the given secret key
+func NewStripeClient(key string) *StripeClient {
 	sc := &client.API{}
-	sc.Init(key, nil)
-	return sc
+	sc.Init(key, stripe.NewBackends(&http.Client{
+		// same as the default of stripe-go
+		Timeout: 80 * time.Second,
+		Transport: &instrumentedTransport{
+			next: http.DefaultTransport,
+		},
+	}))
+	return &StripeClient{
+		api: sc,
+	}
+}
+
+// FindCustomerByEmail returns the first Stripe customer with the given email, or nil if none was found
+func (s *StripeClient) FindCustomerByEmail(ctx context.Context, email string) (*stripe.Customer, error) {
+	listParams := &stripe.CustomerListParams{
+		ListParams: stripe.ListParams{
+			Context: ctx,
+		},
+		Email: stripe.String(email),
+	}
+	listParams.Filters.AddFilter("limit", "", "1")
+	l := s.api.Customers.List(listParams)
+
+	var c *stripe.Customer
+	for l.Next() {
+		c = l.Customer()
+	}
+	if l.Err() != nil {
+		return nil, l.Err()
+	}
+	return c, nil
+}
+
+func (s *StripeClient) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return s.api.Customers.New(params)
+}
+
+func (s *StripeClient) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return s.api.Customers.Get(id, params)
+}
+
+func (s *StripeClient) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return s.api.Customers.Update(id, params)
+}
+
+func (s *StripeClient) AttachPaymentMethod(id string, params *stripe.PaymentMethodAttachParams) (*stripe.PaymentMethod, error) {
+	return s.api.PaymentMethods.Attach(id, params)
+}
+
+func (s *StripeClient) NewProduct(params *stripe.ProductParams) (*stripe.Product, error) {
+	return s.api.Products.New(params)
+}
+
+func (s *StripeClient) UpdateProduct(id string, params *stripe.ProductParams) (*stripe.Product, error) {
+	return s.api.Products.Update(id, params)
+}
+
+// FindProductByMetadata returns the first active Stripe product with the given metadata value, or nil if none was found.
+// Products cannot be filtered by metadata, therefore all active products are listed
+func (s *StripeClient) FindProductByMetadata(ctx context.Context, key, value string) (*stripe.Product, error) {
+	listParams := &stripe.ProductListParams{
+		ListParams: stripe.ListParams{
+			Context: ctx,
+		},
+		Active: stripe.Bool(true),
+	}
+	l := s.api.Products.List(listParams)
+
+	for l.Next() {
+		if p := l.Product(); p.Metadata[key] == value {
+			return p, nil
+		}
+	}
+	if l.Err() != nil {
+		return nil, l.Err()
+	}
+	return nil, nil
+}
+
+func (s *StripeClient) NewPrice(params *stripe.PriceParams) (*stripe.Price, error) {
+	return s.api.Prices.New(params)
+}
+
+// FindPriceByLookupKey returns the active Stripe price with the given lookup key, or nil if none was found
+func (s *StripeClient) FindPriceByLookupKey(ctx context.Context, lookupKey string) (*stripe.Price, error) {
+	listParams := &stripe.PriceListParams{
+		ListParams: stripe.ListParams{
+			Context: ctx,
+		},
+		Active:     stripe.Bool(true),
+		LookupKeys: stripe.StringSlice([]string{lookupKey}),
+	}
+	listParams.Filters.AddFilter("limit", "", "1")
+	l := s.api.Prices.List(listParams)
+
+	var p *stripe.Price
+	for l.Next() {
+		p = l.Price()
+	}
+	if l.Err() != nil {
+		return nil, l.Err()
+	}
+	return p, nil
+}
+
+func (s *StripeClient) UpdatePrice(id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	return s.api.Prices.Update(id, params)
+}
+
+func (s *StripeClient) NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return s.api.Subscriptions.New(params)
+}
+
+func (s *StripeClient) GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return s.api.Subscriptions.Get(id, params)
+}
+
+func (s *StripeClient) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return s.api.Subscriptions.Update(id, params)
+}
+
+func (s *StripeClient) NewUsageRecord(params *stripe.UsageRecordParams) (*stripe.UsageRecord, error) {
+	return s.api.UsageRecords.New(params)
+}
+
+// ListUsageRecordSummaries returns the first page of usage summaries of a subscription item
+func (s *StripeClient) ListUsageRecordSummaries(params *stripe.UsageRecordSummaryListParams) ([]*stripe.UsageRecordSummary, error) {
+	params.Single = true
+	l := s.api.UsageRecordSummaries.List(params)
+
+	summaries := make([]*stripe.UsageRecordSummary, 0, 1)
+	for l.Next() {
+		summaries = append(summaries, l.UsageRecordSummary())
+	}
+	if l.Err() != nil {
+		return nil, l.Err()
+	}
+	return summaries, nil
+}
+
+func (s *StripeClient) NewCoupon(params *stripe.CouponParams) (*stripe.Coupon, error) {
+	return s.api.Coupons.New(params)
+}
+
+func (s *StripeClient) NewPromotionCode(params *stripe.PromotionCodeParams) (*stripe.PromotionCode, error) {
+	return s.api.PromotionCodes.New(params)
+}
+
+// FindPromotionCode returns the active promotion code with the given code, or nil if none was found
+func (s *StripeClient) FindPromotionCode(ctx context.Context, code string) (*stripe.PromotionCode, error) {
+	listParams := &stripe.PromotionCodeListParams{
+		ListParams: stripe.ListParams{
+			Context: ctx,
+		},
+		Active: stripe.Bool(true),
+		Code:   stripe.String(code),
+	}
+	listParams.Filters.AddFilter("limit", "", "1")
+	l := s.api.PromotionCodes.List(listParams)
+
+	var p *stripe.PromotionCode
+	for l.Next() {
+		p = l.PromotionCode()
+	}
+	if l.Err() != nil {
+		return nil, l.Err()
+	}
+	return p, nil
+}
+
+func (s *StripeClient) NewTaxRate(params *stripe.TaxRateParams) (*stripe.TaxRate, error) {
+	return s.api.TaxRates.New(params)
+}
+
+func (s *StripeClient) NewTaxID(params *stripe.TaxIDParams) (*stripe.TaxID, error) {
+	return s.api.TaxIDs.New(params)
+}
+
+func (s *StripeClient) DeleteTaxID(id string, params *stripe.TaxIDParams) (*stripe.TaxID, error) {
+	return s.api.TaxIDs.Del(id, params)
+}
+
+func (s *StripeClient) NewCustomerBalanceTransaction(params *stripe.CustomerBalanceTransactionParams) (*stripe.CustomerBalanceTransaction, error) {
+	return s.api.CustomerBalanceTransactions.New(params)
+}
+
+// ListInvoices returns a single page of invoices, newest first
+func (s *StripeClient) ListInvoices(params *stripe.InvoiceListParams) ([]*stripe.Invoice, error) {
+	params.Single = true
+	l := s.api.Invoices.List(params)
+
+	invoices := make([]*stripe.Invoice, 0, 1)
+	for l.Next() {
+		invoices = append(invoices, l.Invoice())
+	}
+	if l.Err() != nil {
+		return nil, l.Err()
+	}
+	return invoices, nil
+}
+
+func (s *StripeClient) GetInvoice(id string, params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	return s.api.Invoices.Get(id, params)
 }
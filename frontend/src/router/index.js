@@ -11,6 +11,11 @@ const routes = [
         name: 'Home',
         component: Home
     },
+    {
+        path: '/login/oidc/:provider',
+        name: 'OIDCCallback',
+        component: () => import('../views/VerifyToken.vue')
+    },
     {
         path: '/login/:uid/:token',
         name: 'VerifyToken',
@@ -6,13 +6,82 @@ function getHeader(context, payload) {
         credentials: "include",
         headers: {
             "Content-Type": "application/json",
-            "Authorization": "Bearer " + context.state.accessToken
+            "Authorization": "Bearer " + context.state.accessToken,
+            ...payload.headers
         },
     };
+    if (payload.signal) {
+        req.signal = payload.signal
+    }
     if (method != 'GET') {
         req.body = JSON.stringify(payload.body)
     }
     return req
 }
 
-export { getHeader }
\ No newline at end of file
+// watchInstanceEvents streams the state changes of instances from /instances/events, reconnecting with
+// Last-Event-ID when the stream ends. EventSource cannot send the access token, so the stream is read with fetch.
+// Returns a function to stop watching
+function watchInstanceEvents(store, onEvent) {
+    let controller = new AbortController()
+    let lastEventId = null
+    let retry = 3000
+
+    const dispatch = (frame) => {
+        let id = null, event = "message", data = []
+        for (const line of frame.split("\n")) {
+            if (line.startsWith(":")) continue
+            const idx = line.indexOf(":")
+            const field = idx < 0 ? line : line.slice(0, idx)
+            const value = idx < 0 ? "" : line.slice(idx + 1).replace(/^ /, "")
+            if (field === "id") id = value
+            else if (field === "event") event = value
+            else if (field === "data") data.push(value)
+            else if (field === "retry" && /^\d+$/.test(value)) retry = parseInt(value)
+        }
+        if (id !== null) lastEventId = id
+        if (event === "state" && data.length > 0) {
+            onEvent(JSON.parse(data.join("\n")))
+        }
+    }
+
+    const connect = async () => {
+        while (!controller.signal.aborted) {
+            try {
+                let headers = { "Accept": "text/event-stream" }
+                if (lastEventId) headers["Last-Event-ID"] = lastEventId
+                let resp = await store.dispatch({
+                    type: "makeAuthenticatedRequest",
+                    method: "GET",
+                    endpoint: "/instances/events",
+                    headers: headers,
+                    signal: controller.signal,
+                })
+                if (resp.status === 200) {
+                    let reader = resp.body.getReader()
+                    let decoder = new TextDecoder()
+                    let buffer = ""
+                    for (;;) {
+                        let { done, value } = await reader.read()
+                        if (done) break
+                        buffer += decoder.decode(value, { stream: true })
+                        let frames = buffer.split("\n\n")
+                        buffer = frames.pop()
+                        frames.forEach(dispatch)
+                    }
+                } else if (resp.status === 400) {
+                    // the cursor is invalid, start over
+                    lastEventId = null
+                }
+            } catch (err) {
+                if (controller.signal.aborted) return
+            }
+            await new Promise((resolve) => setTimeout(resolve, retry))
+        }
+    }
+    connect()
+
+    return () => controller.abort()
+}
+
+export { getHeader, watchInstanceEvents }
@@ -24,14 +24,24 @@ export default new Vuex.Store({
             state.refreshToken = payload.refreshToken
             localStorage.setItem('accessToken', payload.accessToken)
             localStorage.setItem('refreshToken', payload.refreshToken)
-        },
-        updateAccessToken(state, payload) {
-            state.accessToken = payload.accessToken
-            localStorage.setItem('accessToken', payload.accessToken)
         }
     },
     actions: {
         logout(context) {
+            if (context.state.refreshToken !== '') {
+                // end the session server-side, but do not wait for it
+                fetch(BASE_URL + '/auth/logout', {
+                    method: 'POST',
+                    mode: 'cors',
+                    credentials: "include",
+                    headers: {
+                        "Content-Type": "application/json"
+                    },
+                    body: JSON.stringify({
+                        refreshToken: context.state.refreshToken
+                    })
+                }).catch(() => {})
+            }
             context.state.accessToken = ''
             context.state.refreshToken = ''
             localStorage.removeItem('accessToken')
@@ -69,6 +79,35 @@ export default new Vuex.Store({
                 }
             }
         },
+        async requestOIDCTokens(context, payload) {
+            let req = {
+                method: 'POST',
+                mode: 'cors',
+                credentials: "include",
+                headers: {
+                    "Content-Type": "application/json"
+                },
+                body: JSON.stringify({
+                    code: payload.code,
+                    state: payload.state
+                })
+            }
+            let resp = await fetch(BASE_URL + '/auth/oidc/' + encodeURIComponent(payload.provider) + '/tokens', req)
+            let json = await resp.json()
+            if (resp.status === 200) {
+                context.commit({
+                    type: "setTokens",
+                    accessToken: json.result.accessToken,
+                    refreshToken: json.result.refreshToken,
+                })
+            } else {
+                throw {
+                    apiError: true,
+                    err: json.error,
+                    message: json.messages.join(' - ')
+                }
+            }
+        },
         async refreshSession(context) {
             let req = {
                 method: 'POST',
@@ -84,9 +123,33 @@ export default new Vuex.Store({
             let resp = await fetch(BASE_URL + '/auth/refresh', req)
             let json = await resp.json()
             if (resp.status === 200) {
+                // refresh tokens are rotated on every use
                 context.commit({
-                    type: "updateAccessToken",
-                    accessToken: json.result.accessToken
+                    type: "setTokens",
+                    accessToken: json.result.accessToken,
+                    refreshToken: json.result.refreshToken,
+                })
+            } else {
+                throw {
+                    apiError: true,
+                    error: json.error,
+                    message: json.messages.join(' - ')
+                }
+            }
+        },
+        async stepUp(context, payload) {
+            let resp = await fetch(BASE_URL + '/customers/2fa/verify', getHeader(context, {
+                method: 'POST',
+                body: {
+                    code: payload.code
+                }
+            }))
+            let json = await resp.json()
+            if (resp.status === 200) {
+                context.commit({
+                    type: "setTokens",
+                    accessToken: json.result.accessToken,
+                    refreshToken: context.state.refreshToken,
                 })
             } else {
                 throw {
@@ -98,7 +161,22 @@ export default new Vuex.Store({
         },
         async makeAuthenticatedRequest(context, payload) {
             let resp = await fetch(BASE_URL + payload.endpoint, getHeader(context, payload));
-            if (resp.status === 401) {
+            if (resp.status === 403) {
+                // destructive actions require a code when two-factor authentication is enabled
+                let json = await resp.clone().json().catch(() => ({}))
+                if (json.error !== 'Step-up verification required') {
+                    return resp
+                }
+                let code = window.prompt('Enter a code from your authenticator app, or a recovery code')
+                if (!code) {
+                    return resp
+                }
+                await context.dispatch({
+                    type: 'stepUp',
+                    code: code
+                })
+                return fetch(BASE_URL + payload.endpoint, getHeader(context, payload))
+            } else if (resp.status === 401) {
                 console.log("expired access token")
                 try {
                     await context.dispatch({
@@ -0,0 +1,26 @@
+package health
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v7"
+	"gorm.io/gorm"
+)
+
+// Postgres checks that a connection to the database can be used
+func Postgres(db *gorm.DB) Check {
+	return func(ctx context.Context) error {
+		pool, err := db.DB()
+		if err != nil {
+			return err
+		}
+		return pool.PingContext(ctx)
+	}
+}
+
+// Redis checks that Redis answers a PING
+func Redis(rdb redis.UniversalClient) Check {
+	return func(ctx context.Context) error {
+		return rdb.DoContext(ctx, "ping").Err()
+	}
+}
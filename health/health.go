@@ -0,0 +1,134 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds each check, so a hanging dependency fails the probe instead of timing it out
+const checkTimeout = 3 * time.Second
+
+// Check returns an error if the dependency is unusable
+type Check func(ctx context.Context) error
+
+type check struct {
+	name     string
+	fn       Check
+	critical bool
+}
+
+// Checker serves the liveness (/healthz) and readiness (/readyz) probes of a binary
+type Checker struct {
+	mu     sync.RWMutex
+	checks []check
+}
+
+// NewChecker returns a Checker without checks, always ready
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Add registers a check of a dependency the binary cannot work without, e.g. Postgres
+func (c *Checker) Add(name string, fn Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name: name, fn: fn, critical: true})
+}
+
+// AddInformational registers a check reported by /readyz which does not fail readiness,
+// e.g. the heartbeats of the hosts, as restarting the binary would not help
+func (c *Checker) AddInformational(name string, fn Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name: name, fn: fn, critical: false})
+}
+
+// Result is the outcome of a check, as reported by /readyz
+type Result struct {
+	Status     string  `json:"status"` // ok or failing
+	Error      string  `json:"error,omitempty"`
+	Critical   bool    `json:"critical"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// Report is the body of /readyz
+type Report struct {
+	Status string            `json:"status"` // ok, degraded if only informational checks fail, or unavailable
+	Checks map[string]Result `json:"checks"`
+}
+
+// Run performs the checks concurrently and returns the Report
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.RLock()
+	checks := make([]check, len(c.checks))
+	copy(checks, c.checks)
+	c.mu.RUnlock()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+			start := time.Now()
+			err := checks[i].fn(checkCtx)
+			results[i] = Result{
+				Status:     "ok",
+				Critical:   checks[i].critical,
+				DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if err != nil {
+				results[i].Status = "failing"
+				results[i].Error = err.Error()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	report := Report{
+		Status: "ok",
+		Checks: make(map[string]Result, len(checks)),
+	}
+	for i, check := range checks {
+		report.Checks[check.name] = results[i]
+		if results[i].Status == "ok" {
+			continue
+		}
+		if check.critical {
+			report.Status = "unavailable"
+		} else if report.Status == "ok" {
+			report.Status = "degraded"
+		}
+	}
+	return report
+}
+
+// Handlers returns the probes by path, to be served on the metrics listener
+func (c *Checker) Handlers() map[string]http.Handler {
+	return map[string]http.Handler{
+		// the binary is alive as long as it can serve requests, dependencies are only checked for readiness
+		"/healthz": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		}),
+		"/readyz": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			report := c.Run(r.Context())
+			status := http.StatusOK
+			if report.Status == "unavailable" {
+				status = http.StatusServiceUnavailable
+			}
+			writeJSON(w, status, report)
+		}),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
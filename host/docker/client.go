@@ -1,23 +1,31 @@
 package docker
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miragespace/rmc/spec"
 	"github.com/miragespace/rmc/spec/protocol"
+	"github.com/miragespace/rmc/tracing"
 	"github.com/miragespace/rmc/util"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	extErrors "github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -48,14 +56,24 @@ func NewClient(option Options) (*Client, error) {
 	}, nil
 }
 
-func (c *Client) ProvisionInstance(ctx context.Context, p *protocol.Instance) (int, error) {
+// startSpan starts the span of a Docker operation on the instance, if ctx is part of a trace
+func startSpan(ctx context.Context, operation string, p *protocol.Instance) (context.Context, trace.Span) {
+	return tracing.StartChild(ctx, "docker "+operation, trace.SpanKindClient,
+		attribute.String("rmc.instance_id", p.GetID()),
+	)
+}
+
+func (c *Client) ProvisionInstance(ctx context.Context, p *protocol.Instance) (exposedPort int, err error) {
+	ctx, span := startSpan(ctx, "ProvisionInstance", p)
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
 
 	// Reference: https://medium.com/backendarmy/controlling-the-docker-engine-in-go-d25fc0fe2c45
-	var err error
 	var mcServerPort string
 	var mcServerImage string
 	var mcPortType string
-	var exposedPort int
 	var instanceParams spec.Parameters
 
 	instanceParams.FromProto(p.GetParameters())
@@ -139,7 +157,13 @@ func (c *Client) ProvisionInstance(ctx context.Context, p *protocol.Instance) (i
 	return exposedPort, nil
 }
 
-func (c *Client) DeleteInstance(ctx context.Context, p *protocol.Instance) error {
+func (c *Client) DeleteInstance(ctx context.Context, p *protocol.Instance) (err error) {
+	ctx, span := startSpan(ctx, "DeleteInstance", p)
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
+
 	containerID, err := c.getContainerID(ctx, p.GetID())
 	if err != nil {
 		return extErrors.Wrap(err, "Cannot delete instance")
@@ -180,7 +204,13 @@ func (c *Client) getContainerID(ctx context.Context, instanceID string) (string,
 	return id, nil
 }
 
-func (c *Client) StopInstance(ctx context.Context, p *protocol.Instance) error {
+func (c *Client) StopInstance(ctx context.Context, p *protocol.Instance) (err error) {
+	ctx, span := startSpan(ctx, "StopInstance", p)
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
+
 	containerID, err := c.getContainerID(ctx, p.GetID())
 	if err != nil {
 		return extErrors.Wrap(err, "Cannot stop instance")
@@ -196,7 +226,13 @@ func (c *Client) StopInstance(ctx context.Context, p *protocol.Instance) error {
 	return nil
 }
 
-func (c *Client) StartInstance(ctx context.Context, p *protocol.Instance) error {
+func (c *Client) StartInstance(ctx context.Context, p *protocol.Instance) (err error) {
+	ctx, span := startSpan(ctx, "StartInstance", p)
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
+
 	containerID, err := c.getContainerID(ctx, p.GetID())
 	if err != nil {
 		return extErrors.Wrap(err, "Cannot start instance")
@@ -211,6 +247,49 @@ func (c *Client) StartInstance(ctx context.Context, p *protocol.Instance) error
 	return nil
 }
 
+// Ping checks that the Docker daemon can be reached
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.Client.Ping(ctx)
+	return err
+}
+
+// Container describes the container of a managed instance
+type Container struct {
+	InstanceID  string
+	ContainerID string
+	Image       string
+	State       string // e.g. running or exited
+	Status      string // e.g. Up 2 hours
+	Created     time.Time
+}
+
+// ListInstances returns the containers of the managed instances, including stopped ones
+func (c *Client) ListInstances(ctx context.Context) ([]Container, error) {
+	containers, err := c.Client.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+	})
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot list containers")
+	}
+
+	instances := make([]Container, 0, len(containers))
+	for _, container := range containers {
+		for _, name := range container.Names {
+			if strings.HasPrefix(name, dockerPrefix) {
+				instances = append(instances, Container{
+					InstanceID:  name[dockerPrefixLen:],
+					ContainerID: container.ID,
+					Image:       container.Image,
+					State:       container.State,
+					Status:      container.Status,
+					Created:     time.Unix(container.Created, 0),
+				})
+			}
+		}
+	}
+	return instances, nil
+}
+
 type Stats struct {
 	Running          int64
 	Stopped          int64
@@ -247,3 +326,190 @@ func (c *Client) StatsInstances(ctx context.Context) (stats Stats, err error) {
 
 	return
 }
+
+// Metrics describes the resource usage and counters of a running instance
+type Metrics struct {
+	InstanceID       string
+	StorageBytes     int64   // size of the container's writable layer
+	CPUPercent       float64 // where 100 is one core
+	MemoryBytes      int64   // excluding page cache
+	MemoryLimitBytes int64
+	NetworkRxBytes   uint64 // bytes received since the container started
+	NetworkTxBytes   uint64 // bytes sent since the container started
+	DiskReadBytes    uint64 // bytes read since the container started
+	DiskWriteBytes   uint64 // bytes written since the container started
+	Players          int64  // number of players online
+}
+
+// "localhost:25565 : version=1.16.4 online=2 max=3 motd='A Minecraft Server'"
+var onlinePlayersRegexp = regexp.MustCompile(`online=(\d+)`)
+
+const (
+	// metricsCallTimeout bounds each Docker API call made to collect metrics, so a hanging container
+	// (e.g. an exec that never returns) only loses its own metrics
+	metricsCallTimeout = 10 * time.Second
+	// metricsConcurrency is how many containers are inspected at the same time, as stats take about a second each
+	metricsConcurrency = 4
+)
+
+// MetricsInstances returns the metrics of the running instances. This takes a few seconds,
+// so it should not be called on the heartbeat path
+func (c *Client) MetricsInstances(ctx context.Context) ([]Metrics, error) {
+	listCtx, cancel := context.WithTimeout(ctx, metricsCallTimeout)
+	defer cancel()
+	containers, err := c.Client.ContainerList(listCtx, types.ContainerListOptions{
+		Size: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	metrics := make([]Metrics, 0, 2)
+	concurrentSemaphore := make(chan struct{}, metricsConcurrency)
+
+	for _, container := range containers {
+		for _, name := range container.Names {
+			if !strings.HasPrefix(name, dockerPrefix) || container.State != "running" {
+				continue
+			}
+			wg.Add(1)
+			concurrentSemaphore <- struct{}{}
+			go func(container types.Container, instanceID string) {
+				defer func() {
+					<-concurrentSemaphore
+					wg.Done()
+				}()
+				m := c.containerMetrics(ctx, container, instanceID)
+				mu.Lock()
+				metrics = append(metrics, m)
+				mu.Unlock()
+			}(container, name[dockerPrefixLen:])
+		}
+	}
+	wg.Wait()
+
+	return metrics, nil
+}
+
+// containerMetrics collects the metrics of a single container. Failures are logged, and leave the metric at zero
+func (c *Client) containerMetrics(ctx context.Context, container types.Container, instanceID string) Metrics {
+	m := Metrics{
+		InstanceID:   instanceID,
+		StorageBytes: container.SizeRw,
+	}
+	statsCtx, cancel := context.WithTimeout(ctx, metricsCallTimeout)
+	defer cancel()
+	if err := c.containerStats(statsCtx, container.ID, &m); err != nil {
+		c.Logger.Warn("Cannot get resource stats of instance",
+			zap.String("InstanceID", m.InstanceID),
+			zap.Error(err),
+		)
+	}
+	execCtx, cancel := context.WithTimeout(ctx, metricsCallTimeout)
+	defer cancel()
+	players, err := c.onlinePlayers(execCtx, container.ID, container.Image)
+	if err != nil {
+		c.Logger.Warn("Cannot get online players of instance",
+			zap.String("InstanceID", m.InstanceID),
+			zap.Error(err),
+		)
+	}
+	m.Players = players
+	return m
+}
+
+// containerStats fills the resource usage of the container in m, using the same calculations as docker stats
+func (c *Client) containerStats(ctx context.Context, containerID string, m *Metrics) error {
+	resp, err := c.Client.ContainerStats(ctx, containerID, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var stats types.StatsJSON
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return extErrors.Wrap(err, "Cannot decode container stats")
+	}
+
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	onlineCPUs := float64(stats.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		m.CPUPercent = cpuDelta / systemDelta * onlineCPUs * 100
+	}
+
+	memory := stats.MemoryStats.Usage
+	// page cache can be reclaimed, so it is not counted (cgroup v1 and v2 respectively)
+	if cache, ok := stats.MemoryStats.Stats["cache"]; ok && cache <= memory {
+		memory -= cache
+	} else if inactive, ok := stats.MemoryStats.Stats["inactive_file"]; ok && inactive <= memory {
+		memory -= inactive
+	}
+	m.MemoryBytes = int64(memory)
+	m.MemoryLimitBytes = int64(stats.MemoryStats.Limit)
+
+	for _, network := range stats.Networks {
+		m.NetworkRxBytes += network.RxBytes
+		m.NetworkTxBytes += network.TxBytes
+	}
+	for _, entry := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			m.DiskReadBytes += entry.Value
+		case "write":
+			m.DiskWriteBytes += entry.Value
+		}
+	}
+	return nil
+}
+
+// HostResources returns the number of CPU cores and the total memory available to docker
+func (c *Client) HostResources(ctx context.Context) (cpus int64, memoryBytes int64, err error) {
+	info, err := c.Client.Info(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(info.NCPU), info.MemTotal, nil
+}
+
+// onlinePlayers asks the server inside the container via mc-monitor, which is bundled in both images
+func (c *Client) onlinePlayers(ctx context.Context, containerID, image string) (int64, error) {
+	cmd := []string{"mc-monitor", "status"}
+	if strings.HasPrefix(image, spec.BedrockMinecraftDockerImage) {
+		cmd = []string{"mc-monitor", "status-bedrock", "--host", "127.0.0.1"}
+	}
+
+	exec, err := c.Client.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, extErrors.Wrap(err, "Cannot create exec")
+	}
+	attach, err := c.Client.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return 0, extErrors.Wrap(err, "Cannot attach to exec")
+	}
+	defer attach.Close()
+	// reading the hijacked connection does not observe ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		attach.Conn.SetReadDeadline(deadline)
+	}
+
+	var stdout bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, ioutil.Discard, attach.Reader); err != nil {
+		return 0, extErrors.Wrap(err, "Cannot read exec output")
+	}
+
+	match := onlinePlayersRegexp.FindSubmatch(stdout.Bytes())
+	if match == nil {
+		return 0, fmt.Errorf("Unexpected mc-monitor output: %s", stdout.String())
+	}
+	return strconv.ParseInt(string(match[1]), 10, 64)
+}
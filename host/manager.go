@@ -33,7 +33,7 @@ type Manager struct {
 
 // NewManager returns a new Manager for hosts
 func NewManager(logger *zap.Logger, db *gorm.DB) (*Manager, error) {
-	if err := db.AutoMigrate(&Host{}); err != nil {
+	if err := db.AutoMigrate(&Host{}, &ResourceSample{}); err != nil {
 		return nil, extErrors.Wrap(err, "Cannot initilize host.Manager")
 	}
 	return &Manager{
@@ -99,6 +99,20 @@ func (m *Manager) List(ctx context.Context) ([]Host, error) {
 	return results, nil
 }
 
+// CheckHeartbeats returns an error if hosts are registered but none of them is Alive,
+// e.g. because the workers, or the processing of their heartbeats, are down
+func (m *Manager) CheckHeartbeats(ctx context.Context) error {
+	hosts, err := m.List(ctx)
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot list hosts")
+	}
+	if len(hosts) == 0 || hosts[0].Alive() {
+		return nil
+	}
+	// hosts are ordered by their last heartbeat
+	return fmt.Errorf("No heartbeat from any host since %s", hosts[0].LastHeartbeat.Format(time.RFC3339))
+}
+
 // ProcessHeartbeat will process the heartbeats from hosts and update their status
 func (m *Manager) ProcessHeartbeat(ctx context.Context, p *protocol.Heartbeat) error {
 	host := p.GetHost()
@@ -0,0 +1,325 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/miragespace/rmc/metrics"
+	"github.com/miragespace/rmc/spec/protocol"
+
+	extErrors "github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SampleSource is the custom type to define what a ResourceSample describes
+type SampleSource string
+
+// Define the valid sources of samples
+const (
+	SourceHost     SampleSource = "host"     // SourceID is the Host Name
+	SourceInstance SampleSource = "instance" // SourceID is the Instance ID
+)
+
+// resolution is the width of the buckets samples are downsampled to, and how long they are kept
+type resolution struct {
+	step      time.Duration
+	retention time.Duration
+}
+
+// resolutions are sorted from the finest to the coarsest. Every heartbeat is recorded in each of them
+var resolutions = []resolution{
+	{step: time.Minute, retention: time.Hour * 48},
+	{step: time.Hour, retention: time.Hour * 24 * 90},
+}
+
+const (
+	// MaxMetricsRange is the longest range of a query, which is the retention of the coarsest resolution
+	MaxMetricsRange = time.Hour * 24 * 90
+	// maxPoints is the number of points a query returns at most, samples are aggregated further to fit
+	maxPoints = 300
+)
+
+// ResourceSample is the aggregate of the metrics reported in the heartbeats within a bucket
+type ResourceSample struct {
+	Source           SampleSource `gorm:"primaryKey"`
+	SourceID         string       `gorm:"primaryKey"`
+	Step             int64        `gorm:"primaryKey;autoIncrement:false"` // width of the bucket in seconds
+	Bucket           time.Time    `gorm:"primaryKey"`                     // start of the bucket
+	Heartbeats       int64        // number of heartbeats within the bucket, to compute averages
+	CPUPercentSum    float64
+	CPUPercentMax    float64
+	MemoryBytesSum   int64
+	MemoryBytesMax   int64
+	MemoryLimitBytes int64 // Memory limit of the instance, or the total memory of the host
+	CPUs             int64 // SourceHost only
+	NetworkRxBytes   int64
+	NetworkTxBytes   int64
+	DiskReadBytes    int64
+	DiskWriteBytes   int64
+	StorageBytes     int64 // maximum within the bucket
+	Players          int64 // maximum within the bucket
+}
+
+// MetricsPoint is the aggregate of the metrics within a step of MetricsSeries
+type MetricsPoint struct {
+	Time             time.Time `json:"time"`
+	CPUPercent       float64   `json:"cpuPercent"` // average, where 100 is one core
+	CPUPercentMax    float64   `json:"cpuPercentMax"`
+	MemoryBytes      int64     `json:"memoryBytes"` // average
+	MemoryBytesMax   int64     `json:"memoryBytesMax"`
+	MemoryLimitBytes int64     `json:"memoryLimitBytes"`
+	CPUs             int64     `json:"cpus,omitempty"`
+	NetworkRxBytes   int64     `json:"networkRxBytes"` // total within the step
+	NetworkTxBytes   int64     `json:"networkTxBytes"`
+	DiskReadBytes    int64     `json:"diskReadBytes"`
+	DiskWriteBytes   int64     `json:"diskWriteBytes"`
+	StorageBytes     int64     `json:"storageBytes"`
+	Players          int64     `json:"players"`
+}
+
+// MetricsSeries is the time series of the metrics of a source. Steps without heartbeats are omitted
+type MetricsSeries struct {
+	From        time.Time      `json:"from"`
+	To          time.Time      `json:"to"`
+	StepSeconds int64          `json:"stepSeconds"`
+	Points      []MetricsPoint `json:"points"`
+}
+
+func truncate(t time.Time, step time.Duration) time.Time {
+	return t.UTC().Truncate(step)
+}
+
+func instanceSample(m *protocol.InstanceMetrics) ResourceSample {
+	return ResourceSample{
+		Source:           SourceInstance,
+		SourceID:         m.GetInstanceID(),
+		Heartbeats:       1,
+		CPUPercentSum:    m.GetCPUPercent(),
+		CPUPercentMax:    m.GetCPUPercent(),
+		MemoryBytesSum:   m.GetMemoryBytes(),
+		MemoryBytesMax:   m.GetMemoryBytes(),
+		MemoryLimitBytes: m.GetMemoryLimitBytes(),
+		NetworkRxBytes:   m.GetNetworkRxBytes(),
+		NetworkTxBytes:   m.GetNetworkTxBytes(),
+		DiskReadBytes:    m.GetDiskReadBytes(),
+		DiskWriteBytes:   m.GetDiskWriteBytes(),
+		StorageBytes:     m.GetStorageBytes(),
+		Players:          m.GetPlayers(),
+	}
+}
+
+func hostSample(name string, m *protocol.HostMetrics) ResourceSample {
+	return ResourceSample{
+		Source:           SourceHost,
+		SourceID:         name,
+		Heartbeats:       1,
+		CPUPercentSum:    m.GetCPUPercent(),
+		CPUPercentMax:    m.GetCPUPercent(),
+		MemoryBytesSum:   m.GetMemoryBytes(),
+		MemoryBytesMax:   m.GetMemoryBytes(),
+		MemoryLimitBytes: m.GetMemoryTotalBytes(),
+		CPUs:             m.GetCPUs(),
+		NetworkRxBytes:   m.GetNetworkRxBytes(),
+		NetworkTxBytes:   m.GetNetworkTxBytes(),
+		DiskReadBytes:    m.GetDiskReadBytes(),
+		DiskWriteBytes:   m.GetDiskWriteBytes(),
+		StorageBytes:     m.GetStorageBytes(),
+	}
+}
+
+// RecordMetrics will add the metrics of the heartbeat, sampled at timestamp, to the buckets of each resolution
+func (m *Manager) RecordMetrics(ctx context.Context, p *protocol.Heartbeat, timestamp time.Time) error {
+	current := make([]ResourceSample, 0, len(p.GetInstanceMetrics())+1)
+	seen := make(map[string]bool)
+	for _, im := range p.GetInstanceMetrics() {
+		// a row cannot be upserted twice in the same statement
+		if len(im.GetInstanceID()) == 0 || seen[im.GetInstanceID()] {
+			continue
+		}
+		seen[im.GetInstanceID()] = true
+		current = append(current, instanceSample(im))
+	}
+	if hm := p.GetHostMetrics(); hm != nil {
+		current = append(current, hostSample(p.GetHost().GetName(), hm))
+	}
+	if len(current) == 0 {
+		return nil
+	}
+
+	samples := make([]ResourceSample, 0, len(current)*len(resolutions))
+	for _, res := range resolutions {
+		for _, s := range current {
+			s.Step = int64(res.step / time.Second)
+			s.Bucket = truncate(timestamp, res.step)
+			samples = append(samples, s)
+		}
+	}
+
+	// heartbeats may be processed concurrently by multiple task replicas, so the buckets are updated atomically
+	result := m.db.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "source"}, {Name: "source_id"}, {Name: "step"}, {Name: "bucket"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"heartbeats":         gorm.Expr("resource_samples.heartbeats + excluded.heartbeats"),
+				"cpu_percent_sum":    gorm.Expr("resource_samples.cpu_percent_sum + excluded.cpu_percent_sum"),
+				"cpu_percent_max":    gorm.Expr("GREATEST(resource_samples.cpu_percent_max, excluded.cpu_percent_max)"),
+				"memory_bytes_sum":   gorm.Expr("resource_samples.memory_bytes_sum + excluded.memory_bytes_sum"),
+				"memory_bytes_max":   gorm.Expr("GREATEST(resource_samples.memory_bytes_max, excluded.memory_bytes_max)"),
+				"memory_limit_bytes": gorm.Expr("excluded.memory_limit_bytes"),
+				"cpus":               gorm.Expr("excluded.cpus"),
+				"network_rx_bytes":   gorm.Expr("resource_samples.network_rx_bytes + excluded.network_rx_bytes"),
+				"network_tx_bytes":   gorm.Expr("resource_samples.network_tx_bytes + excluded.network_tx_bytes"),
+				"disk_read_bytes":    gorm.Expr("resource_samples.disk_read_bytes + excluded.disk_read_bytes"),
+				"disk_write_bytes":   gorm.Expr("resource_samples.disk_write_bytes + excluded.disk_write_bytes"),
+				"storage_bytes":      gorm.Expr("GREATEST(resource_samples.storage_bytes, excluded.storage_bytes)"),
+				"players":            gorm.Expr("GREATEST(resource_samples.players, excluded.players)"),
+			}),
+		}).
+		Create(&samples)
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot record metrics")
+	}
+	return nil
+}
+
+// GetMetrics returns the time series of the source between from and to. The finest resolution
+// still retained for the range is used, and samples are aggregated further to return at most 300 points
+func (m *Manager) GetMetrics(ctx context.Context, source SampleSource, sourceID string, from, to time.Time) (*MetricsSeries, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+	res := resolutions[len(resolutions)-1]
+	for _, r := range resolutions {
+		if time.Since(from) <= r.retention {
+			res = r
+			break
+		}
+	}
+	step := res.step
+	if perPoint := to.Sub(from) / maxPoints; perPoint > step {
+		// round up to a multiple of the resolution
+		step = (perPoint + res.step - 1) / res.step * res.step
+	}
+	stepSeconds := int64(step / time.Second)
+
+	points := make([]MetricsPoint, 0, maxPoints)
+	result := m.db.WithContext(ctx).Raw(`SELECT
+			to_timestamp(floor(extract(epoch from bucket) / @step) * @step) AS time,
+			(SUM(cpu_percent_sum) / SUM(heartbeats))::float8 AS cpu_percent,
+			MAX(cpu_percent_max) AS cpu_percent_max,
+			(SUM(memory_bytes_sum) / SUM(heartbeats))::bigint AS memory_bytes,
+			MAX(memory_bytes_max) AS memory_bytes_max,
+			MAX(memory_limit_bytes) AS memory_limit_bytes,
+			MAX(cpus) AS cpus,
+			SUM(network_rx_bytes)::bigint AS network_rx_bytes,
+			SUM(network_tx_bytes)::bigint AS network_tx_bytes,
+			SUM(disk_read_bytes)::bigint AS disk_read_bytes,
+			SUM(disk_write_bytes)::bigint AS disk_write_bytes,
+			MAX(storage_bytes) AS storage_bytes,
+			MAX(players) AS players
+		FROM resource_samples
+		WHERE source = @source AND source_id = @sourceID AND step = @resolution AND bucket >= @from AND bucket < @to AND heartbeats > 0
+		GROUP BY 1
+		ORDER BY 1 ASC`,
+		map[string]interface{}{
+			"step":       stepSeconds,
+			"source":     source,
+			"sourceID":   sourceID,
+			"resolution": int64(res.step / time.Second),
+			"from":       truncate(from, res.step),
+			"to":         to,
+		}).Scan(&points)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot get metrics")
+	}
+	return &MetricsSeries{
+		From:        from,
+		To:          to,
+		StepSeconds: stepSeconds,
+		Points:      points,
+	}, nil
+}
+
+// PruneMetrics will delete the samples older than the retention of their resolution
+func (m *Manager) PruneMetrics(ctx context.Context) (int64, error) {
+	var count int64
+	for _, res := range resolutions {
+		result := m.db.WithContext(ctx).
+			Where("step = ? AND bucket < ?", int64(res.step/time.Second), time.Now().Add(-res.retention)).
+			Delete(&ResourceSample{})
+		if result.Error != nil {
+			return count, extErrors.Wrap(result.Error, "Cannot prune metrics")
+		}
+		count += result.RowsAffected
+	}
+	return count, nil
+}
+
+// HandleMetricsRetention will prune the metrics hourly in the background
+func (m *Manager) HandleMetricsRetention(ctx context.Context) {
+	m.logger.Info("Host metrics retention: " + resolutions[len(resolutions)-1].retention.String())
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		for {
+			count, err := m.PruneMetrics(ctx)
+			if err != nil {
+				m.logger.Error("Unable to prune metrics",
+					zap.Error(err),
+				)
+			} else if count > 0 {
+				m.logger.Info("Pruned metrics",
+					zap.Int64("Count", count),
+				)
+			}
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// ParseMetricsRange returns the time range of a metrics query, from the range (a duration, 24h by default)
+// and to (RFC 3339, now by default) params of the request
+func ParseMetricsRange(r *http.Request) (from, to time.Time, err error) {
+	to = time.Now()
+	if t := r.URL.Query().Get("to"); t != "" {
+		to, err = time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return from, to, fmt.Errorf("Invalid to param")
+		}
+	}
+	length := time.Hour * 24
+	if l := r.URL.Query().Get("range"); l != "" {
+		length, err = time.ParseDuration(l)
+		if err != nil || length < time.Minute || length > MaxMetricsRange {
+			return from, to, fmt.Errorf("range must be a duration between 1m and 2160h (90 days)")
+		}
+	}
+	return to.Add(-length), to, nil
+}
+
+// RegisterMetrics will expose the age of the last heartbeat of each host on /metrics. It must be called once
+func (m *Manager) RegisterMetrics() {
+	metrics.NewGaugeFunc("rmc_host_heartbeat_age_seconds", "Seconds since the last heartbeat of each host", []string{"host"}, func(ctx context.Context) []metrics.Sample {
+		hosts, err := m.List(ctx)
+		if err != nil {
+			return nil
+		}
+		samples := make([]metrics.Sample, 0, len(hosts))
+		for _, h := range hosts {
+			samples = append(samples, metrics.Sample{
+				LabelValues: []string{h.Name},
+				Value:       time.Since(h.LastHeartbeat).Seconds(),
+			})
+		}
+		return samples
+	})
+}
@@ -3,7 +3,9 @@ package host
 import (
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/miragespace/rmc/auth"
 	resp "github.com/miragespace/rmc/response"
 
 	"github.com/go-chi/chi"
@@ -59,11 +61,98 @@ func (s *Service) listHosts(w http.ResponseWriter, r *http.Request) {
 	resp.WriteResponse(w, r, publicResults)
 }
 
+// Detail describes a Host to admins
+type Detail struct {
+	Name          string         `json:"name"`
+	IsAlive       bool           `json:"isAlive"`
+	Running       int64          `json:"running"`
+	Stopped       int64          `json:"stopped"`
+	Capacity      int64          `json:"capacity"`
+	LastHeartbeat time.Time      `json:"lastHeartbeat"`
+	FirstSeen     time.Time      `json:"firstSeen"`
+	Metrics       *MetricsSeries `json:"metrics,omitempty"`
+}
+
+func newDetail(h *Host) Detail {
+	return Detail{
+		Name:          h.Name,
+		IsAlive:       h.Alive(),
+		Running:       h.Running,
+		Stopped:       h.Stopped,
+		Capacity:      h.Capacity,
+		LastHeartbeat: h.LastHeartbeat,
+		FirstSeen:     h.FirstSeen,
+	}
+}
+
+func (s *Service) adminListHosts(w http.ResponseWriter, r *http.Request) {
+	results, err := s.HostManager.List(r.Context())
+	if err != nil {
+		s.Logger.Error("Unable to list hosts",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get the list of hosts"))
+		return
+	}
+
+	details := make([]Detail, len(results))
+	for i := range results {
+		details[i] = newDetail(&results[i])
+	}
+
+	resp.WriteResponse(w, r, details)
+}
+
+func (s *Service) adminGetHost(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	from, to, err := ParseMetricsRange(r)
+	if err != nil {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages(err.Error()))
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	h, err := s.HostManager.GetHostByName(ctx, name)
+	if err != nil {
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get host"))
+		return
+	}
+	if h == nil {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Host does not exist"))
+		return
+	}
+
+	detail := newDetail(h)
+	detail.Metrics, err = s.HostManager.GetMetrics(ctx, SourceHost, h.Name, from, to)
+	if err != nil {
+		s.Logger.Error("Unable to get host metrics",
+			zap.String("HostName", h.Name),
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get the metrics of the host"))
+		return
+	}
+
+	resp.WriteResponse(w, r, detail)
+}
+
+// AdminRouter will return the routes under host API for the internal router
+func (s *Service) AdminRouter() http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/", s.adminListHosts)
+	r.Get("/{name}", s.adminGetHost)
+
+	return r
+}
+
 // Router will return the routes under host API
 func (s *Service) Router() http.Handler {
 	r := chi.NewRouter()
 
-	r.Get("/", s.listHosts)
+	// hosts are needed to make sense of instances
+	r.With(auth.RequireScope(auth.ScopeInstancesRead)).Get("/", s.listHosts)
 
 	return r
 }
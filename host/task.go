@@ -7,7 +7,6 @@ import (
 
 	"github.com/miragespace/rmc/spec"
 	"github.com/miragespace/rmc/spec/broker"
-	"github.com/miragespace/rmc/spec/protocol"
 
 	"github.com/golang/protobuf/ptypes"
 	extErrors "github.com/pkg/errors"
@@ -39,7 +38,7 @@ func NewTask(option TaskOptions) (*Task, error) {
 	}, nil
 }
 
-func (t *Task) handleHeartbeat(ctx context.Context, hChan <-chan *protocol.Heartbeat) {
+func (t *Task) handleHeartbeat(ctx context.Context, hChan <-chan broker.Heartbeat) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -59,11 +58,16 @@ func (t *Task) handleHeartbeat(ctx context.Context, hChan <-chan *protocol.Heart
 				)
 				continue
 			}
-			if err := t.HostManager.ProcessHeartbeat(ctx, hReply); err != nil {
+			if err := t.HostManager.ProcessHeartbeat(hReply.Context, hReply.Heartbeat); err != nil {
 				t.Logger.Error("Cannot process heartbeat",
 					zap.Error(err),
 				)
 			}
+			if err := t.HostManager.RecordMetrics(hReply.Context, hReply.Heartbeat, timestamp); err != nil {
+				t.Logger.Error("Cannot record heartbeat metrics",
+					zap.Error(err),
+				)
+			}
 		}
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
@@ -12,7 +13,10 @@ import (
 	"github.com/miragespace/rmc/spec"
 	"github.com/miragespace/rmc/spec/broker"
 	"github.com/miragespace/rmc/spec/protocol"
+	"github.com/miragespace/rmc/tracing"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -28,8 +32,47 @@ type Options struct {
 type Controller struct {
 	Options
 
-	controlRequest   <-chan *protocol.ControlRequest
-	provisionRequest <-chan *protocol.ProvisionRequest
+	controlRequest   <-chan broker.ControlRequest
+	provisionRequest <-chan broker.ProvisionRequest
+
+	// last seen cumulative counters of each instance, to report the delta between heartbeats
+	lastMetrics map[string]docker.Metrics
+	// used by collectMetrics only
+	lastCPU   cpuTimes
+	resources hostResources
+
+	mu            sync.RWMutex
+	started       time.Time
+	lastHeartbeat time.Time       // last successful publish
+	stats         statsSnapshot   // last containers counted, sent with the next heartbeat
+	snapshot      metricsSnapshot // last metrics collected, sent with the next heartbeat
+}
+
+// statsSnapshot is the last count of the managed containers
+type statsSnapshot struct {
+	stats       docker.Stats
+	collectedAt time.Time
+}
+
+// metricsSnapshot is the result of a metrics collection
+type metricsSnapshot struct {
+	metrics     []docker.Metrics
+	host        hostUsage
+	collectedAt time.Time
+}
+
+// hostResources are the resources available to docker, which rarely change
+type hostResources struct {
+	cpus        int64
+	memoryBytes int64
+	fetchedAt   time.Time
+}
+
+// hostUsage is the resource usage of the whole host, including processes other than the instances
+type hostUsage struct {
+	hostResources
+	cpuPercent  float64 // where 100 is one core
+	memoryBytes int64   // excluding memory the kernel can reclaim
 }
 
 func NewController(option Options) (*Controller, error) {
@@ -55,7 +98,8 @@ func NewController(option Options) (*Controller, error) {
 		return nil, fmt.Errorf("empty host ip is invalid")
 	}
 	return &Controller{
-		Options: option,
+		Options:     option,
+		lastMetrics: make(map[string]docker.Metrics),
 	}, nil
 }
 
@@ -73,6 +117,11 @@ func (c *Controller) Run(ctx context.Context) error {
 	c.controlRequest = crChan
 	c.provisionRequest = prChan
 
+	c.mu.Lock()
+	c.started = time.Now()
+	c.mu.Unlock()
+
+	go c.collectMetrics(ctx)
 	go c.sendHeartbeat(ctx)
 	go c.processControlRequest(ctx)
 	go c.processProvisionRequest(ctx)
@@ -86,55 +135,64 @@ func (c *Controller) processControlRequest(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case d := <-c.controlRequest:
-			if d.GetInstance() == nil {
-				c.Logger.Error("Received provision request with nil Instance")
-				continue
-			}
-			if d.GetInstance().GetID() == "" {
-				c.Logger.Error("Received provision request with empty InstanceID")
-				continue
-			}
+			reqCtx, span := tracing.StartChild(d.Context, "ControlRequest "+d.GetAction().String(), trace.SpanKindConsumer,
+				attribute.String("rmc.instance_id", d.GetInstance().GetID()),
+			)
+			c.handleControlRequest(reqCtx, d.ControlRequest)
+			span.End()
+		}
+	}
+}
 
-			requestedInstance := d.GetInstance()
-			requestedAction := d.GetAction()
-			instanceID := requestedInstance.GetID()
+func (c *Controller) handleControlRequest(ctx context.Context, d *protocol.ControlRequest) {
+	logger := tracing.Logger(ctx, c.Logger)
+	if d.GetInstance() == nil {
+		logger.Error("Received provision request with nil Instance")
+		return
+	}
+	if d.GetInstance().GetID() == "" {
+		logger.Error("Received provision request with empty InstanceID")
+		return
+	}
 
-			logger := c.Logger.With(
-				zap.String("InstanceID", instanceID),
-				zap.String("Action", requestedAction.String()),
-			)
+	requestedInstance := d.GetInstance()
+	requestedAction := d.GetAction()
+	instanceID := requestedInstance.GetID()
 
-			var err error
-			switch d.GetAction() {
-			case protocol.ControlRequest_STOP:
-				err = c.Docker.StopInstance(ctx, requestedInstance)
-			case protocol.ControlRequest_START:
-				err = c.Docker.StartInstance(ctx, requestedInstance)
-			default:
-				logger.Error("Received unknown request")
-				continue
-			}
+	logger = logger.With(
+		zap.String("InstanceID", instanceID),
+		zap.String("Action", requestedAction.String()),
+	)
 
-			var result protocol.ControlReply_ControlResult
-			if err != nil {
-				logger.Error("Cannot control instance",
-					zap.Error(err),
-				)
-				result = protocol.ControlReply_FAILURE
-			} else {
-				result = protocol.ControlReply_SUCCESS
-			}
+	var err error
+	switch d.GetAction() {
+	case protocol.ControlRequest_STOP:
+		err = c.Docker.StopInstance(ctx, requestedInstance)
+	case protocol.ControlRequest_START:
+		err = c.Docker.StartInstance(ctx, requestedInstance)
+	default:
+		logger.Error("Received unknown request")
+		return
+	}
 
-			if err := c.Producer.SendControlReply(&protocol.ControlReply{
-				Instance:      requestedInstance,
-				RequestAction: requestedAction,
-				Result:        result,
-			}); err != nil {
-				c.Logger.Error("Cannot send control reply",
-					zap.Error(err),
-				)
-			}
-		}
+	var result protocol.ControlReply_ControlResult
+	if err != nil {
+		logger.Error("Cannot control instance",
+			zap.Error(err),
+		)
+		result = protocol.ControlReply_FAILURE
+	} else {
+		result = protocol.ControlReply_SUCCESS
+	}
+
+	if err := c.Producer.SendControlReply(ctx, &protocol.ControlReply{
+		Instance:      requestedInstance,
+		RequestAction: requestedAction,
+		Result:        result,
+	}); err != nil {
+		logger.Error("Cannot send control reply",
+			zap.Error(err),
+		)
 	}
 }
 
@@ -144,65 +202,194 @@ func (c *Controller) processProvisionRequest(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case d := <-c.provisionRequest:
-			if d.GetInstance() == nil {
-				c.Logger.Error("Received provision request with nil Instance")
-				continue
-			}
-			if d.GetInstance().GetID() == "" {
-				c.Logger.Error("Received provision request with empty InstanceID")
-				continue
-			}
+			reqCtx, span := tracing.StartChild(d.Context, "ProvisionRequest "+d.GetAction().String(), trace.SpanKindConsumer,
+				attribute.String("rmc.instance_id", d.GetInstance().GetID()),
+			)
+			c.handleProvisionRequest(reqCtx, d.ProvisionRequest)
+			span.End()
+		}
+	}
+}
 
-			requestedInstance := d.GetInstance()
-			requestedAction := d.GetAction()
-			instanceID := requestedInstance.GetID()
-			var instanceParams spec.Parameters
-			instanceParams.FromProto(requestedInstance.Parameters)
+func (c *Controller) handleProvisionRequest(ctx context.Context, d *protocol.ProvisionRequest) {
+	logger := tracing.Logger(ctx, c.Logger)
+	if d.GetInstance() == nil {
+		logger.Error("Received provision request with nil Instance")
+		return
+	}
+	if d.GetInstance().GetID() == "" {
+		logger.Error("Received provision request with empty InstanceID")
+		return
+	}
 
-			logger := c.Logger.With(
-				zap.String("InstanceID", instanceID),
-				zap.String("Action", requestedAction.String()),
-			)
-			var err error
-			var exposedPort int
-			switch requestedAction {
-			case protocol.ProvisionRequest_DELETE:
-				// TODO: timeout or force delete
-				err = c.Docker.DeleteInstance(ctx, requestedInstance)
-			case protocol.ProvisionRequest_CREATE:
-				exposedPort, err = c.Docker.ProvisionInstance(ctx, requestedInstance)
-				// inject provision parameters
-				instanceParams["ServerAddr"] = c.HostIP
-				instanceParams["ServerPort"] = strconv.Itoa(exposedPort)
-				requestedInstance.Parameters = instanceParams.ToProto()
-			default:
-				logger.Error("Received unknown request")
-				continue
-			}
+	requestedInstance := d.GetInstance()
+	requestedAction := d.GetAction()
+	instanceID := requestedInstance.GetID()
+	var instanceParams spec.Parameters
+	instanceParams.FromProto(requestedInstance.Parameters)
 
-			var result protocol.ProvisionReply_ProvisionResult
-			if err != nil {
-				logger.Error("Cannot provision instance",
-					zap.Error(err),
-				)
-				result = protocol.ProvisionReply_FAILURE
-			} else {
-				result = protocol.ProvisionReply_SUCCESS
+	logger = logger.With(
+		zap.String("InstanceID", instanceID),
+		zap.String("Action", requestedAction.String()),
+	)
+	var err error
+	var exposedPort int
+	switch requestedAction {
+	case protocol.ProvisionRequest_DELETE:
+		// TODO: timeout or force delete
+		err = c.Docker.DeleteInstance(ctx, requestedInstance)
+	case protocol.ProvisionRequest_CREATE:
+		exposedPort, err = c.Docker.ProvisionInstance(ctx, requestedInstance)
+		// inject provision parameters
+		instanceParams["ServerAddr"] = c.HostIP
+		instanceParams["ServerPort"] = strconv.Itoa(exposedPort)
+		requestedInstance.Parameters = instanceParams.ToProto()
+	default:
+		logger.Error("Received unknown request")
+		return
+	}
+
+	var result protocol.ProvisionReply_ProvisionResult
+	if err != nil {
+		logger.Error("Cannot provision instance",
+			zap.Error(err),
+		)
+		result = protocol.ProvisionReply_FAILURE
+	} else {
+		result = protocol.ProvisionReply_SUCCESS
+	}
+
+	reply := &protocol.ProvisionReply{
+		Instance:      requestedInstance, // this should include updated Parameters, if any
+		RequestAction: requestedAction,
+		Result:        result,
+	}
+
+	if err := c.Producer.SendProvisionReply(ctx, reply); err != nil {
+		logger.Error("Cannot send provision reply",
+			zap.Error(err),
+		)
+	}
+}
+
+const (
+	// statsTimeout bounds counting the containers, so a hanging Docker daemon does not delay the metrics
+	statsTimeout = 10 * time.Second
+	// metricsMaxAge is how long a metrics snapshot is sent with heartbeats. Metrics older than this are
+	// not sent at all, rather than billing stale gauges
+	metricsMaxAge = 2 * spec.HeartbeatInterval
+	// statsMaxAge is how long a count of the containers is sent with heartbeats. Heartbeats are not sent
+	// once it is older, as the host cannot report which instances are running
+	statsMaxAge = 2 * spec.HeartbeatInterval
+	// resourcesMaxAge is how long the resources reported by docker are cached
+	resourcesMaxAge = 10 * time.Minute
+)
+
+// collectMetrics refreshes the count of the containers and the metrics snapshot every heartbeat interval.
+// Docker is slow to answer on a busy host, so this runs apart from sendHeartbeat, which only sends the
+// last snapshots and never waits for Docker
+func (c *Controller) collectMetrics(ctx context.Context) {
+	ticker := time.NewTicker(spec.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		statsCtx, cancel := context.WithTimeout(ctx, statsTimeout)
+		stats, err := c.Docker.StatsInstances(statsCtx)
+		cancel()
+		if err != nil {
+			c.Logger.Error("Cannot get instance list",
+				zap.Error(err),
+			)
+		} else {
+			c.mu.Lock()
+			c.stats = statsSnapshot{
+				stats:       stats,
+				collectedAt: time.Now(),
 			}
+			c.mu.Unlock()
+		}
 
-			reply := &protocol.ProvisionReply{
-				Instance:      requestedInstance, // this should include updated Parameters, if any
-				RequestAction: requestedAction,
-				Result:        result,
+		metrics, err := c.Docker.MetricsInstances(ctx)
+		if err != nil {
+			c.Logger.Error("Cannot get instance metrics",
+				zap.Error(err),
+			)
+		} else {
+			host := c.hostUsage(ctx)
+			c.mu.Lock()
+			c.snapshot = metricsSnapshot{
+				metrics:     metrics,
+				host:        host,
+				collectedAt: time.Now(),
 			}
+			c.mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
 
-			if err := c.Producer.SendProvisionReply(reply); err != nil {
-				c.Logger.Error("Cannot send provision reply",
-					zap.Error(err),
-				)
+// hostUsage reads the usage of the host from /proc. The CPU usage is averaged since the previous collection
+func (c *Controller) hostUsage(ctx context.Context) hostUsage {
+	if time.Since(c.resources.fetchedAt) > resourcesMaxAge {
+		cpus, memory, err := c.Docker.HostResources(ctx)
+		if err != nil {
+			c.Logger.Warn("Cannot get host resources",
+				zap.Error(err),
+			)
+		} else {
+			c.resources = hostResources{
+				cpus:        cpus,
+				memoryBytes: memory,
+				fetchedAt:   time.Now(),
 			}
 		}
 	}
+	usage := hostUsage{
+		hostResources: c.resources,
+	}
+
+	times, err := readCPUTimes()
+	if err != nil {
+		c.Logger.Warn("Cannot read host CPU usage",
+			zap.Error(err),
+		)
+	} else {
+		usage.cpuPercent = cpuPercent(c.lastCPU, times)
+		c.lastCPU = times
+	}
+	if _, used, err := readMemory(); err != nil {
+		c.Logger.Warn("Cannot read host memory usage",
+			zap.Error(err),
+		)
+	} else {
+		usage.memoryBytes = used
+	}
+	return usage
+}
+
+// lastStats returns the last count of the containers, or nil if it is too old
+func (c *Controller) lastStats() *docker.Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if time.Since(c.stats.collectedAt) > statsMaxAge {
+		return nil
+	}
+	stats := c.stats.stats
+	return &stats
+}
+
+// lastSnapshot returns the last collection, or nil if it is too old
+func (c *Controller) lastSnapshot() *metricsSnapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if time.Since(c.snapshot.collectedAt) > metricsMaxAge {
+		return nil
+	}
+	snapshot := c.snapshot
+	return &snapshot
 }
 
 func (c *Controller) sendHeartbeat(ctx context.Context) {
@@ -214,11 +401,11 @@ func (c *Controller) sendHeartbeat(ctx context.Context) {
 			ticker.Stop()
 			return
 		case <-ticker.C:
-			stats, err := c.Docker.StatsInstances(ctx)
-			if err != nil {
-				c.Logger.Error("Cannot get instance list",
-					zap.Error(err),
-				)
+			stats := c.lastStats()
+			if stats == nil {
+				// the running instances are billed by heartbeat, and the API would count none
+				c.Logger.Warn("Not sending heartbeat, the containers were not counted recently")
+				continue
 			}
 			timestamp, err := ptypes.TimestampProto(time.Now())
 			if err != nil {
@@ -227,7 +414,17 @@ func (c *Controller) sendHeartbeat(ctx context.Context) {
 				)
 				continue
 			}
-			c.Producer.SendHeartbeat(&protocol.Heartbeat{
+			snapshot := c.lastSnapshot()
+			var instanceMetrics []*protocol.InstanceMetrics
+			var hostMetrics *protocol.HostMetrics
+			if snapshot == nil {
+				c.Logger.Warn("Sending heartbeat without metrics, the last collection is too old")
+				instanceMetrics = c.instanceMetrics(nil)
+			} else {
+				instanceMetrics = c.instanceMetrics(snapshot.metrics)
+				hostMetrics = c.hostMetrics(snapshot.host, instanceMetrics)
+			}
+			if err := c.Producer.SendHeartbeat(ctx, &protocol.Heartbeat{
 				Host: &protocol.Host{
 					Name:     c.Host.Name,
 					Running:  stats.Running,
@@ -236,7 +433,71 @@ func (c *Controller) sendHeartbeat(ctx context.Context) {
 				},
 				Timestamp:          timestamp,
 				RunningInstanceIDs: stats.RunningInstances,
-			})
+				InstanceMetrics:    instanceMetrics,
+				HostMetrics:        hostMetrics,
+			}); err != nil {
+				c.Logger.Error("Cannot send heartbeat",
+					zap.Error(err),
+				)
+				continue
+			}
+			c.mu.Lock()
+			c.lastHeartbeat = time.Now()
+			c.mu.Unlock()
 		}
 	}
 }
+
+// counterDelta returns how much a cumulative counter has increased since the previous heartbeat
+func counterDelta(current, last uint64, seen bool) int64 {
+	if !seen {
+		// first sighting, we don't know how much was counted before the previous heartbeat
+		return 0
+	}
+	if last > current {
+		// the counter was reset by a container restart, so everything was counted since
+		return int64(current)
+	}
+	return int64(current - last)
+}
+
+func (c *Controller) instanceMetrics(metrics []docker.Metrics) []*protocol.InstanceMetrics {
+	seen := make(map[string]docker.Metrics, len(metrics))
+	pb := make([]*protocol.InstanceMetrics, 0, len(metrics))
+	for _, m := range metrics {
+		last, ok := c.lastMetrics[m.InstanceID]
+		seen[m.InstanceID] = m
+		pb = append(pb, &protocol.InstanceMetrics{
+			InstanceID:       m.InstanceID,
+			StorageBytes:     m.StorageBytes,
+			NetworkTxBytes:   counterDelta(m.NetworkTxBytes, last.NetworkTxBytes, ok),
+			Players:          m.Players,
+			CPUPercent:       m.CPUPercent,
+			MemoryBytes:      m.MemoryBytes,
+			MemoryLimitBytes: m.MemoryLimitBytes,
+			NetworkRxBytes:   counterDelta(m.NetworkRxBytes, last.NetworkRxBytes, ok),
+			DiskReadBytes:    counterDelta(m.DiskReadBytes, last.DiskReadBytes, ok),
+			DiskWriteBytes:   counterDelta(m.DiskWriteBytes, last.DiskWriteBytes, ok),
+		})
+	}
+	c.lastMetrics = seen
+	return pb
+}
+
+// hostMetrics returns the resources and usage of the host, and the I/O totals of the instances
+func (c *Controller) hostMetrics(host hostUsage, instanceMetrics []*protocol.InstanceMetrics) *protocol.HostMetrics {
+	hm := &protocol.HostMetrics{
+		CPUs:             host.cpus,
+		MemoryTotalBytes: host.hostResources.memoryBytes,
+		CPUPercent:       host.cpuPercent,
+		MemoryBytes:      host.memoryBytes,
+	}
+	for _, m := range instanceMetrics {
+		hm.NetworkRxBytes += m.NetworkRxBytes
+		hm.NetworkTxBytes += m.NetworkTxBytes
+		hm.DiskReadBytes += m.DiskReadBytes
+		hm.DiskWriteBytes += m.DiskWriteBytes
+		hm.StorageBytes += m.StorageBytes
+	}
+	return hm
+}
@@ -0,0 +1,116 @@
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// procRoot is where the proc filesystem of the host is mounted. The worker container shares /proc/stat and
+// /proc/meminfo with the host
+const procRoot = "/proc"
+
+// cpuTimes are the cumulative CPU times of all cores, in USER_HZ
+type cpuTimes struct {
+	total uint64
+	idle  uint64 // including iowait
+	cores int64
+}
+
+// readCPUTimes parses the aggregate "cpu" line of /proc/stat, and counts the "cpuN" lines
+func readCPUTimes() (cpuTimes, error) {
+	var t cpuTimes
+	f, err := os.Open(procRoot + "/stat")
+	if err != nil {
+		return t, err
+	}
+	defer f.Close()
+
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if fields[0] != "cpu" {
+			t.cores++
+			continue
+		}
+		// user nice system idle iowait irq softirq steal, followed by guest times which are already in user
+		for i := 1; i < len(fields) && i <= 8; i++ {
+			v, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return t, fmt.Errorf("Invalid /proc/stat: %v", err)
+			}
+			t.total += v
+			if i == 4 || i == 5 {
+				t.idle += v
+			}
+		}
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return t, err
+	}
+	if !found {
+		return t, fmt.Errorf("No cpu line in /proc/stat")
+	}
+	return t, nil
+}
+
+// cpuPercent returns the CPU usage of the host between two readings, where 100 is one core
+func cpuPercent(last, current cpuTimes) float64 {
+	if last.total == 0 || current.total <= last.total || current.idle < last.idle {
+		// the first reading would be the average since boot
+		return 0
+	}
+	total := float64(current.total - last.total)
+	busy := total - float64(current.idle-last.idle)
+	if busy < 0 {
+		return 0
+	}
+	return busy / total * float64(current.cores) * 100
+}
+
+// readMemory returns the total and used memory of the host from /proc/meminfo. Memory which the kernel can
+// reclaim, such as the page cache, is not counted as used
+func readMemory() (total int64, used int64, err error) {
+	f, err := os.Open(procRoot + "/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var available int64 = -1
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var target *int64
+		switch fields[0] {
+		case "MemTotal:":
+			target = &total
+		case "MemAvailable:":
+			target = &available
+		default:
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid /proc/meminfo: %v", err)
+		}
+		*target = kb * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	if total == 0 || available < 0 {
+		return 0, 0, fmt.Errorf("No MemTotal or MemAvailable in /proc/meminfo")
+	}
+	return total, total - available, nil
+}
@@ -0,0 +1,122 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/miragespace/rmc/host/docker"
+	"github.com/miragespace/rmc/spec"
+
+	"go.uber.org/zap"
+)
+
+// LastHeartbeat returns when a heartbeat was last published, or the zero time if none was
+func (c *Controller) LastHeartbeat() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastHeartbeat
+}
+
+// CheckHeartbeat returns an error if no heartbeat was published within 2 spec.HeartbeatInterval, after which
+// the host is no longer considered alive by the API. Heartbeats only send the last count of the containers,
+// so a busy Docker daemon fails the check only once the containers could not be counted for as long
+func (c *Controller) CheckHeartbeat(ctx context.Context) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.started.IsZero() {
+		return fmt.Errorf("Controller is not running")
+	}
+	last := c.lastHeartbeat
+	if last.IsZero() {
+		// the first heartbeat is only due after an interval
+		last = c.started
+	}
+	if time.Since(last) > 2*spec.HeartbeatInterval {
+		if time.Since(c.stats.collectedAt) > statsMaxAge {
+			if c.stats.collectedAt.IsZero() {
+				return fmt.Errorf("Containers not counted since start at %s", c.started.Format(time.RFC3339))
+			}
+			return fmt.Errorf("Containers last counted at %s", c.stats.collectedAt.Format(time.RFC3339))
+		}
+		if c.lastHeartbeat.IsZero() {
+			return fmt.Errorf("No heartbeat published since start at %s", c.started.Format(time.RFC3339))
+		}
+		return fmt.Errorf("Last heartbeat published at %s", c.lastHeartbeat.Format(time.RFC3339))
+	}
+	return nil
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>rmc worker {{ .HostName }}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Worker {{ .HostName }}</h1>
+<p>Public IP: {{ .HostIP }}, capacity: {{ .Capacity }}</p>
+<p>Last heartbeat published:
+{{ if .LastHeartbeat.IsZero }}never{{ else }}{{ .LastHeartbeat.Format "2006-01-02T15:04:05Z07:00" }} ({{ .HeartbeatAge }} ago){{ end }}
+{{ with .HeartbeatError }}<span class="error">{{ . }}</span>{{ end }}</p>
+<h2>Managed containers</h2>
+{{ with .DockerError }}<p class="error">Cannot list containers: {{ . }}</p>{{ end }}
+<table>
+<tr><th>Instance</th><th>Container</th><th>Image</th><th>State</th><th>Status</th><th>Created</th></tr>
+{{ range .Containers }}<tr><td>{{ .InstanceID }}</td><td>{{ printf "%.12s" .ContainerID }}</td><td>{{ .Image }}</td><td>{{ .State }}</td><td>{{ .Status }}</td><td>{{ .Created.Format "2006-01-02T15:04:05Z07:00" }}</td></tr>
+{{ else }}<tr><td colspan="6">No managed containers</td></tr>
+{{ end }}</table>
+</body>
+</html>
+`))
+
+type statusPage struct {
+	HostName       string
+	HostIP         string
+	Capacity       int64
+	LastHeartbeat  time.Time
+	HeartbeatAge   time.Duration
+	HeartbeatError string
+	Containers     []docker.Container
+	DockerError    string
+}
+
+// StatusHandler serves a page listing the managed containers and the last heartbeat published,
+// to be served on the metrics listener
+func (c *Controller) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := statusPage{
+			HostName:      c.Host.Name,
+			HostIP:        c.HostIP,
+			Capacity:      c.Host.Capacity,
+			LastHeartbeat: c.LastHeartbeat(),
+		}
+		if !page.LastHeartbeat.IsZero() {
+			page.HeartbeatAge = time.Since(page.LastHeartbeat).Truncate(time.Second)
+		}
+		if err := c.CheckHeartbeat(r.Context()); err != nil {
+			page.HeartbeatError = err.Error()
+		}
+		containers, err := c.Docker.ListInstances(r.Context())
+		if err != nil {
+			page.DockerError = err.Error()
+		}
+		page.Containers = containers
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := statusTemplate.Execute(w, page); err != nil {
+			c.Logger.Error("Unable to render status page",
+				zap.Error(err),
+			)
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package instance
+
+import (
+	"context"
+
+	"github.com/miragespace/rmc/ratelimit"
+	resp "github.com/miragespace/rmc/response"
+	"github.com/miragespace/rmc/subscription"
+	"github.com/miragespace/rmc/team"
+	"github.com/miragespace/rmc/tracing"
+
+	"go.uber.org/zap"
+)
+
+// Define the actions to control an instance
+const (
+	ControlStart = "Start"
+	ControlStop  = "Stop"
+)
+
+// controller starts and stops instances on behalf of customers, with the same checks for API requests and Schedules
+type controller struct {
+	InstanceManager     *Manager
+	SubscriptionManager *subscription.Manager
+	LifecycleManager    LifecycleManager
+	Policy              team.Policy
+	Limiter             *ratelimit.Limiter // Optional. How often an instance can be started or stopped is only limited if a Limiter is provided
+	Logger              *zap.Logger
+}
+
+// authorize returns whether the customer can perform the action on the instance, which may be owned by someone else
+func (c *controller) authorize(ctx context.Context, customerID string, inst *Instance, action team.Action) (bool, error) {
+	return c.Policy.Authorize(ctx, customerID, team.Resource{
+		OwnerID:    inst.CustomerID,
+		InstanceID: inst.ID,
+	}, action)
+}
+
+// authorizeUpdate is used within LambdaUpdate, and returns the error response if the customer cannot perform the action
+func (c *controller) authorizeUpdate(ctx context.Context, customerID string, current *Instance, action team.Action) interface{} {
+	allowed, err := c.authorize(ctx, customerID, current, action)
+	if err != nil {
+		c.Logger.Error("Unable to authorize customer",
+			zap.Error(err),
+			zap.String("CustomerID", customerID),
+			zap.String("InstanceID", current.ID),
+		)
+		return resp.ErrUnexpected().AddMessages("Unable to verify permissions")
+	}
+	if allowed {
+		return nil
+	}
+	// only tell customers who can see the instance that it exists
+	if visible, _ := c.authorize(ctx, customerID, current, team.ActionViewInstance); visible {
+		return resp.ErrForbidden().AddMessages("Insufficient role for this instance")
+	}
+	return resp.ErrNotFound().AddMessages("Cannot find instance with specific ID")
+}
+
+// cooldown limits how often each instance can be started or stopped, as it is expensive on the host. The limit is
+// checked once before the update, and only counts requests which would change the state: the instance is read
+// beforehand, and the update checks it again. Returns the error response if the instance is on cooldown
+func (c *controller) cooldown(ctx context.Context, logger *zap.Logger, customerID, instanceID, action string) interface{} {
+	if c.Limiter == nil {
+		return nil
+	}
+	inst, err := c.InstanceManager.Get(ctx, GetOption{
+		InstanceID: instanceID,
+	})
+	if err != nil {
+		return resp.ErrUnexpected().AddMessages("Unable to get instance")
+	}
+	if inst == nil || inst.Status != StatusActive {
+		return resp.ErrNotFound().AddMessages("Cannot find instance with specific ID")
+	}
+	if respError := c.authorizeUpdate(ctx, customerID, inst, team.ActionControlInstance); respError != nil {
+		return respError
+	}
+	if (action == ControlStart && inst.State != StateStopped) || (action == ControlStop && inst.State != StateRunning) {
+		// the update rejects the request with the reason
+		return nil
+	}
+
+	allowed, retryAfter, err := c.Limiter.Allow(ratelimit.ControlInstance, inst.ID)
+	if err != nil {
+		logger.Error("Unable to check instance control cooldown",
+			zap.Error(err),
+		)
+		return nil
+	}
+	if !allowed {
+		return resp.ErrTooManyRequests(retryAfter).AddMessages("Instance was started or stopped too frequently")
+	}
+	return nil
+}
+
+// control performs the action (ControlStart or ControlStop) on the instance for the customer, and sends the control
+// request to the host. If the action is not allowed, LambdaResult.ReturnValue is the *resp.Error describing why
+func (c *controller) control(ctx context.Context, customerID, instanceID, action string) LambdaResult {
+	logger := tracing.Logger(ctx, c.Logger).With(
+		zap.String("CustomerID", customerID),
+		zap.String("InstanceID", instanceID),
+	)
+
+	lambda := func(current *Instance, desired *Instance) (shouldSave bool, respError interface{}) {
+		if current == nil || current.Status != StatusActive {
+			respError = resp.ErrNotFound().AddMessages("Cannot find instance with specific ID")
+			return
+		}
+		if respError = c.authorizeUpdate(ctx, customerID, current, team.ActionControlInstance); respError != nil {
+			return
+		}
+
+		var nextState State
+		switch action {
+		case ControlStart:
+			if current.State != StateStopped {
+				respError = resp.ErrBadRequest().AddMessages("Instance not in 'Stopped' state")
+				return
+			}
+			// the subscription (and its budget) belongs to the owner, not necessarily the customer
+			sub, err := c.SubscriptionManager.Get(ctx, subscription.GetOption{
+				CustomerID:     current.CustomerID,
+				SubscriptionID: current.SubscriptionID,
+			})
+			if err != nil {
+				respError = resp.ErrUnexpected().AddMessages("Unable to verify subscription validity")
+				return
+			}
+			if sub == nil || !sub.Usable() {
+				// e.g. the free trial is exhausted
+				respError = resp.ErrForbidden().AddMessages("Subscription is inactive. Please add a payment method")
+				return
+			}
+			limited, err := c.SubscriptionManager.HardLimitReached(ctx, subscription.BudgetOption{
+				CustomerID:     current.CustomerID,
+				SubscriptionID: current.SubscriptionID,
+			})
+			if err != nil {
+				respError = resp.ErrUnexpected().AddMessages("Unable to verify subscription budget")
+				return
+			}
+			if limited {
+				respError = resp.ErrForbidden().AddMessages("Budget limit reached. Please raise the budget")
+				return
+			}
+			nextState = StateStarting
+		case ControlStop:
+			if current.State != StateRunning {
+				respError = resp.ErrBadRequest().AddMessages("Instance not in 'Running' state")
+				return
+			}
+			nextState = StateStopping
+		default:
+			respError = resp.ErrBadRequest().AddMessages("Unknown action")
+			return
+		}
+
+		// trigger history insertion
+		desired.PreviousState = current.State
+		desired.State = nextState
+		shouldSave = true
+		return
+	}
+
+	if respError := c.cooldown(ctx, logger, customerID, instanceID, action); respError != nil {
+		return LambdaResult{
+			ReturnValue: respError,
+		}
+	}
+
+	lambdaResult := c.InstanceManager.LambdaUpdate(ctx, instanceID, lambda)
+	if lambdaResult.ReturnValue != nil || lambdaResult.TxError != nil {
+		return lambdaResult
+	}
+
+	go func(ctx context.Context, inst *Instance) {
+		opt := LifecycleOption{
+			HostName:   inst.HostName,
+			InstanceID: inst.ID,
+			Parameters: nil,
+		}
+		var err error
+		switch inst.State {
+		case StateStopping:
+			err = c.LifecycleManager.Stop(ctx, opt)
+		case StateStarting:
+			err = c.LifecycleManager.Start(ctx, opt)
+		}
+		if err != nil {
+			logger.Error("Unable to send control request",
+				zap.Error(err),
+				zap.String("HostName", inst.HostName),
+			)
+			// fail through: as long as database state is consistent, manual mediation is possible
+		}
+	}(tracing.Detach(ctx), lambdaResult.Instance)
+
+	return lambdaResult
+}
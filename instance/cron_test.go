@@ -0,0 +1,217 @@
+package instance
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("LoadLocation(%s): %v", name, err)
+	}
+	return loc
+}
+
+func mustParseTime(t *testing.T, value string, loc *time.Location) time.Time {
+	v, err := time.ParseInLocation("2006-01-02 15:04", value, loc)
+	if err != nil {
+		t.Fatalf("ParseInLocation(%s): %v", value, err)
+	}
+	return v
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"0 18 * * fri,sat", true},
+		{"*/15 9-17 1,15 jan-jun MON-FRI", true},
+		{"0 0 * * 7", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"0 0 0 * *", false},
+		{"0 0 32 * *", false},
+		{"0 0 * 13 *", false},
+		{"0 0 * * 8", false},
+		{"0 0 * * fri-mon", false},
+		{"30-10 * * * *", false},
+		{"*/0 * * * *", false},
+		{"*/x * * * *", false},
+		{"noon * * * *", false},
+	}
+	for _, test := range tests {
+		_, err := parseCron(test.expr)
+		if (err == nil) != test.ok {
+			t.Errorf("parseCron(%q) = %v, expected ok: %v", test.expr, err, test.ok)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2021-06-01 is a Tuesday
+	tests := []struct {
+		expr     string
+		from     string
+		expected string // empty if the expression never matches
+	}{
+		// next is strictly after from
+		{"* * * * *", "2021-06-01 10:00", "2021-06-01 10:01"},
+		{"*/15 * * * *", "2021-06-01 10:07", "2021-06-01 10:15"},
+		{"*/15 * * * *", "2021-06-01 10:15", "2021-06-01 10:30"},
+		// a value with a step starts the range at the value
+		{"5/20 * * * *", "2021-06-01 10:30", "2021-06-01 10:45"},
+		{"5/20 * * * *", "2021-06-01 10:50", "2021-06-01 11:05"},
+		{"0 9-17/4 * * *", "2021-06-01 10:00", "2021-06-01 13:00"},
+		{"0 9-17/4 * * *", "2021-06-01 17:00", "2021-06-02 09:00"},
+		{"0 0 1,15 * *", "2021-06-02 00:00", "2021-06-15 00:00"},
+		{"0 0 * * mon-fri", "2021-06-05 12:00", "2021-06-07 00:00"},
+		{"0 0 1 jan,jul *", "2021-06-01 00:00", "2021-07-01 00:00"},
+		{"0 0 1 1 *", "2021-06-01 00:00", "2022-01-01 00:00"},
+		{"0 0 29 2 *", "2021-03-01 00:00", "2024-02-29 00:00"},
+		// with both day of month and day of week restricted, a day matching either is allowed
+		{"0 0 13 * fri", "2021-06-01 00:00", "2021-06-04 00:00"},
+		{"0 0 13 * fri", "2021-06-05 00:00", "2021-06-11 00:00"},
+		{"0 0 13 * fri", "2021-06-12 00:00", "2021-06-13 00:00"},
+		{"0 0 13 * *", "2021-06-01 00:00", "2021-06-13 00:00"},
+		{"0 0 * * fri", "2021-06-05 00:00", "2021-06-11 00:00"},
+		{"0 0 * 6 fri", "2021-06-05 00:00", "2021-06-11 00:00"},
+		// Sunday is either 0 or 7
+		{"0 12 * * 0", "2021-06-01 00:00", "2021-06-06 12:00"},
+		{"0 12 * * 7", "2021-06-01 00:00", "2021-06-06 12:00"},
+		{"0 12 * * sun", "2021-06-01 00:00", "2021-06-06 12:00"},
+		{"0 12 * * 5-7", "2021-06-05 13:00", "2021-06-06 12:00"},
+		{"0 12 * * 6-7", "2021-06-06 13:00", "2021-06-12 12:00"},
+		// February 30th
+		{"0 0 30 2 *", "2021-06-01 00:00", ""},
+		{"0 0 31 4,6,9,11 *", "2021-06-01 00:00", ""},
+	}
+	for _, test := range tests {
+		spec, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", test.expr, err)
+		}
+		next := spec.next(mustParseTime(t, test.from, time.UTC))
+		var expected time.Time
+		if test.expected != "" {
+			expected = mustParseTime(t, test.expected, time.UTC)
+		}
+		if !next.Equal(expected) {
+			t.Errorf("%q after %s = %s, expected %s", test.expr, test.from, next, expected)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	edt := time.FixedZone("EDT", -4*60*60)
+	est := time.FixedZone("EST", -5*60*60)
+	santiago := mustLoadLocation(t, "America/Santiago")
+	clt := time.FixedZone("CLT", -4*60*60)
+	clst := time.FixedZone("CLST", -3*60*60)
+
+	// in New York, clocks go from 02:00 EST to 03:00 EDT on 2021-03-14, and from 02:00 EDT back to 01:00 EST on
+	// 2021-11-07. In Santiago, they go from midnight to 01:00 on 2021-09-05, so the day starts at 01:00
+	tests := []struct {
+		expr     string
+		loc      *time.Location
+		from     time.Time
+		expected time.Time
+	}{
+		// spring forward: a time within the skipped hour does not exist on that day
+		{"30 2 * * *", newYork, time.Date(2021, 3, 13, 12, 0, 0, 0, est), time.Date(2021, 3, 15, 2, 30, 0, 0, edt)},
+		{"0 * * * *", newYork, time.Date(2021, 3, 14, 1, 30, 0, 0, est), time.Date(2021, 3, 14, 3, 0, 0, 0, edt)},
+		{"0 3 * * *", newYork, time.Date(2021, 3, 14, 1, 30, 0, 0, est), time.Date(2021, 3, 14, 3, 0, 0, 0, edt)},
+		// a daily time keeps its wall clock time across the change
+		{"0 12 * * *", newYork, time.Date(2021, 3, 13, 13, 0, 0, 0, est), time.Date(2021, 3, 14, 12, 0, 0, 0, edt)},
+		// fall back: a time within the repeated hour matches both times
+		{"30 1 * * *", newYork, time.Date(2021, 11, 7, 0, 0, 0, 0, edt), time.Date(2021, 11, 7, 1, 30, 0, 0, edt)},
+		{"30 1 * * *", newYork, time.Date(2021, 11, 7, 1, 30, 0, 0, edt), time.Date(2021, 11, 7, 1, 30, 0, 0, est)},
+		{"30 1 * * *", newYork, time.Date(2021, 11, 7, 1, 30, 0, 0, est), time.Date(2021, 11, 8, 1, 30, 0, 0, est)},
+		{"0 12 * * *", newYork, time.Date(2021, 11, 6, 13, 0, 0, 0, edt), time.Date(2021, 11, 7, 12, 0, 0, 0, est)},
+		// the day after a skipped midnight is still matched
+		{"0 12 * * *", santiago, time.Date(2021, 9, 4, 13, 0, 0, 0, clt), time.Date(2021, 9, 5, 12, 0, 0, 0, clst)},
+		{"0 12 * * sun", santiago, time.Date(2021, 9, 4, 13, 0, 0, 0, clt), time.Date(2021, 9, 5, 12, 0, 0, 0, clst)},
+		{"0 * 5 9 *", santiago, time.Date(2021, 9, 4, 13, 0, 0, 0, clt), time.Date(2021, 9, 5, 1, 0, 0, 0, clst)},
+	}
+	for _, test := range tests {
+		spec, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", test.expr, err)
+		}
+		next := spec.next(test.from.In(test.loc))
+		if !next.Equal(test.expected) {
+			t.Errorf("%q after %s = %s, expected %s", test.expr, test.from, next, test.expected)
+		}
+		if next.Location() != test.loc {
+			t.Errorf("%q after %s is in %s, expected %s", test.expr, test.from, next.Location(), test.loc)
+		}
+	}
+}
+
+func TestScheduleRules(t *testing.T) {
+	loc := mustLoadLocation(t, "Europe/Berlin")
+
+	// 2021-06-04 is a Friday
+	tests := []struct {
+		days      []string
+		startTime string
+		stopTime  string
+		from      string
+		start     string
+		stop      string
+	}{
+		{[]string{"fri"}, "18:00", "23:30", "2021-06-04 12:00", "2021-06-04 18:00", "2021-06-04 23:30"},
+		{[]string{"fri"}, "18:00", "23:30", "2021-06-04 23:45", "2021-06-11 18:00", "2021-06-11 23:30"},
+		// a stop time earlier than the start time stops the instance on the next day
+		{[]string{"fri"}, "22:00", "02:00", "2021-06-04 12:00", "2021-06-04 22:00", "2021-06-05 02:00"},
+		{[]string{"fri", "sat"}, "22:00", "02:00", "2021-06-05 03:00", "2021-06-05 22:00", "2021-06-06 02:00"},
+		{[]string{"fri", "sat"}, "22:00", "02:00", "2021-06-06 03:00", "2021-06-11 22:00", "2021-06-12 02:00"},
+		// the window of Saturday ends on Sunday, which wraps around the week
+		{[]string{"sat"}, "23:00", "00:30", "2021-06-05 12:00", "2021-06-05 23:00", "2021-06-06 00:30"},
+		{[]string{"SUN"}, "23:00", "00:30", "2021-06-05 12:00", "2021-06-06 23:00", "2021-06-07 00:30"},
+	}
+	for _, test := range tests {
+		s := Schedule{
+			Type:      ScheduleWeekly,
+			StartTime: test.startTime,
+			StopTime:  test.stopTime,
+		}
+		s.SetDays(test.days)
+		rules, err := s.rules()
+		if err != nil {
+			t.Fatalf("rules(%v %s-%s): %v", test.days, test.startTime, test.stopTime, err)
+		}
+		if len(rules) != 2 || rules[0].action != ControlStart || rules[1].action != ControlStop {
+			t.Fatalf("rules(%v %s-%s): expected a start and a stop rule", test.days, test.startTime, test.stopTime)
+		}
+		from := mustParseTime(t, test.from, loc)
+		for i, expected := range []string{test.start, test.stop} {
+			next := rules[i].spec.next(from)
+			if !next.Equal(mustParseTime(t, expected, loc)) {
+				t.Errorf("%s of %v %s-%s after %s = %s, expected %s",
+					rules[i].action, test.days, test.startTime, test.stopTime, test.from, next, expected)
+			}
+		}
+	}
+
+	invalid := []Schedule{
+		{Type: ScheduleWeekly, StartTime: "18:00", StopTime: "23:00"},
+		{Type: ScheduleWeekly, Days: "fri", StartTime: "18:00"},
+		{Type: ScheduleWeekly, Days: "fri", StartTime: "25:00", StopTime: "23:00"},
+		{Type: ScheduleWeekly, Days: "friday", StartTime: "18:00", StopTime: "23:00"},
+		{Type: ScheduleCron, Action: ControlStart, Cron: "0 0 * *"},
+		{Type: ScheduleCron, Action: "Restart", Cron: "0 0 * * *"},
+		{Type: "monthly"},
+	}
+	for _, s := range invalid {
+		if _, err := s.rules(); err == nil {
+			t.Errorf("rules(%+v): expected an error", s)
+		}
+	}
+}
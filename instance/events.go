@@ -0,0 +1,400 @@
+package instance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miragespace/rmc/auth"
+	resp "github.com/miragespace/rmc/response"
+	"github.com/miragespace/rmc/team"
+	"github.com/miragespace/rmc/tracing"
+
+	"github.com/jackc/pgconn"
+	extErrors "github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// historyChannel is the Postgres NOTIFY channel of new History rows. Notifications are sent within the
+// transaction that inserts the row, so they are only delivered once it is committed
+const historyChannel = "instance_history"
+
+const (
+	subscriberBuffer = 32
+	reconnectDelay   = time.Second * 5
+	replayLimit      = 100
+	keepAlive        = time.Second * 15
+	accessInterval   = time.Second * 30 // how often streams check whether the customer can still view the instances
+	retryMillis      = 3000
+)
+
+// StateEvent is a state change of an instance, as recorded in its History
+type StateEvent struct {
+	Seq           int64     `json:"-"`
+	InstanceID    string    `json:"instanceId"`
+	CustomerID    string    `json:"-"`
+	PreviousState State     `json:"previousState"`
+	State         State     `json:"state"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// ID returns the cursor of the event, used as the SSE event ID to resume after it
+func (e *StateEvent) ID() string {
+	return strconv.FormatInt(e.Seq, 10)
+}
+
+// parseCursor parses the ID of a StateEvent, and returns the Seq of its History
+func parseCursor(id string) (int64, error) {
+	seq, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, fmt.Errorf("Invalid event ID")
+	}
+	return seq, nil
+}
+
+// notifyHistory publishes the new History row to historyChannel. It must be called within the transaction inserting it
+func notifyHistory(tx *gorm.DB, inst *Instance, hist *History) error {
+	payload, err := json.Marshal(struct {
+		StateEvent
+		Seq        int64  `json:"seq"`
+		CustomerID string `json:"customerId"`
+	}{
+		StateEvent: StateEvent{
+			Seq:           hist.Seq,
+			InstanceID:    hist.InstanceID,
+			PreviousState: inst.PreviousState,
+			State:         hist.State,
+			Timestamp:     hist.Timestamp,
+		},
+		Seq:        hist.Seq,
+		CustomerID: inst.CustomerID,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Exec("SELECT pg_notify(?, ?)", historyChannel, string(payload)).Error
+}
+
+// ListStateEvents returns the state changes after the event ID of the instances in access, oldest first
+func (m *Manager) ListStateEvents(ctx context.Context, access *team.Access, afterID string, limit int) ([]StateEvent, error) {
+	seq, err := parseCursor(afterID)
+	if err != nil {
+		return nil, err
+	}
+	instanceIDs := access.InstanceIDs
+	if len(instanceIDs) == 0 {
+		// IN with an empty list is invalid
+		instanceIDs = []string{""}
+	}
+
+	events := make([]StateEvent, 0)
+	result := m.DB.WithContext(ctx).Raw(`SELECT * FROM (
+		SELECT histories.seq, histories.instance_id, histories.timestamp, histories.state, instances.customer_id,
+			COALESCE(LAG(histories.state) OVER (PARTITION BY histories.instance_id ORDER BY histories.seq), '') AS previous_state
+		FROM histories JOIN instances ON instances.id = histories.instance_id
+		WHERE instances.customer_id IN ? OR instances.id IN ?
+	) events
+	WHERE events.seq > ?
+	ORDER BY events.seq
+	LIMIT ?`, access.OwnerIDs, instanceIDs, seq, limit).
+		Scan(&events)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot list state events")
+	}
+	return events, nil
+}
+
+type subscriber struct {
+	events chan *StateEvent
+	filter func(*StateEvent) bool
+}
+
+// EventHubOptions describes the dependencies of EventHub
+type EventHubOptions struct {
+	URI    string // Postgres connection URI. The hub keeps a dedicated connection to LISTEN
+	Logger *zap.Logger
+}
+
+// EventHub receives the state changes of every instance from Postgres, and fans them out to subscribers in this process
+type EventHub struct {
+	EventHubOptions
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+// NewEventHub returns a new EventHub. Run must be called to receive events
+func NewEventHub(option EventHubOptions) (*EventHub, error) {
+	if option.URI == "" {
+		return nil, fmt.Errorf("Empty URI is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	return &EventHub{
+		EventHubOptions: option,
+		subscribers:     make(map[*subscriber]struct{}),
+	}, nil
+}
+
+// Subscribe returns a channel of the events accepted by filter, and a function to unsubscribe. The channel is closed
+// if the subscriber falls behind or events may have been missed, and the subscriber should resume from the last event
+func (h *EventHub) Subscribe(filter func(*StateEvent) bool) (<-chan *StateEvent, func()) {
+	s := &subscriber{
+		events: make(chan *StateEvent, subscriberBuffer),
+		filter: filter,
+	}
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+
+	return s.events, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(s)
+	}
+}
+
+// remove must be called with mu held
+func (h *EventHub) remove(s *subscriber) {
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
+
+func (h *EventHub) publish(e *StateEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		if !s.filter(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			// too slow, the client will resume from its last event
+			h.remove(s)
+		}
+	}
+}
+
+// disconnectAll closes every subscriber, so they resume from their last event
+func (h *EventHub) disconnectAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		h.remove(s)
+	}
+}
+
+// Run listens for state changes until ctx is cancelled, reconnecting to Postgres if the connection is lost.
+// Subscribers are disconnected whenever events may have been missed, and when Run returns
+func (h *EventHub) Run(ctx context.Context) {
+	defer h.disconnectAll()
+	for {
+		if err := h.listen(ctx); err != nil && ctx.Err() == nil {
+			h.Logger.Error("Lost connection for instance events, reconnecting",
+				zap.Error(err),
+			)
+		}
+		h.disconnectAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (h *EventHub) listen(ctx context.Context) error {
+	config, err := pgconn.ParseConfig(h.URI)
+	if err != nil {
+		return extErrors.Wrap(err, "Invalid Postgres URI")
+	}
+	config.OnNotification = func(_ *pgconn.PgConn, n *pgconn.Notification) {
+		var e struct {
+			StateEvent
+			Seq        int64  `json:"seq"`
+			CustomerID string `json:"customerId"`
+		}
+		if err := json.Unmarshal([]byte(n.Payload), &e); err != nil {
+			h.Logger.Error("Received invalid instance event",
+				zap.Error(err),
+			)
+			return
+		}
+		e.StateEvent.Seq = e.Seq
+		e.StateEvent.CustomerID = e.CustomerID
+		h.publish(&e.StateEvent)
+	}
+
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot connect to Postgres")
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+historyChannel).ReadAll(); err != nil {
+		return extErrors.Wrap(err, "Cannot listen for instance events")
+	}
+	for {
+		if err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e *StateEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: state\ndata: %s\n\n", e.ID(), data)
+	return err
+}
+
+// streamEvents streams the state changes of instances accessible by the customer as Server-Sent Events.
+// Clients resuming with Last-Event-ID (or the lastEventId query param) receive the events they have missed first
+func (s *Service) streamEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := tracing.Logger(ctx, s.Logger).With(
+		zap.String("CustomerID", claims.ID),
+	)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Streaming is not supported"))
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	if lastID != "" {
+		if _, err := parseCursor(lastID); err != nil {
+			resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Invalid Last-Event-ID"))
+			return
+		}
+	}
+
+	access, err := s.Policy.Accessible(ctx, claims.ID, team.ActionViewInstance)
+	if err != nil {
+		logger.Error("Unable to get shared instances",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot stream instance events"))
+		return
+	}
+	owners, shared := toSet(access.OwnerIDs), toSet(access.InstanceIDs)
+
+	// subscribe before replaying, so no event is missed in between
+	events, unsubscribe := s.EventHub.Subscribe(func(e *StateEvent) bool {
+		return owners[e.CustomerID] || shared[e.InstanceID]
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", retryMillis)
+	flusher.Flush()
+
+	// events sent during replay may also be received from the hub
+	replayed := make(map[string]bool)
+	if lastID != "" {
+		for {
+			replay, err := s.InstanceManager.ListStateEvents(ctx, access, lastID, replayLimit)
+			if err != nil {
+				logger.Error("Unable to replay instance events",
+					zap.Error(err),
+				)
+				return
+			}
+			for i := range replay {
+				if err := writeEvent(w, &replay[i]); err != nil {
+					return
+				}
+				lastID = replay[i].ID()
+				replayed[lastID] = true
+			}
+			flusher.Flush()
+			if len(replay) < replayLimit {
+				break
+			}
+		}
+	}
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	accessTicker := time.NewTicker(accessInterval)
+	defer accessTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-accessTicker.C:
+			current, err := s.Policy.Accessible(ctx, claims.ID, team.ActionViewInstance)
+			if err != nil {
+				logger.Error("Unable to recheck shared instances",
+					zap.Error(err),
+				)
+				return
+			}
+			if !sameSet(owners, current.OwnerIDs) || !sameSet(shared, current.InstanceIDs) {
+				// e.g. the customer was removed from a team. The client reconnects and resumes with its current access
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, ok := <-events:
+			if !ok {
+				// the hub has disconnected us, the client will reconnect and resume
+				return
+			}
+			if replayed[e.ID()] {
+				continue
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func toSet(ids []string) map[string]bool {
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+// sameSet returns whether set contains exactly the ids
+func sameSet(set map[string]bool, ids []string) bool {
+	current := toSet(ids)
+	if len(current) != len(set) {
+		return false
+	}
+	for id := range current {
+		if !set[id] {
+			return false
+		}
+	}
+	return true
+}
@@ -25,4 +25,5 @@ type History struct {
 	InstanceID string    `json:"-" gorm:"primaryKey;not null"`         // FK to Instance.ID
 	Timestamp  time.Time `json:"timestamp" gorm:"primaryKey;not null"` // Timestamp when the Instance.State was changed
 	State      State     `json:"state" gorm:"primaryKey;not null"`     // State when the Instance.State was changed
+	Seq        int64     `json:"-" gorm:"autoIncrement;uniqueIndex"`   // Increases with every History in commit order, used as the ID of StateEvent
 }
@@ -1,6 +1,7 @@
 package instance
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/miragespace/rmc/host"
@@ -21,11 +22,12 @@ type LifecycleOption struct {
 	Parameters *spec.Parameters
 }
 
+// LifecycleManager sends the requests to the hosts. The trace of ctx, if any, is continued by the host
 type LifecycleManager interface {
-	Start(opt LifecycleOption) error
-	Stop(opt LifecycleOption) error
-	Create(opt LifecycleOption) error
-	Delete(opt LifecycleOption) error
+	Start(ctx context.Context, opt LifecycleOption) error
+	Stop(ctx context.Context, opt LifecycleOption) error
+	Create(ctx context.Context, opt LifecycleOption) error
+	Delete(ctx context.Context, opt LifecycleOption) error
 }
 
 type lifecycleManager struct {
@@ -60,11 +62,12 @@ func getIdentifier(hostName string) string {
 	return h.Identifier()
 }
 
-func (l *lifecycleManager) Start(opt LifecycleOption) error {
+func (l *lifecycleManager) Start(ctx context.Context, opt LifecycleOption) error {
 	if err := opt.Validate(); err != nil {
 		return err
 	}
 	if err := l.Producer.SendControlRequest(
+		ctx,
 		getIdentifier(opt.HostName),
 		&protocol.ControlRequest{
 			Instance: &protocol.Instance{
@@ -78,11 +81,12 @@ func (l *lifecycleManager) Start(opt LifecycleOption) error {
 	return nil
 }
 
-func (l *lifecycleManager) Stop(opt LifecycleOption) error {
+func (l *lifecycleManager) Stop(ctx context.Context, opt LifecycleOption) error {
 	if err := opt.Validate(); err != nil {
 		return err
 	}
 	if err := l.Producer.SendControlRequest(
+		ctx,
 		getIdentifier(opt.HostName),
 		&protocol.ControlRequest{
 			Instance: &protocol.Instance{
@@ -96,11 +100,12 @@ func (l *lifecycleManager) Stop(opt LifecycleOption) error {
 	return nil
 }
 
-func (l *lifecycleManager) Create(opt LifecycleOption) error {
+func (l *lifecycleManager) Create(ctx context.Context, opt LifecycleOption) error {
 	if err := opt.Validate(); err != nil {
 		return err
 	}
 	if err := l.Producer.SendProvisionRequest(
+		ctx,
 		getIdentifier(opt.HostName),
 		&protocol.ProvisionRequest{
 			Instance: &protocol.Instance{
@@ -114,11 +119,12 @@ func (l *lifecycleManager) Create(opt LifecycleOption) error {
 	return nil
 }
 
-func (l *lifecycleManager) Delete(opt LifecycleOption) error {
+func (l *lifecycleManager) Delete(ctx context.Context, opt LifecycleOption) error {
 	if err := opt.Validate(); err != nil {
 		return err
 	}
 	if err := l.Producer.SendProvisionRequest(
+		ctx,
 		getIdentifier(opt.HostName),
 		&protocol.ProvisionRequest{
 			Instance: &protocol.Instance{
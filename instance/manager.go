@@ -7,7 +7,11 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/miragespace/rmc/team"
+
 	extErrors "github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -42,7 +46,7 @@ func NewManager(option ManagerOptions) (*Manager, error) {
 	if option.Logger == nil {
 		return nil, fmt.Errorf("nil Logger is invalid")
 	}
-	if err := option.DB.AutoMigrate(&Instance{}, &History{}); err != nil {
+	if err := option.DB.AutoMigrate(&Instance{}, &History{}, &Schedule{}); err != nil {
 		return nil, extErrors.Wrap(err, "Cannot initilize instance.Manager")
 	}
 	return &Manager{
@@ -52,12 +56,18 @@ func NewManager(option ManagerOptions) (*Manager, error) {
 
 // Create will insert an Instance record to the database
 func (m *Manager) Create(ctx context.Context, inst *Instance) error {
-	result := m.DB.WithContext(ctx).Create(inst)
-	if result.Error != nil {
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// the initial History is inserted along with the Instance
+		if err := lockHistorySeq(tx); err != nil {
+			return err
+		}
+		return tx.Create(inst).Error
+	})
+	if err != nil {
 		m.Logger.Error("Unable to create new instance in database",
-			zap.Error(result.Error),
+			zap.Error(err),
 		)
-		return extErrors.Wrap(result.Error, "Cannot create instance")
+		return extErrors.Wrap(err, "Cannot create instance")
 	}
 	return nil
 }
@@ -102,6 +112,7 @@ func (m *Manager) Get(ctx context.Context, opt GetOption) (*Instance, error) {
 type ListOption struct {
 	CustomerID        string
 	SubscriptionID    string
+	Access            *team.Access // instances shared with the customer, instead of CustomerID
 	IncludeTerminated bool
 	Before            time.Time
 	Limit             int
@@ -114,8 +125,10 @@ func (m *Manager) List(ctx context.Context, opt ListOption) ([]Instance, error)
 		baseQuery = baseQuery.Where("customer_id = ?", opt.CustomerID)
 	} else if len(opt.SubscriptionID) > 0 {
 		baseQuery = baseQuery.Where("subscription_id = ?", opt.SubscriptionID)
+	} else if opt.Access != nil {
+		baseQuery = baseQuery.Where("customer_id IN ? OR id IN ?", opt.Access.OwnerIDs, opt.Access.InstanceIDs)
 	} else {
-		return nil, fmt.Errorf("Either ListOption.CustomerID or ListOption.SubscriptionID is required")
+		return nil, fmt.Errorf("Either ListOption.CustomerID, ListOption.SubscriptionID or ListOption.Access is required")
 	}
 	if !opt.IncludeTerminated {
 		baseQuery = baseQuery.Where("status = ?", StatusActive)
@@ -152,11 +165,25 @@ type LambdaResult struct {
 	Instance    *Instance
 	ReturnValue interface{}
 	TxError     error
+	History     *History // The state change recorded by the update. nil if the state did not change
 }
 
+var lambdaFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "rmc_instance_lambda_update_failures_total",
+	Help: "LambdaUpdate transactions that failed, e.g. after a serialization failure",
+})
+
 // LambdaUpdate will perform a transactional update based on the lambda function.
 // The selected Instance will be locked with FOR UPDATE
 func (m *Manager) LambdaUpdate(ctx context.Context, id string, lambda LambdaUpdateFunc) LambdaResult {
+	result := m.lambdaUpdate(ctx, id, lambda)
+	if result.TxError != nil {
+		lambdaFailures.Inc()
+	}
+	return result
+}
+
+func (m *Manager) lambdaUpdate(ctx context.Context, id string, lambda LambdaUpdateFunc) LambdaResult {
 	logger := m.Logger.With(
 		zap.String("InstanceID", id),
 	)
@@ -204,12 +231,14 @@ func (m *Manager) LambdaUpdate(ctx context.Context, id string, lambda LambdaUpda
 		}
 		logger = logger.With(zap.Time("ReferenceTime", ref.ReferenceTime))
 
-		if err := m.logHistory(tx, ref); err != nil {
+		hist, err := m.logHistory(tx, ref)
+		if err != nil {
 			logger.Error("Cannot insert History log",
 				zap.Error(err),
 			)
 			return err
 		}
+		result.History = hist
 		return nil
 
 	}, &sql.TxOptions{
@@ -225,18 +254,94 @@ type historyRef struct {
 	ReferenceTime time.Time
 }
 
-func (m *Manager) logHistory(tx *gorm.DB, ref historyRef) error {
-	if histRes := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&History{
+// historySeqLock is the advisory lock held from inserting a History until the transaction ends, so History.Seq
+// is assigned in commit order. Otherwise a History could commit after one with a greater Seq, and a client
+// resuming the event stream after the latter would never receive it
+const historySeqLock = 0x726d63686973 // "rmchis"
+
+// lockHistorySeq must be called in the transaction before a History is inserted
+func lockHistorySeq(tx *gorm.DB) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(?)", historySeqLock).Error
+}
+
+func (m *Manager) logHistory(tx *gorm.DB, ref historyRef) (*History, error) {
+	if err := lockHistorySeq(tx); err != nil {
+		return nil, err
+	}
+	hist := &History{
 		InstanceID: ref.Instance.ID,
-		Timestamp:  ref.ReferenceTime,
-		State:      ref.Instance.State,
-	}); histRes.Error != nil {
-		return histRes.Error
+		// Postgres keeps microseconds
+		Timestamp: ref.ReferenceTime.Truncate(time.Microsecond),
+		State:     ref.Instance.State,
 	}
-	return nil
+	histRes := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(hist)
+	if histRes.Error != nil {
+		return nil, histRes.Error
+	}
+	if histRes.RowsAffected == 0 {
+		// recorded before, e.g. a redelivered heartbeat
+		return hist, nil
+	}
+	if err := notifyHistory(tx, ref.Instance, hist); err != nil {
+		return nil, err
+	}
+	return hist, nil
+}
+
+// HistoryListOption is used when querying for the History of an Instance
+type HistoryListOption struct {
+	InstanceID string
+	From       time.Time // inclusive
+	To         time.Time // exclusive
+	Before     time.Time // cursor, the Timestamp of the last History of the previous page
+	Limit      int
 }
 
-func (m *Manager) listSubscriptionIDs(ctx context.Context, instanceIDs []string) ([]string, error) {
+// ListHistory will return the History of an Instance as specified in HistoryListOption, newest first
+func (m *Manager) ListHistory(ctx context.Context, opt HistoryListOption) ([]History, error) {
+	if len(opt.InstanceID) == 0 {
+		return nil, fmt.Errorf("HistoryListOption.InstanceID is required")
+	}
+	baseQuery := m.DB.WithContext(ctx).
+		Where("instance_id = ?", opt.InstanceID).
+		Scopes(historyWithLimit(opt.Limit))
+	if !opt.From.IsZero() {
+		baseQuery = baseQuery.Where("timestamp >= ?", opt.From)
+	}
+	if !opt.To.IsZero() {
+		baseQuery = baseQuery.Where("timestamp < ?", opt.To)
+	}
+	if !opt.Before.IsZero() {
+		baseQuery = baseQuery.Where("timestamp < ?", opt.Before)
+	}
+
+	histories := make([]History, 0, 2)
+	if err := baseQuery.Find(&histories).Error; err != nil {
+		return nil, extErrors.Wrap(err, "Cannot list instance history")
+	}
+	return histories, nil
+}
+
+// listRunningSubscriptionIDs returns the SubscriptionID of each running instance, keyed by InstanceID
+func (m *Manager) listRunningSubscriptionIDs(ctx context.Context) (map[string]string, error) {
+	insts := make([]Instance, 0, 2)
+	result := m.DB.WithContext(ctx).
+		Select("id", "subscription_id").
+		Find(&insts, "state = ?", StateRunning)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	subIDs := make(map[string]string, len(insts))
+	for _, inst := range insts {
+		subIDs[inst.ID] = inst.SubscriptionID
+	}
+	return subIDs, nil
+}
+
+// listInstances returns the instances with the given IDs, keyed by InstanceID
+func (m *Manager) listInstances(ctx context.Context, instanceIDs []string) (map[string]Instance, error) {
 	if len(instanceIDs) == 0 {
 		return nil, nil
 	}
@@ -248,9 +353,9 @@ func (m *Manager) listSubscriptionIDs(ctx context.Context, instanceIDs []string)
 		return nil, result.Error
 	}
 
-	subIDs := make([]string, 0, len(insts))
+	byID := make(map[string]Instance, len(insts))
 	for _, inst := range insts {
-		subIDs = append(subIDs, inst.SubscriptionID)
+		byID[inst.ID] = inst
 	}
-	return subIDs, nil
+	return byID, nil
 }
@@ -0,0 +1,55 @@
+package instance
+
+import (
+	"context"
+
+	"github.com/miragespace/rmc/metrics"
+
+	"go.uber.org/zap"
+)
+
+// states are reported even without instances, so alerts can compare against zero
+var states = []State{
+	StateError,
+	StateProvisioning,
+	StateStarting,
+	StateRunning,
+	StateStopping,
+	StateStopped,
+	StateRemoving,
+}
+
+// RegisterMetrics will expose the number of active instances by State on /metrics. It must be called once
+func (m *Manager) RegisterMetrics() {
+	metrics.NewGaugeFunc("rmc_instances", "Number of active instances by state", []string{"state"}, func(ctx context.Context) []metrics.Sample {
+		type count struct {
+			State State
+			Count int64
+		}
+		counts := make([]count, 0, len(states))
+		if err := m.DB.WithContext(ctx).
+			Model(&Instance{}).
+			Select("state, count(*) AS count").
+			Where("status = ?", StatusActive).
+			Group("state").
+			Scan(&counts).Error; err != nil {
+			m.Logger.Error("Unable to count instances for metrics",
+				zap.Error(err),
+			)
+			return nil
+		}
+
+		byState := make(map[State]int64, len(counts))
+		for _, c := range counts {
+			byState[c.State] = c.Count
+		}
+		samples := make([]metrics.Sample, 0, len(states))
+		for _, state := range states {
+			samples = append(samples, metrics.Sample{
+				LabelValues: []string{string(state)},
+				Value:       float64(byState[state]),
+			})
+		}
+		return samples
+	})
+}
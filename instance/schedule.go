@@ -0,0 +1,360 @@
+package instance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	extErrors "github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// ScheduleType is the custom type to define how a Schedule is specified
+type ScheduleType string
+
+// Define the valid schedule types
+const (
+	ScheduleCron   ScheduleType = "cron"   // Action is performed whenever Cron matches
+	ScheduleWeekly ScheduleType = "weekly" // Started at StartTime and stopped at StopTime on each of the Days
+)
+
+const (
+	maxSchedules = 10
+	// minScheduleGap is how close the actions of a schedule can be, as starting and stopping is expensive on the host
+	minScheduleGap = time.Minute * 15
+	// scheduleGapSamples is how many upcoming actions are checked against minScheduleGap
+	scheduleGapSamples = 50
+)
+
+// Schedule starts or stops an Instance at the specified times, in the Timezone of the customer.
+// Actions are performed with the permissions of the customer who created it, with the same checks as API requests
+type Schedule struct {
+	ID         string       `json:"id" gorm:"primaryKey"`
+	InstanceID string       `json:"instanceId" gorm:"index;not null"`
+	CreatedBy  string       `json:"createdBy" gorm:"not null"` // Customer.ID of the creator
+	Type       ScheduleType `json:"type" gorm:"not null"`
+	Action     string       `json:"action,omitempty"`    // ScheduleCron only. ControlStart or ControlStop
+	Cron       string       `json:"cron,omitempty"`      // ScheduleCron only. e.g. "0 18 * * fri" (minute hour day-of-month month day-of-week)
+	Days       string       `json:"-"`                   // ScheduleWeekly only. Space separated days, e.g. "fri sat". See DayList
+	StartTime  string       `json:"startTime,omitempty"` // ScheduleWeekly only. e.g. "18:00"
+	StopTime   string       `json:"stopTime,omitempty"`  // ScheduleWeekly only. e.g. "23:30". Earlier than StartTime to stop on the next day
+	Timezone   string       `json:"timezone" gorm:"not null"`
+	Enabled    bool         `json:"enabled"`
+	NextRunAt  *time.Time   `json:"nextRunAt" gorm:"index"` // Nil if disabled, or if the schedule never matches again
+	NextAction string       `json:"nextAction"`
+	LastRunAt  *time.Time   `json:"lastRunAt"`
+	LastResult string       `json:"lastResult"`
+	CreatedAt  time.Time    `json:"createdAt"`
+
+	DayList []string `json:"days,omitempty" gorm:"-"`
+}
+
+// GetDays returns the Days of a ScheduleWeekly
+func (s *Schedule) GetDays() []string {
+	if s.Days == "" {
+		return nil
+	}
+	return strings.Split(s.Days, " ")
+}
+
+// SetDays sets the Days of a ScheduleWeekly
+func (s *Schedule) SetDays(days []string) {
+	normalized := make([]string, 0, len(days))
+	for _, day := range days {
+		normalized = append(normalized, strings.ToLower(day))
+	}
+	s.Days = strings.Join(normalized, " ")
+}
+
+type scheduleRule struct {
+	spec   *cronSpec
+	action string
+}
+
+// parseClock parses "HH:MM"
+func parseClock(s string) (int, int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s is not a time of day (HH:MM)", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// rules compiles the Schedule into cron expressions, and validates it
+func (s *Schedule) rules() ([]scheduleRule, error) {
+	switch s.Type {
+	case ScheduleCron:
+		if s.Action != ControlStart && s.Action != ControlStop {
+			return nil, fmt.Errorf("Action must be Start or Stop")
+		}
+		spec, err := parseCron(s.Cron)
+		if err != nil {
+			return nil, err
+		}
+		return []scheduleRule{{spec: spec, action: s.Action}}, nil
+
+	case ScheduleWeekly:
+		days := s.GetDays()
+		if len(days) == 0 {
+			return nil, fmt.Errorf("At least one day is required")
+		}
+		startDays := make([]string, 0, len(days))
+		stopDays := make([]string, 0, len(days))
+		for _, day := range days {
+			d, ok := dayNames[day]
+			if !ok {
+				return nil, fmt.Errorf("%s is not a day (sun, mon, tue, wed, thu, fri or sat)", day)
+			}
+			startDays = append(startDays, day)
+			stopDays = append(stopDays, fmt.Sprint(d))
+		}
+		startHour, startMinute, err := parseClock(s.StartTime)
+		if err != nil {
+			return nil, err
+		}
+		stopHour, stopMinute, err := parseClock(s.StopTime)
+		if err != nil {
+			return nil, err
+		}
+		if startHour*60+startMinute > stopHour*60+stopMinute {
+			// the window ends on the next day
+			for i, day := range days {
+				stopDays[i] = fmt.Sprint((dayNames[day] + 1) % 7)
+			}
+		}
+		start, err := parseCron(fmt.Sprintf("%d %d * * %s", startMinute, startHour, strings.Join(startDays, ",")))
+		if err != nil {
+			return nil, err
+		}
+		stop, err := parseCron(fmt.Sprintf("%d %d * * %s", stopMinute, stopHour, strings.Join(stopDays, ",")))
+		if err != nil {
+			return nil, err
+		}
+		return []scheduleRule{{spec: start, action: ControlStart}, {spec: stop, action: ControlStop}}, nil
+
+	default:
+		return nil, fmt.Errorf("Type must be cron or weekly")
+	}
+}
+
+// nextRun returns the first action of the rules after t, in the Timezone. ok is false if no rule matches again
+func nextRun(rules []scheduleRule, loc *time.Location, t time.Time) (next time.Time, action string, ok bool) {
+	for _, rule := range rules {
+		n := rule.spec.next(t.In(loc))
+		if n.IsZero() {
+			continue
+		}
+		if !ok || n.Before(next) {
+			next, action, ok = n, rule.action, true
+		}
+	}
+	return
+}
+
+// location returns the Timezone of the Schedule, defaulting to UTC
+func (s *Schedule) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		s.Timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown timezone %s", s.Timezone)
+	}
+	return loc, nil
+}
+
+// upcoming returns up to scheduleGapSamples actions of the Schedule after t, in order
+func (s *Schedule) upcoming(t time.Time) ([]time.Time, error) {
+	loc, err := s.location()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := s.rules()
+	if err != nil {
+		return nil, err
+	}
+	times := make([]time.Time, 0, scheduleGapSamples)
+	for len(times) < scheduleGapSamples {
+		next, _, ok := nextRun(rules, loc, t)
+		if !ok {
+			break
+		}
+		times = append(times, next)
+		t = next
+	}
+	return times, nil
+}
+
+// checkGap returns an error if any of the upcoming actions are closer than minScheduleGap
+func checkGap(times []time.Time) error {
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+	for i := 1; i < len(times); i++ {
+		if times[i].Sub(times[i-1]) < minScheduleGap {
+			return fmt.Errorf("Actions must be at least %s apart", minScheduleGap)
+		}
+	}
+	return nil
+}
+
+// schedule validates the Schedule, and sets when it should run next after t
+func (s *Schedule) schedule(t time.Time) error {
+	loc, err := s.location()
+	if err != nil {
+		return err
+	}
+	rules, err := s.rules()
+	if err != nil {
+		return err
+	}
+	// upcoming actions must not be too close together
+	times, err := s.upcoming(t)
+	if err != nil {
+		return err
+	}
+	if err := checkGap(times); err != nil {
+		return err
+	}
+
+	s.NextRunAt = nil
+	s.NextAction = ""
+	if !s.Enabled {
+		return nil
+	}
+	if next, action, ok := nextRun(rules, loc, t); ok {
+		next = next.UTC()
+		s.NextRunAt = &next
+		s.NextAction = action
+	}
+	return nil
+}
+
+// checkInstanceGap validates that the actions of the enabled Schedule are not too close to those of the other
+// enabled Schedules of the instance, as they all start and stop the same instance. Must be called within a transaction
+func checkInstanceGap(tx *gorm.DB, s *Schedule, t time.Time) error {
+	if !s.Enabled {
+		return nil
+	}
+	others := make([]Schedule, 0)
+	if err := tx.
+		Where("instance_id = ? AND id <> ? AND enabled = ?", s.InstanceID, s.ID, true).
+		Find(&others).Error; err != nil {
+		return extErrors.Wrap(err, "Cannot list schedules")
+	}
+	times, err := s.upcoming(t)
+	if err != nil {
+		return ErrInvalidSchedule{err}
+	}
+	for i := range others {
+		upcoming, err := others[i].upcoming(t)
+		if err != nil {
+			// saved schedules were validated before
+			continue
+		}
+		times = append(times, upcoming...)
+	}
+	if err := checkGap(times); err != nil {
+		return ErrInvalidSchedule{fmt.Errorf("Actions must be at least %s apart from those of the other schedules of the instance", minScheduleGap)}
+	}
+	return nil
+}
+
+// ErrInvalidSchedule is returned when the schedule is not valid. The error message describes why
+type ErrInvalidSchedule struct {
+	error
+}
+
+// ErrTooManySchedules is returned when an instance already has maxSchedules
+var ErrTooManySchedules = errors.New("Too many schedules")
+
+// CreateSchedule will validate and insert the Schedule. ErrInvalidSchedule is returned if it is not valid
+func (m *Manager) CreateSchedule(ctx context.Context, s *Schedule) error {
+	s.ID = uuid.New().String()
+	now := time.Now()
+	if err := s.schedule(now); err != nil {
+		return ErrInvalidSchedule{err}
+	}
+	return m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Schedule{}).Where("instance_id = ?", s.InstanceID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= maxSchedules {
+			return ErrTooManySchedules
+		}
+		if err := checkInstanceGap(tx, s, now); err != nil {
+			return err
+		}
+		return tx.Create(s).Error
+	})
+}
+
+// ListSchedules returns the Schedules of the Instance, oldest first
+func (m *Manager) ListSchedules(ctx context.Context, instanceID string) ([]Schedule, error) {
+	schedules := make([]Schedule, 0, 1)
+	if err := m.DB.WithContext(ctx).
+		Where("instance_id = ?", instanceID).
+		Order("created_at ASC").
+		Find(&schedules).Error; err != nil {
+		return nil, extErrors.Wrap(err, "Cannot list schedules")
+	}
+	for i := range schedules {
+		schedules[i].DayList = schedules[i].GetDays()
+	}
+	return schedules, nil
+}
+
+// GetSchedule returns the Schedule of the Instance. nil is returned if the Schedule does not exist
+func (m *Manager) GetSchedule(ctx context.Context, instanceID, scheduleID string) (*Schedule, error) {
+	var s Schedule
+	result := m.DB.WithContext(ctx).
+		Where("id = ? AND instance_id = ?", scheduleID, instanceID).
+		Limit(1).
+		Find(&s)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot get schedule")
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	s.DayList = s.GetDays()
+	return &s, nil
+}
+
+// UpdateSchedule will validate and save the changes to the Schedule, and reschedule it.
+// ErrInvalidSchedule is returned if it is not valid
+func (m *Manager) UpdateSchedule(ctx context.Context, s *Schedule) error {
+	now := time.Now()
+	if err := s.schedule(now); err != nil {
+		return ErrInvalidSchedule{err}
+	}
+	if err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := checkInstanceGap(tx, s, now); err != nil {
+			return err
+		}
+		return tx.Save(s).Error
+	}); err != nil {
+		if _, ok := err.(ErrInvalidSchedule); ok {
+			return err
+		}
+		return extErrors.Wrap(err, "Cannot update schedule")
+	}
+	s.DayList = s.GetDays()
+	return nil
+}
+
+// DeleteSchedule will delete the Schedule of the Instance, and returns whether it existed
+func (m *Manager) DeleteSchedule(ctx context.Context, instanceID, scheduleID string) (bool, error) {
+	result := m.DB.WithContext(ctx).
+		Where("id = ? AND instance_id = ?", scheduleID, instanceID).
+		Delete(&Schedule{})
+	if result.Error != nil {
+		return false, extErrors.Wrap(result.Error, "Cannot delete schedule")
+	}
+	return result.RowsAffected > 0, nil
+}
@@ -0,0 +1,218 @@
+package instance
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miragespace/rmc/audit"
+	resp "github.com/miragespace/rmc/response"
+	"github.com/miragespace/rmc/subscription"
+	"github.com/miragespace/rmc/team"
+	"github.com/miragespace/rmc/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	scheduleBatch = 100
+	// maxScheduleDelay is how late an action can still be performed, e.g. after the task service was down
+	maxScheduleDelay = time.Minute * 10
+)
+
+// SchedulerOptions describes the dependencies of Scheduler
+type SchedulerOptions struct {
+	InstanceManager     *Manager
+	SubscriptionManager *subscription.Manager
+	LifecycleManager    LifecycleManager
+	Policy              team.Policy
+	AuditManager        *audit.Manager // Optional. Scheduled actions are only recorded in the audit log if an AuditManager is provided
+	Logger              *zap.Logger
+}
+
+// Scheduler performs the actions of Schedules when they are due. Multiple replicas can run at the same time,
+// as each action is claimed by a single replica
+type Scheduler struct {
+	SchedulerOptions
+}
+
+// NewScheduler returns a new Scheduler
+func NewScheduler(option SchedulerOptions) (*Scheduler, error) {
+	if option.InstanceManager == nil {
+		return nil, fmt.Errorf("nil InstanceManager is invalid")
+	}
+	if option.SubscriptionManager == nil {
+		return nil, fmt.Errorf("nil SubscriptionManager is invalid")
+	}
+	if option.LifecycleManager == nil {
+		return nil, fmt.Errorf("nil LifecycleManager is invalid")
+	}
+	if option.Policy == nil {
+		return nil, fmt.Errorf("nil Policy is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	return &Scheduler{
+		SchedulerOptions: option,
+	}, nil
+}
+
+func (s *Scheduler) controller() *controller {
+	return &controller{
+		InstanceManager:     s.InstanceManager,
+		SubscriptionManager: s.SubscriptionManager,
+		LifecycleManager:    s.LifecycleManager,
+		Policy:              s.Policy,
+		Logger:              s.Logger,
+	}
+}
+
+// RunDue performs the actions of the Schedules that are due
+func (s *Scheduler) RunDue(ctx context.Context) {
+	now := time.Now()
+	due := make([]Schedule, 0)
+	if err := s.InstanceManager.DB.WithContext(ctx).
+		Where("enabled = ?", true).
+		Where("next_run_at <= ?", now).
+		Order("next_run_at ASC").
+		Limit(scheduleBatch).
+		Find(&due).Error; err != nil {
+		s.Logger.Error("Unable to list due schedules",
+			zap.Error(err),
+		)
+		return
+	}
+
+	for i := range due {
+		sched := &due[i]
+		logger := s.Logger.With(
+			zap.String("ScheduleID", sched.ID),
+			zap.String("InstanceID", sched.InstanceID),
+		)
+
+		scheduledAt := *sched.NextRunAt
+		action := sched.NextAction
+		// a schedule that has become invalid (e.g. a timezone removed from tzdata) is disabled
+		if err := sched.schedule(now); err != nil {
+			sched.Enabled = false
+			sched.NextRunAt = nil
+			sched.NextAction = ""
+		}
+
+		// only the replica that moves NextRunAt performs the action
+		result := s.InstanceManager.DB.WithContext(ctx).
+			Model(&Schedule{}).
+			Where("id = ?", sched.ID).
+			Where("next_run_at = ?", scheduledAt).
+			Updates(map[string]interface{}{
+				"enabled":     sched.Enabled,
+				"next_run_at": sched.NextRunAt,
+				"next_action": sched.NextAction,
+				"last_run_at": now,
+			})
+		if result.Error != nil {
+			logger.Error("Unable to claim due schedule",
+				zap.Error(result.Error),
+			)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			// claimed by another replica, or changed in the meantime
+			continue
+		}
+
+		var lastResult string
+		if now.Sub(scheduledAt) > maxScheduleDelay {
+			lastResult = fmt.Sprintf("%s skipped, it was due at %s", action, scheduledAt.Format(time.RFC3339))
+		} else {
+			// each action starts a trace, followed through the host like the requests of customers
+			actionCtx, span := tracing.Start(ctx, "Schedule "+action, trace.SpanKindInternal,
+				attribute.String("rmc.schedule_id", sched.ID),
+				attribute.String("rmc.instance_id", sched.InstanceID),
+			)
+			lastResult = s.perform(actionCtx, tracing.Logger(actionCtx, logger), sched, action)
+			span.End()
+		}
+
+		if err := s.InstanceManager.DB.WithContext(ctx).
+			Model(&Schedule{}).
+			Where("id = ?", sched.ID).
+			Update("last_result", lastResult).Error; err != nil {
+			logger.Error("Unable to record schedule result",
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// perform controls the instance as the creator of the Schedule, and returns the result to be shown to the customer
+func (s *Scheduler) perform(ctx context.Context, logger *zap.Logger, sched *Schedule, action string) string {
+	lambdaResult := s.controller().control(ctx, sched.CreatedBy, sched.InstanceID, action)
+	if lambdaResult.TxError != nil {
+		logger.Error("Unable to update instance status",
+			zap.Error(lambdaResult.TxError),
+		)
+		return action + " failed: Unable to update Instance status"
+	}
+	if lambdaResult.ReturnValue != nil {
+		respError := lambdaResult.ReturnValue.(*resp.Error)
+		if respError.StatusCode == http.StatusNotFound {
+			// the instance was removed, or the creator lost access to it
+			if err := s.InstanceManager.DB.WithContext(ctx).
+				Model(&Schedule{}).
+				Where("id = ?", sched.ID).
+				Updates(map[string]interface{}{
+					"enabled":     false,
+					"next_run_at": nil,
+					"next_action": "",
+				}).Error; err != nil {
+				logger.Error("Unable to disable schedule",
+					zap.Error(err),
+				)
+			}
+		}
+		return action + " skipped: " + strings.Join(respError.Messages, ", ")
+	}
+
+	inst := lambdaResult.Instance
+	if s.AuditManager != nil {
+		if err := s.AuditManager.Record(ctx, &audit.Entry{
+			ActorType:  audit.ActorSystem,
+			ActorID:    "instance.Scheduler",
+			Action:     "instance.schedule",
+			Target:     "/instances/" + inst.ID + "/schedules/" + sched.ID,
+			CustomerID: inst.CustomerID,
+			InstanceID: inst.ID,
+			Outcome:    audit.OutcomeSuccess,
+			Detail:     fmt.Sprintf("%s on behalf of %s", action, sched.CreatedBy),
+		}); err != nil {
+			logger.Error("Unable to record scheduled action in audit log",
+				zap.Error(err),
+			)
+		}
+	}
+	return fmt.Sprintf("%s succeeded, instance is now %s", action, inst.State)
+}
+
+// HandleSchedule will perform the due actions of Schedules at the interval in the background
+func (s *Scheduler) HandleSchedule(ctx context.Context, interval time.Duration) {
+	s.Logger.Info("Instance schedule interval: " + interval.String())
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				s.RunDue(ctx)
+			}
+		}
+	}()
+}
@@ -1,27 +1,43 @@
 package instance
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/miragespace/rmc/audit"
 	"github.com/miragespace/rmc/auth"
 	"github.com/miragespace/rmc/host"
+	"github.com/miragespace/rmc/ratelimit"
 	resp "github.com/miragespace/rmc/response"
 	"github.com/miragespace/rmc/subscription"
+	"github.com/miragespace/rmc/team"
+	"github.com/miragespace/rmc/tracing"
 
 	"github.com/go-chi/chi"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
+const (
+	historyPageSize    = 50
+	maxHistoryPageSize = 200
+)
+
 // ServiceOptions contains the configuration for Service router
 type ServiceOptions struct {
+	Auth                *auth.Auth // step-up verification for destructive actions
 	SubscriptionManager *subscription.Manager
 	HostManager         *host.Manager
 	InstanceManager     *Manager
 	LifecycleManager    LifecycleManager
+	Policy              team.Policy       // authorizes access to instances owned by other customers
+	GrantManager        team.GrantManager // manages the per-instance grants of Policy
+	EventHub            *EventHub
+	Limiter             *ratelimit.Limiter
 	Logger              *zap.Logger
 }
 
@@ -32,6 +48,9 @@ type Service struct {
 
 // NewService will create an instance of the instance API router
 func NewService(option ServiceOptions) (*Service, error) {
+	if option.Auth == nil {
+		return nil, fmt.Errorf("nil Auth is invalid")
+	}
 	if option.SubscriptionManager == nil {
 		return nil, fmt.Errorf("nil SubscriptionManager is invalid")
 	}
@@ -44,6 +63,18 @@ func NewService(option ServiceOptions) (*Service, error) {
 	if option.LifecycleManager == nil {
 		return nil, fmt.Errorf("nil LifecycleManager is invalid")
 	}
+	if option.Policy == nil {
+		return nil, fmt.Errorf("nil Policy is invalid")
+	}
+	if option.GrantManager == nil {
+		return nil, fmt.Errorf("nil GrantManager is invalid")
+	}
+	if option.EventHub == nil {
+		return nil, fmt.Errorf("nil EventHub is invalid")
+	}
+	if option.Limiter == nil {
+		return nil, fmt.Errorf("nil Limiter is invalid")
+	}
 	if option.Logger == nil {
 		return nil, fmt.Errorf("nil Logger is invalid")
 	}
@@ -52,37 +83,231 @@ func NewService(option ServiceOptions) (*Service, error) {
 	}, nil
 }
 
-func (s *Service) getInstance(w http.ResponseWriter, r *http.Request) {
+// controller returns the controller of instances for customer requests
+func (s *Service) controller() *controller {
+	return &controller{
+		InstanceManager:     s.InstanceManager,
+		SubscriptionManager: s.SubscriptionManager,
+		LifecycleManager:    s.LifecycleManager,
+		Policy:              s.Policy,
+		Limiter:             s.Limiter,
+		Logger:              s.Logger,
+	}
+}
+
+// authorize returns whether the customer can perform the action on the instance, which may be owned by someone else
+func (s *Service) authorize(ctx context.Context, customerID string, inst *Instance, action team.Action) (bool, error) {
+	return s.controller().authorize(ctx, customerID, inst, action)
+}
+
+// authorizeUpdate is used within LambdaUpdate, and returns the error response if the customer cannot perform the action
+func (s *Service) authorizeUpdate(ctx context.Context, customerID string, current *Instance, action team.Action) interface{} {
+	return s.controller().authorizeUpdate(ctx, customerID, current, action)
+}
+
+// viewableInstance returns the instance in the URL if the customer can view it. Terminated instances are only
+// returned if includeTerminated is set, e.g. for disputing the bills of removed instances
+func (s *Service) viewableInstance(w http.ResponseWriter, r *http.Request, opt GetOption, includeTerminated bool) (*Instance, bool) {
 	ctx := r.Context()
 	claims := ctx.Value(auth.Context).(*auth.Claims)
-	instanceID := chi.URLParam(r, "id")
 
-	logger := s.Logger.With(
+	logger := tracing.Logger(ctx, s.Logger).With(
 		zap.String("CustomerID", claims.ID),
-		zap.String("InstanceID", instanceID),
+		zap.String("InstanceID", opt.InstanceID),
 	)
 
-	opt := GetOption{
-		InstanceID:  instanceID,
-		WithHistory: true,
-	}
 	inst, err := s.InstanceManager.Get(ctx, opt)
 	if err != nil {
 		logger.Error("Unable to query instance",
 			zap.Error(err),
 		)
 		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get details about the instance"))
-		return
+		return nil, false
 	}
 
-	if inst == nil || inst.CustomerID != claims.ID || inst.Status != StatusActive {
+	if inst == nil || (inst.Status != StatusActive && !includeTerminated) {
 		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find instance with specific ID"))
+		return nil, false
+	}
+
+	allowed, err := s.authorize(ctx, claims.ID, inst, team.ActionViewInstance)
+	if err != nil {
+		logger.Error("Unable to authorize customer",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get details about the instance"))
+		return nil, false
+	}
+	if !allowed {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find instance with specific ID"))
+		return nil, false
+	}
+
+	return inst, true
+}
+
+func (s *Service) getInstance(w http.ResponseWriter, r *http.Request) {
+	inst, ok := s.viewableInstance(w, r, GetOption{
+		InstanceID:  chi.URLParam(r, "id"),
+		WithHistory: true,
+	}, false)
+	if !ok {
 		return
 	}
 
 	resp.WriteResponse(w, r, inst)
 }
 
+// parseTimeParams parses the RFC3339 query params in names, in order. Empty params are zero
+func parseTimeParams(w http.ResponseWriter, r *http.Request, names ...string) ([]time.Time, bool) {
+	times := make([]time.Time, len(names))
+	for i, name := range names {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		parsedTime, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Invalid "+name+" param"))
+			return nil, false
+		}
+		times[i] = parsedTime
+	}
+	return times, true
+}
+
+func (s *Service) listHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	times, ok := parseTimeParams(w, r, "from", "to", "before")
+	if !ok {
+		return
+	}
+	limit := historyPageSize
+	if l := r.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed <= 0 || parsed > maxHistoryPageSize {
+			resp.WriteError(w, r, resp.ErrBadRequest().AddMessages(fmt.Sprintf("limit must be between 1 and %d", maxHistoryPageSize)))
+			return
+		}
+		limit = parsed
+	}
+
+	inst, ok := s.viewableInstance(w, r, GetOption{
+		InstanceID: chi.URLParam(r, "id"),
+	}, true)
+	if !ok {
+		return
+	}
+
+	// the timestamp of the last entry is the before param of the next page
+	histories, err := s.InstanceManager.ListHistory(ctx, HistoryListOption{
+		InstanceID: inst.ID,
+		From:       times[0],
+		To:         times[1],
+		Before:     times[2],
+		Limit:      limit,
+	})
+	if err != nil {
+		s.Logger.Error("Unable to list instance history",
+			zap.String("InstanceID", inst.ID),
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get the history of the instance"))
+		return
+	}
+
+	resp.WriteResponse(w, r, histories)
+}
+
+func (s *Service) getMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	from, to, err := host.ParseMetricsRange(r)
+	if err != nil {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages(err.Error()))
+		return
+	}
+
+	inst, ok := s.viewableInstance(w, r, GetOption{
+		InstanceID: chi.URLParam(r, "id"),
+	}, true)
+	if !ok {
+		return
+	}
+
+	series, err := s.HostManager.GetMetrics(ctx, host.SourceInstance, inst.ID, from, to)
+	if err != nil {
+		s.Logger.Error("Unable to get instance metrics",
+			zap.String("InstanceID", inst.ID),
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get the metrics of the instance"))
+		return
+	}
+
+	resp.WriteResponse(w, r, series)
+}
+
+func (s *Service) getUptime(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	inst, ok := s.viewableInstance(w, r, GetOption{
+		InstanceID: chi.URLParam(r, "id"),
+	}, true)
+	if !ok {
+		return
+	}
+
+	logger := tracing.Logger(ctx, s.Logger).With(
+		zap.String("InstanceID", inst.ID),
+		zap.String("SubscriptionID", inst.SubscriptionID),
+	)
+
+	histories, err := s.InstanceManager.ListHistory(ctx, HistoryListOption{
+		InstanceID: inst.ID,
+	})
+	if err != nil {
+		logger.Error("Unable to list instance history",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot compute the uptime of the instance"))
+		return
+	}
+	// oldest first
+	for i, j := 0, len(histories)-1; i < j; i, j = i+1, j-1 {
+		histories[i], histories[j] = histories[j], histories[i]
+	}
+
+	// the subscription and its usage belong to the owner, not necessarily the customer
+	subOpt := subscription.GetOption{
+		CustomerID:     inst.CustomerID,
+		SubscriptionID: inst.SubscriptionID,
+	}
+	sub, err := s.SubscriptionManager.Get(ctx, subOpt)
+	if err != nil {
+		logger.Error("Unable to get subscription",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot compute the uptime of the instance"))
+		return
+	}
+	usages, err := s.SubscriptionManager.GetUsage(ctx, subOpt)
+	if err != nil {
+		logger.Error("Unable to get subscription usage",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot compute the uptime of the instance"))
+		return
+	}
+	// the current period is only relevant while the instance exists
+	if inst.Status != StatusActive {
+		sub = nil
+	}
+
+	resp.WriteResponse(w, r, computeUptime(histories, usages, sub, time.Now()))
+}
+
 func (s *Service) listInstances(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	claims := ctx.Value(auth.Context).(*auth.Claims)
@@ -99,12 +324,22 @@ func (s *Service) listInstances(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	logger := s.Logger.With(
+	logger := tracing.Logger(ctx, s.Logger).With(
 		zap.String("CustomerID", claims.ID),
 	)
 
+	access, err := s.Policy.Accessible(ctx, claims.ID, team.ActionViewInstance)
+	if err != nil {
+		logger.Error("Unable to get shared instances",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get the list of instances"))
+		return
+	}
+
+	// includes instances shared with the customer through teams and grants
 	opt := ListOption{
-		CustomerID:        claims.ID,
+		Access:            access,
 		IncludeTerminated: all,
 		Before:            parsedTime,
 		Limit:             10,
@@ -131,7 +366,7 @@ func (s *Service) controlInstance(w http.ResponseWriter, r *http.Request) {
 	instanceID := chi.URLParam(r, "id")
 	claims := ctx.Value(auth.Context).(*auth.Claims)
 
-	logger := s.Logger.With(
+	logger := tracing.Logger(ctx, s.Logger).With(
 		zap.String("CustomerID", claims.ID),
 		zap.String("InstanceID", instanceID),
 	)
@@ -142,40 +377,12 @@ func (s *Service) controlInstance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	lambda := func(current *Instance, desired *Instance) (shouldSave bool, respError interface{}) {
-		if current == nil || current.CustomerID != claims.ID || current.Status != StatusActive {
-			respError = resp.ErrNotFound().AddMessages("Cannot find instance with specific ID")
-			return
-		}
-
-		var nextState State
-		switch req.Action {
-		case "Start":
-			if current.State != StateStopped {
-				respError = resp.ErrBadRequest().AddMessages("Instance not in 'Stopped' state")
-				return
-			}
-			nextState = StateStarting
-		case "Stop":
-			if current.State != StateRunning {
-				respError = resp.ErrBadRequest().AddMessages("Instance not in 'Running' state")
-				return
-			}
-			nextState = StateStopping
-		default:
-			respError = resp.ErrBadRequest().AddMessages("Unknown action")
-			return
-		}
-
-		// trigger history insertion
-		desired.PreviousState = current.State
-		desired.State = nextState
-		shouldSave = true
-		return
+	lambdaResult := s.controller().control(ctx, claims.ID, instanceID, req.Action)
+	if lambdaResult.Instance != nil {
+		// the instance may be shared with the customer
+		audit.SetTarget(ctx, lambdaResult.Instance.CustomerID, "")
 	}
 
-	lambdaResult := s.InstanceManager.LambdaUpdate(ctx, instanceID, lambda)
-
 	if lambdaResult.ReturnValue != nil {
 		resp.WriteError(w, r, lambdaResult.ReturnValue.(*resp.Error))
 		return
@@ -189,28 +396,6 @@ func (s *Service) controlInstance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go func(inst *Instance) {
-		opt := LifecycleOption{
-			HostName:   inst.HostName,
-			InstanceID: inst.ID,
-			Parameters: nil,
-		}
-		var err error
-		switch inst.State {
-		case StateStopping:
-			err = s.LifecycleManager.Stop(opt)
-		case StateStarting:
-			err = s.LifecycleManager.Start(opt)
-		}
-		if err != nil {
-			logger.Error("Unable to send control request",
-				zap.Error(err),
-				zap.String("HostName", inst.HostName),
-			)
-			// fail through: as long as database state is consistent, manual mediation is possible
-		}
-	}(lambdaResult.Instance)
-
 	// background task should handle the aggregate usage update
 
 	w.WriteHeader(http.StatusAccepted)
@@ -221,16 +406,19 @@ func (s *Service) deleteInstance(w http.ResponseWriter, r *http.Request) {
 	instanceID := chi.URLParam(r, "id")
 	claims := ctx.Value(auth.Context).(*auth.Claims)
 
-	logger := s.Logger.With(
+	logger := tracing.Logger(ctx, s.Logger).With(
 		zap.String("CustomerID", claims.ID),
 		zap.String("InstanceID", instanceID),
 	)
 
 	lambda := func(current *Instance, desired *Instance) (shouldSave bool, respError interface{}) {
-		if current == nil || current.CustomerID != claims.ID || current.Status != StatusActive {
+		if current == nil || current.Status != StatusActive {
 			respError = resp.ErrNotFound().AddMessages("Cannot find instance with specific ID")
 			return
 		}
+		if respError = s.authorizeUpdate(ctx, claims.ID, current, team.ActionManageInstance); respError != nil {
+			return
+		}
 
 		if current.State != StateStopped {
 			if current.PreviousState == StateProvisioning && current.State == StateError {
@@ -249,6 +437,10 @@ func (s *Service) deleteInstance(w http.ResponseWriter, r *http.Request) {
 	}
 
 	lambdaResult := s.InstanceManager.LambdaUpdate(ctx, instanceID, lambda)
+	if lambdaResult.Instance != nil {
+		// the instance may be shared with the customer
+		audit.SetTarget(ctx, lambdaResult.Instance.CustomerID, "")
+	}
 
 	if lambdaResult.ReturnValue != nil {
 		resp.WriteError(w, r, lambdaResult.ReturnValue.(*resp.Error))
@@ -263,20 +455,20 @@ func (s *Service) deleteInstance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go func(inst *Instance) {
+	go func(ctx context.Context, inst *Instance) {
 		opt := LifecycleOption{
 			HostName:   inst.HostName,
 			InstanceID: inst.ID,
 			Parameters: &inst.Parameters,
 		}
-		if err := s.LifecycleManager.Delete(opt); err != nil {
+		if err := s.LifecycleManager.Delete(ctx, opt); err != nil {
 			logger.Error("Unable to send DELETE provision request",
 				zap.Error(err),
 				zap.String("HostName", inst.HostName),
 			)
 			// fail through: as long as database state is consistent, manual mediation is possible
 		}
-	}(lambdaResult.Instance)
+	}(tracing.Detach(ctx), lambdaResult.Instance)
 
 	// background task should handle cancelling subscription, if DELETE was successful
 
@@ -295,7 +487,13 @@ func (s *Service) newInstance(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	claims := ctx.Value(auth.Context).(*auth.Claims)
 
-	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+	// admins of a team can create instances on the owner's subscriptions, which are billed to the owner
+	owner := team.Owner(r, claims.ID)
+
+	logger := tracing.Logger(ctx, s.Logger).With(
+		zap.String("CustomerID", claims.ID),
+		zap.String("OwnerID", owner),
+	)
 
 	var req NewInstanceRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -303,8 +501,21 @@ func (s *Service) newInstance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	allowed, err := s.Policy.Authorize(ctx, claims.ID, team.Resource{OwnerID: owner}, team.ActionManageInstance)
+	if err != nil {
+		logger.Error("Unable to authorize customer",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to create Instance"))
+		return
+	}
+	if !allowed {
+		resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Only owner and admins can create instances"))
+		return
+	}
+
 	subOpt := subscription.GetOption{
-		CustomerID:     claims.ID,
+		CustomerID:     owner,
 		SubscriptionID: req.SubscriptionID,
 	}
 	sub, err := s.SubscriptionManager.Get(ctx, subOpt)
@@ -315,7 +526,7 @@ func (s *Service) newInstance(w http.ResponseWriter, r *http.Request) {
 		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to create Instance"))
 		return
 	}
-	if sub == nil || sub.State != subscription.StateActive {
+	if sub == nil || !sub.Usable() {
 		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Invalid Subscription: non-existent or inactive"))
 		return
 	}
@@ -362,8 +573,9 @@ func (s *Service) newInstance(w http.ResponseWriter, r *http.Request) {
 		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to create Instance", "Cannot fetch Plan from database"))
 		return
 	}
-	if plan.Retired {
-		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Unable to create Instance", "Subscription is invalid or is tied to a retired Plan"))
+	// subscriptions of a retired Plan are grandfathered, so it is not checked here
+	if plan == nil {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Unable to create Instance", "Subscription is tied to a non-existent Plan"))
 		return
 	}
 
@@ -375,7 +587,7 @@ func (s *Service) newInstance(w http.ResponseWriter, r *http.Request) {
 
 	inst := Instance{
 		ID:             newID,
-		CustomerID:     claims.ID,
+		CustomerID:     owner,
 		SubscriptionID: req.SubscriptionID,
 		HostName:       host.Name,
 		Parameters:     instanceParams,
@@ -399,21 +611,22 @@ func (s *Service) newInstance(w http.ResponseWriter, r *http.Request) {
 		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to create Instance"))
 		return
 	}
+	audit.SetTarget(ctx, "", inst.ID)
 
-	go func() {
+	go func(ctx context.Context) {
 		opt := LifecycleOption{
 			HostName:   host.Name,
 			InstanceID: inst.ID,
 			Parameters: &inst.Parameters,
 		}
-		if err := s.LifecycleManager.Create(opt); err != nil {
+		if err := s.LifecycleManager.Create(ctx, opt); err != nil {
 			logger.Error("Unable to send CREATE provision request",
 				zap.Error(err),
 				zap.String("HostName", inst.HostName),
 			)
 			// fail through: as long as database state is consistent, manual mediation is possible
 		}
-	}()
+	}(tracing.Detach(ctx))
 
 	resp.WriteResponse(w, r, inst)
 }
@@ -422,7 +635,7 @@ func (s *Service) recoverError(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	instanceID := chi.URLParam(r, "id")
 
-	logger := s.Logger.With(
+	logger := tracing.Logger(ctx, s.Logger).With(
 		zap.String("InstanceID", instanceID),
 	)
 
@@ -458,6 +671,10 @@ func (s *Service) recoverError(w http.ResponseWriter, r *http.Request) {
 	}
 
 	lambdaResult := s.InstanceManager.LambdaUpdate(ctx, instanceID, lambda)
+	if lambdaResult.Instance != nil {
+		// the instance may be shared with the customer
+		audit.SetTarget(ctx, lambdaResult.Instance.CustomerID, "")
+	}
 
 	if lambdaResult.ReturnValue != nil {
 		resp.WriteError(w, r, lambdaResult.ReturnValue.(*resp.Error))
@@ -472,7 +689,7 @@ func (s *Service) recoverError(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go func(inst *Instance) {
+	go func(ctx context.Context, inst *Instance) {
 		opt := LifecycleOption{
 			HostName:   inst.HostName,
 			InstanceID: inst.ID,
@@ -481,9 +698,9 @@ func (s *Service) recoverError(w http.ResponseWriter, r *http.Request) {
 		var err error
 		switch inst.State {
 		case StateProvisioning:
-			err = s.LifecycleManager.Create(opt)
+			err = s.LifecycleManager.Create(ctx, opt)
 		case StateRemoving:
-			err = s.LifecycleManager.Delete(opt)
+			err = s.LifecycleManager.Delete(ctx, opt)
 		}
 		if err != nil {
 			logger.Error("Unable to send provision request for recovery",
@@ -492,11 +709,321 @@ func (s *Service) recoverError(w http.ResponseWriter, r *http.Request) {
 			)
 			// fail through: as long as database state is consistent, manual mediation is possible
 		}
-	}(lambdaResult.Instance)
+	}(tracing.Detach(ctx), lambdaResult.Instance)
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// accessManagedInstance returns the instance if the customer can manage who has access to it
+func (s *Service) accessManagedInstance(w http.ResponseWriter, r *http.Request) (*Instance, bool) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	instanceID := chi.URLParam(r, "id")
+
+	logger := tracing.Logger(ctx, s.Logger).With(
+		zap.String("CustomerID", claims.ID),
+		zap.String("InstanceID", instanceID),
+	)
+
+	inst, err := s.InstanceManager.Get(ctx, GetOption{
+		InstanceID: instanceID,
+	})
+	if err != nil {
+		logger.Error("Unable to query instance",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get details about the instance"))
+		return nil, false
+	}
+	if inst == nil || inst.Status != StatusActive {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find instance with specific ID"))
+		return nil, false
+	}
+	audit.SetTarget(ctx, inst.CustomerID, "")
+
+	if respError := s.authorizeUpdate(ctx, claims.ID, inst, team.ActionManageAccess); respError != nil {
+		resp.WriteError(w, r, respError.(*resp.Error))
+		return nil, false
+	}
+	return inst, true
+}
+
+func (s *Service) listGrants(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	inst, ok := s.accessManagedInstance(w, r)
+	if !ok {
+		return
+	}
+
+	grants, err := s.GrantManager.ListGrants(ctx, inst.ID)
+	if err != nil {
+		s.Logger.Error("Unable to list grants",
+			zap.Error(err),
+			zap.String("InstanceID", inst.ID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list grants"))
+		return
+	}
+
+	resp.WriteResponse(w, r, grants)
+}
+
+// GrantRequest contains the request from client to share an instance with another customer
+type GrantRequest struct {
+	Email string    `json:"email"`
+	Role  team.Role `json:"role"`
+}
+
+func (s *Service) putGrant(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	inst, ok := s.accessManagedInstance(w, r)
+	if !ok {
+		return
+	}
+
+	var req GrantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	// creating and deleting instances is reserved to the team
+	if req.Role != team.RoleViewer && req.Role != team.RoleOperator {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Role must be one of: operator, viewer"))
+		return
+	}
+
+	grant, err := s.GrantManager.PutGrant(ctx, team.GrantOption{
+		Resource: team.Resource{
+			OwnerID:    inst.CustomerID,
+			InstanceID: inst.ID,
+		},
+		Email:     req.Email,
+		Role:      req.Role,
+		GrantedBy: claims.ID,
+	})
+	switch err {
+	case nil:
+	case team.ErrCustomerNotFound:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("No customer with the email address. They must log in once before access can be granted"))
+		return
+	case team.ErrAlreadyMember:
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("The owner already has access to the instance"))
+		return
+	default:
+		s.Logger.Error("Unable to grant access",
+			zap.Error(err),
+			zap.String("InstanceID", inst.ID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to grant access"))
+		return
+	}
+
+	resp.WriteResponse(w, r, grant)
+}
+
+func (s *Service) removeGrant(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	customerID := chi.URLParam(r, "customerId")
+
+	inst, ok := s.accessManagedInstance(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.GrantManager.RemoveGrant(ctx, inst.ID, customerID)
+	switch err {
+	case nil:
+	case team.ErrNotFound:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Customer has no grant on the instance"))
+		return
+	default:
+		s.Logger.Error("Unable to remove grant",
+			zap.Error(err),
+			zap.String("InstanceID", inst.ID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to remove grant"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ScheduleRequest is the model of user request to create or replace a schedule
+type ScheduleRequest struct {
+	Type      ScheduleType `json:"type"`
+	Action    string       `json:"action"`
+	Cron      string       `json:"cron"`
+	Days      []string     `json:"days"`
+	StartTime string       `json:"startTime"`
+	StopTime  string       `json:"stopTime"`
+	Timezone  string       `json:"timezone"`
+	Enabled   *bool        `json:"enabled"` // defaults to true
+}
+
+func (req *ScheduleRequest) apply(sched *Schedule) {
+	sched.Type = req.Type
+	sched.Action = req.Action
+	sched.Cron = req.Cron
+	sched.SetDays(req.Days)
+	sched.StartTime = req.StartTime
+	sched.StopTime = req.StopTime
+	sched.Timezone = req.Timezone
+	sched.Enabled = req.Enabled == nil || *req.Enabled
+}
+
+// schedulableInstance returns the instance in the URL if the customer can view it, and can control it if control is set
+func (s *Service) schedulableInstance(w http.ResponseWriter, r *http.Request, control bool) (*Instance, bool) {
+	inst, ok := s.viewableInstance(w, r, GetOption{
+		InstanceID: chi.URLParam(r, "id"),
+	}, false)
+	if !ok || !control {
+		return inst, ok
+	}
+	claims := r.Context().Value(auth.Context).(*auth.Claims)
+	if respError := s.authorizeUpdate(r.Context(), claims.ID, inst, team.ActionControlInstance); respError != nil {
+		resp.WriteError(w, r, respError.(*resp.Error))
+		return nil, false
+	}
+	return inst, true
+}
+
+// writeScheduleError responds with the error of creating or updating a schedule
+func (s *Service) writeScheduleError(w http.ResponseWriter, r *http.Request, err error) {
+	if invalid, ok := err.(ErrInvalidSchedule); ok {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages(invalid.Error()))
+		return
+	}
+	if err == ErrTooManySchedules {
+		resp.WriteError(w, r, resp.ErrConflict().AddMessages(fmt.Sprintf("An instance can have at most %d schedules", maxSchedules)))
+		return
+	}
+	s.Logger.Error("Unable to save schedule",
+		zap.String("InstanceID", chi.URLParam(r, "id")),
+		zap.Error(err),
+	)
+	resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to save schedule"))
+}
+
+func (s *Service) listSchedules(w http.ResponseWriter, r *http.Request) {
+	inst, ok := s.schedulableInstance(w, r, false)
+	if !ok {
+		return
+	}
+
+	schedules, err := s.InstanceManager.ListSchedules(r.Context(), inst.ID)
+	if err != nil {
+		s.Logger.Error("Unable to list schedules",
+			zap.String("InstanceID", inst.ID),
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list schedules"))
+		return
+	}
+
+	resp.WriteResponse(w, r, schedules)
+}
+
+func (s *Service) createSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	var req ScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+
+	inst, ok := s.schedulableInstance(w, r, true)
+	if !ok {
+		return
+	}
+
+	sched := &Schedule{
+		InstanceID: inst.ID,
+		CreatedBy:  claims.ID,
+	}
+	req.apply(sched)
+	if err := s.InstanceManager.CreateSchedule(ctx, sched); err != nil {
+		s.writeScheduleError(w, r, err)
+		return
+	}
+	sched.DayList = sched.GetDays()
+
+	resp.WriteResponse(w, r, sched)
+}
+
+func (s *Service) updateSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	scheduleID := chi.URLParam(r, "scheduleId")
+
+	var req ScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+
+	inst, ok := s.schedulableInstance(w, r, true)
+	if !ok {
+		return
+	}
+
+	sched, err := s.InstanceManager.GetSchedule(ctx, inst.ID, scheduleID)
+	if err != nil {
+		s.Logger.Error("Unable to get schedule",
+			zap.String("InstanceID", inst.ID),
+			zap.String("ScheduleID", scheduleID),
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to get schedule"))
+		return
+	}
+	if sched == nil {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find schedule with specific ID"))
+		return
+	}
+
+	// the schedule now runs with the permissions of the customer who changed it
+	sched.CreatedBy = claims.ID
+	req.apply(sched)
+	if err := s.InstanceManager.UpdateSchedule(ctx, sched); err != nil {
+		s.writeScheduleError(w, r, err)
+		return
+	}
+
+	resp.WriteResponse(w, r, sched)
+}
+
+func (s *Service) deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	scheduleID := chi.URLParam(r, "scheduleId")
+
+	inst, ok := s.schedulableInstance(w, r, true)
+	if !ok {
+		return
+	}
+
+	deleted, err := s.InstanceManager.DeleteSchedule(ctx, inst.ID, scheduleID)
+	if err != nil {
+		s.Logger.Error("Unable to delete schedule",
+			zap.String("InstanceID", inst.ID),
+			zap.String("ScheduleID", scheduleID),
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to delete schedule"))
+		return
+	}
+	if !deleted {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find schedule with specific ID"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Service) AdminRouter() http.Handler {
 	r := chi.NewRouter()
 
@@ -509,11 +1036,24 @@ func (s *Service) AdminRouter() http.Handler {
 func (s *Service) Router() http.Handler {
 	r := chi.NewRouter()
 
-	r.Get("/", s.listInstances)
-	r.Post("/", s.newInstance)
-	r.Get("/{id}", s.getInstance)
-	r.Post("/{id}", s.controlInstance)
-	r.Delete("/{id}", s.deleteInstance)
+	r.With(auth.RequireScope(auth.ScopeInstancesRead)).Get("/", s.listInstances)
+	r.With(auth.RequireScope(auth.ScopeInstancesRead)).Get("/events", s.streamEvents)
+	r.With(auth.RequireScope(auth.ScopeInstancesRead)).Get("/{id}", s.getInstance)
+	r.With(auth.RequireScope(auth.ScopeInstancesRead)).Get("/{id}/history", s.listHistory)
+	r.With(auth.RequireScope(auth.ScopeInstancesRead)).Get("/{id}/uptime", s.getUptime)
+	r.With(auth.RequireScope(auth.ScopeInstancesRead)).Get("/{id}/metrics", s.getMetrics)
+	limit := s.Limiter.Middleware(ratelimit.ControlCustomer, ratelimit.ByCustomer)
+	r.With(auth.RequireScope(auth.ScopeInstancesControl), limit).Post("/{id}", s.controlInstance)
+	r.With(auth.RequireSession, limit).Post("/", s.newInstance)
+	// deleting an instance also cancels its subscription
+	r.With(auth.RequireSession, s.Auth.RequireStepUp, limit).Delete("/{id}", s.deleteInstance)
+	r.With(auth.RequireScope(auth.ScopeInstancesRead)).Get("/{id}/schedules", s.listSchedules)
+	r.With(auth.RequireScope(auth.ScopeInstancesControl)).Post("/{id}/schedules", s.createSchedule)
+	r.With(auth.RequireScope(auth.ScopeInstancesControl)).Put("/{id}/schedules/{scheduleId}", s.updateSchedule)
+	r.With(auth.RequireScope(auth.ScopeInstancesControl)).Delete("/{id}/schedules/{scheduleId}", s.deleteSchedule)
+	r.With(auth.RequireSession).Get("/{id}/grants", s.listGrants)
+	r.With(auth.RequireSession).Put("/{id}/grants", s.putGrant)
+	r.With(auth.RequireSession).Delete("/{id}/grants/{customerId}", s.removeGrant)
 
 	return r
 }
@@ -3,22 +3,34 @@ package instance
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"time"
 
+	"github.com/miragespace/rmc/audit"
+	"github.com/miragespace/rmc/notification"
 	"github.com/miragespace/rmc/spec"
 	"github.com/miragespace/rmc/spec/broker"
 	"github.com/miragespace/rmc/spec/protocol"
 	"github.com/miragespace/rmc/subscription"
+	"github.com/miragespace/rmc/tracing"
+	"github.com/miragespace/rmc/webhook"
 
 	"github.com/golang/protobuf/ptypes"
 	extErrors "github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 type TaskOptions struct {
 	InstanceManager     *Manager
 	SubscriptionManager *subscription.Manager
+	LifecycleManager    LifecycleManager
 	Consumer            broker.Consumer
 	Logger              *zap.Logger
+	NotificationManager *notification.Manager // Optional. Provisioning results are only notified if a NotificationManager is provided
+	WebhookManager      *webhook.Manager      // Optional. State changes are only sent to webhooks if a WebhookManager is provided
+	AuditManager        *audit.Manager        // Optional. State changes are only recorded in the audit log if an AuditManager is provided
 }
 
 type Task struct {
@@ -32,6 +44,9 @@ func NewTask(option TaskOptions) (*Task, error) {
 	if option.SubscriptionManager == nil {
 		return nil, fmt.Errorf("nil SubscriptionManager is invalid")
 	}
+	if option.LifecycleManager == nil {
+		return nil, fmt.Errorf("nil LifecycleManager is invalid")
+	}
 	if option.Consumer == nil {
 		return nil, fmt.Errorf("nil Consumer is invalid")
 	}
@@ -59,7 +74,7 @@ func (t *Task) handleControlReply(ctx context.Context, reply *protocol.ControlRe
 
 	repliedInstance := reply.GetInstance()
 	instanceID := repliedInstance.GetID()
-	logger := t.Logger.With(
+	logger := tracing.Logger(ctx, t.Logger).With(
 		zap.String("InstanceID", instanceID),
 		zap.String("Action", reply.GetRequestAction().String()),
 	)
@@ -119,6 +134,8 @@ func (t *Task) handleControlReply(ctx context.Context, reply *protocol.ControlRe
 			zap.Error(lambdaResult.TxError),
 		)
 	}
+	t.emitStateChange(ctx, lambdaResult)
+	t.recordStateChange(ctx, lambdaResult, "Control reply from host")
 }
 
 func (t *Task) handleProvisionReply(ctx context.Context, reply *protocol.ProvisionReply) {
@@ -137,7 +154,7 @@ func (t *Task) handleProvisionReply(ctx context.Context, reply *protocol.Provisi
 
 	repliedInstance := reply.GetInstance()
 	instanceID := repliedInstance.GetID()
-	logger := t.Logger.With(
+	logger := tracing.Logger(ctx, t.Logger).With(
 		zap.String("InstanceID", instanceID),
 	)
 
@@ -202,6 +219,11 @@ func (t *Task) handleProvisionReply(ctx context.Context, reply *protocol.Provisi
 			zap.Error(lambdaResult.TxError),
 		)
 	}
+	t.emitStateChange(ctx, lambdaResult)
+	t.recordStateChange(ctx, lambdaResult, "Provision reply from host")
+	if lambdaResult.Instance != nil && reply.GetRequestAction() == protocol.ProvisionRequest_CREATE {
+		t.notifyProvisioned(ctx, lambdaResult.Instance)
+	}
 	if lambdaResult.Instance != nil && lambdaResult.Instance.State == StateRemoved {
 		if err := t.SubscriptionManager.CancelSubscription(ctx, lambdaResult.Instance.SubscriptionID); err != nil {
 			logger.Error("Unable to cancel subscription",
@@ -212,6 +234,92 @@ func (t *Task) handleProvisionReply(ctx context.Context, reply *protocol.Provisi
 	}
 }
 
+// emitStateChange sends the state change recorded by LambdaUpdate to the webhooks of the customer
+func (t *Task) emitStateChange(ctx context.Context, result LambdaResult) {
+	if t.WebhookManager == nil || result.TxError != nil || result.History == nil || result.Instance == nil {
+		return
+	}
+	inst := result.Instance
+	data := map[string]interface{}{
+		"instanceId":     inst.ID,
+		"subscriptionId": inst.SubscriptionID,
+		"previousState":  inst.PreviousState,
+		"state":          result.History.State,
+		"timestamp":      result.History.Timestamp,
+	}
+	summary := fmt.Sprintf("Instance %s is now %s", inst.ID, result.History.State)
+	if result.History.State == StateRunning && inst.Parameters["ServerAddr"] != "" {
+		address := inst.Parameters["ServerAddr"] + ":" + inst.Parameters["ServerPort"]
+		data["serverAddress"] = address
+		summary += " at " + address
+	}
+	if err := t.WebhookManager.Emit(ctx, webhook.EmitOption{
+		CustomerID: inst.CustomerID,
+		Event:      webhook.EventInstanceState,
+		Summary:    summary,
+		Data:       data,
+	}); err != nil {
+		t.Logger.Error("Unable to emit instance state change",
+			zap.String("InstanceID", inst.ID),
+			zap.Error(err),
+		)
+	}
+}
+
+// recordStateChange records the state change made by the task in the audit log, with the reason as detail
+func (t *Task) recordStateChange(ctx context.Context, result LambdaResult, reason string) {
+	if t.AuditManager == nil || result.TxError != nil || result.History == nil || result.Instance == nil {
+		return
+	}
+	inst := result.Instance
+	if err := t.AuditManager.Record(ctx, &audit.Entry{
+		Timestamp:  result.History.Timestamp,
+		ActorType:  audit.ActorSystem,
+		ActorID:    "instance.Task",
+		Action:     "instance.state",
+		Target:     "/instances/" + inst.ID,
+		CustomerID: inst.CustomerID,
+		InstanceID: inst.ID,
+		Outcome:    audit.OutcomeSuccess,
+		Detail:     fmt.Sprintf("%s -> %s: %s", inst.PreviousState, result.History.State, reason),
+	}); err != nil {
+		t.Logger.Error("Unable to record instance state change in audit log",
+			zap.String("InstanceID", inst.ID),
+			zap.Error(err),
+		)
+	}
+}
+
+// notifyProvisioned notifies the customer of the result of provisioning. Repeated replies are deduplicated by the NotificationManager
+func (t *Task) notifyProvisioned(ctx context.Context, inst *Instance) {
+	if t.NotificationManager == nil || inst.PreviousState != StateProvisioning {
+		return
+	}
+	opt := notification.NotifyOption{
+		CustomerID: inst.CustomerID,
+		Key:        inst.ID,
+		Data: map[string]interface{}{
+			"InstanceID": inst.ID,
+		},
+	}
+	switch inst.State {
+	case StateRunning:
+		opt.Event = notification.EventInstanceProvisioned
+		opt.Data["ServerAddr"] = inst.Parameters["ServerAddr"]
+		opt.Data["ServerPort"] = inst.Parameters["ServerPort"]
+	case StateError:
+		opt.Event = notification.EventInstanceFailed
+	default:
+		return
+	}
+	if err := t.NotificationManager.Notify(ctx, opt); err != nil {
+		t.Logger.Error("Unable to notify provisioning result",
+			zap.String("InstanceID", inst.ID),
+			zap.Error(err),
+		)
+	}
+}
+
 func (t *Task) handleHeartbeat(ctx context.Context, hb *protocol.Heartbeat) {
 	if len(hb.GetRunningInstanceIDs()) == 0 {
 		return
@@ -223,24 +331,30 @@ func (t *Task) handleHeartbeat(ctx context.Context, hb *protocol.Heartbeat) {
 		)
 		return
 	}
-	logger := t.Logger.With(
+	logger := tracing.Logger(ctx, t.Logger).With(
 		zap.Time("HeartbeatTime", referenceTime),
 		zap.Strings("InstanceIDs", hb.GetRunningInstanceIDs()),
 	)
 
-	subIDs, err := t.InstanceManager.listSubscriptionIDs(ctx, hb.GetRunningInstanceIDs())
+	insts, err := t.InstanceManager.listInstances(ctx, hb.GetRunningInstanceIDs())
 	if err != nil {
 		logger.Error("Unable to get subscription id list for usage aggregation",
 			zap.Error(err),
 		)
 	}
+	subIDs := make(map[string]string, len(insts))
+	for _, inst := range insts {
+		subIDs[inst.ID] = inst.SubscriptionID
+	}
+
+	intervalSeconds := int64(spec.HeartbeatInterval.Seconds())
 
 	aggregationOpts := make([]subscription.PrimaryUsageOption, 0, 2)
 	for _, subID := range subIDs {
 		aggregationOpts = append(aggregationOpts, subscription.PrimaryUsageOption{
 			SubscriptionID: subID,
 			ReferenceTime:  referenceTime,
-			Amount:         int64(spec.HeartbeatInterval.Seconds()),
+			Amount:         intervalSeconds,
 		})
 	}
 	if err := t.SubscriptionManager.IncrementPrimaryUsage(ctx, aggregationOpts); err != nil {
@@ -248,6 +362,174 @@ func (t *Task) handleHeartbeat(ctx context.Context, hb *protocol.Heartbeat) {
 			zap.Error(err),
 		)
 	}
+
+	secondaryOpts := make([]subscription.SecondaryUsageOption, 0, 2)
+	for _, metrics := range hb.GetInstanceMetrics() {
+		subID, ok := subIDs[metrics.GetInstanceID()]
+		if !ok {
+			continue
+		}
+		inst := insts[metrics.GetInstanceID()]
+		// gauges are accumulated over the heartbeat interval, counters are accumulated as is.
+		// The storage included in the plan is not billed by the add-on
+		amounts := map[subscription.Metric]int64{
+			subscription.MetricStorage:       (metrics.GetStorageBytes() - storageAllowance(&inst)) * intervalSeconds,
+			subscription.MetricNetworkEgress: metrics.GetNetworkTxBytes(),
+			subscription.MetricPlayers:       metrics.GetPlayers() * intervalSeconds,
+		}
+		for metric, amount := range amounts {
+			if amount <= 0 {
+				continue
+			}
+			secondaryOpts = append(secondaryOpts, subscription.SecondaryUsageOption{
+				SubscriptionID: subID,
+				Metric:         metric,
+				ReferenceTime:  referenceTime,
+				Amount:         amount,
+			})
+		}
+	}
+	if err := t.SubscriptionManager.IncrementSecondaryUsage(ctx, secondaryOpts); err != nil {
+		logger.Error("Unable to increment secondary usage to SubscriptionManager",
+			zap.Error(err),
+		)
+	}
+
+	subscriptionIDs := make([]string, 0, len(subIDs))
+	for _, subID := range subIDs {
+		subscriptionIDs = append(subscriptionIDs, subID)
+	}
+
+	limited, err := t.SubscriptionManager.EvaluateBudgets(ctx, subscriptionIDs, referenceTime)
+	if err != nil {
+		logger.Error("Unable to evaluate budgets of running instances",
+			zap.Error(err),
+		)
+	}
+	t.stopSubscriptions(ctx, subIDs, limited, "Stopping instance with budget hard limit reached")
+}
+
+// HandleTrials checks the trials of the subscriptions with running instances every interval. Instances of
+// exhausted trials without a payment method are stopped
+func (t *Task) HandleTrials(ctx context.Context, interval time.Duration) {
+	t.Logger.Info("Trial check interval: " + interval.String())
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				t.checkTrials(ctx)
+			}
+		}
+	}()
+}
+
+func (t *Task) checkTrials(ctx context.Context) {
+	subIDs, err := t.InstanceManager.listRunningSubscriptionIDs(ctx)
+	if err != nil {
+		t.Logger.Error("Unable to get subscription id list for trial check",
+			zap.Error(err),
+		)
+		return
+	}
+
+	unique := make(map[string]bool, len(subIDs))
+	subscriptionIDs := make([]string, 0, len(subIDs))
+	for _, subID := range subIDs {
+		if !unique[subID] {
+			unique[subID] = true
+			subscriptionIDs = append(subscriptionIDs, subID)
+		}
+	}
+
+	exhausted, err := t.SubscriptionManager.ExhaustedTrials(ctx, subscriptionIDs, time.Now())
+	if err != nil {
+		t.Logger.Error("Unable to check trials of running instances",
+			zap.Error(err),
+		)
+	}
+	t.stopSubscriptions(ctx, subIDs, exhausted, "Stopping instance with exhausted trial")
+}
+
+const bytesPerGB = 1000 * 1000 * 1000
+
+// storageAllowance returns the storage included in the plan of the instance in bytes, set by the
+// "Storage" parameter in GB. Plans without it include no storage
+func storageAllowance(inst *Instance) int64 {
+	gb, err := strconv.ParseFloat(inst.Parameters["Storage"], 64)
+	if err != nil || gb < 0 {
+		return 0
+	}
+	return int64(gb * bytesPerGB)
+}
+
+// stopSubscriptions stops running instances of the given subscriptions (e.g. free trial exhausted without a payment
+// method on file, or budget hard limit reached). subIDs is keyed by InstanceID
+func (t *Task) stopSubscriptions(ctx context.Context, subIDs map[string]string, subscriptionIDs []string, reason string) {
+	if len(subscriptionIDs) == 0 {
+		return
+	}
+	stop := make(map[string]bool, len(subscriptionIDs))
+	for _, subID := range subscriptionIDs {
+		stop[subID] = true
+	}
+
+	for instanceID, subID := range subIDs {
+		if !stop[subID] {
+			continue
+		}
+		logger := tracing.Logger(ctx, t.Logger).With(
+			zap.String("InstanceID", instanceID),
+			zap.String("SubscriptionID", subID),
+		)
+
+		lambda := func(current *Instance, desired *Instance) (shouldSave bool, returnError interface{}) {
+			if current == nil {
+				returnError = "nil Instance when stopping subscription"
+				return
+			}
+			if current.State != StateRunning {
+				// already stopping
+				return
+			}
+			// trigger history insertion
+			desired.PreviousState = current.State
+			desired.State = StateStopping
+			shouldSave = true
+			return
+		}
+		lambdaResult := t.InstanceManager.LambdaUpdate(ctx, instanceID, lambda)
+		if lambdaResult.ReturnValue != nil {
+			logger.Error(lambdaResult.ReturnValue.(string))
+			continue
+		}
+		if lambdaResult.TxError != nil {
+			logger.Error("Cannot update instance status",
+				zap.Error(lambdaResult.TxError),
+			)
+			continue
+		}
+		t.emitStateChange(ctx, lambdaResult)
+		t.recordStateChange(ctx, lambdaResult, reason)
+		if lambdaResult.Instance.State != StateStopping || lambdaResult.Instance.PreviousState != StateRunning {
+			continue
+		}
+
+		logger.Info(reason)
+		if err := t.LifecycleManager.Stop(ctx, LifecycleOption{
+			HostName:   lambdaResult.Instance.HostName,
+			InstanceID: instanceID,
+		}); err != nil {
+			logger.Error("Unable to send control request",
+				zap.Error(err),
+				zap.String("HostName", lambdaResult.Instance.HostName),
+			)
+		}
+	}
 }
 
 func (t *Task) HandleReply(ctx context.Context) error {
@@ -268,8 +550,12 @@ func (t *Task) HandleReply(ctx context.Context) error {
 			select {
 			case <-ctx.Done():
 				return
-			case reply := <-cChan:
-				t.handleControlReply(ctx, reply)
+			case d := <-cChan:
+				replyCtx, span := tracing.StartChild(d.Context, "ControlReply "+d.GetRequestAction().String(), trace.SpanKindConsumer,
+					attribute.String("rmc.instance_id", d.GetInstance().GetID()),
+				)
+				t.handleControlReply(replyCtx, d.ControlReply)
+				span.End()
 			}
 		}
 	}()
@@ -278,8 +564,12 @@ func (t *Task) HandleReply(ctx context.Context) error {
 			select {
 			case <-ctx.Done():
 				return
-			case reply := <-pChan:
-				t.handleProvisionReply(ctx, reply)
+			case d := <-pChan:
+				replyCtx, span := tracing.StartChild(d.Context, "ProvisionReply "+d.GetRequestAction().String(), trace.SpanKindConsumer,
+					attribute.String("rmc.instance_id", d.GetInstance().GetID()),
+				)
+				t.handleProvisionReply(replyCtx, d.ProvisionReply)
+				span.End()
 			}
 		}
 	}()
@@ -288,8 +578,8 @@ func (t *Task) HandleReply(ctx context.Context) error {
 			select {
 			case <-ctx.Done():
 				return
-			case heartbeat := <-hChan:
-				t.handleHeartbeat(ctx, heartbeat)
+			case d := <-hChan:
+				t.handleHeartbeat(d.Context, d.Heartbeat)
 			}
 		}
 	}()
@@ -0,0 +1,144 @@
+package instance
+
+import (
+	"time"
+
+	"github.com/miragespace/rmc/spec"
+	"github.com/miragespace/rmc/subscription"
+)
+
+// Interval is a period of time during which an Instance was Running
+type Interval struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Ongoing bool      `json:"ongoing"` // The Instance is still Running, and End is the time of the request
+}
+
+// PeriodUptime describes when an Instance was Running within a billing period, as recorded in its History,
+// and how much runtime was recorded in Usage (and therefore billed) from the heartbeats of its host
+type PeriodUptime struct {
+	PeriodStart        time.Time  `json:"periodStart"`
+	PeriodEnd          time.Time  `json:"periodEnd"`
+	Intervals          []Interval `json:"intervals"`          // Running intervals clipped to the billing period
+	RunningSeconds     int64      `json:"runningSeconds"`     // Total of the Intervals
+	RunningMinutes     int64      `json:"runningMinutes"`     // RunningSeconds rounded up
+	UsageSeconds       int64      `json:"usageSeconds"`       // Runtime recorded in Usage of the primary Part
+	UsageMinutes       int64      `json:"usageMinutes"`       // UsageSeconds rounded up
+	Unit               string     `json:"unit"`               // Unit of the primary Part. Empty if no Usage was recorded
+	BilledQuantity     int64      `json:"billedQuantity"`     // UsageSeconds in Unit, rounded up, as reported to Stripe
+	DiscrepancySeconds int64      `json:"discrepancySeconds"` // UsageSeconds - RunningSeconds
+	Consistent         bool       `json:"consistent"`         // Whether the discrepancy is within the precision of the heartbeats
+}
+
+// runningIntervals returns the intervals during which the Instance was Running, from its History sorted oldest first
+func runningIntervals(histories []History, now time.Time) []Interval {
+	intervals := make([]Interval, 0, 2)
+	var start *time.Time
+	for i := range histories {
+		h := histories[i]
+		if h.State == StateRunning {
+			if start == nil {
+				start = &h.Timestamp
+			}
+			continue
+		}
+		if start != nil {
+			intervals = append(intervals, Interval{
+				Start: *start,
+				End:   h.Timestamp,
+			})
+			start = nil
+		}
+	}
+	if start != nil {
+		intervals = append(intervals, Interval{
+			Start:   *start,
+			End:     now,
+			Ongoing: true,
+		})
+	}
+	return intervals
+}
+
+func minutesOf(seconds int64) int64 {
+	return (seconds + 59) / 60
+}
+
+// periodUptime computes the uptime within the billing period. usage is the runtime Usage of the period, if any
+func periodUptime(intervals []Interval, start, end time.Time, usage *subscription.Usage) PeriodUptime {
+	p := PeriodUptime{
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Intervals:   make([]Interval, 0, 2),
+	}
+	for _, interval := range intervals {
+		if !interval.Start.Before(end) || !interval.End.After(start) {
+			continue
+		}
+		clipped := interval
+		if clipped.Start.Before(start) {
+			clipped.Start = start
+		}
+		if clipped.End.After(end) {
+			clipped.End = end
+			clipped.Ongoing = false
+		}
+		p.Intervals = append(p.Intervals, clipped)
+		p.RunningSeconds += int64(clipped.End.Sub(clipped.Start) / time.Second)
+	}
+	p.RunningMinutes = minutesOf(p.RunningSeconds)
+
+	if usage != nil {
+		p.UsageSeconds = usage.AggregateTotal
+		p.UsageMinutes = minutesOf(usage.AggregateTotal)
+		p.Unit = usage.SubscriptionItem.Part.Unit
+		if unit, ok := subscription.LookupUnit(p.Unit); ok {
+			p.BilledQuantity = unit.Convert(usage.AggregateTotal)
+		}
+	}
+	p.DiscrepancySeconds = p.UsageSeconds - p.RunningSeconds
+
+	// usage is incremented by a heartbeat interval while running, so each interval may be off by up to one heartbeat
+	tolerance := int64(spec.HeartbeatInterval/time.Second) * int64(len(p.Intervals)+1)
+	p.Consistent = p.DiscrepancySeconds <= tolerance && p.DiscrepancySeconds >= -tolerance
+	return p
+}
+
+// isRuntimeUsage returns whether the Usage is the runtime of the primary Part, which is billed by heartbeats
+func isRuntimeUsage(u *subscription.Usage) bool {
+	part := u.SubscriptionItem.Part
+	if !part.Primary || part.Type != subscription.VariableType {
+		return false
+	}
+	unit, ok := subscription.LookupUnit(part.Unit)
+	return ok && unit.Metric == subscription.MetricRuntime
+}
+
+// computeUptime returns the uptime of each billing period, newest first. Billing periods are those with Usage,
+// and the current period of the subscription if no Usage has been recorded in it yet
+func computeUptime(histories []History, usages []subscription.Usage, current *subscription.Subscription, now time.Time) []PeriodUptime {
+	intervals := runningIntervals(histories, now)
+
+	periods := make([]PeriodUptime, 0, len(usages)+1)
+	seen := make(map[int64]bool)
+	if current != nil {
+		var currentUsage *subscription.Usage
+		for i := range usages {
+			if isRuntimeUsage(&usages[i]) && usages[i].EndDate.Equal(current.PeriodEnd) {
+				currentUsage = &usages[i]
+			}
+		}
+		periods = append(periods, periodUptime(intervals, current.PeriodStart, current.PeriodEnd, currentUsage))
+		seen[current.PeriodEnd.Unix()] = true
+	}
+	// usages are sorted by EndDate, newest first
+	for i := range usages {
+		u := &usages[i]
+		if !isRuntimeUsage(u) || seen[u.EndDate.Unix()] {
+			continue
+		}
+		seen[u.EndDate.Unix()] = true
+		periods = append(periods, periodUptime(intervals, u.StartDate, u.EndDate, u))
+	}
+	return periods
+}
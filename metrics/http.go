@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "rmc_http_request_duration_seconds",
+	Help: "Latency of HTTP requests by chi route pattern",
+}, []string{"router", "method", "route", "status"})
+
+// Middleware records the latency of the requests to the router. It must be used before the routes are
+// matched (with Use on the root router), so the route pattern is complete once the request is served
+func Middleware(router string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			defer func() {
+				// requests not matching any route share a label, to keep the number of series bounded
+				route := "unmatched"
+				if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+					route = rctx.RoutePattern()
+				}
+				status := ww.Status()
+				if status == 0 {
+					status = http.StatusOK
+				}
+				requestDuration.WithLabelValues(router, r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+			}()
+			next.ServeHTTP(ww, r)
+		})
+	}
+}
+
+const (
+	// DefaultListen is the address /metrics is served on by default
+	DefaultListen = ":9100"
+	// LocalListen is the default address of the workers, whose listener also serves the unauthenticated
+	// status page. Set METRICS_LISTEN to a private address to scrape them
+	LocalListen = "127.0.0.1:9100"
+)
+
+// NewServer returns the http.Server exposing /metrics on addr, or DefaultListen if addr is empty.
+// handlers are served on the same listener by path, e.g. the health checks
+func NewServer(addr string, handlers map[string]http.Handler) *http.Server {
+	if addr == "" {
+		addr = DefaultListen
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	for path, handler := range handlers {
+		mux.Handle(path, handler)
+	}
+	return &http.Server{
+		Handler: mux,
+		Addr:    addr,
+	}
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// collectTimeout bounds the queries of a GaugeFunc on each scrape
+const collectTimeout = 10 * time.Second
+
+// Handler returns the http.Handler serving the metrics of the default registry in the Prometheus text format.
+// Packages register their metrics with promauto, and the default registry includes the Go and process collectors
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Sample is a series of a GaugeFunc
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc is a Gauge whose series are collected when the metrics are scraped, e.g. from the database
+type GaugeFunc struct {
+	desc    *prometheus.Desc
+	collect func(ctx context.Context) []Sample
+}
+
+// NewGaugeFunc registers a GaugeFunc with the label names in the default registry. collect is called on every
+// scrape, and the context is cancelled after collectTimeout. It panics if the name is already registered
+func NewGaugeFunc(name, help string, labels []string, collect func(ctx context.Context) []Sample) *GaugeFunc {
+	g := &GaugeFunc{
+		desc:    prometheus.NewDesc(name, help, labels, nil),
+		collect: collect,
+	}
+	prometheus.MustRegister(g)
+	return g
+}
+
+// Describe implements prometheus.Collector
+func (g *GaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+// Collect implements prometheus.Collector
+func (g *GaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+	for _, s := range g.collect(ctx) {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, s.Value, s.LabelValues...)
+	}
+}
@@ -0,0 +1,101 @@
+package notification
+
+// built-in English templates. See docs/setup.md for the data available to each event
+
+type defaultTemplate struct {
+	subject string
+	text    string
+	html    string
+}
+
+const (
+	htmlHeader = `<!doctype html><html><body>`
+	htmlFooter = `<p style="color: #888888; font-size: small;">You are receiving this email because you have an account on <a href="{{ .SiteURL }}">{{ .SiteName }}</a>.</p></body></html>`
+	textFooter = `
+
+--
+You are receiving this email because you have an account on {{ .SiteName }} ({{ .SiteURL }}).
+`
+	preferencesHint     = "\nYou can turn off these notifications in your account settings."
+	htmlPreferencesHint = `<p>You can turn off these notifications in your <a href="{{ .SiteURL }}">account settings</a>.</p>`
+)
+
+var defaultTemplates = map[Event]defaultTemplate{
+	EventLogin: {
+		subject: `Login Token for {{ .SiteName }}`,
+		text: `You (or someone who knows your email address) wants to sign in to {{ .SiteName }}.
+
+Your token (expires in 15 minutes) is {{ .Token }} - or use the following link: {{ .Link }}
+
+(If you did not request or were not expecting this email, you can safely ignore it.)
+`,
+		html: htmlHeader +
+			`<p>You (or someone who knows your email address) wants to sign in to {{ .SiteName }}.</p>` +
+			`<p>Your token (expires in 15 minutes) is <b>{{ .Token }}</b> - or <a href="{{ .Link }}">click here</a> to sign in automatically.</p>` +
+			`<p>(If you did not request or were not expecting this email, you can safely ignore it.)</p>` +
+			`</body></html>`,
+	},
+	EventInstanceProvisioned: {
+		subject: `Your server is ready`,
+		text: `Your server {{ .InstanceID }} has been provisioned and is running.
+
+Connect to it at {{ .ServerAddr }}:{{ .ServerPort }}
+` + preferencesHint + textFooter,
+		html: htmlHeader +
+			`<p>Your server <b>{{ .InstanceID }}</b> has been provisioned and is running.</p>` +
+			`<p>Connect to it at <b>{{ .ServerAddr }}:{{ .ServerPort }}</b></p>` +
+			htmlPreferencesHint + htmlFooter,
+	},
+	EventInstanceFailed: {
+		subject: `Your server could not be provisioned`,
+		text: `We were unable to provision your server {{ .InstanceID }}. You will not be charged for it.
+
+Please delete the server and try again, or contact us if the problem persists.
+` + textFooter,
+		html: htmlHeader +
+			`<p>We were unable to provision your server <b>{{ .InstanceID }}</b>. You will not be charged for it.</p>` +
+			`<p>Please delete the server and try again, or contact us if the problem persists.</p>` +
+			htmlFooter,
+	},
+	EventInstanceIdleStopped: {
+		subject: `Your server was stopped due to inactivity`,
+		text: `Your server {{ .InstanceID }} had no players for {{ .IdleFor }} and was stopped to save you money.
+
+You can start it again at any time.
+` + preferencesHint + textFooter,
+		html: htmlHeader +
+			`<p>Your server <b>{{ .InstanceID }}</b> had no players for {{ .IdleFor }} and was stopped to save you money.</p>` +
+			`<p>You can start it again at any time.</p>` +
+			htmlPreferencesHint + htmlFooter,
+	},
+	EventPaymentFailed: {
+		subject: `Your payment of {{ .Amount }} failed`,
+		text: `We were unable to charge {{ .Amount }} for invoice {{ .InvoiceID }}.
+
+Please update your payment method and pay the invoice at {{ .InvoiceURL }} to keep your servers running.
+` + textFooter,
+		html: htmlHeader +
+			`<p>We were unable to charge <b>{{ .Amount }}</b> for invoice {{ .InvoiceID }}.</p>` +
+			`<p>Please update your payment method and <a href="{{ .InvoiceURL }}">pay the invoice</a> to keep your servers running.</p>` +
+			htmlFooter,
+	},
+	EventSubscriptionCancelled: {
+		subject: `Your subscription was cancelled`,
+		text: `Your subscription {{ .SubscriptionID }} was cancelled, and you will no longer be charged for it.
+
+Any outstanding usage will be included in your final invoice.
+` + textFooter,
+		html: htmlHeader +
+			`<p>Your subscription <b>{{ .SubscriptionID }}</b> was cancelled, and you will no longer be charged for it.</p>` +
+			`<p>Any outstanding usage will be included in your final invoice.</p>` +
+			htmlFooter,
+	},
+	EventBackupCompleted: {
+		subject: `Backup of your server completed`,
+		text: `A backup ({{ .BackupID }}) of your server {{ .InstanceID }} was completed.
+` + preferencesHint + textFooter,
+		html: htmlHeader +
+			`<p>A backup ({{ .BackupID }}) of your server <b>{{ .InstanceID }}</b> was completed.</p>` +
+			htmlPreferencesHint + htmlFooter,
+	},
+}
@@ -0,0 +1,328 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miragespace/rmc/customer"
+	"github.com/miragespace/rmc/external"
+
+	"github.com/google/uuid"
+	extErrors "github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrInvalidLocale is returned when setting a locale without templates
+var ErrInvalidLocale = errors.New("Locale is not supported")
+
+const (
+	maxAttempts  = 5
+	retryBackoff = time.Minute // doubled after each failed attempt
+	retryBatch   = 50
+	// a claimed notification is not picked up by other replicas for this long while it is being delivered
+	claimTimeout = time.Minute * 5
+	// sending a notification is given up after this long, and retried later
+	sendTimeout = time.Second * 30
+)
+
+// ManagerOptions is used to setup notification Manager's dependencies
+type ManagerOptions struct {
+	CustomerManager *customer.Manager
+	Mailer          external.Mailer
+	Templates       *Templates
+	DB              *gorm.DB
+	Logger          *zap.Logger
+	SiteName        string
+	SiteURL         string
+}
+
+// Manager renders notifications, delivers them via the Mailer with retries, and manages the preferences of customers
+type Manager struct {
+	ManagerOptions
+}
+
+// NewManager returns a new notification Manager
+func NewManager(option ManagerOptions) (*Manager, error) {
+	if option.CustomerManager == nil {
+		return nil, fmt.Errorf("nil CustomerManager is invalid")
+	}
+	if option.Mailer == nil {
+		return nil, fmt.Errorf("nil Mailer is invalid")
+	}
+	if option.Templates == nil {
+		return nil, fmt.Errorf("nil Templates is invalid")
+	}
+	if option.DB == nil {
+		return nil, fmt.Errorf("nil DB is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	if err := option.DB.AutoMigrate(&Notification{}, &Preferences{}); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot initilize notification.Manager")
+	}
+	return &Manager{
+		ManagerOptions: option,
+	}, nil
+}
+
+// NotifyOption specifies the notification to send
+type NotifyOption struct {
+	CustomerID string
+	Event      Event
+	// Key identifies the occurrence (e.g. the instance or invoice ID), so each occurrence is only notified once
+	Key  string
+	Data map[string]interface{}
+}
+
+// Notify renders the notification and queues it for the customer, unless they opted out of the event or were
+// already notified of the occurrence. The notification is delivered in the background by HandleRetry, so callers
+// (e.g. message consumers and API requests) don't wait on the mail server
+func (m *Manager) Notify(ctx context.Context, opt NotifyOption) error {
+	if !opt.Event.Valid() {
+		return fmt.Errorf("Invalid event %s", opt.Event)
+	}
+	if len(opt.CustomerID) == 0 || len(opt.Key) == 0 {
+		return fmt.Errorf("CustomerID and Key are required")
+	}
+	key := string(opt.Event) + ":" + opt.Key
+
+	// checked before rendering, as periodic checks (e.g. failed payments) notify the same occurrence repeatedly
+	var notified int64
+	if err := m.DB.WithContext(ctx).
+		Model(&Notification{}).
+		Where("key = ?", key).
+		Count(&notified).Error; err != nil {
+		return extErrors.Wrap(err, "Cannot check notification")
+	}
+	if notified > 0 {
+		return nil
+	}
+
+	prefs, err := m.GetPreferences(ctx, opt.CustomerID)
+	if err != nil {
+		return err
+	}
+	if !prefs.Enabled(opt.Event) {
+		return nil
+	}
+
+	cust, err := m.CustomerManager.GetByID(ctx, opt.CustomerID)
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot get customer")
+	}
+	if cust == nil {
+		return fmt.Errorf("Customer %s not found", opt.CustomerID)
+	}
+
+	msg, err := m.Render(prefs.Locale, opt.Event, opt.Data)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	n := &Notification{
+		ID:            uuid.New().String(),
+		CustomerID:    opt.CustomerID,
+		Event:         opt.Event,
+		Key:           key,
+		Email:         cust.Email,
+		Locale:        prefs.Locale,
+		Subject:       msg.Subject,
+		Text:          msg.Text,
+		HTML:          msg.HTML,
+		Status:        StatusPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+	result := m.DB.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(n)
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot save notification")
+	}
+	// RowsAffected is 0 if the occurrence was notified concurrently
+	return nil
+}
+
+// Render executes the template of the event with the site information added to data
+func (m *Manager) Render(locale string, event Event, data map[string]interface{}) (*Message, error) {
+	d := map[string]interface{}{
+		"SiteName": m.SiteName,
+		"SiteURL":  m.SiteURL,
+	}
+	for k, v := range data {
+		d[k] = v
+	}
+	msg, err := m.Templates.Render(locale, event, d)
+	if err != nil {
+		return nil, extErrors.Wrapf(err, "Cannot render notification %s", event)
+	}
+	return msg, nil
+}
+
+// deliver sends the notification and records the result. The caller must have claimed the notification
+func (m *Manager) deliver(ctx context.Context, n *Notification) {
+	logger := m.Logger.With(
+		zap.String("CustomerID", n.CustomerID),
+		zap.String("NotificationID", n.ID),
+		zap.String("Event", string(n.Event)),
+	)
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"attempts": n.Attempts + 1,
+	}
+	sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+	err := m.Mailer.Send(sendCtx, external.Email{
+		To:      n.Email,
+		Subject: n.Subject,
+		Text:    n.Text,
+		HTML:    n.HTML,
+	})
+	cancel()
+	switch {
+	case err == nil:
+		updates["status"] = StatusSent
+		updates["sent_at"] = now
+		updates["last_error"] = ""
+	case n.Attempts+1 >= maxAttempts:
+		logger.Error("Giving up sending notification",
+			zap.Int("Attempts", n.Attempts+1),
+			zap.Error(err),
+		)
+		updates["status"] = StatusFailed
+		updates["last_error"] = err.Error()
+	default:
+		logger.Warn("Unable to send notification, will retry",
+			zap.Int("Attempts", n.Attempts+1),
+			zap.Error(err),
+		)
+		updates["next_attempt_at"] = now.Add(retryBackoff << uint(n.Attempts))
+		updates["last_error"] = err.Error()
+	}
+
+	if err := m.DB.WithContext(ctx).
+		Model(&Notification{}).
+		Where("id = ?", n.ID).
+		Updates(updates).Error; err != nil {
+		logger.Error("Unable to update notification status",
+			zap.Error(err),
+		)
+	}
+}
+
+// RetryPending delivers the queued notifications, and retries those that are due. Each notification is claimed
+// with a conditional update, so it is safe to run on multiple replicas
+func (m *Manager) RetryPending(ctx context.Context) {
+	now := time.Now()
+	pending := make([]Notification, 0)
+	if err := m.DB.WithContext(ctx).
+		Where("status = ?", StatusPending).
+		Where("next_attempt_at <= ?", now).
+		Order("next_attempt_at ASC").
+		Limit(retryBatch).
+		Find(&pending).Error; err != nil {
+		m.Logger.Error("Unable to list pending notifications",
+			zap.Error(err),
+		)
+		return
+	}
+
+	for i := range pending {
+		n := &pending[i]
+		result := m.DB.WithContext(ctx).
+			Model(&Notification{}).
+			Where("id = ?", n.ID).
+			Where("status = ?", StatusPending).
+			Where("next_attempt_at = ?", n.NextAttemptAt).
+			Update("next_attempt_at", time.Now().Add(claimTimeout))
+		if result.Error != nil {
+			m.Logger.Error("Unable to claim pending notification",
+				zap.String("NotificationID", n.ID),
+				zap.Error(result.Error),
+			)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			// claimed by another replica
+			continue
+		}
+		m.deliver(ctx, n)
+	}
+}
+
+// HandleRetry periodically delivers the pending notifications until ctx is cancelled
+func (m *Manager) HandleRetry(ctx context.Context, interval time.Duration) {
+	m.Logger.Info("Notification retry interval: " + interval.String())
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				m.RetryPending(ctx)
+			}
+		}
+	}()
+}
+
+// List returns the most recent notifications of the customer, newest first
+func (m *Manager) List(ctx context.Context, customerID string, limit int) ([]Notification, error) {
+	notifications := make([]Notification, 0)
+	result := m.DB.WithContext(ctx).
+		Where("customer_id = ?", customerID).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&notifications)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notifications, nil
+}
+
+// GetPreferences returns the preferences of the customer, or the defaults if they have not set any
+func (m *Manager) GetPreferences(ctx context.Context, customerID string) (*Preferences, error) {
+	prefs := &Preferences{}
+	result := m.DB.WithContext(ctx).
+		Where("customer_id = ?", customerID).
+		Limit(1).
+		Find(prefs)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot get notification preferences")
+	}
+	if result.RowsAffected == 0 {
+		return &Preferences{
+			CustomerID: customerID,
+			Locale:     DefaultLocale,
+		}, nil
+	}
+	return prefs, nil
+}
+
+// PutPreferences saves the preferences of the customer
+func (m *Manager) PutPreferences(ctx context.Context, prefs *Preferences) error {
+	supported := false
+	for _, locale := range m.Templates.Locales() {
+		if locale == prefs.Locale {
+			supported = true
+		}
+	}
+	if !supported {
+		return ErrInvalidLocale
+	}
+	prefs.UpdatedAt = time.Now()
+	return m.DB.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "customer_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"locale", "disabled_events", "updated_at"}),
+		}).
+		Create(prefs).Error
+}
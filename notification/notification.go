@@ -0,0 +1,122 @@
+package notification
+
+import (
+	"strings"
+	"time"
+)
+
+// Event is the type of notification sent to customers
+type Event string
+
+// define constants
+const (
+	// EventLogin is the login link, sent by auth. It is not recorded and cannot be opted out of
+	EventLogin Event = "login"
+
+	EventInstanceProvisioned   Event = "instance.provisioned"
+	EventInstanceFailed        Event = "instance.failed"
+	EventInstanceIdleStopped   Event = "instance.idleStopped"
+	EventPaymentFailed         Event = "payment.failed"
+	EventSubscriptionCancelled Event = "subscription.cancelled"
+	EventBackupCompleted       Event = "backup.completed"
+)
+
+// Events are the notifications customers can receive, and set preferences for
+var Events = []Event{
+	EventInstanceProvisioned,
+	EventInstanceFailed,
+	EventInstanceIdleStopped,
+	EventPaymentFailed,
+	EventSubscriptionCancelled,
+	EventBackupCompleted,
+}
+
+// Valid returns whether the event is a customer notification
+func (e Event) Valid() bool {
+	for _, event := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Critical returns whether the event is always sent, regardless of the preferences of the customer
+func (e Event) Critical() bool {
+	switch e {
+	case EventLogin, EventInstanceFailed, EventPaymentFailed, EventSubscriptionCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// Status is the delivery status of a Notification
+type Status string
+
+// define constants
+const (
+	StatusPending Status = "Pending" // not delivered yet, will be retried at NextAttemptAt
+	StatusSent    Status = "Sent"
+	StatusFailed  Status = "Failed" // gave up after maxAttempts
+)
+
+// Notification is a rendered message to a customer, and its delivery status
+type Notification struct {
+	ID            string     `json:"id" gorm:"primaryKey"`
+	CustomerID    string     `json:"-" gorm:"index;not null"`
+	Event         Event      `json:"event" gorm:"not null"`
+	Key           string     `json:"-" gorm:"uniqueIndex;not null"` // deduplicates notifications of the same occurrence, e.g. per invoice
+	Email         string     `json:"email" gorm:"not null"`
+	Locale        string     `json:"locale" gorm:"not null"`
+	Subject       string     `json:"subject" gorm:"not null"`
+	Text          string     `json:"-" gorm:"not null"`
+	HTML          string     `json:"-" gorm:"not null"`
+	Status        Status     `json:"status" gorm:"index:idx_notification_pending,priority:1;not null"`
+	Attempts      int        `json:"attempts" gorm:"not null"`
+	LastError     string     `json:"-"`
+	NextAttemptAt time.Time  `json:"-" gorm:"index:idx_notification_pending,priority:2;not null"`
+	CreatedAt     time.Time  `json:"createdAt" gorm:"not null"`
+	SentAt        *time.Time `json:"sentAt"`
+}
+
+// Preferences of a customer. Customers without Preferences receive every notification in DefaultLocale
+type Preferences struct {
+	CustomerID     string    `gorm:"primaryKey"`
+	Locale         string    `gorm:"not null"`
+	DisabledEvents string    `gorm:"not null"` // space separated, similar to OAuth scopes
+	UpdatedAt      time.Time `gorm:"not null"`
+}
+
+// GetDisabledEvents returns the events the customer opted out of
+func (p *Preferences) GetDisabledEvents() []Event {
+	events := make([]Event, 0)
+	for _, e := range strings.Fields(p.DisabledEvents) {
+		events = append(events, Event(e))
+	}
+	return events
+}
+
+// SetDisabledEvents sets the events the customer opted out of. Critical events cannot be disabled and are ignored
+func (p *Preferences) SetDisabledEvents(events []Event) {
+	disabled := make([]string, 0, len(events))
+	for _, e := range events {
+		if e.Valid() && !e.Critical() {
+			disabled = append(disabled, string(e))
+		}
+	}
+	p.DisabledEvents = strings.Join(disabled, " ")
+}
+
+// Enabled returns whether the customer receives the event
+func (p *Preferences) Enabled(event Event) bool {
+	if event.Critical() {
+		return true
+	}
+	for _, e := range p.GetDisabledEvents() {
+		if e == event {
+			return false
+		}
+	}
+	return true
+}
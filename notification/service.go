@@ -0,0 +1,188 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/miragespace/rmc/auth"
+	resp "github.com/miragespace/rmc/response"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+const listLimit = 50
+
+// ServiceOptions contains the configuration for Service router
+type ServiceOptions struct {
+	NotificationManager *Manager
+	Logger              *zap.Logger
+}
+
+// Service is the notification API router
+type Service struct {
+	ServiceOptions
+}
+
+// NewService will create an instance of the notification API router
+func NewService(option ServiceOptions) (*Service, error) {
+	if option.NotificationManager == nil {
+		return nil, fmt.Errorf("nil NotificationManager is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	return &Service{
+		ServiceOptions: option,
+	}, nil
+}
+
+// EventPreference is whether the customer receives an event. Critical events cannot be disabled
+type EventPreference struct {
+	Event    Event `json:"event"`
+	Enabled  bool  `json:"enabled"`
+	Critical bool  `json:"critical"`
+}
+
+// PreferencesResponse is the model of the notification preferences of a customer
+type PreferencesResponse struct {
+	Locale  string            `json:"locale"`
+	Locales []string          `json:"locales"` // available locales
+	Events  []EventPreference `json:"events"`
+}
+
+// PreferencesRequest is the model of user request to update their notification preferences
+type PreferencesRequest struct {
+	Locale string            `json:"locale"`
+	Events []EventPreference `json:"events"` // events not included are unchanged
+}
+
+func (s *Service) toResponse(prefs *Preferences) *PreferencesResponse {
+	events := make([]EventPreference, 0, len(Events))
+	for _, event := range Events {
+		events = append(events, EventPreference{
+			Event:    event,
+			Enabled:  prefs.Enabled(event),
+			Critical: event.Critical(),
+		})
+	}
+	return &PreferencesResponse{
+		Locale:  prefs.Locale,
+		Locales: s.NotificationManager.Templates.Locales(),
+		Events:  events,
+	}
+}
+
+func (s *Service) listNotifications(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	notifications, err := s.NotificationManager.List(ctx, claims.ID, listLimit)
+	if err != nil {
+		logger.Error("Unable to list notifications",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list notifications"))
+		return
+	}
+
+	resp.WriteResponse(w, r, notifications)
+}
+
+func (s *Service) getPreferences(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	prefs, err := s.NotificationManager.GetPreferences(ctx, claims.ID)
+	if err != nil {
+		logger.Error("Unable to get notification preferences",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to get notification preferences"))
+		return
+	}
+
+	resp.WriteResponse(w, r, s.toResponse(prefs))
+}
+
+func (s *Service) putPreferences(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	var req PreferencesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+
+	prefs, err := s.NotificationManager.GetPreferences(ctx, claims.ID)
+	if err != nil {
+		logger.Error("Unable to get notification preferences",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to get notification preferences"))
+		return
+	}
+
+	if len(req.Locale) > 0 {
+		prefs.Locale = req.Locale
+	}
+	disabled := make(map[Event]bool)
+	for _, event := range prefs.GetDisabledEvents() {
+		disabled[event] = true
+	}
+	for _, e := range req.Events {
+		if !e.Event.Valid() {
+			resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Unknown event "+string(e.Event)))
+			return
+		}
+		if e.Event.Critical() && !e.Enabled {
+			resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Critical notifications cannot be disabled"))
+			return
+		}
+		disabled[e.Event] = !e.Enabled
+	}
+	events := make([]Event, 0)
+	for _, event := range Events {
+		if disabled[event] {
+			events = append(events, event)
+		}
+	}
+	prefs.SetDisabledEvents(events)
+
+	switch err := s.NotificationManager.PutPreferences(ctx, prefs); err {
+	case nil:
+	case ErrInvalidLocale:
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Locale is not supported"))
+		return
+	default:
+		logger.Error("Unable to save notification preferences",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to save notification preferences"))
+		return
+	}
+
+	resp.WriteResponse(w, r, s.toResponse(prefs))
+}
+
+// Router returns a http router for notification history and preferences
+func (s *Service) Router() http.Handler {
+	r := chi.NewRouter()
+
+	// preferences belong to the customer, not to integrations
+	r.Use(auth.RequireSession)
+
+	r.Get("/", s.listNotifications)
+	r.Get("/preferences", s.getPreferences)
+	r.Put("/preferences", s.putPreferences)
+
+	return r
+}
@@ -0,0 +1,152 @@
+package notification
+
+import (
+	"bytes"
+	"fmt"
+	htmlTemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	textTemplate "text/template"
+
+	extErrors "github.com/pkg/errors"
+)
+
+// DefaultLocale is used when a customer has no preferred locale, or their locale has no template for an event
+const DefaultLocale = "en"
+
+// Message is a rendered notification
+type Message struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type template struct {
+	subject *textTemplate.Template
+	text    *textTemplate.Template
+	html    *htmlTemplate.Template
+}
+
+// Templates are the localized templates of each Event. Templates are executed with a map of data,
+// which always includes SiteName and SiteURL
+type Templates struct {
+	locales map[string]map[Event]*template
+}
+
+// NewTemplates returns the built-in English templates
+func NewTemplates() *Templates {
+	t := &Templates{
+		locales: make(map[string]map[Event]*template),
+	}
+	for event, d := range defaultTemplates {
+		if err := t.Add(DefaultLocale, event, d.subject, d.text, d.html); err != nil {
+			panic(err)
+		}
+	}
+	return t
+}
+
+// Add parses and adds the template of an event in a locale, replacing the existing one. HTML is optional,
+// and the message will be sent as text only without it
+func (t *Templates) Add(locale string, event Event, subject, text, html string) error {
+	if locale == "" {
+		return fmt.Errorf("Empty locale is invalid")
+	}
+	name := locale + "/" + string(event)
+	tmpl := &template{}
+	var err error
+	if tmpl.subject, err = textTemplate.New(name + ".subject").Option("missingkey=error").Parse(subject); err != nil {
+		return extErrors.Wrap(err, "Cannot parse subject template")
+	}
+	if tmpl.text, err = textTemplate.New(name + ".txt").Option("missingkey=error").Parse(text); err != nil {
+		return extErrors.Wrap(err, "Cannot parse text template")
+	}
+	if html != "" {
+		if tmpl.html, err = htmlTemplate.New(name + ".html").Option("missingkey=error").Parse(html); err != nil {
+			return extErrors.Wrap(err, "Cannot parse html template")
+		}
+	}
+	if _, ok := t.locales[locale]; !ok {
+		t.locales[locale] = make(map[Event]*template)
+	}
+	t.locales[locale][event] = tmpl
+	return nil
+}
+
+// Load adds the templates in dir, overriding the built-in ones. Templates are read from
+// {dir}/{locale}/{event}.subject.tmpl, {event}.txt.tmpl and the optional {event}.html.tmpl
+func (t *Templates) Load(dir string) error {
+	locales, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot read template directory")
+	}
+	for _, locale := range locales {
+		if !locale.IsDir() {
+			continue
+		}
+		for _, event := range append([]Event{EventLogin}, Events...) {
+			prefix := filepath.Join(dir, locale.Name(), string(event))
+			subject, err := ioutil.ReadFile(prefix + ".subject.tmpl")
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return extErrors.Wrap(err, "Cannot read subject template")
+			}
+			text, err := ioutil.ReadFile(prefix + ".txt.tmpl")
+			if err != nil {
+				return extErrors.Wrap(err, "Cannot read text template")
+			}
+			html, err := ioutil.ReadFile(prefix + ".html.tmpl")
+			if err != nil && !os.IsNotExist(err) {
+				return extErrors.Wrap(err, "Cannot read html template")
+			}
+			if err := t.Add(locale.Name(), event, strings.TrimSpace(string(subject)), string(text), string(html)); err != nil {
+				return extErrors.Wrapf(err, "Invalid template %s", prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// Locales returns the locales with at least one template
+func (t *Templates) Locales() []string {
+	locales := make([]string, 0, len(t.locales))
+	for locale := range t.locales {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Render executes the template of the event in the locale, falling back to DefaultLocale
+func (t *Templates) Render(locale string, event Event, data map[string]interface{}) (*Message, error) {
+	tmpl, ok := t.locales[locale][event]
+	if !ok {
+		tmpl, ok = t.locales[DefaultLocale][event]
+	}
+	if !ok {
+		return nil, fmt.Errorf("No template for event %s", event)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot render subject")
+	}
+	if err := tmpl.text.Execute(&text, data); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot render text")
+	}
+	if tmpl.html != nil {
+		if err := tmpl.html.Execute(&html, data); err != nil {
+			return nil, extErrors.Wrap(err, "Cannot render html")
+		}
+	}
+	return &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
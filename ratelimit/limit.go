@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit allows Requests per Window in each bucket
+type Limit struct {
+	Requests int64
+	Window   time.Duration
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Window)
+}
+
+// define the names of limits used by the services. Each name is a separate set of buckets
+const (
+	AuthIP          = "auth:ip"          // every /auth route, per IP
+	LoginIP         = "login:ip"         // login emails, per IP
+	LoginEmail      = "login:email"      // login emails, per recipient
+	TokensIP        = "tokens:ip"        // login PIN verification, per IP
+	ControlCustomer = "control:customer" // lifecycle actions, per customer
+	ControlInstance = "control:instance" // start/stop of an instance, to prevent flapping
+	WebhookTest     = "webhook:test"     // test deliveries to webhook endpoints, per customer
+)
+
+// DefaultLimits are used for names without a configured limit
+var DefaultLimits = map[string]Limit{
+	AuthIP:          {Requests: 120, Window: time.Minute * 10},
+	LoginIP:         {Requests: 10, Window: time.Minute * 10},
+	LoginEmail:      {Requests: 3, Window: time.Minute * 10},
+	TokensIP:        {Requests: 20, Window: time.Minute * 10},
+	ControlCustomer: {Requests: 30, Window: time.Minute},
+	ControlInstance: {Requests: 3, Window: time.Minute * 5},
+	WebhookTest:     {Requests: 10, Window: time.Minute * 10},
+}
+
+// ParseLimit parses a limit in the form of "10/1m", i.e. 10 requests per minute
+func ParseLimit(s string) (Limit, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("Invalid limit %q, expecting e.g. 10/1m", s)
+	}
+	requests, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || requests < 1 {
+		return Limit{}, fmt.Errorf("Invalid number of requests in limit %q", s)
+	}
+	window, err := time.ParseDuration(parts[1])
+	if err != nil || window < time.Millisecond {
+		return Limit{}, fmt.Errorf("Invalid window in limit %q", s)
+	}
+	return Limit{
+		Requests: requests,
+		Window:   window,
+	}, nil
+}
+
+// ParseLimits parses a comma separated list of named limits, e.g. "login:ip=10/10m,login:email=3/10m"
+func ParseLimits(s string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid limit %q, expecting name=requests/window", entry)
+		}
+		limit, err := ParseLimit(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(kv[0])] = limit
+	}
+	return limits, nil
+}
@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	extErrors "github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// KEYS: bucket. ARGV: window in milliseconds. Returns the number of requests in the current window, and its remaining time
+var incrScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+	ttl = tonumber(ARGV[1])
+end
+return {count, ttl}
+`)
+
+// Options provides initialization parameters for Limiter
+type Options struct {
+	Redis  redis.UniversalClient
+	Logger *zap.Logger
+	// Limits overrides DefaultLimits by name
+	Limits map[string]Limit
+}
+
+// Limiter counts requests in fixed windows in Redis, so limits are shared by every replica
+type Limiter struct {
+	Options
+	limits map[string]Limit
+}
+
+// New returns a new Limiter
+func New(option Options) (*Limiter, error) {
+	if option.Redis == nil {
+		return nil, fmt.Errorf("nil Redis is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	limits := make(map[string]Limit)
+	for name, limit := range DefaultLimits {
+		limits[name] = limit
+	}
+	for name, limit := range option.Limits {
+		if _, ok := DefaultLimits[name]; !ok {
+			return nil, fmt.Errorf("Unknown limit %s", name)
+		}
+		limits[name] = limit
+	}
+	return &Limiter{
+		Options: option,
+		limits:  limits,
+	}, nil
+}
+
+func bucketKey(name, key string) string {
+	return "rmc:ratelimit:" + name + ":" + key
+}
+
+// Allow counts a request in the bucket of key under the named limit. If the limit is exceeded,
+// it returns false and how long until the bucket resets
+func (l *Limiter) Allow(name, key string) (bool, time.Duration, error) {
+	limit, ok := l.limits[name]
+	if !ok {
+		return false, 0, fmt.Errorf("Unknown limit %s", name)
+	}
+
+	result, err := incrScript.Run(l.Redis, []string{bucketKey(name, key)}, int64(limit.Window/time.Millisecond)).Result()
+	if err != nil {
+		return false, 0, extErrors.Wrap(err, "Cannot count request")
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("Unexpected result from rate limit script: %v", result)
+	}
+	count, _ := values[0].(int64)
+	ttl, _ := values[1].(int64)
+
+	if count > limit.Requests {
+		return false, time.Duration(ttl) * time.Millisecond, nil
+	}
+	return true, 0, nil
+}
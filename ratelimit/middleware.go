@@ -0,0 +1,125 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miragespace/rmc/auth"
+	resp "github.com/miragespace/rmc/response"
+
+	"go.uber.org/zap"
+)
+
+// request bodies are read at most up to this size to find the key
+const maxBodySize = 1 << 16
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// KeyFunc returns the bucket of the request. Requests without a bucket (ok is false) are not limited
+type KeyFunc func(r *http.Request) (key string, ok bool)
+
+// ByIP puts requests in buckets by the IP address of the client
+func ByIP(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr, r.RemoteAddr != ""
+	}
+	return host, true
+}
+
+// ByCustomer puts requests in buckets by the authenticated customer. It must be used after auth.Middleware
+func ByCustomer(r *http.Request) (string, bool) {
+	claims, ok := r.Context().Value(auth.Context).(*auth.Claims)
+	if !ok {
+		return "", false
+	}
+	return claims.ID, true
+}
+
+// ByJSONField puts requests in buckets by a string field in the JSON body, e.g. the email address.
+// The body is restored for the handler
+func ByJSONField(field string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		if r.Body == nil {
+			return "", false
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize))
+		r.Body = readCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), r.Body),
+			Closer: r.Body,
+		}
+		if err != nil {
+			return "", false
+		}
+
+		value, ok := jsonField(body, field)
+		if !ok || value == "" {
+			return "", false
+		}
+		return strings.ToLower(strings.TrimSpace(value)), true
+	}
+}
+
+// jsonField returns the string field of the JSON object the same way the handler decodes it into a struct:
+// keys match the field case-insensitively, the last matching key wins, and null leaves the value unchanged
+func jsonField(body []byte, field string) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return "", false
+	}
+	var value string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", false
+		}
+		key, _ := tok.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return "", false
+		}
+		if !strings.EqualFold(key, field) {
+			continue
+		}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "", false
+		}
+	}
+	return value, true
+}
+
+// Middleware returns a http middleware that rejects requests with 429 once the bucket of the request
+// exceeds the named limit. If Redis is unavailable, requests are allowed
+func (l *Limiter) Middleware(name string, keyFunc KeyFunc) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := keyFunc(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			allowed, retryAfter, err := l.Allow(name, key)
+			if err != nil {
+				l.Logger.Error("Cannot check rate limit",
+					zap.Error(err),
+					zap.String("Limit", name),
+				)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !allowed {
+				resp.WriteError(w, r, resp.ErrTooManyRequests(retryAfter))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
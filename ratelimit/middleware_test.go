@@ -0,0 +1,27 @@
+package ratelimit
+
+import "testing"
+
+func TestJSONField(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected string
+		ok       bool
+	}{
+		{`{"email": "a@example.com"}`, "a@example.com", true},
+		// decoding into a struct matches keys case-insensitively, and the last key wins
+		{`{"Email": "a@example.com"}`, "a@example.com", true},
+		{`{"email": "a@example.com", "EMAIL": "b@example.com"}`, "b@example.com", true},
+		{`{"email": "a@example.com", "email": null}`, "a@example.com", true},
+		{`{"other": {"email": "a@example.com"}}`, "", true},
+		{`{"email": 1}`, "", false},
+		{`["email"]`, "", false},
+		{`{"email": `, "", false},
+	}
+	for _, test := range tests {
+		value, ok := jsonField([]byte(test.body), "email")
+		if value != test.expected || ok != test.ok {
+			t.Errorf("jsonField(%s) = %q, %v, expected %q, %v", test.body, value, ok, test.expected, test.ok)
+		}
+	}
+}
@@ -1,12 +1,19 @@
 package response
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
 
 type Error struct {
 	StatusCode int
 	Message    string
 	Messages   []string
 	Result     interface{}
+	Header     http.Header
 }
 
 func (e *Error) Error() string {
@@ -28,6 +35,14 @@ func (e *Error) WithResult(result interface{}) *Error {
 	return e
 }
 
+func (e *Error) WithHeader(key, value string) *Error {
+	if e.Header == nil {
+		e.Header = make(http.Header)
+	}
+	e.Header.Set(key, value)
+	return e
+}
+
 func makeError(status int) *Error {
 	return &Error{
 		StatusCode: status,
@@ -73,6 +88,17 @@ func ErrConflict() *Error {
 		WithMessage("Conflict")
 }
 
+func ErrTooManyRequests(retryAfter time.Duration) *Error {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return makeError(429).
+		WithMessage("Too many requests").
+		WithHeader("Retry-After", strconv.FormatInt(seconds, 10)).
+		AddMessages(fmt.Sprintf("Please try again in %d seconds", seconds))
+}
+
 func ErrInvalidJson() *Error {
 	return ErrBadRequest().AddMessages("Invalid JSON body")
 }
@@ -84,3 +110,9 @@ func ErrVerifyToken() *Error {
 func ErrNoBearer() *Error {
 	return ErrUnauthorized().AddMessages("No valid Bearer token found in header")
 }
+
+func ErrStepUpRequired() *Error {
+	return ErrForbidden().
+		WithMessage("Step-up verification required").
+		AddMessages("Enter a code from your authenticator app to continue")
+}
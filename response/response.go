@@ -3,24 +3,41 @@ package response
 import (
 	"encoding/json"
 	"net/http"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type V1Response struct {
 	Result   interface{} `json:"result"`
 	Error    *string     `json:"error"`
 	Messages []string    `json:"messages"`
+	TraceID  string      `json:"traceId,omitempty"` // only set on errors, to correlate with the logs
 }
 
 func WriteError(w http.ResponseWriter, r *http.Request, e *Error) {
+	for key, values := range e.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(e.StatusCode)
 	json.NewEncoder(w).Encode(V1Response{
 		Result:   e.Result,
 		Error:    &e.Message,
 		Messages: e.Messages,
+		TraceID:  traceID(r),
 	})
 }
 
+func traceID(r *http.Request) string {
+	sc := trace.SpanContextFromContext(r.Context())
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
 func WriteResponse(w http.ResponseWriter, r *http.Request, response interface{}) {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
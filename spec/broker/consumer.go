@@ -10,10 +10,49 @@ import (
 // Consumer defines a consumer receiving requests via message broker
 type Consumer interface {
 	Close()
-	ReceiveControlRequest(ctx context.Context, hostIdentifier string) (<-chan *protocol.ControlRequest, error)
-	ReceiveProvisionRequest(ctx context.Context, hostIdentifier string) (<-chan *protocol.ProvisionRequest, error)
-	ReceiveControlReply(ctx context.Context) (<-chan *protocol.ControlReply, error)
-	ReceiveProvisionReply(ctx context.Context) (<-chan *protocol.ProvisionReply, error)
-	ReceiveHeartbeat(ctx context.Context, processor string) (<-chan *protocol.Heartbeat, error)
-	ReceiveTask(ctx context.Context, taskType spec.TaskType) (<-chan *protocol.Task, error)
+	ReceiveControlRequest(ctx context.Context, hostIdentifier string) (<-chan ControlRequest, error)
+	ReceiveProvisionRequest(ctx context.Context, hostIdentifier string) (<-chan ProvisionRequest, error)
+	ReceiveControlReply(ctx context.Context) (<-chan ControlReply, error)
+	ReceiveProvisionReply(ctx context.Context) (<-chan ProvisionReply, error)
+	ReceiveHeartbeat(ctx context.Context, processor string) (<-chan Heartbeat, error)
+	ReceiveTask(ctx context.Context, taskType spec.TaskType) (<-chan Task, error)
+}
+
+// The messages are delivered with a Context derived from the one given to Receive, carrying the trace of
+// the sender, if any, so the processing of the message continues the trace
+
+// ControlRequest is a received protocol.ControlRequest
+type ControlRequest struct {
+	Context context.Context
+	*protocol.ControlRequest
+}
+
+// ProvisionRequest is a received protocol.ProvisionRequest
+type ProvisionRequest struct {
+	Context context.Context
+	*protocol.ProvisionRequest
+}
+
+// ControlReply is a received protocol.ControlReply
+type ControlReply struct {
+	Context context.Context
+	*protocol.ControlReply
+}
+
+// ProvisionReply is a received protocol.ProvisionReply
+type ProvisionReply struct {
+	Context context.Context
+	*protocol.ProvisionReply
+}
+
+// Heartbeat is a received protocol.Heartbeat
+type Heartbeat struct {
+	Context context.Context
+	*protocol.Heartbeat
+}
+
+// Task is a received protocol.Task
+type Task struct {
+	Context context.Context
+	*protocol.Task
 }
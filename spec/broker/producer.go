@@ -1,17 +1,20 @@
 package broker
 
 import (
+	"context"
+
 	"github.com/miragespace/rmc/spec"
 	"github.com/miragespace/rmc/spec/protocol"
 )
 
-// Producer defines a producer sending requests via message broker
+// Producer defines a producer sending requests via message broker. The trace of ctx, if any,
+// is propagated with the message
 type Producer interface {
 	Close()
-	SendControlRequest(hostIdentifier string, p *protocol.ControlRequest) error
-	SendControlReply(p *protocol.ControlReply) error
-	SendProvisionRequest(hostIdentifier string, p *protocol.ProvisionRequest) error
-	SendProvisionReply(p *protocol.ProvisionReply) error
-	SendHeartbeat(p *protocol.Heartbeat) error
-	SendTask(taskType spec.TaskType, p *protocol.Task) error
+	SendControlRequest(ctx context.Context, hostIdentifier string, p *protocol.ControlRequest) error
+	SendControlReply(ctx context.Context, p *protocol.ControlReply) error
+	SendProvisionRequest(ctx context.Context, hostIdentifier string, p *protocol.ProvisionRequest) error
+	SendProvisionReply(ctx context.Context, p *protocol.ProvisionReply) error
+	SendHeartbeat(ctx context.Context, p *protocol.Heartbeat) error
+	SendTask(ctx context.Context, taskType spec.TaskType, p *protocol.Task) error
 }
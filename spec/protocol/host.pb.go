@@ -100,6 +100,8 @@ type Heartbeat struct {
 	Host               *Host                `protobuf:"bytes,1,opt,name=Host,proto3" json:"Host,omitempty"`
 	Timestamp          *timestamp.Timestamp `protobuf:"bytes,2,opt,name=Timestamp,proto3" json:"Timestamp,omitempty"`
 	RunningInstanceIDs []string             `protobuf:"bytes,10,rep,name=RunningInstanceIDs,proto3" json:"RunningInstanceIDs,omitempty"`
+	InstanceMetrics    []*InstanceMetrics   `protobuf:"bytes,11,rep,name=InstanceMetrics,proto3" json:"InstanceMetrics,omitempty"`
+	HostMetrics        *HostMetrics         `protobuf:"bytes,12,opt,name=HostMetrics,proto3" json:"HostMetrics,omitempty"`
 }
 
 func (x *Heartbeat) Reset() {
@@ -155,6 +157,252 @@ func (x *Heartbeat) GetRunningInstanceIDs() []string {
 	return nil
 }
 
+func (x *Heartbeat) GetInstanceMetrics() []*InstanceMetrics {
+	if x != nil {
+		return x.InstanceMetrics
+	}
+	return nil
+}
+
+func (x *Heartbeat) GetHostMetrics() *HostMetrics {
+	if x != nil {
+		return x.HostMetrics
+	}
+	return nil
+}
+
+// InstanceMetrics describes the resource consumption of a running instance since the previous heartbeat
+type InstanceMetrics struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	InstanceID       string  `protobuf:"bytes,1,opt,name=InstanceID,proto3" json:"InstanceID,omitempty"`
+	StorageBytes     int64   `protobuf:"varint,2,opt,name=StorageBytes,proto3" json:"StorageBytes,omitempty"`     // size of the container's writable layer (world and backups)
+	NetworkTxBytes   int64   `protobuf:"varint,3,opt,name=NetworkTxBytes,proto3" json:"NetworkTxBytes,omitempty"` // bytes sent since the previous heartbeat
+	Players          int64   `protobuf:"varint,4,opt,name=Players,proto3" json:"Players,omitempty"`               // number of players online when the heartbeat was sent
+	CPUPercent       float64 `protobuf:"fixed64,5,opt,name=CPUPercent,proto3" json:"CPUPercent,omitempty"`        // CPU usage when the heartbeat was sent, where 100 is one core
+	MemoryBytes      int64   `protobuf:"varint,6,opt,name=MemoryBytes,proto3" json:"MemoryBytes,omitempty"`       // memory usage when the heartbeat was sent, excluding page cache
+	MemoryLimitBytes int64   `protobuf:"varint,7,opt,name=MemoryLimitBytes,proto3" json:"MemoryLimitBytes,omitempty"`
+	NetworkRxBytes   int64   `protobuf:"varint,8,opt,name=NetworkRxBytes,proto3" json:"NetworkRxBytes,omitempty"`  // bytes received since the previous heartbeat
+	DiskReadBytes    int64   `protobuf:"varint,9,opt,name=DiskReadBytes,proto3" json:"DiskReadBytes,omitempty"`    // bytes read from block devices since the previous heartbeat
+	DiskWriteBytes   int64   `protobuf:"varint,10,opt,name=DiskWriteBytes,proto3" json:"DiskWriteBytes,omitempty"` // bytes written to block devices since the previous heartbeat
+}
+
+func (x *InstanceMetrics) Reset() {
+	*x = InstanceMetrics{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_spec_protocol_host_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *InstanceMetrics) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InstanceMetrics) ProtoMessage() {}
+
+func (x *InstanceMetrics) ProtoReflect() protoreflect.Message {
+	mi := &file_spec_protocol_host_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InstanceMetrics.ProtoReflect.Descriptor instead.
+func (*InstanceMetrics) Descriptor() ([]byte, []int) {
+	return file_spec_protocol_host_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *InstanceMetrics) GetInstanceID() string {
+	if x != nil {
+		return x.InstanceID
+	}
+	return ""
+}
+
+func (x *InstanceMetrics) GetStorageBytes() int64 {
+	if x != nil {
+		return x.StorageBytes
+	}
+	return 0
+}
+
+func (x *InstanceMetrics) GetNetworkTxBytes() int64 {
+	if x != nil {
+		return x.NetworkTxBytes
+	}
+	return 0
+}
+
+func (x *InstanceMetrics) GetPlayers() int64 {
+	if x != nil {
+		return x.Players
+	}
+	return 0
+}
+
+func (x *InstanceMetrics) GetCPUPercent() float64 {
+	if x != nil {
+		return x.CPUPercent
+	}
+	return 0
+}
+
+func (x *InstanceMetrics) GetMemoryBytes() int64 {
+	if x != nil {
+		return x.MemoryBytes
+	}
+	return 0
+}
+
+func (x *InstanceMetrics) GetMemoryLimitBytes() int64 {
+	if x != nil {
+		return x.MemoryLimitBytes
+	}
+	return 0
+}
+
+func (x *InstanceMetrics) GetNetworkRxBytes() int64 {
+	if x != nil {
+		return x.NetworkRxBytes
+	}
+	return 0
+}
+
+func (x *InstanceMetrics) GetDiskReadBytes() int64 {
+	if x != nil {
+		return x.DiskReadBytes
+	}
+	return 0
+}
+
+func (x *InstanceMetrics) GetDiskWriteBytes() int64 {
+	if x != nil {
+		return x.DiskWriteBytes
+	}
+	return 0
+}
+
+// HostMetrics describes the resources of a host, and the total consumption of its running instances
+type HostMetrics struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	CPUs             int64   `protobuf:"varint,1,opt,name=CPUs,proto3" json:"CPUs,omitempty"` // number of CPU cores available to docker
+	MemoryTotalBytes int64   `protobuf:"varint,2,opt,name=MemoryTotalBytes,proto3" json:"MemoryTotalBytes,omitempty"`
+	CPUPercent       float64 `protobuf:"fixed64,3,opt,name=CPUPercent,proto3" json:"CPUPercent,omitempty"`        // usage of the host, where 100 is one core
+	MemoryBytes      int64   `protobuf:"varint,4,opt,name=MemoryBytes,proto3" json:"MemoryBytes,omitempty"`       // usage of the host, excluding memory the kernel can reclaim
+	NetworkRxBytes   int64   `protobuf:"varint,5,opt,name=NetworkRxBytes,proto3" json:"NetworkRxBytes,omitempty"` // bytes received by the instances since the previous heartbeat
+	NetworkTxBytes   int64   `protobuf:"varint,6,opt,name=NetworkTxBytes,proto3" json:"NetworkTxBytes,omitempty"` // bytes sent by the instances since the previous heartbeat
+	DiskReadBytes    int64   `protobuf:"varint,7,opt,name=DiskReadBytes,proto3" json:"DiskReadBytes,omitempty"`   // bytes read by the instances since the previous heartbeat
+	DiskWriteBytes   int64   `protobuf:"varint,8,opt,name=DiskWriteBytes,proto3" json:"DiskWriteBytes,omitempty"` // bytes written by the instances since the previous heartbeat
+	StorageBytes     int64   `protobuf:"varint,9,opt,name=StorageBytes,proto3" json:"StorageBytes,omitempty"`     // total size of the writable layers of the instances
+}
+
+func (x *HostMetrics) Reset() {
+	*x = HostMetrics{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_spec_protocol_host_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *HostMetrics) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HostMetrics) ProtoMessage() {}
+
+func (x *HostMetrics) ProtoReflect() protoreflect.Message {
+	mi := &file_spec_protocol_host_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HostMetrics.ProtoReflect.Descriptor instead.
+func (*HostMetrics) Descriptor() ([]byte, []int) {
+	return file_spec_protocol_host_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *HostMetrics) GetCPUs() int64 {
+	if x != nil {
+		return x.CPUs
+	}
+	return 0
+}
+
+func (x *HostMetrics) GetMemoryTotalBytes() int64 {
+	if x != nil {
+		return x.MemoryTotalBytes
+	}
+	return 0
+}
+
+func (x *HostMetrics) GetCPUPercent() float64 {
+	if x != nil {
+		return x.CPUPercent
+	}
+	return 0
+}
+
+func (x *HostMetrics) GetMemoryBytes() int64 {
+	if x != nil {
+		return x.MemoryBytes
+	}
+	return 0
+}
+
+func (x *HostMetrics) GetNetworkRxBytes() int64 {
+	if x != nil {
+		return x.NetworkRxBytes
+	}
+	return 0
+}
+
+func (x *HostMetrics) GetNetworkTxBytes() int64 {
+	if x != nil {
+		return x.NetworkTxBytes
+	}
+	return 0
+}
+
+func (x *HostMetrics) GetDiskReadBytes() int64 {
+	if x != nil {
+		return x.DiskReadBytes
+	}
+	return 0
+}
+
+func (x *HostMetrics) GetDiskWriteBytes() int64 {
+	if x != nil {
+		return x.DiskWriteBytes
+	}
+	return 0
+}
+
+func (x *HostMetrics) GetStorageBytes() int64 {
+	if x != nil {
+		return x.StorageBytes
+	}
+	return 0
+}
+
 var File_spec_protocol_host_proto protoreflect.FileDescriptor
 
 var file_spec_protocol_host_proto_rawDesc = []byte{
@@ -169,7 +417,7 @@ var file_spec_protocol_host_proto_rawDesc = []byte{
 	0x74, 0x6f, 0x70, 0x70, 0x65, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x53, 0x74,
 	0x6f, 0x70, 0x70, 0x65, 0x64, 0x12, 0x1a, 0x0a, 0x08, 0x43, 0x61, 0x70, 0x61, 0x63, 0x69, 0x74,
 	0x79, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x43, 0x61, 0x70, 0x61, 0x63, 0x69, 0x74,
-	0x79, 0x22, 0x99, 0x01, 0x0a, 0x09, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x12,
+	0x79, 0x22, 0x97, 0x02, 0x0a, 0x09, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x12,
 	0x22, 0x0a, 0x04, 0x48, 0x6f, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0e, 0x2e,
 	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x2e, 0x48, 0x6f, 0x73, 0x74, 0x52, 0x04, 0x48,
 	0x6f, 0x73, 0x74, 0x12, 0x38, 0x0a, 0x09, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70,
@@ -178,7 +426,60 @@ var file_spec_protocol_host_proto_rawDesc = []byte{
 	0x6d, 0x70, 0x52, 0x09, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x2e, 0x0a,
 	0x12, 0x52, 0x75, 0x6e, 0x6e, 0x69, 0x6e, 0x67, 0x49, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65,
 	0x49, 0x44, 0x73, 0x18, 0x0a, 0x20, 0x03, 0x28, 0x09, 0x52, 0x12, 0x52, 0x75, 0x6e, 0x6e, 0x69,
-	0x6e, 0x67, 0x49, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x49, 0x44, 0x73, 0x42, 0x29, 0x5a,
+	0x6e, 0x67, 0x49, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x49, 0x44, 0x73, 0x12, 0x43, 0x0a,
+	0x0f, 0x49, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73,
+	0x18, 0x0b, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f,
+	0x6c, 0x2e, 0x49, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63,
+	0x73, 0x52, 0x0f, 0x49, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x4d, 0x65, 0x74, 0x72, 0x69,
+	0x63, 0x73, 0x12, 0x37, 0x0a, 0x0b, 0x48, 0x6f, 0x73, 0x74, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63,
+	0x73, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63,
+	0x6f, 0x6c, 0x2e, 0x48, 0x6f, 0x73, 0x74, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x52, 0x0b,
+	0x48, 0x6f, 0x73, 0x74, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x22, 0xfb, 0x02, 0x0a, 0x0f,
+	0x49, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x12,
+	0x1e, 0x0a, 0x0a, 0x49, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x49, 0x44, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x0a, 0x49, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x49, 0x44, 0x12,
+	0x22, 0x0a, 0x0c, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x42, 0x79,
+	0x74, 0x65, 0x73, 0x12, 0x26, 0x0a, 0x0e, 0x4e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x54, 0x78,
+	0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x4e, 0x65, 0x74,
+	0x77, 0x6f, 0x72, 0x6b, 0x54, 0x78, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x50,
+	0x6c, 0x61, 0x79, 0x65, 0x72, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x50, 0x6c,
+	0x61, 0x79, 0x65, 0x72, 0x73, 0x12, 0x1e, 0x0a, 0x0a, 0x43, 0x50, 0x55, 0x50, 0x65, 0x72, 0x63,
+	0x65, 0x6e, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0a, 0x43, 0x50, 0x55, 0x50, 0x65,
+	0x72, 0x63, 0x65, 0x6e, 0x74, 0x12, 0x20, 0x0a, 0x0b, 0x4d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x42,
+	0x79, 0x74, 0x65, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b, 0x4d, 0x65, 0x6d, 0x6f,
+	0x72, 0x79, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x2a, 0x0a, 0x10, 0x4d, 0x65, 0x6d, 0x6f, 0x72,
+	0x79, 0x4c, 0x69, 0x6d, 0x69, 0x74, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x07, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x10, 0x4d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x4c, 0x69, 0x6d, 0x69, 0x74, 0x42, 0x79,
+	0x74, 0x65, 0x73, 0x12, 0x26, 0x0a, 0x0e, 0x4e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x52, 0x78,
+	0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x08, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x4e, 0x65, 0x74,
+	0x77, 0x6f, 0x72, 0x6b, 0x52, 0x78, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x24, 0x0a, 0x0d, 0x44,
+	0x69, 0x73, 0x6b, 0x52, 0x65, 0x61, 0x64, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x09, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x0d, 0x44, 0x69, 0x73, 0x6b, 0x52, 0x65, 0x61, 0x64, 0x42, 0x79, 0x74, 0x65,
+	0x73, 0x12, 0x26, 0x0a, 0x0e, 0x44, 0x69, 0x73, 0x6b, 0x57, 0x72, 0x69, 0x74, 0x65, 0x42, 0x79,
+	0x74, 0x65, 0x73, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x44, 0x69, 0x73, 0x6b, 0x57,
+	0x72, 0x69, 0x74, 0x65, 0x42, 0x79, 0x74, 0x65, 0x73, 0x22, 0xd1, 0x02, 0x0a, 0x0b, 0x48, 0x6f,
+	0x73, 0x74, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x43, 0x50, 0x55,
+	0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x43, 0x50, 0x55, 0x73, 0x12, 0x2a, 0x0a,
+	0x10, 0x4d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x54, 0x6f, 0x74, 0x61, 0x6c, 0x42, 0x79, 0x74, 0x65,
+	0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x10, 0x4d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x54,
+	0x6f, 0x74, 0x61, 0x6c, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x1e, 0x0a, 0x0a, 0x43, 0x50, 0x55,
+	0x50, 0x65, 0x72, 0x63, 0x65, 0x6e, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0a, 0x43,
+	0x50, 0x55, 0x50, 0x65, 0x72, 0x63, 0x65, 0x6e, 0x74, 0x12, 0x20, 0x0a, 0x0b, 0x4d, 0x65, 0x6d,
+	0x6f, 0x72, 0x79, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b,
+	0x4d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x26, 0x0a, 0x0e, 0x4e,
+	0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x52, 0x78, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x05, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x0e, 0x4e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x52, 0x78, 0x42, 0x79,
+	0x74, 0x65, 0x73, 0x12, 0x26, 0x0a, 0x0e, 0x4e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x54, 0x78,
+	0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x4e, 0x65, 0x74,
+	0x77, 0x6f, 0x72, 0x6b, 0x54, 0x78, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x24, 0x0a, 0x0d, 0x44,
+	0x69, 0x73, 0x6b, 0x52, 0x65, 0x61, 0x64, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x07, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x0d, 0x44, 0x69, 0x73, 0x6b, 0x52, 0x65, 0x61, 0x64, 0x42, 0x79, 0x74, 0x65,
+	0x73, 0x12, 0x26, 0x0a, 0x0e, 0x44, 0x69, 0x73, 0x6b, 0x57, 0x72, 0x69, 0x74, 0x65, 0x42, 0x79,
+	0x74, 0x65, 0x73, 0x18, 0x08, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x44, 0x69, 0x73, 0x6b, 0x57,
+	0x72, 0x69, 0x74, 0x65, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x22, 0x0a, 0x0c, 0x53, 0x74, 0x6f,
+	0x72, 0x61, 0x67, 0x65, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x09, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x0c, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x42, 0x79, 0x74, 0x65, 0x73, 0x42, 0x29, 0x5a,
 	0x27, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x7a, 0x6c, 0x6c, 0x6f,
 	0x76, 0x65, 0x73, 0x75, 0x6b, 0x69, 0x2f, 0x72, 0x6d, 0x63, 0x2f, 0x73, 0x70, 0x65, 0x63, 0x2f,
 	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
@@ -196,20 +497,24 @@ func file_spec_protocol_host_proto_rawDescGZIP() []byte {
 	return file_spec_protocol_host_proto_rawDescData
 }
 
-var file_spec_protocol_host_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_spec_protocol_host_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
 var file_spec_protocol_host_proto_goTypes = []interface{}{
 	(*Host)(nil),                // 0: protocol.Host
 	(*Heartbeat)(nil),           // 1: protocol.Heartbeat
-	(*timestamp.Timestamp)(nil), // 2: google.protobuf.Timestamp
+	(*InstanceMetrics)(nil),     // 2: protocol.InstanceMetrics
+	(*HostMetrics)(nil),         // 3: protocol.HostMetrics
+	(*timestamp.Timestamp)(nil), // 4: google.protobuf.Timestamp
 }
 var file_spec_protocol_host_proto_depIdxs = []int32{
 	0, // 0: protocol.Heartbeat.Host:type_name -> protocol.Host
-	2, // 1: protocol.Heartbeat.Timestamp:type_name -> google.protobuf.Timestamp
-	2, // [2:2] is the sub-list for method output_type
-	2, // [2:2] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	4, // 1: protocol.Heartbeat.Timestamp:type_name -> google.protobuf.Timestamp
+	2, // 2: protocol.Heartbeat.InstanceMetrics:type_name -> protocol.InstanceMetrics
+	3, // 3: protocol.Heartbeat.HostMetrics:type_name -> protocol.HostMetrics
+	4, // [4:4] is the sub-list for method output_type
+	4, // [4:4] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_spec_protocol_host_proto_init() }
@@ -242,6 +547,30 @@ func file_spec_protocol_host_proto_init() {
 				return nil
 			}
 		}
+		file_spec_protocol_host_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*InstanceMetrics); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_spec_protocol_host_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HostMetrics); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -249,7 +578,7 @@ func file_spec_protocol_host_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_spec_protocol_host_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   4,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -10,8 +10,14 @@ const (
 	StatePending   State = "Pending"
 	StateCancelled State = "Cancelled"
 	StateOverdue   State = "Overdue"
+	// Trial states. A trial doesn't need a payment method until it is exhausted
+	StateTrialing     State = "Trialing"
+	StateTrialExpired State = "TrialExpired"
 )
 
+// A trial only limited by compute minutes still ends after this many days
+const defaultTrialDays = 30
+
 // PartType is the custom type to identify what's the Type of this Part in the Plan
 type PartType string
 
@@ -20,3 +26,6 @@ const (
 	FixedType    PartType = "Fixed"
 	VariableType PartType = "Variable"
 )
+
+// Percentages of a Budget at which the customer is emailed
+var budgetThresholds = []int64{50, 80, 100}
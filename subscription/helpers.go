@@ -4,17 +4,22 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/miragespace/rmc/external"
+
 	extErrors "github.com/pkg/errors"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/client"
 )
 
 var lookupKeyRegex = regexp.MustCompile("[^a-zA-Z0-9]+")
 
+// productKeyMetadata is the metadata key of the Product holding Plan.productKey
+const productKeyMetadata = "rmc_plan_key"
+
 //				Subscription struct helpers
 
 func (s *Subscription) findSubscriptionItemByPartID(partID string) *SubscriptionItem {
@@ -38,10 +43,24 @@ func (s *Subscription) findPrimaryVariableItem() *SubscriptionItem {
 	return nil
 }
 
+// findSecondaryVariableItem returns the add-on item metering the metric, if the Plan bills it
+func (s *Subscription) findSecondaryVariableItem(metric Metric) *SubscriptionItem {
+	for k, item := range s.SubscriptionItems {
+		if item.Part.Primary || item.Part.Type != VariableType {
+			continue
+		}
+		if unit, ok := LookupUnit(item.Part.Unit); ok && unit.Metric == metric {
+			return &s.SubscriptionItems[k]
+		}
+	}
+	return nil
+}
+
 func (s *Subscription) fromStripeResponse(sub *stripe.Subscription, plan *Plan) error {
 	items := make([]SubscriptionItem, 0, 2)
 	for _, subItem := range sub.Items.Data {
-		part := plan.lookupPartByLookupKey(subItem.Price.LookupKey)
+		// match by Price ID, as lookup keys change when a Plan is renamed
+		part := plan.lookupPartByID(subItem.Price.ID)
 		if part == nil {
 			return fmt.Errorf("Inconsistent data: no corresponding Price/Part")
 		}
@@ -55,7 +74,10 @@ func (s *Subscription) fromStripeResponse(sub *stripe.Subscription, plan *Plan)
 	}
 
 	var subState State
-	if sub.Status == stripe.SubscriptionStatusActive && sub.PendingSetupIntent == nil {
+	if sub.Status == stripe.SubscriptionStatusTrialing {
+		// trials don't need a payment method
+		subState = StateTrialing
+	} else if sub.Status == stripe.SubscriptionStatusActive && sub.PendingSetupIntent == nil {
 		subState = StateActive
 	} else {
 		subState = StatePending
@@ -71,10 +93,101 @@ func (s *Subscription) fromStripeResponse(sub *stripe.Subscription, plan *Plan)
 		PeriodEnd:         time.Unix(sub.CurrentPeriodEnd, 0),
 		Plan:              *plan,
 	}
+	if len(sub.Items.Data) > 0 {
+		s.Currency = string(sub.Items.Data[0].Price.Currency)
+	}
+	for _, rate := range sub.DefaultTaxRates {
+		s.TaxPercent += rate.Percentage
+	}
+	if sub.Status == stripe.SubscriptionStatusTrialing {
+		trialEnd := time.Unix(sub.TrialEnd, 0)
+		s.TrialEnd = &trialEnd
+		s.TrialMinutes = plan.TrialMinutes
+	}
 
 	return nil
 }
 
+// Usable returns true if instances can run under this subscription
+func (s *Subscription) Usable() bool {
+	return s.State == StateActive || s.State == StateTrialing
+}
+
+// trialExhausted returns true if the trial has ended, or the compute minutes included in the trial were used up
+func (s *Subscription) trialExhausted(referenceTime time.Time, runtimeSeconds int64) bool {
+	if s.TrialEnd != nil && !referenceTime.Before(*s.TrialEnd) {
+		return true
+	}
+	return s.TrialMinutes > 0 && runtimeSeconds >= s.TrialMinutes*60
+}
+
+//				Invoice struct helpers
+
+// fromStripeInvoice populates the Invoice from Stripe's response. parts is keyed by Part.ID (Stripe's Price ID)
+func (i *Invoice) fromStripeInvoice(inv *stripe.Invoice, parts map[string]Part) {
+	lines := make([]InvoiceLine, 0, 2)
+	if inv.Lines != nil {
+		for _, l := range inv.Lines.Data {
+			line := InvoiceLine{
+				Description:   l.Description,
+				Quantity:      l.Quantity,
+				AmountInCents: float64(l.Amount),
+			}
+			if l.Period != nil {
+				line.PeriodStart = time.Unix(l.Period.Start, 0)
+				line.PeriodEnd = time.Unix(l.Period.End, 0)
+			}
+			if l.Price != nil {
+				if part, ok := parts[l.Price.ID]; ok {
+					line.Part = &part
+				}
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	var subscriptionID string
+	if inv.Subscription != nil {
+		subscriptionID = inv.Subscription.ID
+	}
+
+	*i = Invoice{
+		ID:                inv.ID,
+		Number:            inv.Number,
+		SubscriptionID:    subscriptionID,
+		Status:            string(inv.Status),
+		Currency:          string(inv.Currency),
+		PeriodStart:       time.Unix(inv.PeriodStart, 0),
+		PeriodEnd:         time.Unix(inv.PeriodEnd, 0),
+		CreatedAt:         time.Unix(inv.Created, 0),
+		DiscountInCents:   float64(inv.Subtotal + inv.Tax - inv.Total),
+		TaxInCents:        float64(inv.Tax),
+		TotalInCents:      float64(inv.Total),
+		CreditInCents:     float64(inv.Total - inv.AmountDue),
+		AmountDueInCents:  float64(inv.AmountDue),
+		AmountPaidInCents: float64(inv.AmountPaid),
+		HostedInvoiceURL:  inv.HostedInvoiceURL,
+		InvoicePDF:        inv.InvoicePDF,
+		Lines:             lines,
+	}
+}
+
+// partIDs returns the Price IDs referenced by the invoice line items
+func partIDs(invoices []*stripe.Invoice) []string {
+	ids := make([]string, 0, 2)
+	for _, inv := range invoices {
+		if inv.Lines == nil {
+			continue
+		}
+		for _, l := range inv.Lines.Data {
+			if l.Price != nil {
+				ids = append(ids, l.Price.ID)
+			}
+		}
+	}
+	return ids
+}
+
 //				Plan struct helpers
 
 // lookupKey will generate a unique LookupKey on stripe to identify each Part of the Plan
@@ -82,23 +195,49 @@ func (p *Plan) lookupKey(part Part) string {
 	planName := lookupKeyRegex.ReplaceAllString(p.Name, "-")
 	partName := lookupKeyRegex.ReplaceAllString(part.Name, "-")
 	amountPart := fmt.Sprintf("%f", part.AmountInCents)
-	return strings.ToLower(fmt.Sprintf("%s_%s_%s_%s_%s_%s", planName, p.Interval, part.Type, partName, amountPart, part.Unit))
+	return strings.ToLower(fmt.Sprintf("%s_%s_%s_%s_%s_%s_%s", planName, p.Interval, part.Type, partName, amountPart, part.Unit, part.Currency))
+}
+
+// productKey identifies the Product of the Plan on Stripe the same way an existing Plan is matched in the database,
+// so Products created by an interrupted seeding are found again instead of duplicated
+func (p *Plan) productKey() string {
+	planName := lookupKeyRegex.ReplaceAllString(p.Name, "-")
+	return strings.ToLower(fmt.Sprintf("%s_%s_%s", planName, p.Interval, p.Currency))
+}
+
+// productMetadata returns the Parameters of the Plan along with the productKey, to be set as the Product's metadata
+func (p *Plan) productMetadata() map[string]string {
+	metadata := make(map[string]string, len(p.Parameters)+1)
+	for k, v := range p.Parameters {
+		metadata[k] = v
+	}
+	metadata[productKeyMetadata] = p.productKey()
+	return metadata
 }
 
-// createPlanOnStripe will create missing Plan as Product on Stripe
-func (p *Plan) createPlanOnStripe(ctx context.Context, s *client.API) error {
+// createPlanOnStripe will create missing Plan as Product on Stripe, or reuse the Product created by a previous attempt
+func (p *Plan) createPlanOnStripe(ctx context.Context, b external.BillingProvider) error {
+	if len(p.ID) == 0 {
+		existing, err := b.FindProductByMetadata(ctx, productKeyMetadata, p.productKey())
+		if err != nil {
+			return extErrors.Wrap(err, "Cannot look up Plan as Product on Stripe")
+		}
+		if existing != nil {
+			p.ID = existing.ID
+		}
+	}
 	if len(p.ID) == 0 {
 		// Create corresponding Product
 		prodParams := &stripe.ProductParams{
 			Params: stripe.Params{
 				Context:  ctx,
-				Metadata: p.Parameters,
+				Metadata: p.productMetadata(),
 			},
 			Active:      stripe.Bool(true),
 			Name:        stripe.String(p.Name),
 			Description: stripe.String(p.Description),
 		}
-		stripeProduct, err := s.Products.New(prodParams)
+		stripeProduct, err := b.NewProduct(prodParams)
 		if err != nil {
 			return extErrors.Wrap(err, "Cannot create Plan as Product on Stripe")
 		}
@@ -106,11 +245,11 @@ func (p *Plan) createPlanOnStripe(ctx context.Context, s *client.API) error {
 		p.ID = stripeProduct.ID
 	}
 
-	return p.createPartsOnStripe(ctx, s)
+	return p.createPartsOnStripe(ctx, b)
 }
 
 // createPartsOnStripe will create missing Parts as Price on Stripe
-func (p *Plan) createPartsOnStripe(ctx context.Context, s *client.API) error {
+func (p *Plan) createPartsOnStripe(ctx context.Context, b external.BillingProvider) error {
 
 	if len(p.ID) == 0 {
 		return fmt.Errorf("Plan ID doesn't exist, please create Plan before Parts")
@@ -135,6 +274,16 @@ func (p *Plan) createPartsOnStripe(ctx context.Context, s *client.API) error {
 			continue
 		}
 
+		// a previous attempt may have created the Price before failing
+		existing, err := b.FindPriceByLookupKey(ctx, p.lookupKey(part))
+		if err != nil {
+			return extErrors.Wrap(err, "Cannot look up Part as Price on Stripe")
+		}
+		if existing != nil && existing.Product != nil && existing.Product.ID == p.ID {
+			p.Parts[k].ID = existing.ID
+			continue
+		}
+
 		pParams := &stripe.PriceParams{
 			Params: stripe.Params{
 				Context: ctx,
@@ -146,7 +295,7 @@ func (p *Plan) createPartsOnStripe(ctx context.Context, s *client.API) error {
 			Active:            stripe.Bool(true),
 			Nickname:          stripe.String(part.Name),
 			BillingScheme:     stripe.String("per_unit"),
-			Currency:          stripe.String(p.Currency),
+			Currency:          stripe.String(part.Currency),
 			UnitAmountDecimal: stripe.Float64(part.AmountInCents),
 			Product:           stripe.String(p.ID),
 			LookupKey:         stripe.String(p.lookupKey(part)),
@@ -157,7 +306,7 @@ func (p *Plan) createPartsOnStripe(ctx context.Context, s *client.API) error {
 		case VariableType:
 			pParams.Recurring = variableRecurring
 		}
-		partPrice, err := s.Prices.New(pParams)
+		partPrice, err := b.NewPrice(pParams)
 		if err != nil {
 			return extErrors.Wrap(err, "Cannot create Part as Price on Stripe")
 		}
@@ -167,46 +316,165 @@ func (p *Plan) createPartsOnStripe(ctx context.Context, s *client.API) error {
 	return nil
 }
 
-func (p *Plan) lookupPartByLookupKey(lookupKey string) *Part {
+func (p *Plan) lookupPartByID(partID string) *Part {
 	for k, part := range p.Parts {
-		if lookupKey == p.lookupKey(part) {
+		if partID == part.ID {
 			return &p.Parts[k]
 		}
 	}
 	return nil
 }
 
-func (p *Plan) findVariablePart(primary bool, partID *string) *Part {
-	if !primary && partID == nil {
-		return nil
+// partsIn returns the active Parts priced in the currency
+func (p *Plan) partsIn(currency string) []Part {
+	parts := make([]Part, 0, 4)
+	for _, part := range p.activeParts() {
+		if part.Currency == currency {
+			parts = append(parts, part)
+		}
 	}
-	if p == nil || p.ID == "" || len(p.Parts) == 0 {
-		return nil
+	return parts
+}
+
+// billingCurrency returns the preferred currency if the Plan is priced in it, otherwise the default currency of the Plan
+func (p *Plan) billingCurrency(preferred string) string {
+	if len(preferred) > 0 && len(p.partsIn(preferred)) > 0 {
+		return preferred
+	}
+	return p.Currency
+}
+
+// localize returns a copy of the Plan with only the active Parts in the billing currency for the preferred currency
+func (p *Plan) localize(preferred string) Plan {
+	localized := *p
+	localized.Currency = p.billingCurrency(preferred)
+	localized.Parts = p.partsIn(localized.Currency)
+	return localized
+}
+
+// expandCurrencies sets the Currency of Parts without one to the default currency of the Plan, and creates a copy
+// of the Part for each of its LocalizedAmountsInCents
+func (p *Plan) expandCurrencies() {
+	p.Currency = strings.ToLower(p.Currency)
+	parts := make([]Part, 0, len(p.Parts))
+	for _, part := range p.Parts {
+		if len(part.Currency) == 0 {
+			part.Currency = p.Currency
+		}
+		part.Currency = strings.ToLower(part.Currency)
+		localized := part.LocalizedAmountsInCents
+		part.LocalizedAmountsInCents = nil
+		parts = append(parts, part)
+
+		currencies := make([]string, 0, len(localized))
+		for currency := range localized {
+			currencies = append(currencies, currency)
+		}
+		sort.Strings(currencies)
+		for _, currency := range currencies {
+			copied := part
+			copied.ID = ""
+			copied.Currency = strings.ToLower(currency)
+			copied.AmountInCents = localized[currency]
+			parts = append(parts, copied)
+		}
 	}
+	p.Parts = parts
+}
+
+// activeParts returns the current version of the Parts, which new subscriptions are billed by
+func (p *Plan) activeParts() []Part {
+	parts := make([]Part, 0, len(p.Parts))
 	for _, part := range p.Parts {
-		if primary {
-			if part.Primary && part.Type == VariableType {
-				return &part
+		if !part.Retired {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+//				Part struct helpers
+
+// sameSlot returns true if both Parts bill the same thing, possibly at a different price (i.e. versions of the same Part)
+func (part *Part) sameSlot(other Part) bool {
+	return part.Type == other.Type && part.Primary == other.Primary && part.Currency == other.Currency &&
+		strings.EqualFold(part.Name, other.Name)
+}
+
+// samePrice returns true if both Parts are billed the same. A Price on Stripe cannot be changed, therefore a Part
+// with a different price is a new version
+func (part *Part) samePrice(other Part) bool {
+	return part.AmountInCents == other.AmountInCents && part.Unit == other.Unit
+}
+
+// validate checks that the Plan can be created, and every Variable Part is billed in a registered unit
+func (p *Plan) validate() error {
+	if len(p.Name) == 0 {
+		return fmt.Errorf("Plan must have a Name")
+	}
+	primaryVariable := make(map[string]int)
+	for _, part := range p.activeParts() {
+		if len(part.Currency) == 0 {
+			return fmt.Errorf("Part %s of Plan %s must have a Currency", part.Name, p.Name)
+		}
+		switch part.Type {
+		case FixedType:
+		case VariableType:
+			unit, ok := LookupUnit(part.Unit)
+			if !ok {
+				return fmt.Errorf("Part %s of Plan %s has unsupported Unit: %s", part.Name, p.Name, part.Unit)
 			}
-		} else {
-			if !part.Primary && part.Type == VariableType && part.ID == *partID {
-				return &part
+			if part.Primary {
+				if unit.Metric != MetricRuntime {
+					return fmt.Errorf("Primary Part %s of Plan %s must be billed by runtime", part.Name, p.Name)
+				}
+				primaryVariable[part.Currency]++
 			}
+		default:
+			return fmt.Errorf("Part %s of Plan %s has unknown Type: %s", part.Name, p.Name, part.Type)
+		}
+	}
+	if _, ok := primaryVariable[p.Currency]; !ok {
+		return fmt.Errorf("Plan %s must have Parts in its default Currency %s", p.Name, p.Currency)
+	}
+	for currency, count := range primaryVariable {
+		if count != 1 {
+			return fmt.Errorf("Plan %s must have exactly one primary Variable Part in %s", p.Name, currency)
 		}
 	}
+	if p.TrialDays < 0 || p.TrialMinutes < 0 {
+		return fmt.Errorf("Plan %s has negative trial", p.Name)
+	}
 	return nil
 }
 
-func (p *Plan) toStripeSubscriptionParams(ctx context.Context, customerID string) *stripe.SubscriptionParams {
+// hasTrial returns true if new customers can try this Plan for free
+func (p *Plan) hasTrial() bool {
+	return p.TrialDays > 0 || p.TrialMinutes > 0
+}
+
+// trialDays returns the length of the trial. A trial only limited by compute minutes lasts at most defaultTrialDays
+func (p *Plan) trialDays() int64 {
+	if p.TrialDays > 0 {
+		return p.TrialDays
+	}
+	return defaultTrialDays
+}
+
+// toStripeSubscriptionParams returns the parameters to subscribe the customer to the Parts of the Plan in the currency,
+// taxed by taxRateIDs
+func (p *Plan) toStripeSubscriptionParams(ctx context.Context, customerID, currency string, taxRateIDs []string) *stripe.SubscriptionParams {
 	sParams := &stripe.SubscriptionParams{
 		Params: stripe.Params{
 			Context: ctx,
 		},
-		Customer: stripe.String(customerID),
-		Items:    []*stripe.SubscriptionItemsParams{},
+		Customer:        stripe.String(customerID),
+		Items:           []*stripe.SubscriptionItemsParams{},
+		DefaultTaxRates: stripe.StringSlice(taxRateIDs),
 	}
 
-	for _, part := range p.Parts {
+	// retired Parts only bill existing subscriptions (grandfathered)
+	for _, part := range p.partsIn(currency) {
 		pParams := &stripe.SubscriptionItemsParams{
 			Price: stripe.String(part.ID),
 		}
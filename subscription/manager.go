@@ -5,17 +5,23 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"strings"
 	"time"
 
+	"github.com/miragespace/rmc/db"
+	"github.com/miragespace/rmc/external"
+	"github.com/miragespace/rmc/notification"
 	"github.com/miragespace/rmc/spec"
 	"github.com/miragespace/rmc/spec/broker"
 	"github.com/miragespace/rmc/spec/protocol"
+	"github.com/miragespace/rmc/webhook"
 
 	"github.com/golang/protobuf/ptypes"
 	"github.com/jackc/pgconn"
 	extErrors "github.com/pkg/errors"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/client"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -23,10 +29,15 @@ import (
 
 // ManagerOptions is used to setup SubscriptionManager's dependencies
 type ManagerOptions struct {
-	StripeClient *client.API
-	Producer     broker.Producer
-	DB           *gorm.DB
-	Logger       *zap.Logger
+	BillingProvider external.BillingProvider
+	Producer        broker.Producer
+	DB              *gorm.DB
+	Logger          *zap.Logger
+	Mailer          external.Mailer // Optional. Budget alerts are only sent if a Mailer is provided
+	// Optional. Cancellations and failed payments are only notified if a NotificationManager is provided
+	NotificationManager *notification.Manager
+	// Optional. State changes and budget thresholds are only sent to webhooks if a WebhookManager is provided
+	WebhookManager *webhook.Manager
 }
 
 // Manager struct is used to manage Subscriptions and Plans
@@ -36,8 +47,8 @@ type Manager struct {
 
 // NewManager returns a new SubscriptionManager
 func NewManager(option ManagerOptions) (*Manager, error) {
-	if option.StripeClient == nil {
-		return nil, fmt.Errorf("nil StripeClient is invalid")
+	if option.BillingProvider == nil {
+		return nil, fmt.Errorf("nil BillingProvider is invalid")
 	}
 	if option.Producer == nil {
 		return nil, fmt.Errorf("nil Producer is invalid")
@@ -48,7 +59,19 @@ func NewManager(option ManagerOptions) (*Manager, error) {
 	if option.Logger == nil {
 		return nil, fmt.Errorf("nil Logger is invalid")
 	}
-	if err := option.DB.AutoMigrate(&Plan{}, &Part{}, &Subscription{}, &SubscriptionItem{}, &Usage{}); err != nil {
+	if err := option.DB.AutoMigrate(&Plan{}, &Part{}, &Subscription{}, &SubscriptionItem{}, &Usage{}, &Budget{}, &TaxRate{}, &TrialClaim{}); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot initilize subscription.Manager")
+	}
+	// Parts and Subscriptions created before multi-currency support are in the Plan's currency
+	if err := db.RunMigration(option.DB, "subscription_backfill_currency", func(tx *gorm.DB) error {
+		for _, table := range []string{"parts", "subscriptions"} {
+			if err := tx.Exec("UPDATE " + table + " SET currency = plans.currency FROM plans " +
+				"WHERE " + table + ".plan_id = plans.id AND " + table + ".currency = ''").Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
 		return nil, extErrors.Wrap(err, "Cannot initilize subscription.Manager")
 	}
 
@@ -57,7 +80,7 @@ func NewManager(option ManagerOptions) (*Manager, error) {
 	}, nil
 }
 
-// Create inserts a new Subscription record in the database
+// Create inserts a new Subscription record in the database, and sends its state to the webhooks of the customer
 func (m *Manager) Create(ctx context.Context, si *Subscription) error {
 	result := m.DB.WithContext(ctx).Omit("Plan", "SubscriptionItems.Part").Create(si)
 	if result.Error != nil {
@@ -66,6 +89,7 @@ func (m *Manager) Create(ctx context.Context, si *Subscription) error {
 		)
 		return extErrors.Wrap(result.Error, "Cannot create subscription")
 	}
+	m.emitState(ctx, si.CustomerID, si.ID, si.State)
 	return nil
 }
 
@@ -148,7 +172,7 @@ func (m *Manager) GetStripe(ctx context.Context, opt GetOption) (*stripe.Subscri
 		return nil, fmt.Errorf("SubscriptionID is required")
 	}
 
-	return m.StripeClient.Subscriptions.Get(opt.SubscriptionID, nil)
+	return m.BillingProvider.GetSubscription(opt.SubscriptionID, nil)
 }
 
 // GetUsage will return the aggregate total usage for a single subscription
@@ -159,196 +183,1797 @@ func (m *Manager) GetUsage(ctx context.Context, opt GetOption) ([]Usage, error)
 	if len(opt.SubscriptionID) == 0 {
 		return nil, fmt.Errorf("SubscriptionID is required")
 	}
-	var sub Subscription
-	result := m.DB.WithContext(ctx).
-		Preload("SubscriptionItems").
-		Where("customer_id = ?", opt.CustomerID).
-		Where("id = ?", opt.SubscriptionID).
-		First(&sub)
-
-	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+	var sub Subscription
+	result := m.DB.WithContext(ctx).
+		Preload("SubscriptionItems").
+		Where("customer_id = ?", opt.CustomerID).
+		Where("id = ?", opt.SubscriptionID).
+		First(&sub)
+
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+
+	subItemsID := make([]string, 0, 2)
+	for _, item := range sub.SubscriptionItems {
+		subItemsID = append(subItemsID, item.ID)
+	}
+
+	usages := make([]Usage, 0, 2)
+	result = m.DB.WithContext(ctx).
+		Clauses(clause.Locking{Strength: "SHARE"}).
+		Preload("SubscriptionItem").
+		Preload("SubscriptionItem.Part").
+		Order("usages.end_date desc").
+		Where("subscription_item_id IN ?", subItemsID).
+		Find(&usages)
+
+	if result.Error != nil {
+		m.Logger.Error("Database returned error",
+			zap.Error(result.Error),
+		)
+		return nil, result.Error
+	}
+	return usages, nil
+}
+
+// AttachPaymentOptions is used for AttachmentPayment
+type AttachPaymentOptions struct {
+	CustomerID      string
+	PaymentMethodID string
+}
+
+// AttachPayment will attach a default payment method to a customer
+func (m *Manager) AttachPayment(ctx context.Context, opt AttachPaymentOptions) error {
+	if len(opt.CustomerID) == 0 {
+		return fmt.Errorf("AttachPaymentOptions.CustomerID is required")
+	}
+	if len(opt.PaymentMethodID) == 0 {
+		return fmt.Errorf("AttachPaymentOptions.PaymentMethodID is required")
+	}
+	params := &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(opt.CustomerID),
+	}
+	pm, err := m.BillingProvider.AttachPaymentMethod(
+		opt.PaymentMethodID,
+		params,
+	)
+	if err != nil {
+		return err
+	}
+
+	customerParams := &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(pm.ID),
+		},
+	}
+	if _, err := m.BillingProvider.UpdateCustomer(
+		opt.CustomerID,
+		customerParams,
+	); err != nil {
+		return err
+	}
+
+	// a payment method on file lifts the restriction of exhausted trials
+	if err := m.convertExpiredTrials(ctx, opt.CustomerID); err != nil {
+		m.Logger.Error("Unable to convert expired trials after attaching payment",
+			zap.String("CustomerID", opt.CustomerID),
+			zap.Error(err),
+		)
+	}
+
+	return nil
+}
+
+// ErrInvalidPromotionCode is returned when the promotion code does not exist, or can no longer be redeemed
+var ErrInvalidPromotionCode = errors.New("Invalid promotion code")
+
+// CreateFromPlanOption is used to specify parameters for creating a subscription
+type CreateFromPlanOption struct {
+	CustomerID    string
+	Plan          Plan
+	PromotionCode string // Optional customer facing promotion code to redeem
+}
+
+// CreateSubscriptionFromPlan will create a subscription with Stripe from an existing Plan
+func (m *Manager) CreateSubscriptionFromPlan(ctx context.Context, opt CreateFromPlanOption) (*stripe.Subscription, error) {
+	if len(opt.CustomerID) == 0 {
+		return nil, fmt.Errorf("SetupOptions.CustomerID is required")
+	}
+	if len(opt.Plan.ID) == 0 {
+		return nil, fmt.Errorf("SetupOptions.Plan needs to be a synchronized Plan")
+	}
+
+	customerParams := &stripe.CustomerParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	}
+	// tax_ids is only returned when expanded, see vatTaxID
+	customerParams.AddExpand("tax_ids")
+	c, err := m.BillingProvider.GetCustomer(opt.CustomerID, customerParams)
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Unable to fetch customer from Stripe")
+	}
+	if err := m.syncReverseCharge(ctx, c); err != nil {
+		return nil, err
+	}
+	taxRateIDs := make([]string, 0, 1)
+	taxRate, err := m.taxRateFor(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if taxRate != nil {
+		taxRateIDs = append(taxRateIDs, taxRate.ID)
+	}
+
+	currency := opt.Plan.billingCurrency(currencyForCountry(c.Address.Country))
+	subscriptionParams := opt.Plan.toStripeSubscriptionParams(ctx, opt.CustomerID, currency, taxRateIDs)
+	subscriptionParams.AddExpand("latest_invoice.payment_intent")
+	subscriptionParams.AddExpand("pending_setup_intent")
+
+	if len(opt.PromotionCode) > 0 {
+		promo, err := m.BillingProvider.FindPromotionCode(ctx, opt.PromotionCode)
+		if err != nil {
+			return nil, extErrors.Wrap(err, "Unable to lookup promotion code")
+		}
+		if promo == nil {
+			return nil, ErrInvalidPromotionCode
+		}
+		subscriptionParams.PromotionCode = stripe.String(promo.ID)
+	}
+
+	var trial bool
+	if opt.Plan.hasTrial() {
+		trial, err = m.claimTrial(ctx, opt.CustomerID)
+		if err != nil {
+			return nil, extErrors.Wrap(err, "Unable to claim trial")
+		}
+		if trial {
+			subscriptionParams.TrialPeriodDays = stripe.Int64(opt.Plan.trialDays())
+		}
+	}
+
+	sub, err := m.BillingProvider.NewSubscription(subscriptionParams)
+
+	if err != nil {
+		if trial {
+			m.releaseTrial(ctx, opt.CustomerID)
+		}
+		return nil, err
+	}
+
+	if trial {
+		result := m.DB.WithContext(ctx).
+			Model(&TrialClaim{}).
+			Where("customer_id = ?", opt.CustomerID).
+			Update("subscription_id", sub.ID)
+		if result.Error != nil {
+			// the claim is held regardless, and is bound to the subscription when it is finalized
+			m.Logger.Error("Unable to record subscription of trial claim",
+				zap.String("CustomerID", opt.CustomerID),
+				zap.Error(result.Error),
+			)
+		}
+	}
+
+	return sub, nil
+}
+
+// claimTrial returns true if the customer is eligible for a trial, and records that they used it.
+// Concurrent claims of a customer conflict on the primary key of TrialClaim, so only one of them gets the trial
+func (m *Manager) claimTrial(ctx context.Context, customerID string) (bool, error) {
+	eligible, err := m.TrialEligible(ctx, customerID)
+	if err != nil || !eligible {
+		return false, err
+	}
+	result := m.DB.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&TrialClaim{
+			CustomerID: customerID,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// releaseTrial gives the trial back to the customer, when the subscription it was claimed for could not be created
+func (m *Manager) releaseTrial(ctx context.Context, customerID string) {
+	result := m.DB.WithContext(ctx).
+		Where("customer_id = ?", customerID).
+		Where("subscription_id = ?", "").
+		Delete(&TrialClaim{})
+	if result.Error != nil {
+		m.Logger.Error("Unable to release trial claim",
+			zap.String("CustomerID", customerID),
+			zap.Error(result.Error),
+		)
+	}
+}
+
+func (m *Manager) synchronizeSubscriptionPeriod(ctx context.Context, subscriptionID string) error {
+	subscriptionParams := &stripe.SubscriptionParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	}
+	sub, err := m.BillingProvider.GetSubscription(subscriptionID, subscriptionParams)
+	if err != nil {
+		return extErrors.Wrap(err, "Unable to fetch from Stripe to synchronize billing period")
+	}
+	fmt.Printf("%+v\n", sub)
+	result := m.DB.WithContext(ctx).
+		Model(&Subscription{}).
+		Where("id = ?", subscriptionID).
+		Updates(map[string]interface{}{
+			"period_start": time.Unix(sub.CurrentPeriodStart, 0),
+			"period_end":   time.Unix(sub.CurrentPeriodEnd, 0),
+		})
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Unable to update subscription billing period in database")
+	}
+	return nil
+}
+
+func (m *Manager) synchronizeSubscriptionStatus(ctx context.Context, subscriptionID string) error {
+	subscriptionParams := &stripe.SubscriptionParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	}
+	subscriptionParams.AddExpand("latest_invoice.payment_intent")
+	subscriptionParams.AddExpand("pending_setup_intent")
+	sub, err := m.BillingProvider.GetSubscription(subscriptionID, subscriptionParams)
+	if err != nil {
+		return extErrors.Wrap(err, "Unable to fetch from Stripe to synchronize status")
+	}
+	// TODO: also synchronize cancelled/overdue
+	if sub.Status == stripe.SubscriptionStatusActive && sub.PendingSetupIntent == nil {
+		result := m.DB.WithContext(ctx).
+			Model(&Subscription{}).
+			Where("id = ?", subscriptionID).
+			Update("state", StateActive)
+		if result.Error != nil {
+			return extErrors.Wrap(result.Error, "Unable to mark subscription as active in database")
+		}
+	}
+	return nil
+}
+
+// CancelSubscription will mark the subscription to be cancelled in the next billing period
+func (m *Manager) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	updateParams := &stripe.SubscriptionParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+		CancelAtPeriodEnd: stripe.Bool(true),
+	}
+	sub, err := m.BillingProvider.UpdateSubscription(subscriptionID, updateParams)
+	if err != nil {
+		return extErrors.Wrap(err, "Unable to cancel subscription on Stripe")
+	}
+	if sub.CancelAtPeriodEnd != true {
+		return fmt.Errorf("Stripe did not mark subscription as cancel at end of period")
+	}
+	result := m.DB.WithContext(ctx).Model(&Subscription{}).Where("id = ?", subscriptionID).Update("state", StateInactive)
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Unable to mark subscription as inactive in database")
+	}
+	m.emitState(ctx, "", subscriptionID, StateInactive)
+	if m.NotificationManager != nil {
+		// the subscription was cancelled regardless, so notification failures are only logged
+		if err := m.notifyCancelled(ctx, subscriptionID); err != nil {
+			m.Logger.Error("Unable to notify subscription cancellation",
+				zap.String("SubscriptionID", subscriptionID),
+				zap.Error(err),
+			)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) customerOf(ctx context.Context, subscriptionID string) (string, error) {
+	var sub Subscription
+	result := m.DB.WithContext(ctx).
+		Select("customer_id").
+		Where("id = ?", subscriptionID).
+		First(&sub)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	return sub.CustomerID, nil
+}
+
+func (m *Manager) notifyCancelled(ctx context.Context, subscriptionID string) error {
+	customerID, err := m.customerOf(ctx, subscriptionID)
+	if err != nil {
+		return err
+	}
+	return m.NotificationManager.Notify(ctx, notification.NotifyOption{
+		CustomerID: customerID,
+		Event:      notification.EventSubscriptionCancelled,
+		Key:        subscriptionID,
+		Data: map[string]interface{}{
+			"SubscriptionID": subscriptionID,
+		},
+	})
+}
+
+// emitState sends the new state of the subscription to the webhooks of the customer. The state has been saved
+// regardless, so failures are only logged. If customerID is empty, it is looked up
+func (m *Manager) emitState(ctx context.Context, customerID, subscriptionID string, state State) {
+	if m.WebhookManager == nil {
+		return
+	}
+	logger := m.Logger.With(
+		zap.String("SubscriptionID", subscriptionID),
+	)
+	if len(customerID) == 0 {
+		var err error
+		if customerID, err = m.customerOf(ctx, subscriptionID); err != nil {
+			logger.Error("Unable to get customer of subscription",
+				zap.Error(err),
+			)
+			return
+		}
+	}
+	if err := m.WebhookManager.Emit(ctx, webhook.EmitOption{
+		CustomerID: customerID,
+		Event:      webhook.EventSubscriptionState,
+		Summary:    fmt.Sprintf("Subscription %s is now %s", subscriptionID, state),
+		Data: map[string]interface{}{
+			"subscriptionId": subscriptionID,
+			"state":          state,
+		},
+	}); err != nil {
+		logger.Error("Unable to emit subscription state change",
+			zap.Error(err),
+		)
+	}
+}
+
+// TrialClaimedBy returns true if the trial of the customer was claimed for the subscription. A claim not yet bound to
+// a subscription (if recording it failed in CreateSubscriptionFromPlan) is bound to this one
+func (m *Manager) TrialClaimedBy(ctx context.Context, customerID, subscriptionID string) (bool, error) {
+	var claim TrialClaim
+	result := m.DB.WithContext(ctx).
+		Where("customer_id = ?", customerID).
+		Limit(1).
+		Find(&claim)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	if claim.SubscriptionID != "" {
+		return claim.SubscriptionID == subscriptionID, nil
+	}
+	result = m.DB.WithContext(ctx).
+		Model(&TrialClaim{}).
+		Where("customer_id = ?", customerID).
+		Where("subscription_id = ?", "").
+		Update("subscription_id", subscriptionID)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// TrialEligible returns true if the customer has never had a trial before
+func (m *Manager) TrialEligible(ctx context.Context, customerID string) (bool, error) {
+	var count int64
+	result := m.DB.WithContext(ctx).
+		Model(&TrialClaim{}).
+		Where("customer_id = ?", customerID).
+		Count(&count)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if count > 0 {
+		return false, nil
+	}
+	// trials started before claims were recorded
+	result = m.DB.WithContext(ctx).
+		Model(&Subscription{}).
+		Where("customer_id = ?", customerID).
+		Where("trial_end IS NOT NULL").
+		Count(&count)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return count == 0, nil
+}
+
+// ExhaustedTrials checks the trials of the subscriptions and returns the ones that are exhausted without a payment method.
+// Instances of those subscriptions should be stopped. Exhausted trials with a payment method are converted to paid subscriptions
+func (m *Manager) ExhaustedTrials(ctx context.Context, subscriptionIDs []string, referenceTime time.Time) ([]string, error) {
+	if len(subscriptionIDs) == 0 {
+		return nil, nil
+	}
+	subs := make([]Subscription, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Preload("SubscriptionItems").
+		Preload("SubscriptionItems.Part").
+		Where("id IN ?", subscriptionIDs).
+		Where("state IN ?", []State{StateTrialing, StateTrialExpired}).
+		Find(&subs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	exhausted := make([]string, 0, len(subs))
+	for k, sub := range subs {
+		if sub.State == StateTrialExpired {
+			exhausted = append(exhausted, sub.ID)
+			continue
+		}
+
+		var runtimeSeconds int64
+		if item := sub.findPrimaryVariableItem(); item != nil {
+			u, err := m.getUsageBySubscriptionItemID(ctx, usageLookupOption{
+				SubscriptionItemID: item.ID,
+				ReferenceTime:      referenceTime,
+			})
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, extErrors.Wrap(err, "Cannot get usage by subscription item id")
+			}
+			if u != nil {
+				runtimeSeconds = u.AggregateTotal
+			}
+		}
+		if !sub.trialExhausted(referenceTime, runtimeSeconds) {
+			continue
+		}
+
+		converted, err := m.endTrial(ctx, &subs[k])
+		if err != nil {
+			return nil, err
+		}
+		if !converted {
+			exhausted = append(exhausted, sub.ID)
+		}
+	}
+	return exhausted, nil
+}
+
+// endTrial converts the trial to a paid subscription if the customer has a payment method on file, otherwise
+// the subscription is marked as StateTrialExpired
+func (m *Manager) endTrial(ctx context.Context, sub *Subscription) (converted bool, err error) {
+	c, err := m.BillingProvider.GetCustomer(sub.CustomerID, &stripe.CustomerParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	})
+	if err != nil {
+		return false, extErrors.Wrap(err, "Unable to fetch customer from Stripe")
+	}
+	if c.InvoiceSettings != nil && c.InvoiceSettings.DefaultPaymentMethod != nil {
+		if err := m.convertTrial(ctx, sub.ID); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	result := m.DB.WithContext(ctx).
+		Model(&Subscription{}).
+		Where("id = ?", sub.ID).
+		Update("state", StateTrialExpired)
+	if result.Error != nil {
+		return false, extErrors.Wrap(result.Error, "Unable to mark trial as expired in database")
+	}
+	m.emitState(ctx, sub.CustomerID, sub.ID, StateTrialExpired)
+	return false, nil
+}
+
+// convertTrial ends the trial on Stripe (if it's not over already) so the subscription is billed from now on
+func (m *Manager) convertTrial(ctx context.Context, subscriptionID string) error {
+	sub, err := m.BillingProvider.GetSubscription(subscriptionID, &stripe.SubscriptionParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	})
+	if err != nil {
+		return extErrors.Wrap(err, "Unable to fetch subscription from Stripe")
+	}
+	if sub.Status == stripe.SubscriptionStatusTrialing {
+		sub, err = m.BillingProvider.UpdateSubscription(subscriptionID, &stripe.SubscriptionParams{
+			Params: stripe.Params{
+				Context: ctx,
+			},
+			TrialEndNow: stripe.Bool(true),
+		})
+		if err != nil {
+			return extErrors.Wrap(err, "Unable to end trial on Stripe")
+		}
+	}
+	if sub.Status != stripe.SubscriptionStatusActive {
+		return fmt.Errorf("Subscription is %s on Stripe after ending the trial", sub.Status)
+	}
+
+	result := m.DB.WithContext(ctx).
+		Model(&Subscription{}).
+		Where("id = ?", subscriptionID).
+		Updates(map[string]interface{}{
+			"state":        StateActive,
+			"period_start": time.Unix(sub.CurrentPeriodStart, 0),
+			"period_end":   time.Unix(sub.CurrentPeriodEnd, 0),
+		})
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Unable to mark subscription as active in database")
+	}
+	m.emitState(ctx, "", subscriptionID, StateActive)
+	return nil
+}
+
+func (m *Manager) convertExpiredTrials(ctx context.Context, customerID string) error {
+	subs := make([]Subscription, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Where("customer_id = ?", customerID).
+		Where("state = ?", StateTrialExpired).
+		Find(&subs)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, sub := range subs {
+		if err := m.convertTrial(ctx, sub.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PromotionOption specifies the discount of a new promotion code
+type PromotionOption struct {
+	Code             string  `json:"code"`             // Customer facing code, e.g. SUMMER2021
+	PercentOff       float64 `json:"percentOff"`       // Either PercentOff or AmountOffInCents is required
+	AmountOffInCents int64   `json:"amountOffInCents"` // Either PercentOff or AmountOffInCents is required
+	Currency         string  `json:"currency"`         // Required with AmountOffInCents
+	Duration         string  `json:"duration"`         // once, repeating or forever
+	DurationInMonths int64   `json:"durationInMonths"` // Required if Duration is repeating
+	MaxRedemptions   int64   `json:"maxRedemptions"`   // 0 for unlimited
+}
+
+// CreatePromotion creates a coupon and its promotion code on Stripe
+func (m *Manager) CreatePromotion(ctx context.Context, opt PromotionOption) (*stripe.PromotionCode, error) {
+	if len(opt.Code) == 0 {
+		return nil, fmt.Errorf("Code is required")
+	}
+	if (opt.PercentOff > 0) == (opt.AmountOffInCents > 0) {
+		return nil, fmt.Errorf("Exactly one of PercentOff or AmountOffInCents is required")
+	}
+	couponParams := &stripe.CouponParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+		Name:     stripe.String(opt.Code),
+		Duration: stripe.String(string(stripe.CouponDurationOnce)),
+	}
+	if opt.PercentOff > 0 {
+		couponParams.PercentOff = stripe.Float64(opt.PercentOff)
+	} else {
+		couponParams.AmountOff = stripe.Int64(opt.AmountOffInCents)
+		couponParams.Currency = stripe.String(opt.Currency)
+	}
+	if len(opt.Duration) > 0 {
+		couponParams.Duration = stripe.String(opt.Duration)
+	}
+	if opt.DurationInMonths > 0 {
+		couponParams.DurationInMonths = stripe.Int64(opt.DurationInMonths)
+	}
+	if opt.MaxRedemptions > 0 {
+		couponParams.MaxRedemptions = stripe.Int64(opt.MaxRedemptions)
+	}
+	coupon, err := m.BillingProvider.NewCoupon(couponParams)
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Unable to create coupon on Stripe")
+	}
+
+	promoParams := &stripe.PromotionCodeParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+		Coupon: stripe.String(coupon.ID),
+		Code:   stripe.String(opt.Code),
+	}
+	if opt.MaxRedemptions > 0 {
+		promoParams.MaxRedemptions = stripe.Int64(opt.MaxRedemptions)
+	}
+	promo, err := m.BillingProvider.NewPromotionCode(promoParams)
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Unable to create promotion code on Stripe")
+	}
+	return promo, nil
+}
+
+// CreditOption specifies how much credit to grant to a customer
+type CreditOption struct {
+	CustomerID    string `json:"customerId"`
+	AmountInCents int64  `json:"amountInCents"`
+	Currency      string `json:"currency"`
+	Description   string `json:"description"`
+}
+
+// GrantCredit adds to the customer's credit balance, which is drawn down by the next invoices before charging the payment method
+func (m *Manager) GrantCredit(ctx context.Context, opt CreditOption) error {
+	if len(opt.CustomerID) == 0 {
+		return fmt.Errorf("CustomerID is required")
+	}
+	if opt.AmountInCents <= 0 {
+		return fmt.Errorf("AmountInCents must be positive")
+	}
+	if len(opt.Currency) == 0 {
+		return fmt.Errorf("Currency is required")
+	}
+	params := &stripe.CustomerBalanceTransactionParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+		Customer: stripe.String(opt.CustomerID),
+		Amount:   stripe.Int64(-opt.AmountInCents),
+		Currency: stripe.String(opt.Currency),
+	}
+	if len(opt.Description) > 0 {
+		params.Description = stripe.String(opt.Description)
+	}
+	if _, err := m.BillingProvider.NewCustomerBalanceTransaction(params); err != nil {
+		return extErrors.Wrap(err, "Unable to grant credit on Stripe")
+	}
+	return nil
+}
+
+// CreditBalance returns the remaining credit of a customer in cents
+func (m *Manager) CreditBalance(ctx context.Context, customerID string) (int64, error) {
+	c, err := m.BillingProvider.GetCustomer(customerID, &stripe.CustomerParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	})
+	if err != nil {
+		return 0, extErrors.Wrap(err, "Unable to fetch customer from Stripe")
+	}
+	// a negative balance is a credit
+	if c.Balance >= 0 {
+		return 0, nil
+	}
+	return -c.Balance, nil
+}
+
+// ErrInvalidBillingDetails is returned when the billing country or VAT number is invalid
+var ErrInvalidBillingDetails = errors.New("Invalid billing details")
+
+// GetBillingDetails will return the billing address and VAT number of the customer
+func (m *Manager) GetBillingDetails(ctx context.Context, customerID string) (*BillingDetails, error) {
+	customerParams := &stripe.CustomerParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	}
+	// tax_ids is only returned when expanded, see vatTaxID
+	customerParams.AddExpand("tax_ids")
+	c, err := m.BillingProvider.GetCustomer(customerID, customerParams)
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Unable to fetch customer from Stripe")
+	}
+	details := &BillingDetails{
+		Name:       c.Name,
+		Line1:      c.Address.Line1,
+		Line2:      c.Address.Line2,
+		City:       c.Address.City,
+		PostalCode: c.Address.PostalCode,
+		State:      c.Address.State,
+		Country:    c.Address.Country,
+	}
+	if id := vatTaxID(c); id != nil {
+		details.VATID = id.Value
+	}
+	return details, nil
+}
+
+// vatTaxID returns the VAT number of the customer, or nil if they didn't provide one. The customer must be fetched
+// with tax_ids expanded, as Stripe omits it otherwise
+func vatTaxID(c *stripe.Customer) *stripe.TaxID {
+	var vat *stripe.TaxID
+	if c.TaxIDs != nil {
+		for _, id := range c.TaxIDs.Data {
+			if id.Type == stripe.TaxIDTypeEUVAT {
+				vat = id
+			}
+		}
+	}
+	return vat
+}
+
+// reverseCharged returns true if the customer's VAT number was verified by Stripe, which exempts them from VAT
+func reverseCharged(c *stripe.Customer) bool {
+	id := vatTaxID(c)
+	return id != nil && id.Verification != nil && id.Verification.Status == stripe.TaxIDVerificationStatusVerified
+}
+
+// UpdateBillingDetails will update the billing address of the customer on Stripe, which is shown on the invoices.
+// The VAT number of a business is added to its invoices, and once Stripe has verified it, the business is exempted
+// from VAT (reverse charge). The changes only apply to new subscriptions
+func (m *Manager) UpdateBillingDetails(ctx context.Context, customerID string, details BillingDetails) error {
+	details.Country = strings.ToUpper(strings.TrimSpace(details.Country))
+	details.VATID = strings.ToUpper(strings.ReplaceAll(details.VATID, " ", ""))
+	if len(details.Country) != 2 {
+		return ErrInvalidBillingDetails
+	}
+	if len(details.VATID) > 0 && !validVATID(details.VATID, details.Country) {
+		return ErrInvalidBillingDetails
+	}
+
+	customerParams := &stripe.CustomerParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	}
+	// tax_ids is only returned when expanded, see vatTaxID
+	customerParams.AddExpand("tax_ids")
+	current, err := m.BillingProvider.GetCustomer(customerID, customerParams)
+	if err != nil {
+		return extErrors.Wrap(err, "Unable to fetch customer from Stripe")
+	}
+	// VAT numbers which were replaced are removed, so they are no longer shown on invoices or considered for reverse charge
+	if current.TaxIDs != nil {
+		for _, id := range current.TaxIDs.Data {
+			if id.Type != stripe.TaxIDTypeEUVAT || id.Value == details.VATID {
+				continue
+			}
+			if _, err := m.BillingProvider.DeleteTaxID(id.ID, &stripe.TaxIDParams{
+				Params: stripe.Params{
+					Context: ctx,
+				},
+				Customer: stripe.String(customerID),
+			}); err != nil {
+				return extErrors.Wrap(err, "Unable to remove VAT number on Stripe")
+			}
+		}
+	}
+
+	var vat *stripe.TaxID
+	if id := vatTaxID(current); id != nil && id.Value == details.VATID {
+		vat = id
+	} else if len(details.VATID) > 0 {
+		vat, err = m.BillingProvider.NewTaxID(&stripe.TaxIDParams{
+			Params: stripe.Params{
+				Context: ctx,
+			},
+			Customer: stripe.String(customerID),
+			Type:     stripe.String(string(stripe.TaxIDTypeEUVAT)),
+			Value:    stripe.String(details.VATID),
+		})
+		if err != nil {
+			return extErrors.Wrap(err, "Unable to add VAT number on Stripe")
+		}
+	}
+
+	// until Stripe has verified the VAT number, the customer is charged VAT. See syncReverseCharge
+	taxExempt := stripe.CustomerTaxExemptNone
+	if vat != nil && vat.Verification != nil && vat.Verification.Status == stripe.TaxIDVerificationStatusVerified {
+		taxExempt = stripe.CustomerTaxExemptReverse
+	}
+	if _, err := m.BillingProvider.UpdateCustomer(customerID, &stripe.CustomerParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+		Name: stripe.String(details.Name),
+		Address: &stripe.AddressParams{
+			Line1:      stripe.String(details.Line1),
+			Line2:      stripe.String(details.Line2),
+			City:       stripe.String(details.City),
+			PostalCode: stripe.String(details.PostalCode),
+			State:      stripe.String(details.State),
+			Country:    stripe.String(details.Country),
+		},
+		TaxExempt: stripe.String(string(taxExempt)),
+	}); err != nil {
+		return extErrors.Wrap(err, "Unable to update customer on Stripe")
+	}
+	return nil
+}
+
+// syncReverseCharge exempts the customer from VAT once Stripe has verified their VAT number, which happens
+// asynchronously after UpdateBillingDetails. The exemption is revoked if the verification failed afterwards
+func (m *Manager) syncReverseCharge(ctx context.Context, c *stripe.Customer) error {
+	if c.TaxExempt == stripe.CustomerTaxExemptExempt {
+		return nil
+	}
+	taxExempt := stripe.CustomerTaxExemptNone
+	if reverseCharged(c) {
+		taxExempt = stripe.CustomerTaxExemptReverse
+	}
+	if c.TaxExempt == taxExempt {
+		return nil
+	}
+	if _, err := m.BillingProvider.UpdateCustomer(c.ID, &stripe.CustomerParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+		TaxExempt: stripe.String(string(taxExempt)),
+	}); err != nil {
+		return extErrors.Wrap(err, "Unable to update customer on Stripe")
+	}
+	c.TaxExempt = taxExempt
+	return nil
+}
+
+// taxRateFor returns the VAT rate charged to the customer based on their billing country, creating the Tax Rate
+// on Stripe if needed. nil if the customer is not taxed
+func (m *Manager) taxRateFor(ctx context.Context, c *stripe.Customer) (*TaxRate, error) {
+	if c.TaxExempt == stripe.CustomerTaxExemptExempt || reverseCharged(c) {
+		return nil, nil
+	}
+	percentage, ok := vatRates[c.Address.Country]
+	if !ok {
+		return nil, nil
+	}
+
+	var rate TaxRate
+	result := m.DB.WithContext(ctx).
+		Where("country = ?", c.Address.Country).
+		Where("percentage = ?", percentage).
+		First(&rate)
+	if result.Error == nil {
+		return &rate, nil
+	}
+	if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, result.Error
+	}
+
+	stripeRate, err := m.BillingProvider.NewTaxRate(&stripe.TaxRateParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+		DisplayName:  stripe.String("VAT"),
+		Description:  stripe.String("VAT " + c.Address.Country),
+		Jurisdiction: stripe.String(c.Address.Country),
+		Percentage:   stripe.Float64(percentage),
+		Inclusive:    stripe.Bool(false),
+	})
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot create Tax Rate on Stripe")
+	}
+	rate = TaxRate{
+		ID:         stripeRate.ID,
+		Country:    c.Address.Country,
+		Percentage: percentage,
+	}
+	// another request may have created the same rate concurrently, in which case theirs is used
+	if createRes := m.DB.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&rate); createRes.Error != nil {
+		return nil, createRes.Error
+	}
+	if lookupRes := m.DB.WithContext(ctx).
+		Where("country = ?", rate.Country).
+		Where("percentage = ?", rate.Percentage).
+		First(&rate); lookupRes.Error != nil {
+		return nil, lookupRes.Error
+	}
+	return &rate, nil
+}
+
+// PreferredCurrency returns the currency the customer is billed in based on their billing country, or an empty
+// string if they are billed in the default currency of the Plans
+func (m *Manager) PreferredCurrency(ctx context.Context, customerID string) (string, error) {
+	c, err := m.BillingProvider.GetCustomer(customerID, &stripe.CustomerParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	})
+	if err != nil {
+		return "", extErrors.Wrap(err, "Unable to fetch customer from Stripe")
+	}
+	return currencyForCountry(c.Address.Country), nil
+}
+
+// BudgetOption specifies the budget of a customer. An empty SubscriptionID refers to the account-wide budget
+type BudgetOption struct {
+	CustomerID     string
+	SubscriptionID string
+	Currency       string // Currency of the account-wide budget. Defaults to the currency of the latest subscription
+}
+
+// ErrBudgetCurrency is returned when the currency of an account-wide budget is not specified and cannot be inferred
+var ErrBudgetCurrency = errors.New("Currency of the budget is required")
+
+// GetBudget will return the budget as specified in BudgetOption, or nil if no budget is set
+func (m *Manager) GetBudget(ctx context.Context, opt BudgetOption) (*Budget, error) {
+	if len(opt.CustomerID) == 0 {
+		return nil, fmt.Errorf("CustomerID is required")
+	}
+	var b Budget
+	result := m.DB.WithContext(ctx).
+		Where("customer_id = ?", opt.CustomerID).
+		Where("subscription_id = ?", opt.SubscriptionID).
+		First(&b)
+
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &b, nil
+}
+
+// PutBudget will create or replace the budget. A zero LimitInCents removes the budget
+func (m *Manager) PutBudget(ctx context.Context, b *Budget) error {
+	if len(b.CustomerID) == 0 {
+		return fmt.Errorf("CustomerID is required")
+	}
+	if b.LimitInCents < 0 {
+		return fmt.Errorf("LimitInCents cannot be negative")
+	}
+
+	if b.LimitInCents == 0 {
+		result := m.DB.WithContext(ctx).
+			Where("customer_id = ?", b.CustomerID).
+			Where("subscription_id = ?", b.SubscriptionID).
+			Delete(&Budget{})
+		return result.Error
+	}
+
+	currency, err := m.budgetCurrency(ctx, b)
+	if err != nil {
+		return err
+	}
+	b.Currency = currency
+
+	// NotifiedThreshold is kept so changing the limit doesn't send the same alerts again
+	result := m.DB.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "customer_id"}, {Name: "subscription_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"limit_in_cents", "currency", "hard_limit", "updated_at"}),
+		}).
+		Create(b)
+	if result.Error != nil {
+		m.Logger.Error("Unable to save budget in database",
+			zap.Error(result.Error),
+		)
+		return extErrors.Wrap(result.Error, "Cannot save budget")
+	}
+	return nil
+}
+
+// budgetCurrency returns the currency of the budget. A subscription budget is in the currency of the subscription. An
+// account-wide budget defaults to the currency of the latest subscription, otherwise the currency of the billing country
+func (m *Manager) budgetCurrency(ctx context.Context, b *Budget) (string, error) {
+	if len(b.SubscriptionID) == 0 && len(b.Currency) > 0 {
+		return strings.ToLower(b.Currency), nil
+	}
+
+	var sub Subscription
+	query := m.DB.WithContext(ctx).
+		Where("customer_id = ?", b.CustomerID)
+	if len(b.SubscriptionID) > 0 {
+		query = query.Where("id = ?", b.SubscriptionID)
+	}
+	result := query.Order("created_at desc").
+		Limit(1).
+		Find(&sub)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected > 0 {
+		return sub.Currency, nil
+	}
+	if len(b.SubscriptionID) > 0 {
+		return "", fmt.Errorf("Subscription of the budget does not exist")
+	}
+
+	currency, err := m.PreferredCurrency(ctx, b.CustomerID)
+	if err != nil {
+		return "", err
+	}
+	if len(currency) == 0 {
+		return "", ErrBudgetCurrency
+	}
+	return currency, nil
+}
+
+// GetBudgetStatus will return the budget as specified in BudgetOption along with the spend of the current period
+func (m *Manager) GetBudgetStatus(ctx context.Context, opt BudgetOption) (*BudgetStatus, error) {
+	b, err := m.GetBudget(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		opt.Currency = b.Currency
+	}
+	spend, projected, currency, err := m.budgetSpend(ctx, opt, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &BudgetStatus{
+		Budget:                b,
+		Currency:              currency,
+		SpendInCents:          spend,
+		ProjectedSpendInCents: projected,
+	}, nil
+}
+
+// HardLimitReached returns true if the spend has reached a hard limit budget covering the subscription,
+// either set on the subscription itself or account-wide
+func (m *Manager) HardLimitReached(ctx context.Context, opt BudgetOption) (bool, error) {
+	budgets := make([]Budget, 0, 2)
+	result := m.DB.WithContext(ctx).
+		Where("customer_id = ?", opt.CustomerID).
+		Where("subscription_id IN ?", []string{"", opt.SubscriptionID}).
+		Where("hard_limit = ?", true).
+		Find(&budgets)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if len(budgets) == 0 {
+		return false, nil
+	}
+
+	var sub Subscription
+	result = m.DB.WithContext(ctx).
+		Where("customer_id = ?", opt.CustomerID).
+		Where("id = ?", opt.SubscriptionID).
+		Limit(1).
+		Find(&sub)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	now := time.Now()
+	for _, b := range budgets {
+		spend, _, currency, err := m.budgetSpend(ctx, BudgetOption{
+			CustomerID:     b.CustomerID,
+			SubscriptionID: b.SubscriptionID,
+			Currency:       b.Currency,
+		}, now)
+		if err != nil {
+			return false, err
+		}
+		if currency != sub.Currency {
+			// the account-wide budget doesn't cover subscriptions billed in other currencies
+			continue
+		}
+		if spend >= b.LimitInCents {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// EvaluateBudgets checks the budgets covering the subscriptions against the spend of the current period, and emails the
+// customer as alert thresholds are crossed. Returns the subscriptions whose spend reached a hard limit. Instances of
+// those subscriptions should be stopped
+func (m *Manager) EvaluateBudgets(ctx context.Context, subscriptionIDs []string, referenceTime time.Time) ([]string, error) {
+	if len(subscriptionIDs) == 0 {
+		return nil, nil
+	}
+	subs := make([]Subscription, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Where("id IN ?", subscriptionIDs).
+		Find(&subs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(subs) == 0 {
+		return nil, nil
+	}
+
+	subsByCustomer := make(map[string][]Subscription)
+	for _, sub := range subs {
+		subsByCustomer[sub.CustomerID] = append(subsByCustomer[sub.CustomerID], sub)
+	}
+	customerIDs := make([]string, 0, len(subsByCustomer))
+	for customerID := range subsByCustomer {
+		customerIDs = append(customerIDs, customerID)
+	}
+
+	budgets := make([]Budget, 0, 1)
+	result = m.DB.WithContext(ctx).
+		Where("customer_id IN ?", customerIDs).
+		Where("(subscription_id = '' OR subscription_id IN ?)", subscriptionIDs).
+		Find(&budgets)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	limited := make([]string, 0)
+	for k, b := range budgets {
+		spend, projected, currency, err := m.budgetSpend(ctx, BudgetOption{
+			CustomerID:     b.CustomerID,
+			SubscriptionID: b.SubscriptionID,
+			Currency:       b.Currency,
+		}, referenceTime)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := m.notifyBudget(ctx, &budgets[k], spend, projected, currency); err != nil {
+			m.Logger.Error("Unable to send budget alert",
+				zap.String("CustomerID", b.CustomerID),
+				zap.String("SubscriptionID", b.SubscriptionID),
+				zap.Error(err),
+			)
+		}
+
+		if !b.HardLimit || spend < b.LimitInCents {
+			continue
+		}
+		if b.SubscriptionID == "" {
+			for _, sub := range subsByCustomer[b.CustomerID] {
+				if sub.Currency == currency {
+					limited = append(limited, sub.ID)
+				}
+			}
+		} else {
+			limited = append(limited, b.SubscriptionID)
+		}
+	}
+	return limited, nil
+}
+
+// budgetSpend returns the spend so far and the projected spend of the current period of the subscriptions covered
+// by the budget as specified in BudgetOption, and their currency. Spend is never summed across currencies: an account-wide
+// budget only covers the subscriptions billed in its currency. Trials are not billed and don't count towards the spend
+func (m *Manager) budgetSpend(ctx context.Context, opt BudgetOption, referenceTime time.Time) (spend float64, projected float64, currency string, err error) {
+	baseQuery := m.DB.WithContext(ctx).
+		Preload("SubscriptionItems").
+		Preload("SubscriptionItems.Part").
+		Preload("Plan").
+		Where("customer_id = ?", opt.CustomerID).
+		Where("state IN ?", []State{StateActive, StateOverdue}).
+		Order("created_at desc")
+	if len(opt.SubscriptionID) > 0 {
+		baseQuery = baseQuery.Where("id = ?", opt.SubscriptionID)
+	}
+
+	subs := make([]Subscription, 0, 1)
+	if result := baseQuery.Find(&subs); result.Error != nil {
+		return 0, 0, "", result.Error
+	}
+
+	currency = strings.ToLower(opt.Currency)
+	if len(currency) == 0 && len(subs) > 0 {
+		currency = subs[0].Currency
+	}
+
+	for k, sub := range subs {
+		if sub.Currency != currency {
+			continue
+		}
+		invoice, err := m.upcomingInvoice(ctx, &subs[k], referenceTime)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		var fixed float64
+		for _, line := range invoice.Lines {
+			if line.Part != nil && line.Part.Type == FixedType {
+				fixed += line.AmountInCents
+			}
+		}
+		spend += invoice.TotalInCents
+
+		// fixed parts are billed once per period, only the variable parts are extrapolated
+		variable := invoice.TotalInCents - fixed
+		elapsed := referenceTime.Sub(sub.PeriodStart)
+		period := sub.PeriodEnd.Sub(sub.PeriodStart)
+		if elapsed > 0 && elapsed < period {
+			variable = variable * float64(period) / float64(elapsed)
+		}
+		projected += fixed + variable
+	}
+	return spend, projected, currency, nil
+}
+
+// notifyBudget emails the customer when the spend crosses an alert threshold of the budget
+func (m *Manager) notifyBudget(ctx context.Context, b *Budget, spend, projected float64, currency string) error {
+	var threshold int64
+	for _, t := range budgetThresholds {
+		if spend*100 >= b.LimitInCents*float64(t) {
+			threshold = t
+		}
+	}
+	if threshold == b.NotifiedThreshold {
+		return nil
+	}
+
+	// conditional update so concurrent evaluations only send the alert once
+	result := m.DB.WithContext(ctx).
+		Model(&Budget{}).
+		Where("customer_id = ?", b.CustomerID).
+		Where("subscription_id = ?", b.SubscriptionID).
+		Where("notified_threshold = ?", b.NotifiedThreshold).
+		Update("notified_threshold", threshold)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 || threshold < b.NotifiedThreshold {
+		// spend dropped after renewal, there's nothing to notify about
+		return nil
+	}
+	m.emitThreshold(ctx, b, threshold, spend, projected, currency)
+	if m.Mailer == nil {
+		return nil
+	}
+
+	c, err := m.BillingProvider.GetCustomer(b.CustomerID, &stripe.CustomerParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	})
+	if err != nil {
+		return extErrors.Wrap(err, "Unable to fetch customer from Stripe")
+	}
+
+	scope := "your account"
+	if len(b.SubscriptionID) > 0 {
+		scope = "subscription " + b.SubscriptionID
+	}
+	currency = strings.ToUpper(currency)
+	text := fmt.Sprintf("You have spent %.2f %s of your %.2f %s budget for %s in the current billing period (%d%%).\n\n"+
+		"At the current rate, you will spend %.2f %s by the end of the period.",
+		spend/100, currency, b.LimitInCents/100, currency, scope, threshold, projected/100, currency)
+	if b.HardLimit && threshold >= 100 {
+		text += "\n\nAs the budget is a hard limit, your instances are being stopped. Raise the budget to start them again."
+	}
+
+	return m.Mailer.Send(ctx, external.Email{
+		To:      c.Email,
+		Subject: fmt.Sprintf("You have reached %d%% of your budget", threshold),
+		Text:    text,
+	})
+}
+
+// emitThreshold sends the budget alert to the webhooks of the customer
+func (m *Manager) emitThreshold(ctx context.Context, b *Budget, threshold int64, spend, projected float64, currency string) {
+	if m.WebhookManager == nil {
+		return
+	}
+	scope := "your account"
+	if len(b.SubscriptionID) > 0 {
+		scope = "subscription " + b.SubscriptionID
+	}
+	if err := m.WebhookManager.Emit(ctx, webhook.EmitOption{
+		CustomerID: b.CustomerID,
+		Event:      webhook.EventUsageThreshold,
+		Summary:    fmt.Sprintf("Spend for %s reached %d%% of the budget", scope, threshold),
+		Data: map[string]interface{}{
+			"subscriptionId":   b.SubscriptionID,
+			"threshold":        threshold,
+			"spendInCents":     spend,
+			"projectedInCents": projected,
+			"limitInCents":     b.LimitInCents,
+			"currency":         currency,
+			"hardLimit":        b.HardLimit,
+		},
+	}); err != nil {
+		m.Logger.Error("Unable to emit budget threshold",
+			zap.String("CustomerID", b.CustomerID),
+			zap.Error(err),
+		)
+	}
+}
+
+// NotifyFailedPayments notifies customers of open invoices created after notBefore that Stripe failed to charge.
+// Each invoice is only notified once
+func (m *Manager) NotifyFailedPayments(ctx context.Context, notBefore time.Time) error {
+	if m.NotificationManager == nil {
+		return nil
+	}
+	params := &stripe.InvoiceListParams{
+		ListParams: stripe.ListParams{
+			Context: ctx,
+		},
+		Status: stripe.String(string(stripe.InvoiceStatusOpen)),
+		CreatedRange: &stripe.RangeQueryParams{
+			GreaterThanOrEqual: notBefore.Unix(),
+		},
+	}
+	params.Limit = stripe.Int64(100)
+
+	for {
+		invoices, err := m.BillingProvider.ListInvoices(params)
+		if err != nil {
+			return extErrors.Wrap(err, "Unable to list open invoices from Stripe")
+		}
+		for _, inv := range invoices {
+			if inv.Paid || inv.AttemptCount == 0 || inv.AmountDue <= 0 || inv.Customer == nil {
+				continue
+			}
+			if err := m.NotificationManager.Notify(ctx, notification.NotifyOption{
+				CustomerID: inv.Customer.ID,
+				Event:      notification.EventPaymentFailed,
+				Key:        inv.ID,
+				Data: map[string]interface{}{
+					"InvoiceID":  inv.ID,
+					"Amount":     fmt.Sprintf("%.2f %s", float64(inv.AmountDue)/100, strings.ToUpper(string(inv.Currency))),
+					"InvoiceURL": inv.HostedInvoiceURL,
+				},
+			}); err != nil {
+				m.Logger.Error("Unable to notify failed payment",
+					zap.String("CustomerID", inv.Customer.ID),
+					zap.String("InvoiceID", inv.ID),
+					zap.Error(err),
+				)
+			}
+		}
+		if int64(len(invoices)) < *params.Limit {
+			return nil
+		}
+		params.StartingAfter = stripe.String(invoices[len(invoices)-1].ID)
+	}
+}
+
+// InvoiceListOption specifies the parameters for invoice listing
+type InvoiceListOption struct {
+	CustomerID     string
+	SubscriptionID string
+	StartingAfter  string // Invoice ID to list after, for pagination
+	Limit          int64
+}
+
+// ListInvoices will return a page of invoices of a customer, newest first
+func (m *Manager) ListInvoices(ctx context.Context, opt InvoiceListOption) ([]Invoice, error) {
+	if len(opt.CustomerID) == 0 {
+		return nil, fmt.Errorf("CustomerID is required")
+	}
+	params := &stripe.InvoiceListParams{
+		ListParams: stripe.ListParams{
+			Context: ctx,
+		},
+		Customer: stripe.String(opt.CustomerID),
+	}
+	if len(opt.SubscriptionID) > 0 {
+		params.Subscription = stripe.String(opt.SubscriptionID)
+	}
+	if len(opt.StartingAfter) > 0 {
+		params.StartingAfter = stripe.String(opt.StartingAfter)
+	}
+	if opt.Limit > 0 {
+		params.Limit = stripe.Int64(opt.Limit)
+	}
+
+	stripeInvoices, err := m.BillingProvider.ListInvoices(params)
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Unable to list invoices from Stripe")
+	}
+
+	parts, err := m.getPartsByID(ctx, partIDs(stripeInvoices))
+	if err != nil {
+		return nil, err
+	}
+
+	invoices := make([]Invoice, len(stripeInvoices))
+	for k, inv := range stripeInvoices {
+		invoices[k].fromStripeInvoice(inv, parts)
+	}
+	return invoices, nil
+}
+
+// InvoiceGetOption specifies the parameters for getting a single invoice
+type InvoiceGetOption struct {
+	CustomerID string
+	InvoiceID  string
+}
+
+// GetInvoice will return an invoice of a customer. If the invoice does not exist or belongs to another customer, it will be nil
+func (m *Manager) GetInvoice(ctx context.Context, opt InvoiceGetOption) (*Invoice, error) {
+	if len(opt.CustomerID) == 0 {
+		return nil, fmt.Errorf("CustomerID is required")
+	}
+	if len(opt.InvoiceID) == 0 {
+		return nil, fmt.Errorf("InvoiceID is required")
+	}
+	stripeInvoice, err := m.BillingProvider.GetInvoice(opt.InvoiceID, &stripe.InvoiceParams{
+		Params: stripe.Params{
+			Context: ctx,
+		},
+	})
+	if err != nil {
+		if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+			return nil, nil
+		}
+		return nil, extErrors.Wrap(err, "Unable to get invoice from Stripe")
+	}
+	if stripeInvoice.Customer == nil || stripeInvoice.Customer.ID != opt.CustomerID {
 		return nil, nil
 	}
 
-	subItemsID := make([]string, 0, 2)
-	for _, item := range sub.SubscriptionItems {
-		subItemsID = append(subItemsID, item.ID)
+	parts, err := m.getPartsByID(ctx, partIDs([]*stripe.Invoice{stripeInvoice}))
+	if err != nil {
+		return nil, err
 	}
 
-	usages := make([]Usage, 0, 2)
-	result = m.DB.WithContext(ctx).
-		Clauses(clause.Locking{Strength: "SHARE"}).
-		Preload("SubscriptionItem").
-		Preload("SubscriptionItem.Part").
-		Order("usages.end_date desc").
-		Where("subscription_item_id IN ?", subItemsID).
-		Find(&usages)
+	var invoice Invoice
+	invoice.fromStripeInvoice(stripeInvoice, parts)
+	return &invoice, nil
+}
 
+// UpcomingInvoices will return a preview of the invoice for the current period of each active subscription of a customer.
+// The preview is computed from the local Usage records and Part.AmountInCents, without asking Stripe
+func (m *Manager) UpcomingInvoices(ctx context.Context, customerID string) ([]Invoice, error) {
+	if len(customerID) == 0 {
+		return nil, fmt.Errorf("CustomerID is required")
+	}
+	subs := make([]Subscription, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Preload("SubscriptionItems").
+		Preload("SubscriptionItems.Part").
+		Preload("Plan").
+		Where("customer_id = ?", customerID).
+		Where("state = ?", StateActive).
+		Order("created_at desc").
+		Find(&subs)
 	if result.Error != nil {
 		m.Logger.Error("Database returned error",
 			zap.Error(result.Error),
 		)
 		return nil, result.Error
 	}
-	return usages, nil
-}
 
-// AttachPaymentOptions is used for AttachmentPayment
-type AttachPaymentOptions struct {
-	CustomerID      string
-	PaymentMethodID string
+	credit, err := m.CreditBalance(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	invoices := make([]Invoice, 0, len(subs))
+	for k := range subs {
+		invoice, err := m.upcomingInvoice(ctx, &subs[k], now)
+		if err != nil {
+			return nil, err
+		}
+		// credit is drawn down before the payment method is charged
+		invoice.CreditInCents = math.Min(float64(credit), invoice.TotalInCents)
+		credit -= int64(invoice.CreditInCents)
+		invoice.AmountDueInCents = invoice.TotalInCents - invoice.CreditInCents
+		invoices = append(invoices, *invoice)
+	}
+	return invoices, nil
 }
 
-// AttachPayment will attach a default payment method to a customer
-func (m *Manager) AttachPayment(ctx context.Context, opt AttachPaymentOptions) error {
-	if len(opt.CustomerID) == 0 {
-		return fmt.Errorf("AttachPaymentOptions.CustomerID is required")
+// upcomingInvoice computes the invoice for the current period of the subscription from the local Usage records as of referenceTime.
+// Subscription.SubscriptionItems and their Part must be preloaded
+func (m *Manager) upcomingInvoice(ctx context.Context, sub *Subscription, referenceTime time.Time) (*Invoice, error) {
+	invoice := Invoice{
+		SubscriptionID: sub.ID,
+		Status:         "upcoming",
+		Upcoming:       true,
+		Currency:       sub.Currency,
+		PeriodStart:    sub.PeriodStart,
+		PeriodEnd:      sub.PeriodEnd,
+		CreatedAt:      referenceTime,
+		Lines:          make([]InvoiceLine, 0, len(sub.SubscriptionItems)),
 	}
-	if len(opt.PaymentMethodID) == 0 {
-		return fmt.Errorf("AttachPaymentOptions.PaymentMethodID is required")
+	for k, item := range sub.SubscriptionItems {
+		line := InvoiceLine{
+			Description: item.Part.Name,
+			Part:        &sub.SubscriptionItems[k].Part,
+			PeriodStart: sub.PeriodStart,
+			PeriodEnd:   sub.PeriodEnd,
+		}
+		switch item.Part.Type {
+		case FixedType:
+			line.Quantity = 1
+		case VariableType:
+			u, err := m.getUsageBySubscriptionItemID(ctx, usageLookupOption{
+				SubscriptionItemID: item.ID,
+				ReferenceTime:      referenceTime,
+			})
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				break
+			}
+			if err != nil {
+				return nil, extErrors.Wrap(err, "Cannot get usage by subscription item id")
+			}
+			quantity, err := unitConversion(u)
+			if err != nil {
+				return nil, extErrors.Wrap(err, "Error converting unit for usage")
+			}
+			line.Quantity = quantity
+		}
+		line.AmountInCents = float64(line.Quantity) * item.Part.AmountInCents
+		invoice.TotalInCents += line.AmountInCents
+		invoice.Lines = append(invoice.Lines, line)
 	}
-	params := &stripe.PaymentMethodAttachParams{
-		Customer: stripe.String(opt.CustomerID),
+	invoice.TaxInCents = math.Round(invoice.TotalInCents * sub.TaxPercent / 100)
+	invoice.TotalInCents += invoice.TaxInCents
+	return &invoice, nil
+}
+
+func (m *Manager) getPartsByID(ctx context.Context, partIDs []string) (map[string]Part, error) {
+	parts := make(map[string]Part)
+	if len(partIDs) == 0 {
+		return parts, nil
 	}
-	pm, err := m.StripeClient.PaymentMethods.Attach(
-		opt.PaymentMethodID,
-		params,
-	)
-	if err != nil {
-		return err
+	results := make([]Part, 0, len(partIDs))
+	if lookupRes := m.DB.WithContext(ctx).
+		Find(&results, "id IN ?", partIDs); lookupRes.Error != nil {
+		return nil, lookupRes.Error
 	}
-
-	customerParams := &stripe.CustomerParams{
-		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
-			DefaultPaymentMethod: stripe.String(pm.ID),
-		},
+	for _, part := range results {
+		parts[part.ID] = part
 	}
-	if _, err := m.StripeClient.Customers.Update(
-		opt.CustomerID,
-		customerParams,
-	); err != nil {
-		return err
+	return parts, nil
+}
+
+// ErrPlanNotFound is returned when updating a Plan that doesn't exist
+var ErrPlanNotFound = errors.New("Plan does not exist")
+
+// createPlans will create the Plans on Stripe and in the database. A Plan with the same ID, or the same Name, Interval
+// and Currency as an existing Plan updates it instead (see UpdatePlan), so applying the same plans.json again is a no-op
+func (m *Manager) createPlans(ctx context.Context, plans []Plan) error {
+	for k := range plans {
+		plans[k].expandCurrencies()
+		if err := plans[k].validate(); err != nil {
+			return err
+		}
 	}
+	for k := range plans {
+		existing, err := m.findExistingPlan(ctx, &plans[k])
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			updated, err := m.UpdatePlan(ctx, existing.ID, plans[k])
+			if err != nil {
+				return err
+			}
+			plans[k] = *updated
+			continue
+		}
 
+		if err := plans[k].createPlanOnStripe(ctx, m.BillingProvider); err != nil {
+			return err
+		}
+		if createRes := m.DB.WithContext(ctx).Create(&plans[k]); createRes.Error != nil {
+			return createRes.Error
+		}
+		if plans[k].Retired {
+			if err := m.setPlanActive(ctx, &plans[k], false); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-// CreateFromPlanOption is used to specify parameters for creating a subscription
-type CreateFromPlanOption struct {
-	CustomerID string
-	Plan       Plan
+// findExistingPlan returns the Plan matching plan by ID, or by Name, Interval and Currency. nil if none was found
+func (m *Manager) findExistingPlan(ctx context.Context, plan *Plan) (*Plan, error) {
+	if len(plan.ID) > 0 {
+		return m.GetPlan(ctx, plan.ID)
+	}
+	var existing Plan
+	lookupRes := m.DB.WithContext(ctx).
+		Preload("Parts").
+		Where("name = ?", plan.Name).
+		Where("interval = ?", plan.Interval).
+		Where("currency = ?", plan.Currency).
+		Order("retired asc").
+		First(&existing)
+	if errors.Is(lookupRes.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if lookupRes.Error != nil {
+		return nil, lookupRes.Error
+	}
+	return &existing, nil
 }
 
-// CreateSubscriptionFromPlan will create a subscription with Stripe from an existing Plan
-func (m *Manager) CreateSubscriptionFromPlan(ctx context.Context, opt CreateFromPlanOption) (*stripe.Subscription, error) {
-	if len(opt.CustomerID) == 0 {
-		return nil, fmt.Errorf("SetupOptions.CustomerID is required")
+// UpdatePlan will update the Plan to match desired. Parts of desired are matched to the current Parts by ID, or by
+// Type, Primary and Name. A matched Part with a different price (AmountInCents or Unit) becomes a new version: the old
+// Part is retired, so existing subscriptions keep being billed by it, while new subscriptions are billed by the new
+// version. Current Parts missing from desired are retired. Interval and Currency cannot be changed
+func (m *Manager) UpdatePlan(ctx context.Context, planID string, desired Plan) (*Plan, error) {
+	current, err := m.GetPlan(ctx, planID)
+	if err != nil {
+		return nil, err
 	}
-	if len(opt.Plan.ID) == 0 {
-		return nil, fmt.Errorf("SetupOptions.Plan needs to be a synchronized Plan")
+	if current == nil {
+		return nil, ErrPlanNotFound
 	}
 
-	subscriptionParams := opt.Plan.toStripeSubscriptionParams(ctx, opt.CustomerID)
-	subscriptionParams.AddExpand("latest_invoice.payment_intent")
-	subscriptionParams.AddExpand("pending_setup_intent")
+	desired.ID = current.ID
+	if desired.Interval == "" {
+		desired.Interval = current.Interval
+	}
+	if desired.Currency == "" {
+		desired.Currency = current.Currency
+	}
+	desired.expandCurrencies()
+	if desired.Interval != current.Interval || desired.Currency != current.Currency {
+		return nil, fmt.Errorf("Interval and Currency of Plan %s cannot be changed, create a new Plan instead", current.Name)
+	}
+	if err := desired.validate(); err != nil {
+		return nil, err
+	}
+
+	logger := m.Logger.With(zap.String("PlanID", current.ID))
+
+	if desired.Name != current.Name ||
+		desired.Description != current.Description ||
+		!reflect.DeepEqual(desired.Parameters, current.Parameters) {
+		if _, err := m.BillingProvider.UpdateProduct(current.ID, &stripe.ProductParams{
+			Params: stripe.Params{
+				Context:  ctx,
+				Metadata: desired.productMetadata(),
+			},
+			Name:        stripe.String(desired.Name),
+			Description: stripe.String(desired.Description),
+		}); err != nil {
+			return nil, extErrors.Wrap(err, "Cannot update Plan as Product on Stripe")
+		}
+	}
 
-	sub, err := m.StripeClient.Subscriptions.New(subscriptionParams)
+	parts := make([]Part, 0, len(current.Parts)+1)
+	kept := make(map[string]bool, len(current.Parts))
+	for _, part := range desired.activeParts() {
+		var match *Part
+		for k, c := range current.Parts {
+			if kept[c.ID] {
+				continue
+			}
+			if (len(part.ID) > 0 && part.ID == c.ID) || (len(part.ID) == 0 && !c.Retired && c.sameSlot(part)) {
+				match = &current.Parts[k]
+				break
+			}
+		}
+		if len(part.ID) > 0 && match == nil {
+			return nil, fmt.Errorf("Part %s does not belong to Plan %s", part.ID, current.Name)
+		}
 
-	if err != nil {
-		return nil, err
+		if match == nil || !match.samePrice(part) {
+			// a new version. Reuse a retired version with the same price (e.g. a reverted price change) if there's one
+			part.ID = ""
+			for k, c := range current.Parts {
+				if !kept[c.ID] && c.Retired && c.sameSlot(part) && c.samePrice(part) {
+					match = &current.Parts[k]
+					break
+				}
+			}
+			if match == nil || !match.samePrice(part) {
+				part.PlanID = current.ID
+				part.Retired = false
+				parts = append(parts, part)
+				continue
+			}
+		}
+
+		kept[match.ID] = true
+		updated := *match
+		updated.Name = part.Name
+		updated.Retired = false
+		if updated.Name != match.Name || match.Retired {
+			if _, err := m.BillingProvider.UpdatePrice(match.ID, &stripe.PriceParams{
+				Params: stripe.Params{
+					Context: ctx,
+				},
+				Active:   stripe.Bool(!desired.Retired),
+				Nickname: stripe.String(updated.Name),
+			}); err != nil {
+				return nil, extErrors.Wrap(err, "Cannot update Part as Price on Stripe")
+			}
+		}
+		parts = append(parts, updated)
 	}
 
-	return sub, nil
-}
+	// everything else is retired, but kept for the subscriptions billed by them
+	for _, c := range current.Parts {
+		if kept[c.ID] {
+			continue
+		}
+		if !c.Retired {
+			logger.Info("Retiring Part",
+				zap.String("PartID", c.ID),
+			)
+			if _, err := m.BillingProvider.UpdatePrice(c.ID, &stripe.PriceParams{
+				Params: stripe.Params{
+					Context: ctx,
+				},
+				Active: stripe.Bool(false),
+			}); err != nil {
+				return nil, extErrors.Wrap(err, "Cannot archive Part as Price on Stripe")
+			}
+			c.Retired = true
+		}
+		parts = append(parts, c)
+	}
 
-func (m *Manager) synchronizeSubscriptionPeriod(ctx context.Context, subscriptionID string) error {
-	subscriptionParams := &stripe.SubscriptionParams{
-		Params: stripe.Params{
-			Context: ctx,
-		},
+	desired.Parts = parts
+	if err := desired.createPartsOnStripe(ctx, m.BillingProvider); err != nil {
+		return nil, err
 	}
-	sub, err := m.StripeClient.Subscriptions.Get(subscriptionID, subscriptionParams)
-	if err != nil {
-		return extErrors.Wrap(err, "Unable to fetch from Stripe to synchronize billing period")
+
+	if desired.Retired != current.Retired {
+		if err := m.setPlanActive(ctx, &desired, !desired.Retired); err != nil {
+			return nil, err
+		}
 	}
-	fmt.Printf("%+v\n", sub)
-	result := m.DB.WithContext(ctx).
-		Model(&Subscription{}).
-		Where("id = ?", subscriptionID).
-		Updates(map[string]interface{}{
-			"period_start": time.Unix(sub.CurrentPeriodStart, 0),
-			"period_end":   time.Unix(sub.CurrentPeriodEnd, 0),
-		})
-	if result.Error != nil {
-		return extErrors.Wrap(result.Error, "Unable to update subscription billing period in database")
+
+	if err := m.savePlan(ctx, &desired); err != nil {
+		return nil, err
 	}
-	return nil
+	return &desired, nil
 }
 
-func (m *Manager) synchronizeSubscriptionStatus(ctx context.Context, subscriptionID string) error {
-	subscriptionParams := &stripe.SubscriptionParams{
-		Params: stripe.Params{
-			Context: ctx,
-		},
-	}
-	subscriptionParams.AddExpand("latest_invoice.payment_intent")
-	subscriptionParams.AddExpand("pending_setup_intent")
-	sub, err := m.StripeClient.Subscriptions.Get(subscriptionID, subscriptionParams)
+// RetirePlan will archive the Plan and its Parts on Stripe, so no new subscriptions can be created from it.
+// Existing subscriptions are grandfathered and continue to be billed
+func (m *Manager) RetirePlan(ctx context.Context, planID string) (*Plan, error) {
+	plan, err := m.GetPlan(ctx, planID)
 	if err != nil {
-		return extErrors.Wrap(err, "Unable to fetch from Stripe to synchronize status")
+		return nil, err
 	}
-	// TODO: also synchronize cancelled/overdue
-	if sub.Status == stripe.SubscriptionStatusActive && sub.PendingSetupIntent == nil {
-		result := m.DB.WithContext(ctx).
-			Model(&Subscription{}).
-			Where("id = ?", subscriptionID).
-			Update("state", StateActive)
-		if result.Error != nil {
-			return extErrors.Wrap(result.Error, "Unable to mark subscription as active in database")
-		}
+	if plan == nil {
+		return nil, ErrPlanNotFound
 	}
-	return nil
+	if plan.Retired {
+		return plan, nil
+	}
+	if err := m.setPlanActive(ctx, plan, false); err != nil {
+		return nil, err
+	}
+	plan.Retired = true
+	if err := m.savePlan(ctx, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
 }
 
-// CancelSubscription will mark the subscription to be cancelled in the next billing period
-func (m *Manager) CancelSubscription(ctx context.Context, subscriptionID string) error {
-	updateParams := &stripe.SubscriptionParams{
+// setPlanActive archives or restores the Product and the Prices of the active Parts on Stripe
+func (m *Manager) setPlanActive(ctx context.Context, plan *Plan, active bool) error {
+	if _, err := m.BillingProvider.UpdateProduct(plan.ID, &stripe.ProductParams{
 		Params: stripe.Params{
 			Context: ctx,
 		},
-		CancelAtPeriodEnd: stripe.Bool(true),
-	}
-	sub, err := m.StripeClient.Subscriptions.Update(subscriptionID, updateParams)
-	if err != nil {
-		return extErrors.Wrap(err, "Unable to cancel subscription on Stripe")
-	}
-	if sub.CancelAtPeriodEnd != true {
-		return fmt.Errorf("Stripe did not mark subscription as cancel at end of period")
+		Active: stripe.Bool(active),
+	}); err != nil {
+		return extErrors.Wrap(err, "Cannot update Plan as Product on Stripe")
 	}
-	result := m.DB.WithContext(ctx).Model(&Subscription{}).Where("id = ?", subscriptionID).Update("state", StateInactive)
-	if result.Error != nil {
-		return extErrors.Wrap(result.Error, "Unable to mark subscription as inactive in database")
+	for _, part := range plan.activeParts() {
+		if _, err := m.BillingProvider.UpdatePrice(part.ID, &stripe.PriceParams{
+			Params: stripe.Params{
+				Context: ctx,
+			},
+			Active: stripe.Bool(active),
+		}); err != nil {
+			return extErrors.Wrap(err, "Cannot update Part as Price on Stripe")
+		}
 	}
 	return nil
 }
 
-func (m *Manager) createPlans(ctx context.Context, plans []Plan) error {
-	for k := range plans {
-		if err := plans[k].createPlanOnStripe(ctx, m.StripeClient); err != nil {
-			return err
+// savePlan updates the Plan and upserts all of its Parts
+func (m *Manager) savePlan(ctx context.Context, plan *Plan) error {
+	return m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if saveRes := tx.Omit("Parts").Save(plan); saveRes.Error != nil {
+			return saveRes.Error
 		}
-	}
-	if createRes := m.DB.WithContext(ctx).Create(&plans); createRes.Error != nil {
-		return createRes.Error
-	}
-	return nil
+		for k := range plan.Parts {
+			plan.Parts[k].PlanID = plan.ID
+			if saveRes := tx.Save(&plan.Parts[k]); saveRes.Error != nil {
+				return saveRes.Error
+			}
+		}
+		return nil
+	})
 }
 
-func (m *Manager) listPlans(ctx context.Context) ([]Plan, error) {
+// listPlans returns all Plans. Unless includeRetired is true, retired Plans and Parts are excluded, which is the
+// catalog offered to new customers
+func (m *Manager) listPlans(ctx context.Context, includeRetired bool) ([]Plan, error) {
 	plans := make([]Plan, 0, 1)
-	if lookupRes := m.DB.WithContext(ctx).
-		Preload("Parts").
-		Find(&plans); lookupRes.Error != nil {
+	baseQuery := m.DB.WithContext(ctx)
+	if includeRetired {
+		baseQuery = baseQuery.Preload("Parts")
+	} else {
+		baseQuery = baseQuery.
+			Preload("Parts", "retired = ?", false).
+			Where("retired = ?", false)
+	}
+	if lookupRes := baseQuery.Find(&plans); lookupRes.Error != nil {
 		return nil, lookupRes.Error
 	}
 	return plans, nil
@@ -407,7 +2032,7 @@ func (m *Manager) IncrementPrimaryUsage(ctx context.Context, opts []PrimaryUsage
 		go func(aggr PrimaryUsageOption) {
 			if err := m.txIncrementOrNew(ctx, usageOption{
 				SubscriptionID: aggr.SubscriptionID,
-				PartID:         nil,
+				Metric:         nil,
 				ReferenceTime:  aggr.ReferenceTime,
 				Amount:         aggr.Amount,
 			}); err != nil {
@@ -422,10 +2047,11 @@ func (m *Manager) IncrementPrimaryUsage(ctx context.Context, opts []PrimaryUsage
 	return nil
 }
 
-// SecondaryUsageOption specifies which secondary subscription to increment and by how much
+// SecondaryUsageOption specifies which secondary subscription to increment and by how much.
+// Amount is in the base unit of the Metric. If the Plan has no secondary Part metering the Metric, the usage is ignored
 type SecondaryUsageOption struct {
 	SubscriptionID string
-	PartID         string
+	Metric         Metric
 	ReferenceTime  time.Time
 	Amount         int64
 }
@@ -434,8 +2060,8 @@ func (s *SecondaryUsageOption) validate() error {
 	if len(s.SubscriptionID) == 0 {
 		return fmt.Errorf("empty SubscriptionID is invalid")
 	}
-	if len(s.PartID) == 0 {
-		return fmt.Errorf("empty PartID is invalid")
+	if len(s.Metric) == 0 {
+		return fmt.Errorf("empty Metric is invalid")
 	}
 	if s.ReferenceTime.IsZero() {
 		return fmt.Errorf("invalid ReferenceTime")
@@ -464,13 +2090,13 @@ func (m *Manager) IncrementSecondaryUsage(ctx context.Context, opts []SecondaryU
 		go func(aggr SecondaryUsageOption) {
 			if err := m.txIncrementOrNew(ctx, usageOption{
 				SubscriptionID: aggr.SubscriptionID,
-				PartID:         &aggr.PartID,
+				Metric:         &aggr.Metric,
 				ReferenceTime:  aggr.ReferenceTime,
 				Amount:         aggr.Amount,
 			}); err != nil {
 				m.Logger.Error("Error incrementing secondary usage",
 					zap.String("SubscriptionID", aggr.SubscriptionID),
-					zap.String("PartID", aggr.PartID),
+					zap.String("Metric", string(aggr.Metric)),
 					zap.Error(err),
 				)
 			}
@@ -480,9 +2106,11 @@ func (m *Manager) IncrementSecondaryUsage(ctx context.Context, opts []SecondaryU
 	return nil
 }
 
+var errNotMetered = errors.New("Metric is not metered by the Plan")
+
 type usageOption struct {
 	SubscriptionID string
-	PartID         *string
+	Metric         *Metric // nil for the primary usage
 	ReferenceTime  time.Time
 	Amount         int64
 	retryCount     int
@@ -496,7 +2124,6 @@ func (m *Manager) txIncrementOrNew(ctx context.Context, aggr usageOption) error
 	}
 
 	var sub Subscription
-	var variableItem *SubscriptionItem
 	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		lookupRes := tx.Clauses(clause.Locking{Strength: "SHARE"}).
 			Preload("SubscriptionItems").
@@ -509,14 +2136,15 @@ func (m *Manager) txIncrementOrNew(ctx context.Context, aggr usageOption) error
 			return lookupRes.Error
 		}
 
-		if aggr.PartID == nil {
+		var variableItem *SubscriptionItem
+		if aggr.Metric == nil {
 			variableItem = sub.findPrimaryVariableItem()
 		} else {
-			variablePart := sub.Plan.findVariablePart(false, aggr.PartID)
-			if variablePart == nil {
-				return fmt.Errorf("No secondary variable Part found for subscription with ID %s", aggr.SubscriptionID)
+			variableItem = sub.findSecondaryVariableItem(*aggr.Metric)
+			if variableItem == nil {
+				// the Plan does not bill this metric
+				return errNotMetered
 			}
-			variableItem = sub.findSubscriptionItemByPartID(variablePart.ID)
 		}
 
 		if variableItem == nil {
@@ -551,6 +2179,9 @@ func (m *Manager) txIncrementOrNew(ctx context.Context, aggr usageOption) error
 		Isolation: sql.LevelSerializable,
 	})
 
+	if errors.Is(err, errNotMetered) {
+		return nil
+	}
 	if err != nil {
 		pgErr, ok := err.(*pgconn.PgError)
 		if ok {
@@ -563,7 +2194,7 @@ func (m *Manager) txIncrementOrNew(ctx context.Context, aggr usageOption) error
 				// PrimaryKey constraint violation
 				// this only happens when PeriodStart/PeriodEnd has not been updated yet
 				timestamp, _ := ptypes.TimestampProto(aggr.ReferenceTime)
-				err := m.Producer.SendTask(spec.SubscriptionTask, &protocol.Task{
+				err := m.Producer.SendTask(ctx, spec.SubscriptionTask, &protocol.Task{
 					Timestamp: timestamp,
 					SubscriptionTask: &protocol.SubscriptionTask{
 						Function:       protocol.SubscriptionTask_Synchronize,
@@ -583,21 +2214,7 @@ func (m *Manager) txIncrementOrNew(ctx context.Context, aggr usageOption) error
 		return err
 	}
 
-	timestamp, _ := ptypes.TimestampProto(aggr.ReferenceTime)
-	if err := m.Producer.SendTask(spec.SubscriptionTask, &protocol.Task{
-		Timestamp: timestamp,
-		SubscriptionTask: &protocol.SubscriptionTask{
-			Function:           protocol.SubscriptionTask_ReportUsage,
-			SubscriptionItemID: variableItem.ID,
-		},
-		Type: protocol.Task_Subscription,
-	}); err != nil {
-		m.Logger.Error("Unable to send async task to report usage",
-			zap.Error(err),
-		)
-		return err
-	}
-
+	// usage is reported to Stripe in batches by Task, see Task.HandleSchedule
 	return nil
 }
 
@@ -654,3 +2271,60 @@ func (m *Manager) getUsageBySubscriptionItemID(ctx context.Context, opt usageLoo
 	}
 	return &usage, nil
 }
+
+// listPendingUsages returns Usage records that were incremented since they were last acknowledged by Stripe,
+// and whose period ended no earlier than notBefore
+func (m *Manager) listPendingUsages(ctx context.Context, notBefore time.Time) ([]Usage, error) {
+	usages := make([]Usage, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Preload("SubscriptionItem").
+		Preload("SubscriptionItem.Part").
+		Where("reported_at IS NULL OR aggregate_total <> reported_total").
+		Where("end_date > ?", notBefore).
+		Order("end_date asc").
+		Find(&usages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return usages, nil
+}
+
+// listReportedUsages returns Usage records of the current period that are in sync with what was last acknowledged by Stripe
+func (m *Manager) listReportedUsages(ctx context.Context, referenceTime time.Time) ([]Usage, error) {
+	usages := make([]Usage, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Preload("SubscriptionItem").
+		Preload("SubscriptionItem.Part").
+		Where("reported_at IS NOT NULL AND aggregate_total = reported_total").
+		Where("start_date < ? AND ? < end_date", referenceTime, referenceTime).
+		Find(&usages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return usages, nil
+}
+
+// markUsageReported records that Stripe has acknowledged the usage up to reportedTotal.
+// If the usage was incremented in the meantime, it will remain pending
+func (m *Manager) markUsageReported(ctx context.Context, u *Usage, reportedTotal int64, reportedAt time.Time) error {
+	return m.DB.WithContext(ctx).
+		Model(&Usage{}).
+		Where("subscription_item_id = ?", u.SubscriptionItemID).
+		Where("end_date = ?", u.EndDate).
+		Updates(map[string]interface{}{
+			"reported_total": reportedTotal,
+			"reported_at":    reportedAt,
+		}).Error
+}
+
+// markUsageUnreported forces the usage to be reported again in the next batch, with a new idempotency key
+func (m *Manager) markUsageUnreported(ctx context.Context, u *Usage) error {
+	return m.DB.WithContext(ctx).
+		Model(&Usage{}).
+		Where("subscription_item_id = ?", u.SubscriptionItemID).
+		Where("end_date = ?", u.EndDate).
+		Updates(map[string]interface{}{
+			"reported_at":   nil,
+			"report_resets": gorm.Expr("report_resets + 1"),
+		}).Error
+}
@@ -6,25 +6,31 @@ import (
 
 // Part describes each Part of a Plan. This corresponds to Stripe's "Price"
 type Part struct {
-	ID            string   `json:"id" gorm:"primaryKey"`    // Corresponding to Stripe's PriceID
-	Name          string   `json:"name"`                    // Name to describe this Part
-	AmountInCents float64  `json:"amountInCents"`           // Amount in cents (e.g. 15.0 for $0.015/{period})
-	Unit          string   `json:"unit"`                    // How should the AmountInCents apply. If Type is FixedType, then this Part will be billed AmountInCents/month regardless. If Type is Variable, then this Part will be billed Usage * AmountInCents/{unit} in a month
-	Type          PartType `json:"type"`                    // Either FixedType or VariableType
-	Primary       bool     `json:"primary"`                 // Indicate if this Part is the Primary part (e.g. Instance, not Addon) or not
-	PlanID        string   `json:"-" gorm:"index;not null"` // Corresponds to Plan.ID (foreign key: belongs to)
+	ID            string   `json:"id" gorm:"primaryKey"`                // Corresponding to Stripe's PriceID
+	Name          string   `json:"name"`                                // Name to describe this Part
+	AmountInCents float64  `json:"amountInCents"`                       // Amount in cents (e.g. 15.0 for $0.015/{period})
+	Unit          string   `json:"unit"`                                // How should the AmountInCents apply. If Type is FixedType, then this Part will be billed AmountInCents/month regardless. If Type is Variable, then this Part will be billed Usage * AmountInCents/{unit} in a month. See units.go for supported units
+	Type          PartType `json:"type"`                                // Either FixedType or VariableType
+	Primary       bool     `json:"primary"`                             // Indicate if this Part is the Primary part (e.g. Instance, not Addon) or not
+	Retired       bool     `json:"retired"`                             // Flag if the Part was superseded by a new price or removed (Archived on Stripe). Existing subscriptions are still billed by it
+	Currency      string   `json:"currency" gorm:"not null;default:''"` // The ISO currency code of AmountInCents. A Plan has a set of Parts for each currency it is priced in
+	PlanID        string   `json:"-" gorm:"index;not null"`             // Corresponds to Plan.ID (foreign key: belongs to)
+
+	LocalizedAmountsInCents map[string]float64 `json:"localizedAmountsInCents,omitempty" gorm:"-"` // Only used when creating or updating Plans. A copy of the Part is created for each currency (e.g. {"eur": 280})
 }
 
 // Plan describes an Instance plan. This corresponds to Stripe's "Product"
 type Plan struct {
-	ID          string          `json:"id" gorm:"primaryKey"` // Corresponds to Stripe's Product ID
-	Name        string          `json:"name"`                 // Represent the name shown to the customer and on Stripe
-	Description string          `json:"description"`          // Shown to the customer
-	Currency    string          `json:"currency"`             // The ISO currency code (e.g. usd)
-	Interval    string          `json:"interval"`             // Billing Frequency (e.g. month)
-	Parts       []Part          `json:"parts"`                // See Part struct above
-	Parameters  spec.Parameters `json:"parameters"`           // Describes what this Plan will have (e.g. {Ram: 2GB, Players: 6})
-	Retired     bool            `json:"retired"`              // Flag if the Plan is no longer valid (Archived on Stripe)
+	ID           string          `json:"id" gorm:"primaryKey"` // Corresponds to Stripe's Product ID
+	Name         string          `json:"name"`                 // Represent the name shown to the customer and on Stripe
+	Description  string          `json:"description"`          // Shown to the customer
+	Currency     string          `json:"currency"`             // The default ISO currency code (e.g. usd). See tax.go for how the currency of a customer is selected
+	Interval     string          `json:"interval"`             // Billing Frequency (e.g. month)
+	Parts        []Part          `json:"parts"`                // See Part struct above
+	Parameters   spec.Parameters `json:"parameters"`           // Describes what this Plan will have (e.g. {Ram: 2GB, Players: 6})
+	Retired      bool            `json:"retired"`              // Flag if the Plan is no longer valid (Archived on Stripe)
+	TrialDays    int64           `json:"trialDays"`            // Length of the free trial for new customers. 0 if the trial is only limited by TrialMinutes
+	TrialMinutes int64           `json:"trialMinutes"`         // Compute minutes included in the free trial. 0 if the trial is only limited by TrialDays
 }
 
 // -----------------------------------------------------------------------------
@@ -46,3 +52,10 @@ type Plan struct {
 // See https://stripe.com/docs/api/prices/create for details
 // When creating a new subscription, we will bill the Fixed part with Quantity of 1 (and "renew" it every new billing period)
 // When reporting usage, we will report the Variable part with Subscription.RunningTotalMinutes/60, rounded *up* to the nearest hour
+
+// Add-ons (e.g. backup storage, network egress) are secondary Variable parts, metered by the unit they are billed in.
+// A plan without a secondary part for a metric simply doesn't bill it
+
+// Prices on Stripe cannot be changed. Changing the price of a Part creates a new version of it (a new Price),
+// and the old version is retired (archived on Stripe). Existing subscriptions are grandfathered and keep being billed
+// by the retired Part, while new subscriptions are billed by the new version. See Manager.UpdatePlan for details
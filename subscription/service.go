@@ -2,13 +2,16 @@ package subscription
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/miragespace/rmc/audit"
 	"github.com/miragespace/rmc/auth"
 	resp "github.com/miragespace/rmc/response"
+	"github.com/miragespace/rmc/team"
 
 	"github.com/go-chi/chi"
 	"github.com/stripe/stripe-go/v72"
@@ -16,7 +19,9 @@ import (
 )
 
 type ServiceOptions struct {
+	Auth                *auth.Auth // step-up verification for payment method changes
 	SubscriptionManager *Manager
+	Policy              team.Policy
 	Logger              *zap.Logger
 }
 
@@ -25,9 +30,15 @@ type Service struct {
 }
 
 func NewService(option ServiceOptions) (*Service, error) {
+	if option.Auth == nil {
+		return nil, fmt.Errorf("nil Auth is invalid")
+	}
 	if option.SubscriptionManager == nil {
 		return nil, fmt.Errorf("nil SubscriptionManager is invalid")
 	}
+	if option.Policy == nil {
+		return nil, fmt.Errorf("nil Policy is invalid")
+	}
 	if option.Logger == nil {
 		return nil, fmt.Errorf("nil Logger is invalid")
 	}
@@ -76,7 +87,8 @@ func (s *Service) setupPayment(w http.ResponseWriter, r *http.Request) {
 }
 
 type SubscriptionSetupRequest struct {
-	PlanID string `json:"planId"`
+	PlanID        string `json:"planId"`
+	PromotionCode string `json:"promotionCode"`
 }
 
 func (s *Service) createStripeSubscription(w http.ResponseWriter, r *http.Request) {
@@ -107,13 +119,18 @@ func (s *Service) createStripeSubscription(w http.ResponseWriter, r *http.Reques
 	logger = logger.With(zap.String("PlanID", req.PlanID))
 
 	opt := CreateFromPlanOption{
-		CustomerID: claims.ID,
-		Plan:       *plan,
+		CustomerID:    claims.ID,
+		Plan:          *plan,
+		PromotionCode: strings.TrimSpace(req.PromotionCode),
 	}
 
 	sub, err := s.SubscriptionManager.CreateSubscriptionFromPlan(ctx, opt)
 
 	if err != nil {
+		if errors.Is(err, ErrInvalidPromotionCode) {
+			resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Invalid or expired promotion code"))
+			return
+		}
 		if stripeErr, ok := err.(*stripe.Error); ok {
 			if stripeErr.Code == stripe.ErrorCodeResourceMissing && strings.Contains(stripeErr.Msg, "no attached payment source") {
 				resp.WriteError(w, r, resp.ErrForbidden().WithMessage("No payment method on file"))
@@ -154,13 +171,29 @@ func (s *Service) createSubscription(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if sub.Status != stripe.SubscriptionStatusActive {
+	if sub.Status != stripe.SubscriptionStatusActive && sub.Status != stripe.SubscriptionStatusTrialing {
 		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Unable to setup scription - Subscription is not active"))
 		return
 	}
 
 	logger = logger.With(zap.String("SubscriptionID", sub.ID))
 
+	if sub.Status == stripe.SubscriptionStatusTrialing {
+		// customers only get one trial, claimed when the subscription was created
+		claimed, err := s.SubscriptionManager.TrialClaimedBy(ctx, claims.ID, sub.ID)
+		if err != nil {
+			logger.Error("Unable to check trial claim",
+				zap.Error(err),
+			)
+			resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to setup subscription - Database returns error"))
+			return
+		}
+		if !claimed {
+			resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Unable to setup subscription - Free trial was already used"))
+			return
+		}
+	}
+
 	// we have to lookup the actual planID from the subscription
 	var planID string
 	for _, item := range sub.Items.Data {
@@ -214,9 +247,32 @@ func (s *Service) createSubscription(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (s *Service) listSubscriptions(w http.ResponseWriter, r *http.Request) {
+// viewableOwner returns the customer whose subscriptions the request is for (see team.Owner).
+// Team members can view the subscriptions of the owner, while billing stays with the owner
+func (s *Service) viewableOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
 	ctx := r.Context()
 	claims := ctx.Value(auth.Context).(*auth.Claims)
+	owner := team.Owner(r, claims.ID)
+
+	allowed, err := s.Policy.Authorize(ctx, claims.ID, team.Resource{OwnerID: owner}, team.ActionViewSubscription)
+	if err != nil {
+		s.Logger.Error("Unable to authorize customer",
+			zap.Error(err),
+			zap.String("CustomerID", claims.ID),
+			zap.String("OwnerID", owner),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to verify permissions"))
+		return "", false
+	}
+	if !allowed {
+		resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Cannot view subscriptions of this customer"))
+		return "", false
+	}
+	return owner, true
+}
+
+func (s *Service) listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	before := r.URL.Query().Get("before")
 
 	var parsedTime time.Time
@@ -229,10 +285,15 @@ func (s *Service) listSubscriptions(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+	owner, ok := s.viewableOwner(w, r)
+	if !ok {
+		return
+	}
+
+	logger := s.Logger.With(zap.String("CustomerID", owner))
 
 	opt := ListOption{
-		CustomerID: claims.ID,
+		CustomerID: owner,
 		Before:     parsedTime,
 		Limit:      10,
 	}
@@ -251,11 +312,15 @@ func (s *Service) listSubscriptions(w http.ResponseWriter, r *http.Request) {
 
 func (s *Service) getSubscription(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	claims := ctx.Value(auth.Context).(*auth.Claims)
 	id := chi.URLParam(r, "id")
 
+	owner, ok := s.viewableOwner(w, r)
+	if !ok {
+		return
+	}
+
 	sub, err := s.SubscriptionManager.Get(ctx, GetOption{
-		CustomerID:     claims.ID,
+		CustomerID:     owner,
 		SubscriptionID: id,
 	})
 	if err != nil {
@@ -273,11 +338,15 @@ func (s *Service) getSubscription(w http.ResponseWriter, r *http.Request) {
 
 func (s *Service) getSubscriptionUsage(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	claims := ctx.Value(auth.Context).(*auth.Claims)
 	id := chi.URLParam(r, "id")
 
+	owner, ok := s.viewableOwner(w, r)
+	if !ok {
+		return
+	}
+
 	usages, err := s.SubscriptionManager.GetUsage(ctx, GetOption{
-		CustomerID:     claims.ID,
+		CustomerID:     owner,
 		SubscriptionID: id,
 	})
 	if err != nil {
@@ -293,6 +362,79 @@ func (s *Service) getSubscriptionUsage(w http.ResponseWriter, r *http.Request) {
 	resp.WriteResponse(w, r, usages)
 }
 
+func (s *Service) listInvoices(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	opt := InvoiceListOption{
+		CustomerID:     claims.ID,
+		SubscriptionID: r.URL.Query().Get("subscriptionId"),
+		StartingAfter:  r.URL.Query().Get("startingAfter"),
+		Limit:          10,
+	}
+
+	invoices, err := s.SubscriptionManager.ListInvoices(ctx, opt)
+	if err != nil {
+		logger.Error("Unable to list invoices by customer id",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get the list of invoices"))
+		return
+	}
+
+	resp.WriteResponse(w, r, invoices)
+}
+
+func (s *Service) getInvoice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	id := chi.URLParam(r, "id")
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+		zap.String("InvoiceID", id),
+	)
+
+	invoice, err := s.SubscriptionManager.GetInvoice(ctx, InvoiceGetOption{
+		CustomerID: claims.ID,
+		InvoiceID:  id,
+	})
+	if err != nil {
+		logger.Error("Unable to fetch invoice",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to fetch invoice"))
+		return
+	}
+
+	if invoice == nil {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find invoice with specific ID"))
+		return
+	}
+
+	resp.WriteResponse(w, r, invoice)
+}
+
+func (s *Service) listUpcomingInvoices(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	invoices, err := s.SubscriptionManager.UpcomingInvoices(ctx, claims.ID)
+	if err != nil {
+		logger.Error("Unable to compute upcoming invoices",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot compute upcoming invoices"))
+		return
+	}
+
+	resp.WriteResponse(w, r, invoices)
+}
+
 func (s *Service) createPlans(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	plans := make([]Plan, 0, 1)
@@ -314,23 +456,446 @@ func (s *Service) createPlans(w http.ResponseWriter, r *http.Request) {
 	resp.WriteResponse(w, r, plans)
 }
 
+// listPlans returns the Plans with prices in the currency specified by the "currency" or "country" query parameter,
+// otherwise in the currency of the customer's billing country
 func (s *Service) listPlans(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
 
-	plans, err := s.SubscriptionManager.listPlans(ctx)
+	currency := strings.ToLower(r.URL.Query().Get("currency"))
+	if country := r.URL.Query().Get("country"); len(currency) == 0 && len(country) > 0 {
+		currency = currencyForCountry(country)
+	} else if len(currency) == 0 {
+		var err error
+		currency, err = s.SubscriptionManager.PreferredCurrency(ctx, claims.ID)
+		if err != nil {
+			s.Logger.Error("Unable to get preferred currency",
+				zap.String("CustomerID", claims.ID),
+				zap.Error(err),
+			)
+			resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list plans"))
+			return
+		}
+	}
+
+	plans, err := s.SubscriptionManager.listPlans(ctx, false)
 	if err != nil {
 		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list plans"))
 		return
 	}
+	for k := range plans {
+		plans[k] = plans[k].localize(currency)
+	}
 
 	resp.WriteResponse(w, r, plans)
 }
 
+func (s *Service) listAllPlans(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	plans, err := s.SubscriptionManager.listPlans(ctx, true)
+	if err != nil {
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list plans"))
+		return
+	}
+
+	resp.WriteResponse(w, r, plans)
+}
+
+func (s *Service) getPlan(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := chi.URLParam(r, "id")
+
+	plan, err := s.SubscriptionManager.GetPlan(ctx, id)
+	if err != nil {
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to get plan"))
+		return
+	}
+	if plan == nil {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Specified Plan does not exist"))
+		return
+	}
+
+	resp.WriteResponse(w, r, plan)
+}
+
+// writePlanUpdate writes the result of UpdatePlan or RetirePlan
+func (s *Service) writePlanUpdate(w http.ResponseWriter, r *http.Request, plan *Plan, err error) {
+	if errors.Is(err, ErrPlanNotFound) {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Specified Plan does not exist"))
+		return
+	}
+	if err != nil {
+		s.Logger.Error("Unable to update plan",
+			zap.String("PlanID", chi.URLParam(r, "id")),
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().WithResult(err).AddMessages("Unable to update plan"))
+		return
+	}
+
+	resp.WriteResponse(w, r, plan)
+}
+
+func (s *Service) updatePlan(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := chi.URLParam(r, "id")
+
+	var req Plan
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+
+	plan, err := s.SubscriptionManager.UpdatePlan(ctx, id, req)
+	s.writePlanUpdate(w, r, plan, err)
+}
+
+func (s *Service) retirePlan(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := chi.URLParam(r, "id")
+
+	plan, err := s.SubscriptionManager.RetirePlan(ctx, id)
+	s.writePlanUpdate(w, r, plan, err)
+}
+
+// modifyParts applies fn to the active Parts of the Plan, and updates the Plan with the result
+func (s *Service) modifyParts(w http.ResponseWriter, r *http.Request, fn func(parts []Part) ([]Part, *resp.Error)) {
+	ctx := r.Context()
+	id := chi.URLParam(r, "id")
+
+	plan, err := s.SubscriptionManager.GetPlan(ctx, id)
+	if err != nil {
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to get plan"))
+		return
+	}
+	if plan == nil {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Specified Plan does not exist"))
+		return
+	}
+
+	parts, respErr := fn(plan.activeParts())
+	if respErr != nil {
+		resp.WriteError(w, r, respErr)
+		return
+	}
+	plan.Parts = parts
+
+	updated, err := s.SubscriptionManager.UpdatePlan(ctx, id, *plan)
+	s.writePlanUpdate(w, r, updated, err)
+}
+
+func (s *Service) createPart(w http.ResponseWriter, r *http.Request) {
+	var req Part
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	req.ID = ""
+
+	s.modifyParts(w, r, func(parts []Part) ([]Part, *resp.Error) {
+		return append(parts, req), nil
+	})
+}
+
+func (s *Service) updatePart(w http.ResponseWriter, r *http.Request) {
+	partID := chi.URLParam(r, "partId")
+
+	var req Part
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	req.ID = partID
+
+	s.modifyParts(w, r, func(parts []Part) ([]Part, *resp.Error) {
+		for k, part := range parts {
+			if part.ID == partID {
+				// changing the price creates a new version of the Part
+				parts[k] = req
+				return parts, nil
+			}
+		}
+		return nil, resp.ErrNotFound().AddMessages("Specified Part does not exist or is retired")
+	})
+}
+
+func (s *Service) retirePart(w http.ResponseWriter, r *http.Request) {
+	partID := chi.URLParam(r, "partId")
+
+	s.modifyParts(w, r, func(parts []Part) ([]Part, *resp.Error) {
+		for k, part := range parts {
+			if part.ID == partID {
+				return append(parts[:k], parts[k+1:]...), nil
+			}
+		}
+		return nil, resp.ErrNotFound().AddMessages("Specified Part does not exist or is retired")
+	})
+}
+
+type CreditBalanceResponse struct {
+	BalanceInCents int64 `json:"balanceInCents"`
+}
+
+func (s *Service) getCreditBalance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	balance, err := s.SubscriptionManager.CreditBalance(ctx, claims.ID)
+	if err != nil {
+		logger.Error("Unable to get credit balance",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get credit balance"))
+		return
+	}
+
+	resp.WriteResponse(w, r, CreditBalanceResponse{
+		BalanceInCents: balance,
+	})
+}
+
+func (s *Service) getBillingDetails(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	details, err := s.SubscriptionManager.GetBillingDetails(ctx, claims.ID)
+	if err != nil {
+		logger.Error("Unable to get billing details",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get billing details"))
+		return
+	}
+
+	resp.WriteResponse(w, r, details)
+}
+
+func (s *Service) updateBillingDetails(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	var req BillingDetails
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+
+	err := s.SubscriptionManager.UpdateBillingDetails(ctx, claims.ID, req)
+	if errors.Is(err, ErrInvalidBillingDetails) {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Invalid country or VAT number"))
+		return
+	}
+	if err != nil {
+		logger.Error("Unable to update billing details",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot update billing details"))
+		return
+	}
+
+	s.getBillingDetails(w, r)
+}
+
+func (s *Service) grantCredit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req CreditOption
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+
+	logger := s.Logger.With(zap.String("CustomerID", req.CustomerID))
+	audit.SetTarget(ctx, req.CustomerID, "")
+
+	if err := s.SubscriptionManager.GrantCredit(ctx, req); err != nil {
+		logger.Error("Unable to grant credit",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().WithResult(err).AddMessages("Unable to grant credit"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) createPromotion(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req PromotionOption
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+
+	promo, err := s.SubscriptionManager.CreatePromotion(ctx, req)
+	if err != nil {
+		s.Logger.Error("Unable to create promotion",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().WithResult(err).AddMessages("Unable to create promotion"))
+		return
+	}
+
+	resp.WriteResponse(w, r, promo)
+}
+
+type BudgetRequest struct {
+	LimitInCents float64 `json:"limitInCents"` // 0 removes the budget
+	Currency     string  `json:"currency"`     // ISO currency code of the limit of an account-wide budget. Subscription budgets are in the currency of the subscription
+	HardLimit    bool    `json:"hardLimit"`
+}
+
+// budgetOption returns the budget specified by the request. Subscription budgets are checked for ownership
+func (s *Service) budgetOption(w http.ResponseWriter, r *http.Request) (*BudgetOption, bool) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	opt := BudgetOption{
+		CustomerID:     claims.ID,
+		SubscriptionID: chi.URLParam(r, "id"),
+	}
+	if len(opt.SubscriptionID) == 0 {
+		return &opt, true
+	}
+
+	sub, err := s.SubscriptionManager.Get(ctx, GetOption{
+		CustomerID:     opt.CustomerID,
+		SubscriptionID: opt.SubscriptionID,
+	})
+	if err != nil {
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to fetch subscription"))
+		return nil, false
+	}
+	if sub == nil {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Cannot find subscription with specific ID"))
+		return nil, false
+	}
+	return &opt, true
+}
+
+func (s *Service) getBudget(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	opt, ok := s.budgetOption(w, r)
+	if !ok {
+		return
+	}
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", opt.CustomerID),
+		zap.String("SubscriptionID", opt.SubscriptionID),
+	)
+
+	status, err := s.SubscriptionManager.GetBudgetStatus(ctx, *opt)
+	if err != nil {
+		logger.Error("Unable to get budget status",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get budget"))
+		return
+	}
+
+	resp.WriteResponse(w, r, status)
+}
+
+func (s *Service) putBudget(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req BudgetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	if req.LimitInCents < 0 {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("limitInCents cannot be negative"))
+		return
+	}
+	if len(req.Currency) > 0 && len(req.Currency) != 3 {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("currency must be an ISO currency code"))
+		return
+	}
+
+	opt, ok := s.budgetOption(w, r)
+	if !ok {
+		return
+	}
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", opt.CustomerID),
+		zap.String("SubscriptionID", opt.SubscriptionID),
+	)
+
+	err := s.SubscriptionManager.PutBudget(ctx, &Budget{
+		CustomerID:     opt.CustomerID,
+		SubscriptionID: opt.SubscriptionID,
+		LimitInCents:   req.LimitInCents,
+		Currency:       req.Currency,
+		HardLimit:      req.HardLimit,
+	})
+	if errors.Is(err, ErrBudgetCurrency) {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("currency is required as it cannot be inferred from your subscriptions"))
+		return
+	}
+	if err != nil {
+		logger.Error("Unable to save budget",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot save budget"))
+		return
+	}
+
+	status, err := s.SubscriptionManager.GetBudgetStatus(ctx, *opt)
+	if err != nil {
+		logger.Error("Unable to get budget status",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Cannot get budget"))
+		return
+	}
+
+	resp.WriteResponse(w, r, status)
+}
+
 func (s *Service) AdminRouter() http.Handler {
 	r := chi.NewRouter()
 
 	r.Post("/plans", s.createPlans)
-	r.Get("/plans", s.listPlans)
+	r.Get("/plans", s.listAllPlans)
+	r.Get("/plans/{id}", s.getPlan)
+	r.Put("/plans/{id}", s.updatePlan)
+	r.Delete("/plans/{id}", s.retirePlan)
+	r.Post("/plans/{id}/parts", s.createPart)
+	r.Put("/plans/{id}/parts/{partId}", s.updatePart)
+	r.Delete("/plans/{id}/parts/{partId}", s.retirePart)
+	r.Post("/promotions", s.createPromotion)
+	r.Post("/credits", s.grantCredit)
+
+	return r
+}
+
+// BillingRouter will return the routes under billing API
+func (s *Service) BillingRouter() http.Handler {
+	r := chi.NewRouter()
+
+	read := r.With(auth.RequireScope(auth.ScopeBillingRead))
+	read.Get("/invoices", s.listInvoices)
+	read.Get("/invoices/upcoming", s.listUpcomingInvoices)
+	read.Get("/invoices/{id}", s.getInvoice)
+	read.Get("/credits", s.getCreditBalance)
+	read.Get("/budget", s.getBudget)
+	read.Get("/details", s.getBillingDetails)
+
+	session := r.With(auth.RequireSession)
+	session.Put("/budget", s.putBudget)
+	session.Put("/details", s.updateBillingDetails)
 
 	return r
 }
@@ -340,11 +905,16 @@ func (s *Service) Router() http.Handler {
 
 	r.Get("/plans", s.listPlans)
 
-	r.Get("/", s.listSubscriptions)
-	r.Get("/{id}", s.getSubscription)
-	r.Get("/{id}/usages", s.getSubscriptionUsage)
-	r.Post("/initialSetup", s.setupPayment)
-	r.Post("/", s.createStripeSubscription)
-	r.Put("/{id}", s.createSubscription)
+	read := r.With(auth.RequireScope(auth.ScopeSubscriptionsRead))
+	read.Get("/", s.listSubscriptions)
+	read.Get("/{id}", s.getSubscription)
+	read.Get("/{id}/usages", s.getSubscriptionUsage)
+	read.Get("/{id}/budget", s.getBudget)
+
+	session := r.With(auth.RequireSession)
+	session.Put("/{id}/budget", s.putBudget)
+	session.With(s.Auth.RequireStepUp).Post("/initialSetup", s.setupPayment)
+	session.Post("/", s.createStripeSubscription)
+	session.Put("/{id}", s.createSubscription)
 	return r
 }
@@ -12,6 +12,10 @@ type Subscription struct {
 	PeriodStart       time.Time          `json:"periodStart" gorm:"not null"`      // Used for accounting purposes, this signals when the RunningUsage stars
 	PeriodEnd         time.Time          `json:"periodEnd" gorm:"not null"`        // Used for accounting purposes, this signals when the RunningUsage end
 	CreatedAt         time.Time          `json:"createdAt" gorm:"autoCreateTime"`  // when the subscription was created
+	TrialEnd          *time.Time         `json:"trialEnd"`                         // When the free trial ends. Nil if the subscription was created without a trial
+	TrialMinutes      int64              `json:"trialMinutes"`                     // Compute minutes included in the free trial. 0 if the trial is only limited by TrialEnd
+	Currency          string             `json:"currency"`                         // The ISO currency code of the Parts the subscription is billed by
+	TaxPercent        float64            `json:"taxPercent"`                       // VAT charged on top of the invoices. 0 if the customer is not taxed (e.g. reverse charge)
 	Plan              Plan               `json:"plan"`                             // used for gorm to Preload
 	SubscriptionItems []SubscriptionItem `json:"subscriptionItems"`                // A list of items that belong to this subscription
 	PlanID            string             `json:"-" gorm:"not null"`                // Corresponds to Stripe's Product ID and Plan.ID (foreign key: belongs to)
@@ -32,4 +36,85 @@ type Usage struct {
 	StartDate          time.Time        `json:"startDate" gorm:"not null"`
 	EndDate            time.Time        `json:"endDate" gorm:"primaryKey"`
 	AggregateTotal     int64            `json:"aggregateTotal"`
+	ReportedTotal      int64            `json:"-" gorm:"not null;default:0"` // AggregateTotal as of the last usage record acknowledged by Stripe
+	ReportedAt         *time.Time       `json:"-"`                           // When Stripe last acknowledged a usage record. Nil if never reported, or if reconciliation requested a re-report
+	ReportResets       int64            `json:"-" gorm:"not null;default:0"` // Number of re-reports requested by reconciliation, part of the idempotency key so corrections reach Stripe
+}
+
+// Invoice is a customer facing view of a Stripe Invoice, with line items broken down by Part
+type Invoice struct {
+	ID                string        `json:"id"`                // Corresponds to Stripe's Invoice ID. Empty if Upcoming
+	Number            string        `json:"number"`            // Invoice number shown on the invoice PDF
+	SubscriptionID    string        `json:"subscriptionId"`    // Corresponds to Subscription.ID
+	Status            string        `json:"status"`            // Stripe's invoice status (e.g. paid, open), or "upcoming"
+	Upcoming          bool          `json:"upcoming"`          // True if this is a preview computed from local Usage records
+	Currency          string        `json:"currency"`          // The ISO currency code (e.g. usd)
+	PeriodStart       time.Time     `json:"periodStart"`       // Start of the billing period covered by this invoice
+	PeriodEnd         time.Time     `json:"periodEnd"`         // End of the billing period covered by this invoice
+	CreatedAt         time.Time     `json:"createdAt"`         // When the invoice was created
+	DiscountInCents   float64       `json:"discountInCents"`   // Amount taken off by a promotion code
+	TaxInCents        float64       `json:"taxInCents"`        // VAT charged on the amount after discounts
+	TotalInCents      float64       `json:"totalInCents"`      // Total amount of the invoice, after discounts and tax
+	CreditInCents     float64       `json:"creditInCents"`     // Amount drawn from the customer's credit balance
+	AmountDueInCents  float64       `json:"amountDueInCents"`  // Amount due after credits and discounts
+	AmountPaidInCents float64       `json:"amountPaidInCents"` // Amount that has been paid
+	HostedInvoiceURL  string        `json:"hostedInvoiceUrl"`  // Link to the Stripe hosted invoice page
+	InvoicePDF        string        `json:"invoicePdf"`        // Link to download the invoice PDF
+	Lines             []InvoiceLine `json:"lines"`             // See InvoiceLine struct below
+}
+
+// InvoiceLine describes the amount billed for a single Part within an Invoice
+type InvoiceLine struct {
+	Description   string    `json:"description"`
+	Part          *Part     `json:"part"`          // The Part billed by this line. nil if the line does not correspond to a Part (e.g. proration)
+	Quantity      int64     `json:"quantity"`      // Quantity in Part.Unit
+	AmountInCents float64   `json:"amountInCents"` // Quantity * Part.AmountInCents
+	PeriodStart   time.Time `json:"periodStart"`
+	PeriodEnd     time.Time `json:"periodEnd"`
+}
+
+// TrialClaim records that a customer has used their free trial. The primary key allows a single trial per customer,
+// even when subscriptions are created concurrently
+type TrialClaim struct {
+	CustomerID     string    `gorm:"primaryKey"`
+	SubscriptionID string    // Corresponds to Subscription.ID. Empty until the subscription is created on Stripe
+	CreatedAt      time.Time `gorm:"autoCreateTime"`
+}
+
+// Budget is a monthly spending limit set by a customer, either on a single Subscription or on the whole account
+type Budget struct {
+	CustomerID        string    `json:"-" gorm:"primaryKey"`
+	SubscriptionID    string    `json:"subscriptionId" gorm:"primaryKey"`    // Corresponds to Subscription.ID. Empty if the budget covers all subscriptions of the customer
+	LimitInCents      float64   `json:"limitInCents" gorm:"not null"`        // Spending limit for a billing period
+	Currency          string    `json:"currency" gorm:"not null;default:''"` // The ISO currency code of LimitInCents. An account-wide budget only covers the subscriptions billed in it
+	HardLimit         bool      `json:"hardLimit" gorm:"not null"`           // If true, instances are stopped once the spend reaches LimitInCents
+	NotifiedThreshold int64     `json:"-" gorm:"not null;default:0"`         // Highest alert threshold (in percent) the customer has been emailed about. Lowered again when the spend drops on renewal
+	UpdatedAt         time.Time `json:"updatedAt"`
+}
+
+// BudgetStatus describes the spend of the current billing period against a Budget
+type BudgetStatus struct {
+	Budget                *Budget `json:"budget"`                // nil if no budget is set
+	Currency              string  `json:"currency"`              // The ISO currency code of the spend. Empty if there's nothing billed yet
+	SpendInCents          float64 `json:"spendInCents"`          // Amount spent so far in the current period, computed the same way as the upcoming invoice
+	ProjectedSpendInCents float64 `json:"projectedSpendInCents"` // Spend at the end of the current period if usage continues at the current rate
+}
+
+// TaxRate is a local copy of a Stripe Tax Rate. One is created for the VAT of each country as needed
+type TaxRate struct {
+	ID         string  `json:"id" gorm:"primaryKey"`                              // Corresponds to Stripe's Tax Rate ID
+	Country    string  `json:"country" gorm:"uniqueIndex:idx_country_percentage"` // ISO 3166-1 alpha-2 country code
+	Percentage float64 `json:"percentage" gorm:"uniqueIndex:idx_country_percentage"`
+}
+
+// BillingDetails is the billing address and VAT number of a customer, which determine the currency and tax of new subscriptions
+type BillingDetails struct {
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	PostalCode string `json:"postalCode"`
+	State      string `json:"state"`
+	Country    string `json:"country"` // ISO 3166-1 alpha-2 country code
+	VATID      string `json:"vatId"`   // VAT number of an EU business. Its invoices are reverse charged
 }
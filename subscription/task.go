@@ -3,24 +3,41 @@ package subscription
 import (
 	"context"
 	"fmt"
-	"math"
+	"strconv"
+	"time"
 
+	"github.com/miragespace/rmc/external"
 	"github.com/miragespace/rmc/spec"
 	"github.com/miragespace/rmc/spec/broker"
 	"github.com/miragespace/rmc/spec/protocol"
+	"github.com/miragespace/rmc/tracing"
 
 	"github.com/golang/protobuf/ptypes"
 	extErrors "github.com/pkg/errors"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/client"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+const (
+	defaultReportInterval    = time.Minute
+	defaultReconcileInterval = time.Hour
+	defaultPaymentInterval   = time.Minute * 15
+	// open invoices older than this are no longer checked for failed payments
+	paymentLookback = time.Hour * 24 * 30
+	// Stripe accepts usage records for a short while after the period ended, until the invoice is finalized.
+	// Pending usages older than this are left to reconciliation instead of being retried forever
+	reportGracePeriod = time.Hour * 24
+)
+
 type TaskOptions struct {
-	StripeClient        *client.API
+	BillingProvider     external.BillingProvider
 	Consumer            broker.Consumer
 	SubscriptionManager *Manager
 	Logger              *zap.Logger
+	ReportInterval      time.Duration // How often pending usages are reported to Stripe. Defaults to 1 minute
+	ReconcileInterval   time.Duration // How often local usages are compared against Stripe's summaries. Defaults to 1 hour
+	PaymentInterval     time.Duration // How often open invoices are checked for failed payments. Defaults to 15 minutes
 }
 
 type Task struct {
@@ -28,8 +45,8 @@ type Task struct {
 }
 
 func NewTask(option TaskOptions) (*Task, error) {
-	if option.StripeClient == nil {
-		return nil, fmt.Errorf("nil StripeClient is invalid")
+	if option.BillingProvider == nil {
+		return nil, fmt.Errorf("nil BillingProvider is invalid")
 	}
 	if option.Consumer == nil {
 		return nil, fmt.Errorf("nil Consumer is invalid")
@@ -40,6 +57,15 @@ func NewTask(option TaskOptions) (*Task, error) {
 	if option.Logger == nil {
 		return nil, fmt.Errorf("nil Logger is invalid")
 	}
+	if option.ReportInterval <= 0 {
+		option.ReportInterval = defaultReportInterval
+	}
+	if option.ReconcileInterval <= 0 {
+		option.ReconcileInterval = defaultReconcileInterval
+	}
+	if option.PaymentInterval <= 0 {
+		option.PaymentInterval = defaultPaymentInterval
+	}
 	return &Task{
 		TaskOptions: option,
 	}, nil
@@ -56,44 +82,88 @@ func (t *Task) HandleTask(ctx context.Context) error {
 	return nil
 }
 
-func (t *Task) handle(ctx context.Context, tChan <-chan *protocol.Task) {
+// HandleSchedule starts the periodic jobs: batched usage reporting, reconciliation against Stripe
+// and, if notifications are enabled, failed payment notifications
+func (t *Task) HandleSchedule(ctx context.Context) {
+	t.Logger.Info("Usage report interval: " + t.ReportInterval.String())
+	t.Logger.Info("Usage reconcile interval: " + t.ReconcileInterval.String())
+
+	go t.schedule(ctx, t.ReportInterval, t.reportPendingUsages)
+	go t.schedule(ctx, t.ReconcileInterval, t.reconcileUsages)
+
+	if t.SubscriptionManager.NotificationManager != nil {
+		t.Logger.Info("Failed payment check interval: " + t.PaymentInterval.String())
+		go t.schedule(ctx, t.PaymentInterval, t.notifyFailedPayments)
+	}
+}
+
+func (t *Task) notifyFailedPayments(ctx context.Context) {
+	if err := t.SubscriptionManager.NotifyFailedPayments(ctx, time.Now().Add(-paymentLookback)); err != nil {
+		t.Logger.Error("Unable to check for failed payments",
+			zap.Error(err),
+		)
+	}
+}
+
+func (t *Task) schedule(ctx context.Context, interval time.Duration, job func(context.Context)) {
+	ticker := time.NewTicker(interval)
 	for {
 		select {
 		case <-ctx.Done():
+			ticker.Stop()
 			return
-		case task := <-tChan:
-			if task.GetType() != protocol.Task_Subscription {
-				t.Logger.Error("Received non Subscription task")
-				continue
-			}
-			timestamp := task.GetTimestamp()
-			if timestamp == nil {
-				t.Logger.Error("Received nil Timestamp")
-				continue
-			}
-			subTask := task.GetSubscriptionTask()
-			if subTask == nil {
-				t.Logger.Error("Task has nil SubscriptionTask")
-				continue
-			}
+		case <-ticker.C:
+			job(ctx)
+		}
+	}
+}
 
-			switch subTask.GetFunction() {
-			case protocol.SubscriptionTask_ReportUsage:
-				if err := t.reportUsage(ctx, task); err != nil {
-					t.Logger.Error("Unable to report usage",
-						zap.Error(err),
-					)
-				}
-			case protocol.SubscriptionTask_Synchronize:
-				if err := t.synchronizePeriod(ctx, task); err != nil {
-					t.Logger.Error("Unable to synchronize period with Stripe",
-						zap.Error(err),
-					)
-				}
-			default:
-				t.Logger.Error("SubscriptionTask received unknown Function")
-			}
+func (t *Task) handle(ctx context.Context, tChan <-chan broker.Task) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-tChan:
+			taskCtx, span := tracing.StartChild(d.Context, "SubscriptionTask "+d.GetSubscriptionTask().GetFunction().String(), trace.SpanKindConsumer)
+			t.process(taskCtx, d.Task)
+			span.End()
+		}
+	}
+}
+
+func (t *Task) process(ctx context.Context, task *protocol.Task) {
+	logger := tracing.Logger(ctx, t.Logger)
+
+	if task.GetType() != protocol.Task_Subscription {
+		logger.Error("Received non Subscription task")
+		return
+	}
+	timestamp := task.GetTimestamp()
+	if timestamp == nil {
+		logger.Error("Received nil Timestamp")
+		return
+	}
+	subTask := task.GetSubscriptionTask()
+	if subTask == nil {
+		logger.Error("Task has nil SubscriptionTask")
+		return
+	}
+
+	switch subTask.GetFunction() {
+	case protocol.SubscriptionTask_ReportUsage:
+		if err := t.reportUsage(ctx, task); err != nil {
+			logger.Error("Unable to report usage",
+				zap.Error(err),
+			)
+		}
+	case protocol.SubscriptionTask_Synchronize:
+		if err := t.synchronizePeriod(ctx, task); err != nil {
+			logger.Error("Unable to synchronize period with Stripe",
+				zap.Error(err),
+			)
 		}
+	default:
+		logger.Error("SubscriptionTask received unknown Function")
 	}
 }
 
@@ -105,6 +175,7 @@ func (t *Task) synchronizePeriod(ctx context.Context, pb *protocol.Task) error {
 	return t.SubscriptionManager.synchronizeSubscriptionPeriod(ctx, subscriptionID)
 }
 
+// reportUsage handles ReportUsage tasks still in the queue from before usage was reported in batches
 func (t *Task) reportUsage(ctx context.Context, pb *protocol.Task) error {
 	subscriptionItemID := pb.GetSubscriptionTask().GetSubscriptionItemID()
 	if len(subscriptionItemID) == 0 {
@@ -123,35 +194,150 @@ func (t *Task) reportUsage(ctx context.Context, pb *protocol.Task) error {
 		return extErrors.Wrap(err, "Cannot get usage by subscription item id")
 	}
 
+	return t.reportUsageRecord(ctx, u, time.Now())
+}
+
+// reportPendingUsages reports every usage that has changed since Stripe last acknowledged it.
+// Failed reports stay pending and are retried on the next run
+func (t *Task) reportPendingUsages(ctx context.Context) {
+	now := time.Now()
+	usages, err := t.SubscriptionManager.listPendingUsages(ctx, now.Add(-reportGracePeriod))
+	if err != nil {
+		t.Logger.Error("Unable to list pending usages",
+			zap.Error(err),
+		)
+		return
+	}
+
+	var failed int
+	for k := range usages {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := t.reportUsageRecord(ctx, &usages[k], now); err != nil {
+			failed++
+			t.Logger.Warn("Unable to report usage, will retry",
+				zap.String("SubscriptionItemID", usages[k].SubscriptionItemID),
+				zap.Error(err),
+			)
+		}
+	}
+	if failed > 0 {
+		t.Logger.Error("Some usages failed to report to Stripe",
+			zap.Int("Failed", failed),
+			zap.Int("Pending", len(usages)),
+		)
+	}
+}
+
+// reportUsageRecord sends the absolute quantity of a Usage to Stripe and records the acknowledged total
+func (t *Task) reportUsageRecord(ctx context.Context, u *Usage, now time.Time) error {
 	quantity, err := unitConversion(u)
 	if err != nil {
 		return extErrors.Wrap(err, "Error converting unit for usage")
 	}
 
-	_, err = t.StripeClient.UsageRecords.New(&stripe.UsageRecordParams{
+	if u.ReportedAt != nil {
+		// skip the API call if the quantity Stripe has is still accurate
+		reported := *u
+		reported.AggregateTotal = u.ReportedTotal
+		if reportedQuantity, err := unitConversion(&reported); err == nil && reportedQuantity == quantity {
+			return t.SubscriptionManager.markUsageReported(ctx, u, u.AggregateTotal, *u.ReportedAt)
+		}
+	}
+
+	// usage record has to be timestamped within the period it belongs to
+	timestamp := now
+	if !timestamp.Before(u.EndDate) {
+		timestamp = u.EndDate.Add(-time.Second)
+	}
+
+	params := &stripe.UsageRecordParams{
 		Params: stripe.Params{
 			Context: ctx,
+			// multiple task replicas may report the same usage, but a re-report requested by
+			// reconciliation must not be answered with the cached response of the previous one
+			IdempotencyKey: stripe.String(u.SubscriptionItemID + "-" +
+				strconv.FormatInt(u.EndDate.Unix(), 10) + "-" +
+				strconv.FormatInt(u.AggregateTotal, 10) + "-" +
+				strconv.FormatInt(u.ReportResets, 10)),
 		},
 		SubscriptionItem: stripe.String(u.SubscriptionItemID),
 		Quantity:         stripe.Int64(quantity),
-		Timestamp:        stripe.Int64(referenceTime.Unix()),
+		Timestamp:        stripe.Int64(timestamp.Unix()),
 		Action:           stripe.String(string(stripe.UsageRecordActionSet)),
-	})
-	if err != nil {
+	}
+	if _, err := t.BillingProvider.NewUsageRecord(params); err != nil {
 		return extErrors.Wrap(err, "Cannot report usage to Stripe")
 	}
 
+	if err := t.SubscriptionManager.markUsageReported(ctx, u, u.AggregateTotal, now); err != nil {
+		return extErrors.Wrap(err, "Cannot mark usage as reported")
+	}
 	return nil
 }
 
-func unitConversion(u *Usage) (int64, error) {
-	// convert from singular unit to Part unit
-	var quantity int64
-	switch u.SubscriptionItem.Part.Unit {
-	case "minute":
-		quantity = int64(math.Ceil(float64(u.AggregateTotal) / 60))
-	default:
-		return 0, fmt.Errorf("Unsupported Unit: %s", u.SubscriptionItem.Part.Unit)
+// reconcileUsages compares the acknowledged usages of the current period against Stripe's usage summaries.
+// Mismatches are reported as errors and the usage is re-reported on the next run
+func (t *Task) reconcileUsages(ctx context.Context) {
+	usages, err := t.SubscriptionManager.listReportedUsages(ctx, time.Now())
+	if err != nil {
+		t.Logger.Error("Unable to list reported usages",
+			zap.Error(err),
+		)
+		return
+	}
+
+	for k := range usages {
+		if ctx.Err() != nil {
+			return
+		}
+		u := &usages[k]
+		logger := t.Logger.With(
+			zap.String("SubscriptionItemID", u.SubscriptionItemID),
+		)
+
+		quantity, err := unitConversion(u)
+		if err != nil {
+			logger.Error("Error converting unit for usage",
+				zap.Error(err),
+			)
+			continue
+		}
+
+		summaries, err := t.BillingProvider.ListUsageRecordSummaries(&stripe.UsageRecordSummaryListParams{
+			ListParams: stripe.ListParams{
+				Context: ctx,
+			},
+			SubscriptionItem: stripe.String(u.SubscriptionItemID),
+		})
+		if err != nil {
+			logger.Warn("Unable to list usage record summaries from Stripe",
+				zap.Error(err),
+			)
+			continue
+		}
+
+		var stripeQuantity int64
+		for _, summary := range summaries {
+			// the summary of the current period has not been invoiced yet
+			if summary.Invoice == "" {
+				stripeQuantity = summary.TotalUsage
+				break
+			}
+		}
+		if stripeQuantity == quantity {
+			continue
+		}
+
+		logger.Error("Usage mismatch between local record and Stripe",
+			zap.Int64("LocalQuantity", quantity),
+			zap.Int64("StripeQuantity", stripeQuantity),
+		)
+		if err := t.SubscriptionManager.markUsageUnreported(ctx, u); err != nil {
+			logger.Error("Unable to mark usage for re-report",
+				zap.Error(err),
+			)
+		}
 	}
-	return quantity, nil
 }
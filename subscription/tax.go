@@ -0,0 +1,46 @@
+package subscription
+
+import (
+	"regexp"
+	"strings"
+)
+
+// vatRates are the standard VAT rates (in percent) of the EU member states, keyed by ISO 3166-1 alpha-2 country code.
+// Customers in these countries are charged VAT, unless they are a business with a VAT number (reverse charge)
+var vatRates = map[string]float64{
+	"AT": 20, "BE": 21, "BG": 20, "CY": 19, "CZ": 21, "DE": 19, "DK": 25, "EE": 20, "ES": 21,
+	"FI": 24, "FR": 20, "GR": 24, "HR": 25, "HU": 27, "IE": 23, "IT": 22, "LT": 21, "LU": 17,
+	"LV": 21, "MT": 18, "NL": 21, "PL": 23, "PT": 23, "RO": 19, "SE": 25, "SI": 22, "SK": 20,
+}
+
+// countryCurrencies are the currencies customers are billed in, keyed by their billing country.
+// Customers in other countries, or subscribing to a Plan without prices in their currency, are billed in Plan.Currency
+var countryCurrencies = map[string]string{
+	"AT": "eur", "BE": "eur", "CY": "eur", "DE": "eur", "EE": "eur", "ES": "eur", "FI": "eur",
+	"FR": "eur", "GR": "eur", "IE": "eur", "IT": "eur", "LT": "eur", "LU": "eur", "LV": "eur",
+	"MT": "eur", "NL": "eur", "PT": "eur", "SI": "eur", "SK": "eur",
+	"GB": "gbp",
+	"CA": "cad",
+	"AU": "aud",
+}
+
+var vatIDRegex = regexp.MustCompile("^[A-Z]{2}[0-9A-Z]{2,12}$")
+
+// currencyForCountry returns the currency customers in the country are billed in, or an empty string if
+// they are billed in the Plan's default currency
+func currencyForCountry(country string) string {
+	return countryCurrencies[strings.ToUpper(country)]
+}
+
+// validVATID returns true if the VAT number is well formed and was issued by the country. Stripe verifies it afterwards
+func validVATID(vatID, country string) bool {
+	if !vatIDRegex.MatchString(vatID) {
+		return false
+	}
+	if _, ok := vatRates[country]; !ok {
+		return false
+	}
+	prefix := vatID[:2]
+	// Greek VAT numbers use the EL prefix
+	return prefix == country || (prefix == "EL" && country == "GR")
+}
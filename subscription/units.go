@@ -0,0 +1,60 @@
+package subscription
+
+import (
+	"fmt"
+	"math"
+)
+
+// Metric is a dimension of usage measured by the hosts. Usage.AggregateTotal is accumulated in the base unit of its Metric
+type Metric string
+
+// Defining metered dimensions
+const (
+	MetricRuntime       Metric = "runtime"       // seconds an instance has been running
+	MetricStorage       Metric = "storage"       // byte-seconds of storage used by an instance
+	MetricNetworkEgress Metric = "networkEgress" // bytes sent by an instance
+	MetricPlayers       Metric = "players"       // player-seconds of players online on an instance
+)
+
+const (
+	bytesPerGB      = 1000 * 1000 * 1000
+	secondsPerHour  = 60 * 60
+	secondsPerMonth = secondsPerHour * 730 // the average month, same as Stripe and most cloud providers
+)
+
+// Unit describes how a Part's unit is converted from the base unit of its Metric
+type Unit struct {
+	Metric  Metric  // which metric this unit is measuring
+	PerUnit float64 // how many base units of the Metric make up one of this unit
+}
+
+// units is the registry of units that a Variable Part can be billed in
+var units = map[string]Unit{
+	"second":         {Metric: MetricRuntime, PerUnit: 1},
+	"minute":         {Metric: MetricRuntime, PerUnit: 60},
+	"hour":           {Metric: MetricRuntime, PerUnit: secondsPerHour},
+	"GB-hour":        {Metric: MetricStorage, PerUnit: bytesPerGB * secondsPerHour},
+	"GB-month":       {Metric: MetricStorage, PerUnit: bytesPerGB * secondsPerMonth},
+	"GB-transferred": {Metric: MetricNetworkEgress, PerUnit: bytesPerGB},
+	"player-hour":    {Metric: MetricPlayers, PerUnit: secondsPerHour},
+}
+
+// LookupUnit returns the registered Unit by its name
+func LookupUnit(name string) (Unit, bool) {
+	u, ok := units[name]
+	return u, ok
+}
+
+// Convert will convert an amount in the base unit of the Metric to this unit, rounded *up*
+func (u Unit) Convert(amount int64) int64 {
+	return int64(math.Ceil(float64(amount) / u.PerUnit))
+}
+
+func unitConversion(u *Usage) (int64, error) {
+	// convert from singular unit to Part unit
+	unit, ok := LookupUnit(u.SubscriptionItem.Part.Unit)
+	if !ok {
+		return 0, fmt.Errorf("Unsupported Unit: %s", u.SubscriptionItem.Part.Unit)
+	}
+	return unit.Convert(u.AggregateTotal), nil
+}
@@ -0,0 +1,545 @@
+package team
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miragespace/rmc/customer"
+	"github.com/miragespace/rmc/external"
+
+	"github.com/google/uuid"
+	extErrors "github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrTeamExists is returned when a customer who already owns a team creates another one
+var ErrTeamExists = errors.New("Customer already owns a team")
+
+// ErrAlreadyMember is returned when inviting or adding a customer who is already in the team
+var ErrAlreadyMember = errors.New("Customer is already a member of the team")
+
+// ErrNotFound is returned when the member, invitation or grant does not exist
+var ErrNotFound = errors.New("Not found")
+
+// ErrCustomerNotFound is returned when granting access to an email without an account
+var ErrCustomerNotFound = errors.New("No customer with the email address")
+
+const invitationTTL = time.Hour * 24 * 7
+
+// ManagerOptions is used to setup team Manager's dependencies
+type ManagerOptions struct {
+	CustomerManager *customer.Manager
+	DB              *gorm.DB
+	Logger          *zap.Logger
+	Mailer          external.Mailer // Optional. Invitations are only emailed if a Mailer is provided
+	SiteName        string
+	InvitationURL   string // where customers can see and accept their pending invitations
+}
+
+// Manager handles the database operations relating to Teams, and implements Policy and GrantManager
+type Manager struct {
+	ManagerOptions
+}
+
+// NewManager returns a new team Manager
+func NewManager(option ManagerOptions) (*Manager, error) {
+	if option.CustomerManager == nil {
+		return nil, fmt.Errorf("nil CustomerManager is invalid")
+	}
+	if option.DB == nil {
+		return nil, fmt.Errorf("nil DB is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	if err := option.DB.AutoMigrate(&Team{}, &Membership{}, &Invitation{}, &InstanceGrant{}); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot initilize team.Manager")
+	}
+	return &Manager{
+		ManagerOptions: option,
+	}, nil
+}
+
+// Create will create a new team owned by the customer
+func (m *Manager) Create(ctx context.Context, ownerID, ownerEmail, name string) (*Team, error) {
+	now := time.Now()
+	t := &Team{
+		ID:        uuid.New().String(),
+		Name:      name,
+		OwnerID:   ownerID,
+		CreatedAt: now,
+		Members: []Membership{
+			{
+				CustomerID: ownerID,
+				Email:      ownerEmail,
+				Role:       RoleOwner,
+				CreatedAt:  now,
+			},
+		},
+	}
+
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Team{}).Where("owner_id = ?", ownerID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrTeamExists
+		}
+		return tx.Create(t).Error
+	})
+	if err == ErrTeamExists {
+		return nil, err
+	}
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot create team")
+	}
+
+	return t, nil
+}
+
+// Get returns the team with its members, or nil if the team does not exist
+func (m *Manager) Get(ctx context.Context, teamID string) (*Team, error) {
+	var t Team
+	result := m.DB.WithContext(ctx).
+		Preload("Members", func(db *gorm.DB) *gorm.DB {
+			return db.Order("created_at asc")
+		}).
+		Where("id = ?", teamID).
+		First(&t)
+
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot get team")
+	}
+
+	return &t, nil
+}
+
+// MemberTeam is a team as seen by one of its members
+type MemberTeam struct {
+	Team
+	Role Role `json:"role"`
+}
+
+// List returns the teams the customer is a member of, including the team the customer owns
+func (m *Manager) List(ctx context.Context, customerID string) ([]MemberTeam, error) {
+	memberships := make([]Membership, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Where("customer_id = ?", customerID).
+		Find(&memberships)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot list memberships")
+	}
+
+	roles := make(map[string]Role)
+	teamIDs := make([]string, 0, len(memberships))
+	for _, membership := range memberships {
+		roles[membership.TeamID] = membership.Role
+		teamIDs = append(teamIDs, membership.TeamID)
+	}
+
+	teams := make([]Team, 0, len(teamIDs))
+	if len(teamIDs) > 0 {
+		result = m.DB.WithContext(ctx).
+			Where("id IN ?", teamIDs).
+			Order("created_at asc").
+			Find(&teams)
+		if result.Error != nil {
+			return nil, extErrors.Wrap(result.Error, "Cannot list teams")
+		}
+	}
+
+	results := make([]MemberTeam, len(teams))
+	for i, t := range teams {
+		results[i] = MemberTeam{
+			Team: t,
+			Role: roles[t.ID],
+		}
+	}
+	return results, nil
+}
+
+// Rename will update the name of the team
+func (m *Manager) Rename(ctx context.Context, teamID, name string) error {
+	result := m.DB.WithContext(ctx).
+		Model(&Team{}).
+		Where("id = ?", teamID).
+		Update("name", name)
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot rename team")
+	}
+	return nil
+}
+
+// Delete will remove the team, its members and pending invitations. Instance grants are not affected
+func (m *Manager) Delete(ctx context.Context, teamID string) error {
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("team_id = ?", teamID).Delete(&Invitation{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("team_id = ?", teamID).Delete(&Membership{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", teamID).Delete(&Team{}).Error
+	})
+	if err != nil {
+		return extErrors.Wrap(err, "Cannot delete team")
+	}
+	return nil
+}
+
+// Role returns the role of the customer in the team, or an empty Role if the customer is not a member
+func (m *Manager) Role(ctx context.Context, teamID, customerID string) (Role, error) {
+	var membership Membership
+	result := m.DB.WithContext(ctx).
+		Where("team_id = ? AND customer_id = ?", teamID, customerID).
+		First(&membership)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if result.Error != nil {
+		return "", extErrors.Wrap(result.Error, "Cannot get membership")
+	}
+	return membership.Role, nil
+}
+
+// UpdateMember will change the role of a member
+func (m *Manager) UpdateMember(ctx context.Context, teamID, customerID string, role Role) error {
+	result := m.DB.WithContext(ctx).
+		Model(&Membership{}).
+		Where("team_id = ? AND customer_id = ?", teamID, customerID).
+		Update("role", role)
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot update member")
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RemoveMember will remove the customer from the team
+func (m *Manager) RemoveMember(ctx context.Context, teamID, customerID string) error {
+	result := m.DB.WithContext(ctx).
+		Where("team_id = ? AND customer_id = ?", teamID, customerID).
+		Delete(&Membership{})
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot remove member")
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// InviteOption specifies the parameters to invite an email address to a team
+type InviteOption struct {
+	Team         *Team
+	InviterEmail string
+	InviterID    string
+	Email        string
+	Role         Role
+}
+
+// Invite will invite the email address to join the team. Inviting the same email again replaces the invitation
+func (m *Manager) Invite(ctx context.Context, opt InviteOption) (*Invitation, error) {
+	email := strings.ToLower(opt.Email)
+	for _, member := range opt.Team.Members {
+		if strings.ToLower(member.Email) == email {
+			return nil, ErrAlreadyMember
+		}
+	}
+
+	now := time.Now()
+	invitation := &Invitation{
+		ID:        uuid.New().String(),
+		TeamID:    opt.Team.ID,
+		Email:     email,
+		Role:      opt.Role,
+		InvitedBy: opt.InviterID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(invitationTTL),
+	}
+
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("team_id = ? AND email = ?", opt.Team.ID, email).Delete(&Invitation{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(invitation).Error
+	})
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot save invitation")
+	}
+
+	if m.Mailer != nil {
+		text := fmt.Sprintf("%s invited you to join the team \"%s\" on %s as %s.\n\n"+
+			"Log in with this email address at %s to accept the invitation. It expires on %s.\n",
+			opt.InviterEmail, opt.Team.Name, m.SiteName, opt.Role,
+			m.InvitationURL, invitation.ExpiresAt.Format("January 2, 2006"),
+		)
+		if err := m.Mailer.Send(ctx, external.Email{
+			To:      email,
+			Subject: fmt.Sprintf("You are invited to join %s on %s", opt.Team.Name, m.SiteName),
+			Text:    text,
+		}); err != nil {
+			// the invitation can still be seen after logging in
+			m.Logger.Error("Cannot send invitation email",
+				zap.Error(err),
+				zap.String("TeamID", opt.Team.ID),
+				zap.String("InvitationID", invitation.ID),
+			)
+		}
+	}
+
+	return invitation, nil
+}
+
+// ListInvitations returns the pending invitations of the team
+func (m *Manager) ListInvitations(ctx context.Context, teamID string) ([]Invitation, error) {
+	invitations := make([]Invitation, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Where("team_id = ? AND expires_at > ?", teamID, time.Now()).
+		Order("created_at desc").
+		Find(&invitations)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot list invitations")
+	}
+	return invitations, nil
+}
+
+// RevokeInvitation will remove a pending invitation of the team
+func (m *Manager) RevokeInvitation(ctx context.Context, teamID, invitationID string) error {
+	result := m.DB.WithContext(ctx).
+		Where("id = ? AND team_id = ?", invitationID, teamID).
+		Delete(&Invitation{})
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot revoke invitation")
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// PendingInvitations returns the invitations sent to the email address
+func (m *Manager) PendingInvitations(ctx context.Context, email string) ([]Invitation, error) {
+	invitations := make([]Invitation, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Preload("Team").
+		Where("email = ? AND expires_at > ?", strings.ToLower(email), time.Now()).
+		Order("created_at desc").
+		Find(&invitations)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot list invitations")
+	}
+	return invitations, nil
+}
+
+// AcceptInvitation will add the customer to the team, if the invitation was sent to the customer's email
+func (m *Manager) AcceptInvitation(ctx context.Context, invitationID, customerID, email string) (*Membership, error) {
+	var membership *Membership
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var invitation Invitation
+		result := tx.
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND email = ? AND expires_at > ?", invitationID, strings.ToLower(email), time.Now()).
+			First(&invitation)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if err := tx.Delete(&invitation).Error; err != nil {
+			return err
+		}
+
+		membership = &Membership{
+			TeamID:     invitation.TeamID,
+			CustomerID: customerID,
+			Email:      email,
+			Role:       invitation.Role,
+			CreatedAt:  time.Now(),
+		}
+		result = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(membership)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrAlreadyMember
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+		return membership, nil
+	case ErrNotFound, ErrAlreadyMember:
+		return nil, err
+	default:
+		return nil, extErrors.Wrap(err, "Cannot accept invitation")
+	}
+}
+
+// DeclineInvitation will remove an invitation sent to the email address
+func (m *Manager) DeclineInvitation(ctx context.Context, invitationID, email string) error {
+	result := m.DB.WithContext(ctx).
+		Where("id = ? AND email = ?", invitationID, strings.ToLower(email)).
+		Delete(&Invitation{})
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot decline invitation")
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListGrants returns the customers who are granted access to the instance individually
+func (m *Manager) ListGrants(ctx context.Context, instanceID string) ([]InstanceGrant, error) {
+	grants := make([]InstanceGrant, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Where("instance_id = ?", instanceID).
+		Order("created_at asc").
+		Find(&grants)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot list grants")
+	}
+	return grants, nil
+}
+
+// GrantOption specifies the parameters to grant a customer a role on an instance
+type GrantOption struct {
+	Resource  Resource
+	Email     string
+	Role      Role
+	GrantedBy string
+}
+
+// PutGrant will grant (or update) the role of the customer with the email address on the instance
+func (m *Manager) PutGrant(ctx context.Context, opt GrantOption) (*InstanceGrant, error) {
+	cust, err := m.CustomerManager.GetByEmail(ctx, opt.Email)
+	if err != nil {
+		return nil, err
+	}
+	if cust == nil {
+		return nil, ErrCustomerNotFound
+	}
+	if cust.ID == opt.Resource.OwnerID {
+		return nil, ErrAlreadyMember
+	}
+
+	grant := &InstanceGrant{
+		InstanceID: opt.Resource.InstanceID,
+		CustomerID: cust.ID,
+		OwnerID:    opt.Resource.OwnerID,
+		Email:      cust.Email,
+		Role:       opt.Role,
+		GrantedBy:  opt.GrantedBy,
+		CreatedAt:  time.Now(),
+	}
+	result := m.DB.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "instance_id"}, {Name: "customer_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"role", "granted_by"}),
+		}).
+		Create(grant)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot save grant")
+	}
+	return grant, nil
+}
+
+// RemoveGrant will revoke the customer's access to the instance
+func (m *Manager) RemoveGrant(ctx context.Context, instanceID, customerID string) error {
+	result := m.DB.WithContext(ctx).
+		Where("instance_id = ? AND customer_id = ?", instanceID, customerID).
+		Delete(&InstanceGrant{})
+	if result.Error != nil {
+		return extErrors.Wrap(result.Error, "Cannot remove grant")
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Authorize returns whether the customer can perform the action on the resource.
+// The effective role is the higher of the team role (in the owner's team) and the instance grant
+func (m *Manager) Authorize(ctx context.Context, customerID string, resource Resource, action Action) (bool, error) {
+	if customerID == resource.OwnerID {
+		return true, nil
+	}
+
+	roles := make([]Role, 0, 2)
+	result := m.DB.WithContext(ctx).
+		Model(&Membership{}).
+		Joins("JOIN teams ON teams.id = memberships.team_id").
+		Where("teams.owner_id = ? AND memberships.customer_id = ?", resource.OwnerID, customerID).
+		Pluck("memberships.role", &roles)
+	if result.Error != nil {
+		return false, extErrors.Wrap(result.Error, "Cannot get team role")
+	}
+
+	if len(resource.InstanceID) > 0 {
+		grants := make([]Role, 0, 1)
+		result = m.DB.WithContext(ctx).
+			Model(&InstanceGrant{}).
+			Where("instance_id = ? AND owner_id = ? AND customer_id = ?", resource.InstanceID, resource.OwnerID, customerID).
+			Pluck("role", &grants)
+		if result.Error != nil {
+			return false, extErrors.Wrap(result.Error, "Cannot get instance grant")
+		}
+		roles = append(roles, grants...)
+	}
+
+	for _, role := range roles {
+		if role.Allows(action) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Accessible returns the resources the customer can perform the action on
+func (m *Manager) Accessible(ctx context.Context, customerID string, action Action) (*Access, error) {
+	roles := rolesAllowing(action)
+
+	ownerIDs := make([]string, 0, 1)
+	result := m.DB.WithContext(ctx).
+		Model(&Membership{}).
+		Joins("JOIN teams ON teams.id = memberships.team_id").
+		Where("memberships.customer_id = ? AND memberships.role IN ?", customerID, roles).
+		Pluck("teams.owner_id", &ownerIDs)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot list team owners")
+	}
+
+	instanceIDs := make([]string, 0, 1)
+	result = m.DB.WithContext(ctx).
+		Model(&InstanceGrant{}).
+		Where("customer_id = ? AND role IN ?", customerID, roles).
+		Pluck("instance_id", &instanceIDs)
+	if result.Error != nil {
+		return nil, extErrors.Wrap(result.Error, "Cannot list instance grants")
+	}
+
+	access := &Access{
+		OwnerIDs:    []string{customerID},
+		InstanceIDs: instanceIDs,
+	}
+	for _, ownerID := range ownerIDs {
+		if ownerID != customerID {
+			access.OwnerIDs = append(access.OwnerIDs, ownerID)
+		}
+	}
+	return access, nil
+}
@@ -0,0 +1,84 @@
+package team
+
+import (
+	"context"
+	"net/http"
+)
+
+// Action is the custom type to define what is being done to a resource
+type Action string
+
+// Define the actions that can be authorized by a Policy
+const (
+	ActionViewInstance     Action = "instance:view"
+	ActionControlInstance  Action = "instance:control"
+	ActionManageInstance   Action = "instance:manage" // create and delete
+	ActionViewSubscription Action = "subscription:view"
+	ActionManageAccess     Action = "access:manage" // team members, invitations and instance grants
+	ActionManageBilling    Action = "billing:manage"
+)
+
+// minimum role required for each action
+var actionRoles = map[Action]Role{
+	ActionViewInstance:     RoleViewer,
+	ActionControlInstance:  RoleOperator,
+	ActionManageInstance:   RoleAdmin,
+	ActionViewSubscription: RoleViewer,
+	ActionManageAccess:     RoleAdmin,
+	ActionManageBilling:    RoleOwner,
+}
+
+// Allows returns whether the role is sufficient for the action
+func (r Role) Allows(action Action) bool {
+	min, ok := actionRoles[action]
+	if !ok {
+		return false
+	}
+	return !min.Outranks(r)
+}
+
+// rolesAllowing returns every role that is sufficient for the action
+func rolesAllowing(action Action) []Role {
+	roles := make([]Role, 0, len(roleRanks))
+	for role := range roleRanks {
+		if role.Allows(action) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// Resource identifies what is being acted on. InstanceID is optional, and enables per-instance grants
+type Resource struct {
+	OwnerID    string
+	InstanceID string
+}
+
+// Access lists the resources a customer can act on
+type Access struct {
+	OwnerIDs    []string // every resource of these customers, including the customer's own
+	InstanceIDs []string // in addition to OwnerIDs, these instances are granted individually
+}
+
+// Policy authorizes customers to act on resources owned by other customers, via team memberships
+// and per-instance grants. Customers can always act on their own resources
+type Policy interface {
+	Authorize(ctx context.Context, customerID string, resource Resource, action Action) (bool, error)
+	Accessible(ctx context.Context, customerID string, action Action) (*Access, error)
+}
+
+// GrantManager manages the per-instance grants considered by Policy
+type GrantManager interface {
+	ListGrants(ctx context.Context, instanceID string) ([]InstanceGrant, error)
+	PutGrant(ctx context.Context, opt GrantOption) (*InstanceGrant, error)
+	RemoveGrant(ctx context.Context, instanceID, customerID string) error
+}
+
+// Owner returns the customer whose resources the request is for, specified with ?owner=.
+// Defaults to the customer making the request
+func Owner(r *http.Request, customerID string) string {
+	if owner := r.URL.Query().Get("owner"); owner != "" {
+		return owner
+	}
+	return customerID
+}
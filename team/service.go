@@ -0,0 +1,506 @@
+package team
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/miragespace/rmc/auth"
+	resp "github.com/miragespace/rmc/response"
+
+	"github.com/go-chi/chi"
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+)
+
+var validate *validator.Validate = validator.New()
+
+// ServiceOptions contains the configuration for Service router
+type ServiceOptions struct {
+	TeamManager *Manager
+	Logger      *zap.Logger
+}
+
+// Service is the team API router
+type Service struct {
+	ServiceOptions
+}
+
+// NewService will create an instance of the team API router
+func NewService(option ServiceOptions) (*Service, error) {
+	if option.TeamManager == nil {
+		return nil, fmt.Errorf("nil TeamManager is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	return &Service{
+		ServiceOptions: option,
+	}, nil
+}
+
+// TeamRequest is the model of user request to create or rename a team
+type TeamRequest struct {
+	Name string `json:"name"`
+}
+
+func (r *TeamRequest) validate() bool {
+	return len(r.Name) > 0 && len(r.Name) <= 64
+}
+
+// membership returns the team and the role of the customer in it. Non-members get a 404
+func (s *Service) membership(w http.ResponseWriter, r *http.Request) (*Team, Role, bool) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	teamID := chi.URLParam(r, "id")
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+		zap.String("TeamID", teamID),
+	)
+
+	t, err := s.TeamManager.Get(ctx, teamID)
+	if err != nil {
+		logger.Error("Unable to get team",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to get team"))
+		return nil, "", false
+	}
+	if t != nil {
+		for _, member := range t.Members {
+			if member.CustomerID == claims.ID {
+				return t, member.Role, true
+			}
+		}
+	}
+
+	resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find team with specific ID"))
+	return nil, "", false
+}
+
+func (s *Service) listTeams(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	teams, err := s.TeamManager.List(ctx, claims.ID)
+	if err != nil {
+		logger.Error("Unable to list teams",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list teams"))
+		return
+	}
+
+	resp.WriteResponse(w, r, teams)
+}
+
+func (s *Service) createTeam(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	var req TeamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	if !req.validate() {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Team name must be between 1 and 64 characters"))
+		return
+	}
+
+	t, err := s.TeamManager.Create(ctx, claims.ID, claims.Email, req.Name)
+	switch err {
+	case nil:
+	case ErrTeamExists:
+		resp.WriteError(w, r, resp.ErrConflict().AddMessages("You already own a team"))
+		return
+	default:
+		logger.Error("Unable to create team",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to create team"))
+		return
+	}
+
+	resp.WriteResponse(w, r, t)
+}
+
+func (s *Service) getTeam(w http.ResponseWriter, r *http.Request) {
+	t, _, ok := s.membership(w, r)
+	if !ok {
+		return
+	}
+
+	resp.WriteResponse(w, r, t)
+}
+
+func (s *Service) renameTeam(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	t, role, ok := s.membership(w, r)
+	if !ok {
+		return
+	}
+	if !role.Allows(ActionManageAccess) {
+		resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Only owner and admins can rename the team"))
+		return
+	}
+
+	var req TeamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	if !req.validate() {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Team name must be between 1 and 64 characters"))
+		return
+	}
+
+	if err := s.TeamManager.Rename(ctx, t.ID, req.Name); err != nil {
+		s.Logger.Error("Unable to rename team",
+			zap.Error(err),
+			zap.String("TeamID", t.ID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to rename team"))
+		return
+	}
+	t.Name = req.Name
+
+	resp.WriteResponse(w, r, t)
+}
+
+func (s *Service) deleteTeam(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	t, role, ok := s.membership(w, r)
+	if !ok {
+		return
+	}
+	if role != RoleOwner {
+		resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Only the owner can delete the team"))
+		return
+	}
+
+	if err := s.TeamManager.Delete(ctx, t.ID); err != nil {
+		s.Logger.Error("Unable to delete team",
+			zap.Error(err),
+			zap.String("TeamID", t.ID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to delete team"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MemberRequest is the model of user request to change the role of a member
+type MemberRequest struct {
+	Role Role `json:"role"`
+}
+
+func (s *Service) updateMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	customerID := chi.URLParam(r, "customerId")
+
+	t, role, ok := s.membership(w, r)
+	if !ok {
+		return
+	}
+
+	var req MemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	if !req.Role.Valid() || req.Role == RoleOwner {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Role must be one of: admin, operator, viewer"))
+		return
+	}
+
+	// members can only manage members below them, and only assign roles below their own
+	var target *Membership
+	for i := range t.Members {
+		if t.Members[i].CustomerID == customerID {
+			target = &t.Members[i]
+		}
+	}
+	if target == nil {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find member with specific ID"))
+		return
+	}
+	if !role.Allows(ActionManageAccess) || !role.Outranks(target.Role) || !role.Outranks(req.Role) {
+		resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Insufficient role to change this member"))
+		return
+	}
+
+	if err := s.TeamManager.UpdateMember(ctx, t.ID, customerID, req.Role); err != nil {
+		s.Logger.Error("Unable to update member",
+			zap.Error(err),
+			zap.String("TeamID", t.ID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to update member"))
+		return
+	}
+	target.Role = req.Role
+
+	resp.WriteResponse(w, r, target)
+}
+
+func (s *Service) removeMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	customerID := chi.URLParam(r, "customerId")
+
+	t, role, ok := s.membership(w, r)
+	if !ok {
+		return
+	}
+
+	var target *Membership
+	for i := range t.Members {
+		if t.Members[i].CustomerID == customerID {
+			target = &t.Members[i]
+		}
+	}
+	if target == nil {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find member with specific ID"))
+		return
+	}
+	if target.Role == RoleOwner {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("The owner cannot leave the team. Delete the team instead"))
+		return
+	}
+	// members can always leave
+	if customerID != claims.ID && (!role.Allows(ActionManageAccess) || !role.Outranks(target.Role)) {
+		resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Insufficient role to remove this member"))
+		return
+	}
+
+	if err := s.TeamManager.RemoveMember(ctx, t.ID, customerID); err != nil && err != ErrNotFound {
+		s.Logger.Error("Unable to remove member",
+			zap.Error(err),
+			zap.String("TeamID", t.ID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to remove member"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// InviteRequest is the model of user request to invite an email address to the team
+type InviteRequest struct {
+	Email string `json:"email" validate:"required,email"`
+	Role  Role   `json:"role"`
+}
+
+func (s *Service) invite(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	t, role, ok := s.membership(w, r)
+	if !ok {
+		return
+	}
+
+	var req InviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	if err := validate.Struct(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Invalid email"))
+		return
+	}
+	if !req.Role.Valid() || req.Role == RoleOwner {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("Role must be one of: admin, operator, viewer"))
+		return
+	}
+	if !role.Allows(ActionManageAccess) || !role.Outranks(req.Role) {
+		resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Insufficient role to invite with this role"))
+		return
+	}
+
+	invitation, err := s.TeamManager.Invite(ctx, InviteOption{
+		Team:         t,
+		InviterID:    claims.ID,
+		InviterEmail: claims.Email,
+		Email:        req.Email,
+		Role:         req.Role,
+	})
+	switch err {
+	case nil:
+	case ErrAlreadyMember:
+		resp.WriteError(w, r, resp.ErrConflict().AddMessages("Email is already a member of the team"))
+		return
+	default:
+		s.Logger.Error("Unable to invite member",
+			zap.Error(err),
+			zap.String("TeamID", t.ID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to invite member"))
+		return
+	}
+
+	resp.WriteResponse(w, r, invitation)
+}
+
+func (s *Service) listInvitations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	t, role, ok := s.membership(w, r)
+	if !ok {
+		return
+	}
+	if !role.Allows(ActionManageAccess) {
+		resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Only owner and admins can see invitations"))
+		return
+	}
+
+	invitations, err := s.TeamManager.ListInvitations(ctx, t.ID)
+	if err != nil {
+		s.Logger.Error("Unable to list invitations",
+			zap.Error(err),
+			zap.String("TeamID", t.ID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list invitations"))
+		return
+	}
+
+	resp.WriteResponse(w, r, invitations)
+}
+
+func (s *Service) revokeInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	invitationID := chi.URLParam(r, "invitationId")
+
+	t, role, ok := s.membership(w, r)
+	if !ok {
+		return
+	}
+	if !role.Allows(ActionManageAccess) {
+		resp.WriteError(w, r, resp.ErrForbidden().AddMessages("Only owner and admins can revoke invitations"))
+		return
+	}
+
+	err := s.TeamManager.RevokeInvitation(ctx, t.ID, invitationID)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find invitation with specific ID"))
+		return
+	default:
+		s.Logger.Error("Unable to revoke invitation",
+			zap.Error(err),
+			zap.String("TeamID", t.ID),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to revoke invitation"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) listPendingInvitations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	invitations, err := s.TeamManager.PendingInvitations(ctx, claims.Email)
+	if err != nil {
+		logger.Error("Unable to list pending invitations",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list invitations"))
+		return
+	}
+
+	resp.WriteResponse(w, r, invitations)
+}
+
+func (s *Service) acceptInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	invitationID := chi.URLParam(r, "invitationId")
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+		zap.String("InvitationID", invitationID),
+	)
+
+	membership, err := s.TeamManager.AcceptInvitation(ctx, invitationID, claims.ID, claims.Email)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Invitation does not exist or has expired"))
+		return
+	case ErrAlreadyMember:
+		resp.WriteError(w, r, resp.ErrConflict().AddMessages("You are already a member of the team"))
+		return
+	default:
+		logger.Error("Unable to accept invitation",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to accept invitation"))
+		return
+	}
+
+	resp.WriteResponse(w, r, membership)
+}
+
+func (s *Service) declineInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	invitationID := chi.URLParam(r, "invitationId")
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+		zap.String("InvitationID", invitationID),
+	)
+
+	err := s.TeamManager.DeclineInvitation(ctx, invitationID, claims.Email)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find invitation with specific ID"))
+		return
+	default:
+		logger.Error("Unable to decline invitation",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to decline invitation"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Router will return the routes under team API
+func (s *Service) Router() http.Handler {
+	r := chi.NewRouter()
+
+	// membership is tied to the customer's email, so API keys cannot manage teams
+	r.Use(auth.RequireSession)
+
+	r.Get("/", s.listTeams)
+	r.Post("/", s.createTeam)
+	r.Get("/invitations", s.listPendingInvitations)
+	r.Post("/invitations/{invitationId}", s.acceptInvitation)
+	r.Delete("/invitations/{invitationId}", s.declineInvitation)
+	r.Get("/{id}", s.getTeam)
+	r.Put("/{id}", s.renameTeam)
+	r.Delete("/{id}", s.deleteTeam)
+	r.Put("/{id}/members/{customerId}", s.updateMember)
+	r.Delete("/{id}/members/{customerId}", s.removeMember)
+	r.Get("/{id}/invitations", s.listInvitations)
+	r.Post("/{id}/invitations", s.invite)
+	r.Delete("/{id}/invitations/{invitationId}", s.revokeInvitation)
+
+	return r
+}
@@ -0,0 +1,78 @@
+package team
+
+import "time"
+
+// Role is the custom type to define what a member can do with the resources of the team owner
+type Role string
+
+// Define the valid roles, from the most privileged
+// Owner: everything, including billing. Every team has exactly one owner, who pays for the resources
+// Admin: create/delete instances, manage members and grants
+// Operator: start/stop instances
+// Viewer: read-only access to instances and subscriptions
+const (
+	RoleOwner    Role = "owner"
+	RoleAdmin    Role = "admin"
+	RoleOperator Role = "operator"
+	RoleViewer   Role = "viewer"
+)
+
+var roleRanks = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+	RoleOwner:    4,
+}
+
+// Valid returns whether the role is one of the defined roles
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// Outranks returns whether r is strictly more privileged than other
+func (r Role) Outranks(other Role) bool {
+	return roleRanks[r] > roleRanks[other]
+}
+
+// Team describes a group of customers sharing access to the resources of the owner.
+// A customer can own at most one team, but can be a member of many
+type Team struct {
+	ID        string       `json:"id" gorm:"primaryKey"`
+	Name      string       `json:"name" gorm:"not null"`
+	OwnerID   string       `json:"ownerId" gorm:"uniqueIndex;not null"` // Corresponds to Stripe's customer ID. Billing stays with the owner
+	CreatedAt time.Time    `json:"createdAt"`
+	Members   []Membership `json:"members,omitempty"`
+}
+
+// Membership describes the role of a customer in a team
+type Membership struct {
+	TeamID     string    `json:"-" gorm:"primaryKey"`
+	CustomerID string    `json:"customerId" gorm:"primaryKey;index"`
+	Email      string    `json:"email" gorm:"not null"`
+	Role       Role      `json:"role" gorm:"not null"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Invitation is a pending invitation for an email address to join a team
+type Invitation struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	TeamID    string    `json:"teamId" gorm:"index;not null"`
+	Team      *Team     `json:"team,omitempty"`
+	Email     string    `json:"email" gorm:"index;not null"` // always lower case
+	Role      Role      `json:"role" gorm:"not null"`
+	InvitedBy string    `json:"invitedBy" gorm:"not null"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// InstanceGrant gives a customer a role on a single instance, regardless of team membership
+type InstanceGrant struct {
+	InstanceID string    `json:"instanceId" gorm:"primaryKey"`
+	CustomerID string    `json:"customerId" gorm:"primaryKey;index"`
+	OwnerID    string    `json:"-" gorm:"index;not null"` // owner of the instance at the time of grant
+	Email      string    `json:"email" gorm:"not null"`
+	Role       Role      `json:"role" gorm:"not null"`
+	GrantedBy  string    `json:"grantedBy" gorm:"not null"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
@@ -0,0 +1,108 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.uber.org/zap"
+)
+
+// Options configures the tracer provider of the process
+type Options struct {
+	ServiceName string                // e.g. rmc-api, the service.name of the exported spans
+	Exporter    sdktrace.SpanExporter // Optional. Without an Exporter, trace IDs are still propagated and logged
+	SampleRatio float64               // share of the new traces which are exported, see ParseSampleRatio
+	Logger      *zap.Logger
+}
+
+var provider *sdktrace.TracerProvider
+
+// Init installs the global tracer provider, which exports the sampled spans in batches with the Exporter.
+// It must be called once before any span is started
+func Init(option Options) error {
+	if option.Logger == nil {
+		return fmt.Errorf("nil Logger is invalid")
+	}
+	if len(option.ServiceName) == 0 {
+		return fmt.Errorf("empty ServiceName is invalid")
+	}
+	if provider != nil {
+		return fmt.Errorf("tracing is already initialized")
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(option.ServiceName),
+	))
+	if err != nil {
+		return err
+	}
+	// IDs are generated even if no span is sampled. Traces started by another process are sampled as decided
+	// by the parent, so they are either exported completely or not at all
+	sampler := sdktrace.NeverSample()
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+	}
+	if option.Exporter != nil {
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(option.SampleRatio))
+		opts = append(opts, sdktrace.WithBatcher(option.Exporter))
+	}
+	opts = append(opts, sdktrace.WithSampler(sampler))
+
+	provider = sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		option.Logger.Error("Tracing error",
+			zap.Error(err),
+		)
+	}))
+	return nil
+}
+
+// Shutdown exports the queued spans and stops exporting, or gives up when ctx is done
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+// NewExporter returns the exporter by name, as configured with TRACING_EXPORTER: stdout, or otlp sending to the
+// OTLP/HTTP collector at endpoint (OTEL_EXPORTER_OTLP_ENDPOINT). It returns nil if name is empty or none
+func NewExporter(ctx context.Context, name, endpoint string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case "", "none":
+		return nil, nil
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		opts := make([]otlptracehttp.Option, 0, 1)
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %s", name)
+	}
+}
+
+// ParseSampleRatio parses the share of new traces which are sampled (TRACING_SAMPLE_RATIO), from 0 to 1.
+// Every trace is sampled if value is empty
+func ParseSampleRatio(value string) (float64, error) {
+	if value == "" {
+		return 1, nil
+	}
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return 0, fmt.Errorf("invalid sample ratio %s, must be between 0 and 1", value)
+	}
+	return ratio, nil
+}
@@ -0,0 +1,43 @@
+package tracing
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts a span for each request to the router. Like metrics.Middleware, it must be used before the
+// routes are matched, so the span can be named after the route pattern. Requests to a public router always start
+// a new trace, as clients could otherwise choose the trace ID and whether the trace is sampled. Requests to
+// internal routers continue the trace of the traceparent header, if any
+func Middleware(router string, public bool) func(next http.Handler) http.Handler {
+	opts := []otelhttp.Option{
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			return "HTTP " + r.Method
+		}),
+	}
+	if public {
+		opts = append(opts, otelhttp.WithPropagators(propagation.NewCompositeTextMapPropagator()))
+	} else {
+		opts = append(opts, otelhttp.WithPropagators(propagator))
+	}
+	return func(next http.Handler) http.Handler {
+		named := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			span := trace.SpanFromContext(r.Context())
+			span.SetAttributes(attribute.String("rmc.router", router))
+			defer func() {
+				if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+					span.SetName(r.Method + " " + rctx.RoutePattern())
+					span.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+				}
+			}()
+			next.ServeHTTP(w, r)
+		})
+		return otelhttp.NewHandler(named, router, opts...)
+	}
+}
@@ -0,0 +1,22 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// propagator carries the span context between processes in the W3C Trace Context headers
+var propagator = propagation.TraceContext{}
+
+// Inject sets the traceparent of the current span of ctx in carrier, e.g. the headers of an AMQP message,
+// if ctx is part of a trace
+func Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	propagator.Inject(ctx, carrier)
+}
+
+// Extract returns a copy of ctx with the span context of the traceparent in carrier as the remote parent.
+// ctx is returned as is if carrier has no valid traceparent
+func Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return propagator.Extract(ctx, carrier)
+}
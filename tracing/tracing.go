@@ -0,0 +1,69 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// instrumentationName is the name of the tracer of every span started by rmc
+const instrumentationName = "github.com/miragespace/rmc"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts a span as a child of the current span of ctx, or as the root of a new trace.
+// The returned context carries the span, and the span must be ended by the caller
+func Start(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// StartChild is Start, but only if ctx is part of a trace. Otherwise it returns ctx and a span which records
+// nothing, so periodic jobs, e.g. heartbeats, don't produce a trace for each query they make
+func StartChild(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return Start(ctx, name, kind, attrs...)
+}
+
+// SetError marks the span as failed with err. A nil err is ignored
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Fields returns the zap fields identifying the current span of ctx, or none if ctx is not part of a trace
+func Fields(ctx context.Context) []zap.Field {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return []zap.Field{
+		zap.String("TraceID", sc.TraceID().String()),
+		zap.String("SpanID", sc.SpanID().String()),
+	}
+}
+
+// Logger returns logger with the fields identifying the current span of ctx, if any
+func Logger(ctx context.Context, logger *zap.Logger) *zap.Logger {
+	fields := Fields(ctx)
+	if len(fields) == 0 {
+		return logger
+	}
+	return logger.With(fields...)
+}
+
+// Detach returns a context carrying only the span of ctx, for work outliving ctx, e.g. a goroutine
+// started by a request, which should continue the trace but not be canceled with the request
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedFor sets the RemoteAddr of requests to the client IP in X-Forwarded-For, as seen by the trusted proxies
+// in front of the server. Each proxy appends the address it received the request from, so the client IP is the
+// entry added by the outermost trusted proxy, counting proxies from the right. Entries further left, and headers
+// such as X-Real-IP, are set by the client and cannot be trusted. Requests with fewer entries are left unchanged
+func ForwardedFor(trustedProxies int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ip := forwardedIP(r.Header.Values("X-Forwarded-For"), trustedProxies); ip != "" {
+				r.RemoteAddr = ip
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func forwardedIP(headers []string, trustedProxies int) string {
+	if trustedProxies < 1 {
+		return ""
+	}
+	entries := make([]string, 0, len(headers))
+	for _, header := range headers {
+		entries = append(entries, strings.Split(header, ",")...)
+	}
+	if len(entries) < trustedProxies {
+		return ""
+	}
+	ip := net.ParseIP(strings.TrimSpace(entries[len(entries)-trustedProxies]))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,27 @@
+package util
+
+import "testing"
+
+func TestForwardedIP(t *testing.T) {
+	tests := []struct {
+		headers        []string
+		trustedProxies int
+		expected       string
+	}{
+		{[]string{"203.0.113.7"}, 1, "203.0.113.7"},
+		// the client spoofed the left-most entry
+		{[]string{"10.0.0.1, 203.0.113.7"}, 1, "203.0.113.7"},
+		{[]string{"10.0.0.1", "203.0.113.7"}, 1, "203.0.113.7"},
+		{[]string{"10.0.0.1, 203.0.113.7, 198.51.100.2"}, 2, "203.0.113.7"},
+		{[]string{"2001:db8::1"}, 1, "2001:db8::1"},
+		{[]string{"203.0.113.7"}, 2, ""},
+		{[]string{"not an ip"}, 1, ""},
+		{nil, 1, ""},
+		{[]string{"203.0.113.7"}, 0, ""},
+	}
+	for _, test := range tests {
+		if ip := forwardedIP(test.headers, test.trustedProxies); ip != test.expected {
+			t.Errorf("forwardedIP(%q, %d) = %q, expected %q", test.headers, test.trustedProxies, ip, test.expected)
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	extErrors "github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidURL is returned when the URL of an endpoint is not an absolute http(s) URL
+var ErrInvalidURL = errors.New("URL must be an absolute http or https URL")
+
+// ErrTooManyEndpoints is returned when a customer registers more than maxEndpoints endpoints
+var ErrTooManyEndpoints = errors.New("Too many webhook endpoints")
+
+const (
+	maxEndpoints = 10
+	maxAttempts  = 8
+	retryBackoff = time.Second * 30 // doubled after each failed attempt
+	retryBatch   = 50
+	// a claimed delivery is not picked up by other replicas for this long while it is being delivered
+	claimTimeout = time.Minute * 5
+	// emitted events are delivered by this many workers. Deliveries which don't fit in the queue are left
+	// pending, and are sent by HandleRetry once their claim expires
+	deliveryWorkers = 8
+	deliveryQueue   = 256
+)
+
+// ManagerOptions is used to setup webhook Manager's dependencies
+type ManagerOptions struct {
+	DB     *gorm.DB
+	Logger *zap.Logger
+	// Optional. Defaults to a client that refuses to connect to private networks
+	HTTPClient *http.Client
+}
+
+// Manager manages the webhook endpoints of customers, and delivers events to them with retries
+type Manager struct {
+	ManagerOptions
+	queue chan queuedDelivery
+}
+
+type queuedDelivery struct {
+	endpoint *Endpoint
+	delivery *Delivery
+}
+
+// NewManager returns a new webhook Manager
+func NewManager(option ManagerOptions) (*Manager, error) {
+	if option.DB == nil {
+		return nil, fmt.Errorf("nil DB is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	if option.HTTPClient == nil {
+		option.HTTPClient = publicClient()
+	}
+	if err := option.DB.AutoMigrate(&Endpoint{}, &Delivery{}); err != nil {
+		return nil, extErrors.Wrap(err, "Cannot initilize webhook.Manager")
+	}
+	m := &Manager{
+		ManagerOptions: option,
+		queue:          make(chan queuedDelivery, deliveryQueue),
+	}
+	for i := 0; i < deliveryWorkers; i++ {
+		go m.worker()
+	}
+	return m, nil
+}
+
+func (m *Manager) worker() {
+	for q := range m.queue {
+		m.deliver(context.Background(), q.endpoint, q.delivery)
+	}
+}
+
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// EndpointOption specifies the endpoint to create or update. On update, empty fields are unchanged
+type EndpointOption struct {
+	URL         string
+	Format      Format
+	Events      []Event
+	Description *string
+	Active      *bool
+}
+
+// Create registers a new endpoint for the customer. The Secret of the returned endpoint should be shown to the customer
+func (m *Manager) Create(ctx context.Context, customerID string, opt EndpointOption) (*Endpoint, error) {
+	if err := validateURL(opt.URL); err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := m.DB.WithContext(ctx).
+		Model(&Endpoint{}).
+		Where("customer_id = ?", customerID).
+		Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count >= maxEndpoints {
+		return nil, ErrTooManyEndpoints
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot generate secret")
+	}
+	e := &Endpoint{
+		ID:         uuid.New().String(),
+		CustomerID: customerID,
+		URL:        opt.URL,
+		Format:     opt.Format,
+		Secret:     secret,
+		Active:     true,
+		CreatedAt:  time.Now(),
+	}
+	if e.Format == "" {
+		e.Format = FormatJSON
+	}
+	if opt.Description != nil {
+		e.Description = *opt.Description
+	}
+	if opt.Active != nil {
+		e.Active = *opt.Active
+	}
+	e.SetEvents(opt.Events)
+	if err := m.DB.WithContext(ctx).Create(e).Error; err != nil {
+		return nil, extErrors.Wrap(err, "Cannot save endpoint")
+	}
+	e.EventList = e.GetEvents()
+	return e, nil
+}
+
+// List returns the endpoints of the customer
+func (m *Manager) List(ctx context.Context, customerID string) ([]Endpoint, error) {
+	endpoints := make([]Endpoint, 0)
+	result := m.DB.WithContext(ctx).
+		Where("customer_id = ?", customerID).
+		Order("created_at ASC").
+		Find(&endpoints)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	for k := range endpoints {
+		endpoints[k].EventList = endpoints[k].GetEvents()
+	}
+	return endpoints, nil
+}
+
+// Get returns an endpoint of the customer. If the endpoint does not exist or belongs to another customer, it will be nil
+func (m *Manager) Get(ctx context.Context, customerID, endpointID string) (*Endpoint, error) {
+	e := &Endpoint{}
+	result := m.DB.WithContext(ctx).
+		Where("customer_id = ?", customerID).
+		Where("id = ?", endpointID).
+		Limit(1).
+		Find(e)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	e.EventList = e.GetEvents()
+	return e, nil
+}
+
+// Update changes the endpoint of the customer. If the endpoint does not exist, it will return nil
+func (m *Manager) Update(ctx context.Context, customerID, endpointID string, opt EndpointOption) (*Endpoint, error) {
+	e, err := m.Get(ctx, customerID, endpointID)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	if opt.URL != "" {
+		if err := validateURL(opt.URL); err != nil {
+			return nil, err
+		}
+		e.URL = opt.URL
+	}
+	if opt.Format != "" {
+		e.Format = opt.Format
+	}
+	if opt.Events != nil {
+		e.SetEvents(opt.Events)
+	}
+	if opt.Description != nil {
+		e.Description = *opt.Description
+	}
+	if opt.Active != nil {
+		e.Active = *opt.Active
+	}
+	if err := m.DB.WithContext(ctx).
+		Model(&Endpoint{}).
+		Where("id = ?", e.ID).
+		Updates(map[string]interface{}{
+			"url":         e.URL,
+			"format":      e.Format,
+			"events":      e.Events,
+			"description": e.Description,
+			"active":      e.Active,
+		}).Error; err != nil {
+		return nil, extErrors.Wrap(err, "Cannot update endpoint")
+	}
+	e.EventList = e.GetEvents()
+	return e, nil
+}
+
+// Delete removes the endpoint of the customer and its deliveries. It returns false if the endpoint does not exist
+func (m *Manager) Delete(ctx context.Context, customerID, endpointID string) (bool, error) {
+	var deleted bool
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.
+			Where("customer_id = ?", customerID).
+			Where("id = ?", endpointID).
+			Delete(&Endpoint{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		deleted = true
+		return tx.Where("endpoint_id = ?", endpointID).Delete(&Delivery{}).Error
+	})
+	return deleted, err
+}
+
+// ListDeliveries returns the most recent deliveries to the endpoint, newest first
+func (m *Manager) ListDeliveries(ctx context.Context, endpointID string, limit int) ([]Delivery, error) {
+	deliveries := make([]Delivery, 0)
+	result := m.DB.WithContext(ctx).
+		Where("endpoint_id = ?", endpointID).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&deliveries)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return deliveries, nil
+}
+
+// EmitOption specifies the event to send
+type EmitOption struct {
+	CustomerID string
+	Event      Event
+	Summary    string      // human readable, e.g. "Instance abc is now Running". This is the message in FormatDiscord
+	Data       interface{} // marshalled as JSON
+}
+
+// Emit sends the event to the active endpoints of the customer subscribed to it. The deliveries are recorded
+// and sent in the background, and failures are retried by HandleRetry
+func (m *Manager) Emit(ctx context.Context, opt EmitOption) error {
+	endpoints := make([]Endpoint, 0)
+	if err := m.DB.WithContext(ctx).
+		Where("customer_id = ?", opt.CustomerID).
+		Where("active = ?", true).
+		Find(&endpoints).Error; err != nil {
+		return extErrors.Wrap(err, "Cannot list endpoints")
+	}
+
+	payload := Payload{
+		ID:        uuid.New().String(),
+		Type:      opt.Event,
+		CreatedAt: time.Now(),
+		Summary:   opt.Summary,
+		Data:      opt.Data,
+	}
+	for k := range endpoints {
+		e := &endpoints[k]
+		if !e.Subscribed(opt.Event) {
+			continue
+		}
+		d, err := m.newDelivery(ctx, e, payload)
+		if err != nil {
+			return err
+		}
+		select {
+		case m.queue <- queuedDelivery{endpoint: e, delivery: d}:
+		default:
+			m.Logger.Warn("Webhook delivery queue is full, leaving delivery for retry",
+				zap.String("CustomerID", e.CustomerID),
+				zap.String("EndpointID", e.ID),
+				zap.String("DeliveryID", d.ID),
+			)
+		}
+	}
+	return nil
+}
+
+// Test sends a ping event to the endpoint, even if it is not active, and returns the result
+func (m *Manager) Test(ctx context.Context, e *Endpoint) (*Delivery, error) {
+	d, err := m.newDelivery(ctx, e, Payload{
+		ID:        uuid.New().String(),
+		Type:      EventPing,
+		CreatedAt: time.Now(),
+		Summary:   "Webhook test from RMC",
+		Data:      map[string]interface{}{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.deliver(ctx, e, d)
+	return d, nil
+}
+
+func (m *Manager) newDelivery(ctx context.Context, e *Endpoint, payload Payload) (*Delivery, error) {
+	var body interface{} = payload
+	if e.Format == FormatDiscord {
+		body = map[string]interface{}{
+			"content": payload.Summary,
+		}
+	}
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, extErrors.Wrap(err, "Cannot encode payload")
+	}
+
+	now := time.Now()
+	d := &Delivery{
+		ID:            uuid.New().String(),
+		EndpointID:    e.ID,
+		EventID:       payload.ID,
+		Event:         payload.Type,
+		Body:          string(encoded),
+		Status:        StatusPending,
+		NextAttemptAt: now.Add(claimTimeout),
+		CreatedAt:     now,
+	}
+	if err := m.DB.WithContext(ctx).Create(d).Error; err != nil {
+		return nil, extErrors.Wrap(err, "Cannot save delivery")
+	}
+	return d, nil
+}
+
+// send makes the request to the endpoint, and returns the response status code if the endpoint responded
+func (m *Manager) send(ctx context.Context, e *Endpoint, d *Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader([]byte(d.Body)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "RMC-Webhook/1.0")
+	req.Header.Set(HeaderSignature, Sign(e.Secret, time.Now(), []byte(d.Body)))
+	req.Header.Set(HeaderEvent, string(d.Event))
+	req.Header.Set(HeaderDelivery, d.ID)
+
+	res, err := m.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("Endpoint responded with %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// deliver sends the delivery and records the result in d. The caller must have claimed the delivery
+func (m *Manager) deliver(ctx context.Context, e *Endpoint, d *Delivery) {
+	logger := m.Logger.With(
+		zap.String("CustomerID", e.CustomerID),
+		zap.String("EndpointID", e.ID),
+		zap.String("DeliveryID", d.ID),
+	)
+
+	now := time.Now()
+	code, err := m.send(ctx, e, d)
+	d.Attempts++
+	d.ResponseCode = code
+	switch {
+	case err == nil:
+		d.Status = StatusDelivered
+		d.DeliveredAt = &now
+		d.LastError = ""
+	case d.Attempts >= maxAttempts:
+		logger.Warn("Giving up webhook delivery",
+			zap.Int("Attempts", d.Attempts),
+			zap.Error(err),
+		)
+		d.Status = StatusFailed
+		d.LastError = err.Error()
+	default:
+		d.NextAttemptAt = now.Add(retryBackoff << uint(d.Attempts-1))
+		d.LastError = err.Error()
+	}
+
+	if err := m.DB.WithContext(ctx).
+		Model(&Delivery{}).
+		Where("id = ?", d.ID).
+		Updates(map[string]interface{}{
+			"status":          d.Status,
+			"attempts":        d.Attempts,
+			"response_code":   d.ResponseCode,
+			"last_error":      d.LastError,
+			"next_attempt_at": d.NextAttemptAt,
+			"delivered_at":    d.DeliveredAt,
+		}).Error; err != nil {
+		logger.Error("Unable to update delivery status",
+			zap.Error(err),
+		)
+	}
+}
+
+// RetryPending sends the pending deliveries that are due. Each delivery is claimed with a
+// conditional update, so it is safe to run on multiple replicas
+func (m *Manager) RetryPending(ctx context.Context) {
+	now := time.Now()
+	pending := make([]Delivery, 0)
+	if err := m.DB.WithContext(ctx).
+		Where("status = ?", StatusPending).
+		Where("next_attempt_at <= ?", now).
+		Order("next_attempt_at ASC").
+		Limit(retryBatch).
+		Find(&pending).Error; err != nil {
+		m.Logger.Error("Unable to list pending deliveries",
+			zap.Error(err),
+		)
+		return
+	}
+
+	endpoints := make(map[string]*Endpoint)
+	for i := range pending {
+		d := &pending[i]
+		result := m.DB.WithContext(ctx).
+			Model(&Delivery{}).
+			Where("id = ?", d.ID).
+			Where("status = ?", StatusPending).
+			Where("next_attempt_at = ?", d.NextAttemptAt).
+			Update("next_attempt_at", now.Add(claimTimeout))
+		if result.Error != nil {
+			m.Logger.Error("Unable to claim pending delivery",
+				zap.String("DeliveryID", d.ID),
+				zap.Error(result.Error),
+			)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			// claimed by another replica
+			continue
+		}
+
+		e, ok := endpoints[d.EndpointID]
+		if !ok {
+			e = &Endpoint{}
+			result := m.DB.WithContext(ctx).Where("id = ?", d.EndpointID).Limit(1).Find(e)
+			if result.Error != nil {
+				m.Logger.Error("Unable to get endpoint of pending delivery",
+					zap.String("DeliveryID", d.ID),
+					zap.Error(result.Error),
+				)
+				continue
+			}
+			if result.RowsAffected == 0 {
+				e = nil
+			}
+			endpoints[d.EndpointID] = e
+		}
+		if e == nil || !e.Active {
+			// the endpoint was disabled after the event, deliveries of deleted endpoints are removed with them
+			if err := m.DB.WithContext(ctx).
+				Model(&Delivery{}).
+				Where("id = ?", d.ID).
+				Updates(map[string]interface{}{
+					"status":     StatusFailed,
+					"last_error": "Endpoint was disabled",
+				}).Error; err != nil {
+				m.Logger.Error("Unable to update delivery status",
+					zap.String("DeliveryID", d.ID),
+					zap.Error(err),
+				)
+			}
+			continue
+		}
+		m.deliver(ctx, e, d)
+	}
+}
+
+// HandleRetry periodically retries pending deliveries until ctx is cancelled
+func (m *Manager) HandleRetry(ctx context.Context, interval time.Duration) {
+	m.Logger.Info("Webhook retry interval: " + interval.String())
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				m.RetryPending(ctx)
+			}
+		}
+	}()
+}
@@ -0,0 +1,308 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/miragespace/rmc/auth"
+	"github.com/miragespace/rmc/ratelimit"
+	resp "github.com/miragespace/rmc/response"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+const deliveryListLimit = 50
+
+// ServiceOptions contains the configuration for Service router
+type ServiceOptions struct {
+	WebhookManager *Manager
+	Limiter        *ratelimit.Limiter
+	Logger         *zap.Logger
+}
+
+// Service is the webhook API router
+type Service struct {
+	ServiceOptions
+}
+
+// NewService will create an instance of the webhook API router
+func NewService(option ServiceOptions) (*Service, error) {
+	if option.WebhookManager == nil {
+		return nil, fmt.Errorf("nil WebhookManager is invalid")
+	}
+	if option.Limiter == nil {
+		return nil, fmt.Errorf("nil Limiter is invalid")
+	}
+	if option.Logger == nil {
+		return nil, fmt.Errorf("nil Logger is invalid")
+	}
+	return &Service{
+		ServiceOptions: option,
+	}, nil
+}
+
+// EndpointRequest is the model of user request to create or update a webhook endpoint.
+// On update, omitted fields are unchanged
+type EndpointRequest struct {
+	URL         string  `json:"url"`
+	Format      Format  `json:"format"`
+	Events      []Event `json:"events"`
+	Description *string `json:"description"`
+	Active      *bool   `json:"active"`
+}
+
+func (r *EndpointRequest) validate() string {
+	if r.Format != "" && !r.Format.Valid() {
+		return "Format must be json or discord"
+	}
+	for _, event := range r.Events {
+		if !event.Valid() {
+			return "Unknown event " + string(event)
+		}
+	}
+	if r.Description != nil && len(*r.Description) > 256 {
+		return "Description must be at most 256 characters"
+	}
+	return ""
+}
+
+func (r *EndpointRequest) toOption() EndpointOption {
+	return EndpointOption{
+		URL:         r.URL,
+		Format:      r.Format,
+		Events:      r.Events,
+		Description: r.Description,
+		Active:      r.Active,
+	}
+}
+
+// EndpointCreated is the response of a new endpoint, the only time the secret is shown
+type EndpointCreated struct {
+	*Endpoint
+	Secret string `json:"secret"`
+}
+
+func (s *Service) listEndpoints(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	endpoints, err := s.WebhookManager.List(ctx, claims.ID)
+	if err != nil {
+		logger.Error("Unable to list webhook endpoints",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list webhook endpoints"))
+		return
+	}
+
+	resp.WriteResponse(w, r, endpoints)
+}
+
+func (s *Service) createEndpoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+
+	logger := s.Logger.With(zap.String("CustomerID", claims.ID))
+
+	var req EndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	if msg := req.validate(); msg != "" {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages(msg))
+		return
+	}
+	if len(req.Events) == 0 {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("At least one event is required"))
+		return
+	}
+
+	e, err := s.WebhookManager.Create(ctx, claims.ID, req.toOption())
+	switch err {
+	case nil:
+	case ErrInvalidURL:
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages(err.Error()))
+		return
+	case ErrTooManyEndpoints:
+		resp.WriteError(w, r, resp.ErrConflict().AddMessages("You can register at most 10 webhook endpoints"))
+		return
+	default:
+		logger.Error("Unable to create webhook endpoint",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to create webhook endpoint"))
+		return
+	}
+
+	resp.WriteResponse(w, r, EndpointCreated{
+		Endpoint: e,
+		Secret:   e.Secret,
+	})
+}
+
+// endpoint returns the endpoint in the URL. Endpoints of other customers get a 404
+func (s *Service) endpoint(w http.ResponseWriter, r *http.Request) (*Endpoint, bool) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	endpointID := chi.URLParam(r, "id")
+
+	e, err := s.WebhookManager.Get(ctx, claims.ID, endpointID)
+	if err != nil {
+		s.Logger.Error("Unable to get webhook endpoint",
+			zap.String("CustomerID", claims.ID),
+			zap.String("EndpointID", endpointID),
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to get webhook endpoint"))
+		return nil, false
+	}
+	if e == nil {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find webhook endpoint with specific ID"))
+		return nil, false
+	}
+	return e, true
+}
+
+func (s *Service) getEndpoint(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.endpoint(w, r)
+	if !ok {
+		return
+	}
+
+	resp.WriteResponse(w, r, e)
+}
+
+func (s *Service) updateEndpoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	endpointID := chi.URLParam(r, "id")
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+		zap.String("EndpointID", endpointID),
+	)
+
+	var req EndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.WriteError(w, r, resp.ErrInvalidJson())
+		return
+	}
+	if msg := req.validate(); msg != "" {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages(msg))
+		return
+	}
+	if req.Events != nil && len(req.Events) == 0 {
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages("At least one event is required"))
+		return
+	}
+
+	e, err := s.WebhookManager.Update(ctx, claims.ID, endpointID, req.toOption())
+	switch err {
+	case nil:
+	case ErrInvalidURL:
+		resp.WriteError(w, r, resp.ErrBadRequest().AddMessages(err.Error()))
+		return
+	default:
+		logger.Error("Unable to update webhook endpoint",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to update webhook endpoint"))
+		return
+	}
+	if e == nil {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find webhook endpoint with specific ID"))
+		return
+	}
+
+	resp.WriteResponse(w, r, e)
+}
+
+func (s *Service) deleteEndpoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := ctx.Value(auth.Context).(*auth.Claims)
+	endpointID := chi.URLParam(r, "id")
+
+	logger := s.Logger.With(
+		zap.String("CustomerID", claims.ID),
+		zap.String("EndpointID", endpointID),
+	)
+
+	deleted, err := s.WebhookManager.Delete(ctx, claims.ID, endpointID)
+	if err != nil {
+		logger.Error("Unable to delete webhook endpoint",
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to delete webhook endpoint"))
+		return
+	}
+	if !deleted {
+		resp.WriteError(w, r, resp.ErrNotFound().AddMessages("Cannot find webhook endpoint with specific ID"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) testEndpoint(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.endpoint(w, r)
+	if !ok {
+		return
+	}
+
+	d, err := s.WebhookManager.Test(r.Context(), e)
+	if err != nil {
+		s.Logger.Error("Unable to send test webhook",
+			zap.String("CustomerID", e.CustomerID),
+			zap.String("EndpointID", e.ID),
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to send test webhook"))
+		return
+	}
+
+	resp.WriteResponse(w, r, d)
+}
+
+func (s *Service) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.endpoint(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := s.WebhookManager.ListDeliveries(r.Context(), e.ID, deliveryListLimit)
+	if err != nil {
+		s.Logger.Error("Unable to list webhook deliveries",
+			zap.String("CustomerID", e.CustomerID),
+			zap.String("EndpointID", e.ID),
+			zap.Error(err),
+		)
+		resp.WriteError(w, r, resp.ErrUnexpected().AddMessages("Unable to list webhook deliveries"))
+		return
+	}
+
+	resp.WriteResponse(w, r, deliveries)
+}
+
+// Router returns a http router for the webhook endpoints of the customer
+func (s *Service) Router() http.Handler {
+	r := chi.NewRouter()
+
+	// endpoints receive the secrets to verify deliveries, so API keys cannot manage them
+	r.Use(auth.RequireSession)
+
+	r.Get("/", s.listEndpoints)
+	r.Post("/", s.createEndpoint)
+	r.Get("/{id}", s.getEndpoint)
+	r.Put("/{id}", s.updateEndpoint)
+	r.Delete("/{id}", s.deleteEndpoint)
+	// test deliveries are sent synchronously to an arbitrary URL
+	r.With(s.Limiter.Middleware(ratelimit.WebhookTest, ratelimit.ByCustomer)).Post("/{id}/test", s.testEndpoint)
+	r.Get("/{id}/deliveries", s.listDeliveries)
+
+	return r
+}
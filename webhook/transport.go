@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// define the headers sent with every delivery
+const (
+	HeaderSignature = "X-RMC-Signature" // t=<unix timestamp>,v1=<hex HMAC-SHA256 of "<timestamp>.<body>">
+	HeaderEvent     = "X-RMC-Event"
+	HeaderDelivery  = "X-RMC-Delivery"
+)
+
+const requestTimeout = time.Second * 10
+
+// Sign returns the value of HeaderSignature. Receivers should compute the same HMAC with the secret of the endpoint,
+// and reject timestamps that are too old to prevent replays
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var privateNetworks = func() []*net.IPNet {
+	cidrs := []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24", // IETF protocol assignments
+		"192.168.0.0/16",
+		"198.18.0.0/15", // benchmarking
+		"240.0.0.0/4",   // reserved, including broadcast
+		"::/128",
+		"::1/128",
+		"64:ff9b::/96", // NAT64, embeds an IPv4 address which may be private
+		"2002::/16",    // 6to4, embeds an IPv4 address which may be private
+		"fc00::/7",
+		"fe80::/10",
+	}
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isPrivate(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicClient returns a http client that refuses to connect to private networks, so customers cannot
+// use webhooks to reach internal services. The check is done after DNS resolution, and on every redirect
+func publicClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: requestTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || isPrivate(ip) {
+				return fmt.Errorf("Connecting to %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: requestTimeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     time.Minute,
+		},
+	}
+}
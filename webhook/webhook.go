@@ -0,0 +1,129 @@
+package webhook
+
+import (
+	"strings"
+	"time"
+)
+
+// Event is the type of event sent to webhook endpoints
+type Event string
+
+// define constants
+const (
+	EventInstanceState     Event = "instance.state"     // an instance changed state, as recorded in its History
+	EventUsageThreshold    Event = "usage.threshold"    // the spend crossed an alert threshold of a budget
+	EventSubscriptionState Event = "subscription.state" // a subscription changed state
+	EventPing              Event = "ping"               // sent by the test-fire endpoint, to every endpoint regardless of its events
+)
+
+// Events are the events endpoints can subscribe to
+var Events = []Event{
+	EventInstanceState,
+	EventUsageThreshold,
+	EventSubscriptionState,
+}
+
+// Valid returns whether endpoints can subscribe to the event
+func (e Event) Valid() bool {
+	for _, event := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Format is the body format of the requests to an endpoint
+type Format string
+
+// define constants
+const (
+	FormatJSON    Format = "json"    // the Payload as is
+	FormatDiscord Format = "discord" // a Discord (or Slack compatible) message with the summary of the event
+)
+
+// Valid returns whether the format is supported
+func (f Format) Valid() bool {
+	return f == FormatJSON || f == FormatDiscord
+}
+
+// Endpoint is a URL registered by a customer to receive events
+type Endpoint struct {
+	ID          string    `json:"id" gorm:"primaryKey"`
+	CustomerID  string    `json:"-" gorm:"index;not null"`
+	URL         string    `json:"url" gorm:"not null"`
+	Format      Format    `json:"format" gorm:"not null"`
+	Events      string    `json:"-" gorm:"not null"` // space separated, similar to OAuth scopes
+	Secret      string    `json:"-" gorm:"not null"` // HMAC key of the signatures, only shown when the endpoint is created
+	Description string    `json:"description"`
+	Active      bool      `json:"active" gorm:"not null"`
+	CreatedAt   time.Time `json:"createdAt" gorm:"not null"`
+	// for JSON output
+	EventList []Event `json:"events" gorm:"-"`
+}
+
+// GetEvents returns the events the endpoint subscribed to
+func (e *Endpoint) GetEvents() []Event {
+	events := make([]Event, 0)
+	for _, event := range strings.Fields(e.Events) {
+		events = append(events, Event(event))
+	}
+	return events
+}
+
+// SetEvents sets the events the endpoint subscribes to
+func (e *Endpoint) SetEvents(events []Event) {
+	list := make([]string, 0, len(events))
+	for _, event := range events {
+		list = append(list, string(event))
+	}
+	e.Events = strings.Join(list, " ")
+}
+
+// Subscribed returns whether the endpoint receives the event
+func (e *Endpoint) Subscribed(event Event) bool {
+	if event == EventPing {
+		return true
+	}
+	for _, s := range e.GetEvents() {
+		if s == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Status is the delivery status of a Delivery
+type Status string
+
+// define constants
+const (
+	StatusPending   Status = "Pending" // not delivered yet, will be retried at NextAttemptAt
+	StatusDelivered Status = "Delivered"
+	StatusFailed    Status = "Failed" // gave up after maxAttempts
+)
+
+// Payload is the JSON body sent to endpoints in FormatJSON
+type Payload struct {
+	ID        string      `json:"id"` // unique per event, the same across retries and endpoints
+	Type      Event       `json:"type"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Summary   string      `json:"summary"` // human readable description of the event
+	Data      interface{} `json:"data"`
+}
+
+// Delivery is a request of an event to an endpoint, and its latest result
+type Delivery struct {
+	ID            string     `json:"id" gorm:"primaryKey"`
+	EndpointID    string     `json:"-" gorm:"index;not null"`
+	EventID       string     `json:"eventId" gorm:"not null"`
+	Event         Event      `json:"event" gorm:"not null"`
+	Body          string     `json:"-" gorm:"not null"`
+	Status        Status     `json:"status" gorm:"index:idx_delivery_pending,priority:1;not null"`
+	Attempts      int        `json:"attempts" gorm:"not null"`
+	ResponseCode  int        `json:"responseCode"` // 0 if the endpoint could not be reached
+	LastError     string     `json:"lastError"`
+	NextAttemptAt time.Time  `json:"-" gorm:"index:idx_delivery_pending,priority:2;not null"`
+	CreatedAt     time.Time  `json:"createdAt" gorm:"not null"`
+	DeliveredAt   *time.Time `json:"deliveredAt"`
+}